@@ -0,0 +1,25 @@
+package cache // import "github.com/docker/docker/api/server/router/cache"
+
+import (
+	"context"
+
+	"github.com/docker/docker/api/types"
+)
+
+// Backend is all the methods that need to be implemented
+// to provide image cache specific functionality.
+type Backend interface {
+	PromoteImage(refOrID string) error
+	RebuildCache() error
+	DrainCache(ctx context.Context, target int64) error
+	CacheReclaimable() (types.ImageCacheReclaimable, error)
+	CacheEfficiency() (types.ImageCacheEfficiency, error)
+	ResetCacheStats() error
+	CacheConfig() (types.ImageCacheConfig, error)
+	CacheImages() ([]types.ImageCacheEntry, error)
+	CacheImagePosition(refOrID string) (types.ImageCachePosition, error)
+	CacheImageFreeable(refOrID string) (types.ImageCacheFreeable, error)
+	ValidateCachePolicy(policy string, capacity int64) (types.ImageCachePolicyValidation, error)
+	PinCachePattern(pattern string) error
+	UnpinCachePattern(pattern string) error
+}
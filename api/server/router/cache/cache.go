@@ -0,0 +1,44 @@
+package cache // import "github.com/docker/docker/api/server/router/cache"
+
+import "github.com/docker/docker/api/server/router"
+
+// cacheRouter is a router to talk with the image cache
+type cacheRouter struct {
+	backend Backend
+	routes  []router.Route
+}
+
+// NewRouter initializes a new image cache router
+func NewRouter(b Backend) router.Router {
+	r := &cacheRouter{
+		backend: b,
+	}
+	r.initRoutes()
+	return r
+}
+
+// Routes returns the available routes to the image cache
+func (r *cacheRouter) Routes() []router.Route {
+	return r.routes
+}
+
+func (r *cacheRouter) initRoutes() {
+	r.routes = []router.Route{
+		// GET
+		router.NewGetRoute("/cache/reclaimable", r.getReclaimable),
+		router.NewGetRoute("/cache/efficiency", r.getEfficiency),
+		router.NewGetRoute("/cache/config", r.getConfig),
+		router.NewGetRoute("/cache/images", r.getImages),
+		router.NewGetRoute("/cache/images/{name:.*}/position", r.getImagePosition),
+		router.NewGetRoute("/cache/images/{name:.*}/freeable", r.getImageFreeable),
+		// POST
+		router.NewPostRoute("/cache/images/{name:.*}/promote", r.postImagePromote),
+		router.NewPostRoute("/cache/rebuild", r.postRebuild),
+		router.NewPostRoute("/cache/drain", r.postDrain),
+		router.NewPostRoute("/cache/efficiency/reset", r.postEfficiencyReset),
+		router.NewPostRoute("/cache/pins", r.postPin),
+		router.NewPostRoute("/cache/validate", r.postValidate),
+		// DELETE
+		router.NewDeleteRoute("/cache/pins", r.deletePin),
+	}
+}
@@ -0,0 +1,152 @@
+package cache // import "github.com/docker/docker/api/server/router/cache"
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+
+	"github.com/docker/docker/api/server/httputils"
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/errdefs"
+	"github.com/pkg/errors"
+)
+
+func (r *cacheRouter) postImagePromote(ctx context.Context, w http.ResponseWriter, req *http.Request, vars map[string]string) error {
+	if err := r.backend.PromoteImage(vars["name"]); err != nil {
+		return err
+	}
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+func (r *cacheRouter) postRebuild(ctx context.Context, w http.ResponseWriter, req *http.Request, vars map[string]string) error {
+	if err := r.backend.RebuildCache(); err != nil {
+		return err
+	}
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+func (r *cacheRouter) postDrain(ctx context.Context, w http.ResponseWriter, req *http.Request, vars map[string]string) error {
+	if err := httputils.ParseForm(req); err != nil {
+		return err
+	}
+	if req.Form.Get("target") == "" {
+		return errdefs.InvalidParameter(errors.New("missing cache drain target"))
+	}
+	target, err := httputils.Int64ValueOrDefault(req, "target", 0)
+	if err != nil {
+		return errdefs.InvalidParameter(errors.Wrap(err, "invalid cache drain target"))
+	}
+	if err := r.backend.DrainCache(ctx, target); err != nil {
+		return err
+	}
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+func (r *cacheRouter) getReclaimable(ctx context.Context, w http.ResponseWriter, req *http.Request, vars map[string]string) error {
+	reclaimable, err := r.backend.CacheReclaimable()
+	if err != nil {
+		return err
+	}
+	return httputils.WriteJSON(w, http.StatusOK, reclaimable)
+}
+
+func (r *cacheRouter) getEfficiency(ctx context.Context, w http.ResponseWriter, req *http.Request, vars map[string]string) error {
+	efficiency, err := r.backend.CacheEfficiency()
+	if err != nil {
+		return err
+	}
+	return httputils.WriteJSON(w, http.StatusOK, efficiency)
+}
+
+func (r *cacheRouter) postEfficiencyReset(ctx context.Context, w http.ResponseWriter, req *http.Request, vars map[string]string) error {
+	if err := r.backend.ResetCacheStats(); err != nil {
+		return err
+	}
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+func (r *cacheRouter) getConfig(ctx context.Context, w http.ResponseWriter, req *http.Request, vars map[string]string) error {
+	config, err := r.backend.CacheConfig()
+	if err != nil {
+		return err
+	}
+	return httputils.WriteJSON(w, http.StatusOK, config)
+}
+
+func (r *cacheRouter) getImages(ctx context.Context, w http.ResponseWriter, req *http.Request, vars map[string]string) error {
+	images, err := r.backend.CacheImages()
+	if err != nil {
+		return err
+	}
+	return httputils.WriteJSON(w, http.StatusOK, images)
+}
+
+func (r *cacheRouter) getImagePosition(ctx context.Context, w http.ResponseWriter, req *http.Request, vars map[string]string) error {
+	position, err := r.backend.CacheImagePosition(vars["name"])
+	if err != nil {
+		return err
+	}
+	return httputils.WriteJSON(w, http.StatusOK, position)
+}
+
+func (r *cacheRouter) getImageFreeable(ctx context.Context, w http.ResponseWriter, req *http.Request, vars map[string]string) error {
+	freeable, err := r.backend.CacheImageFreeable(vars["name"])
+	if err != nil {
+		return err
+	}
+	return httputils.WriteJSON(w, http.StatusOK, freeable)
+}
+
+func (r *cacheRouter) postPin(ctx context.Context, w http.ResponseWriter, req *http.Request, vars map[string]string) error {
+	if err := httputils.CheckForJSON(req); err != nil {
+		return err
+	}
+
+	var pin types.ImageCachePin
+	if err := json.NewDecoder(req.Body).Decode(&pin); err != nil {
+		if err == io.EOF {
+			return errdefs.InvalidParameter(errors.New("got EOF while reading request body"))
+		}
+		return errdefs.InvalidParameter(err)
+	}
+	if err := r.backend.PinCachePattern(pin.Pattern); err != nil {
+		return err
+	}
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+func (r *cacheRouter) postValidate(ctx context.Context, w http.ResponseWriter, req *http.Request, vars map[string]string) error {
+	if err := httputils.CheckForJSON(req); err != nil {
+		return err
+	}
+
+	var policy types.ImageCachePolicy
+	if err := json.NewDecoder(req.Body).Decode(&policy); err != nil {
+		if err == io.EOF {
+			return errdefs.InvalidParameter(errors.New("got EOF while reading request body"))
+		}
+		return errdefs.InvalidParameter(err)
+	}
+	validation, err := r.backend.ValidateCachePolicy(policy.Policy, policy.Capacity)
+	if err != nil {
+		return err
+	}
+	return httputils.WriteJSON(w, http.StatusOK, validation)
+}
+
+func (r *cacheRouter) deletePin(ctx context.Context, w http.ResponseWriter, req *http.Request, vars map[string]string) error {
+	if err := httputils.ParseForm(req); err != nil {
+		return err
+	}
+	if err := r.backend.UnpinCachePattern(req.Form.Get("pattern")); err != nil {
+		return err
+	}
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
@@ -0,0 +1,336 @@
+package cache // import "github.com/docker/docker/api/server/router/cache"
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/errdefs"
+	"gotest.tools/assert"
+	is "gotest.tools/assert/cmp"
+)
+
+type fakeBackend struct {
+	promoted    []string
+	rebuilds    int
+	reclaimable types.ImageCacheReclaimable
+	efficiency  types.ImageCacheEfficiency
+	resets      int
+	pins        map[string]bool
+	config      types.ImageCacheConfig
+	images      []types.ImageCacheEntry
+	drained     []int64
+}
+
+func (b *fakeBackend) PromoteImage(refOrID string) error {
+	if refOrID == "missing" {
+		return errdefs.NotFound(errors.New("image missing is not in cache"))
+	}
+	b.promoted = append(b.promoted, refOrID)
+	return nil
+}
+
+func (b *fakeBackend) RebuildCache() error {
+	b.rebuilds++
+	return nil
+}
+
+func (b *fakeBackend) DrainCache(ctx context.Context, target int64) error {
+	if target < 0 {
+		return errdefs.InvalidParameter(errors.New("invalid cache drain target"))
+	}
+	b.drained = append(b.drained, target)
+	return nil
+}
+
+func (b *fakeBackend) CacheReclaimable() (types.ImageCacheReclaimable, error) {
+	return b.reclaimable, nil
+}
+
+func (b *fakeBackend) CacheEfficiency() (types.ImageCacheEfficiency, error) {
+	return b.efficiency, nil
+}
+
+func (b *fakeBackend) ResetCacheStats() error {
+	b.resets++
+	return nil
+}
+
+func (b *fakeBackend) CacheConfig() (types.ImageCacheConfig, error) {
+	return b.config, nil
+}
+
+func (b *fakeBackend) CacheImages() ([]types.ImageCacheEntry, error) {
+	return b.images, nil
+}
+
+func (b *fakeBackend) CacheImagePosition(refOrID string) (types.ImageCachePosition, error) {
+	for i, image := range b.images {
+		if image.ID == refOrID {
+			return types.ImageCachePosition{ID: image.ID, Rank: i, Total: len(b.images)}, nil
+		}
+	}
+	return types.ImageCachePosition{}, errdefs.NotFound(errors.New("image is not in cache"))
+}
+
+func (b *fakeBackend) CacheImageFreeable(refOrID string) (types.ImageCacheFreeable, error) {
+	for _, image := range b.images {
+		if image.ID == refOrID {
+			return types.ImageCacheFreeable{ID: image.ID, Bytes: image.Size}, nil
+		}
+	}
+	return types.ImageCacheFreeable{}, errdefs.NotFound(errors.New("image is not in cache"))
+}
+
+func (b *fakeBackend) ValidateCachePolicy(policy string, capacity int64) (types.ImageCachePolicyValidation, error) {
+	if policy != "image-lru" {
+		return types.ImageCachePolicyValidation{}, errdefs.InvalidParameter(errors.New("invalid cache policy"))
+	}
+	return types.ImageCachePolicyValidation{Warnings: []string{fmt.Sprintf("capacity %d", capacity)}}, nil
+}
+
+func (b *fakeBackend) PinCachePattern(pattern string) error {
+	if pattern == "" {
+		return errdefs.InvalidParameter(errors.New("invalid pin pattern"))
+	}
+	b.pins[pattern] = true
+	return nil
+}
+
+func (b *fakeBackend) UnpinCachePattern(pattern string) error {
+	if !b.pins[pattern] {
+		return errdefs.NotFound(errors.New("pattern is not pinned"))
+	}
+	delete(b.pins, pattern)
+	return nil
+}
+
+func TestPostImagePromote(t *testing.T) {
+	b := &fakeBackend{}
+	r := NewRouter(b).(*cacheRouter)
+
+	req := httptest.NewRequest(http.MethodPost, "/cache/images/busybox:latest/promote", nil)
+	w := httptest.NewRecorder()
+	err := r.postImagePromote(context.Background(), w, req, map[string]string{"name": "busybox:latest"})
+	assert.NilError(t, err)
+	assert.Check(t, is.Equal(http.StatusNoContent, w.Code))
+	assert.Check(t, is.DeepEqual([]string{"busybox:latest"}, b.promoted))
+
+	w = httptest.NewRecorder()
+	err = r.postImagePromote(context.Background(), w, req, map[string]string{"name": "missing"})
+	assert.Check(t, errdefs.IsNotFound(err))
+}
+
+func TestPostRebuild(t *testing.T) {
+	b := &fakeBackend{}
+	r := NewRouter(b).(*cacheRouter)
+
+	req := httptest.NewRequest(http.MethodPost, "/cache/rebuild", nil)
+	w := httptest.NewRecorder()
+	err := r.postRebuild(context.Background(), w, req, nil)
+	assert.NilError(t, err)
+	assert.Check(t, is.Equal(http.StatusNoContent, w.Code))
+	assert.Check(t, is.Equal(1, b.rebuilds))
+}
+
+func TestPostDrain(t *testing.T) {
+	b := &fakeBackend{}
+	r := NewRouter(b).(*cacheRouter)
+
+	req := httptest.NewRequest(http.MethodPost, "/cache/drain?target=1024", nil)
+	w := httptest.NewRecorder()
+	err := r.postDrain(context.Background(), w, req, nil)
+	assert.NilError(t, err)
+	assert.Check(t, is.Equal(http.StatusNoContent, w.Code))
+	assert.Check(t, is.DeepEqual([]int64{1024}, b.drained))
+
+	for _, query := range []string{"", "?target=", "?target=1GB", "?target=-1"} {
+		req = httptest.NewRequest(http.MethodPost, "/cache/drain"+query, nil)
+		err = r.postDrain(context.Background(), httptest.NewRecorder(), req, nil)
+		assert.Check(t, errdefs.IsInvalidParameter(err), query)
+	}
+	assert.Check(t, is.Len(b.drained, 1))
+}
+
+func TestGetReclaimable(t *testing.T) {
+	b := &fakeBackend{reclaimable: types.ImageCacheReclaimable{Free: 10, Pinned: 20, InUse: 30}}
+	r := NewRouter(b).(*cacheRouter)
+
+	req := httptest.NewRequest(http.MethodGet, "/cache/reclaimable", nil)
+	w := httptest.NewRecorder()
+	err := r.getReclaimable(context.Background(), w, req, nil)
+	assert.NilError(t, err)
+	assert.Check(t, is.Equal(http.StatusOK, w.Code))
+
+	var reclaimable types.ImageCacheReclaimable
+	assert.NilError(t, json.NewDecoder(w.Body).Decode(&reclaimable))
+	assert.Check(t, is.DeepEqual(b.reclaimable, reclaimable))
+}
+
+func TestEfficiency(t *testing.T) {
+	b := &fakeBackend{efficiency: types.ImageCacheEfficiency{
+		Since:        time.Date(2019, 1, 1, 0, 0, 0, 0, time.UTC),
+		Hits:         3,
+		Misses:       1,
+		Evictions:    2,
+		Repulls:      1,
+		HitRatio:     0.75,
+		EvictionRate: 2,
+		RepullRate:   0.5,
+	}}
+	r := NewRouter(b).(*cacheRouter)
+
+	req := httptest.NewRequest(http.MethodGet, "/cache/efficiency", nil)
+	w := httptest.NewRecorder()
+	err := r.getEfficiency(context.Background(), w, req, nil)
+	assert.NilError(t, err)
+	assert.Check(t, is.Equal(http.StatusOK, w.Code))
+
+	var efficiency types.ImageCacheEfficiency
+	assert.NilError(t, json.NewDecoder(w.Body).Decode(&efficiency))
+	assert.Check(t, is.DeepEqual(b.efficiency, efficiency))
+
+	req = httptest.NewRequest(http.MethodPost, "/cache/efficiency/reset", nil)
+	w = httptest.NewRecorder()
+	err = r.postEfficiencyReset(context.Background(), w, req, nil)
+	assert.NilError(t, err)
+	assert.Check(t, is.Equal(http.StatusNoContent, w.Code))
+	assert.Check(t, is.Equal(1, b.resets))
+}
+
+func TestGetConfig(t *testing.T) {
+	b := &fakeBackend{config: types.ImageCacheConfig{
+		Policy:         "image-lru",
+		Capacity:       100,
+		EvictThreshold: 100,
+		RecencyWeight:  1,
+		Fallbacks:      []string{`cache-archive is ignored by the "image-lru" cache policy`},
+	}}
+	r := NewRouter(b).(*cacheRouter)
+
+	req := httptest.NewRequest(http.MethodGet, "/cache/config", nil)
+	w := httptest.NewRecorder()
+	err := r.getConfig(context.Background(), w, req, nil)
+	assert.NilError(t, err)
+	assert.Check(t, is.Equal(http.StatusOK, w.Code))
+
+	var config types.ImageCacheConfig
+	assert.NilError(t, json.NewDecoder(w.Body).Decode(&config))
+	assert.Check(t, is.DeepEqual(b.config, config))
+}
+
+func TestGetImages(t *testing.T) {
+	b := &fakeBackend{images: []types.ImageCacheEntry{
+		{ID: "sha256:a", Size: 10, ArchivePresent: true, ArchiveBytes: 4},
+		{ID: "sha256:b", Size: 20},
+	}}
+	r := NewRouter(b).(*cacheRouter)
+
+	req := httptest.NewRequest(http.MethodGet, "/cache/images", nil)
+	w := httptest.NewRecorder()
+	err := r.getImages(context.Background(), w, req, nil)
+	assert.NilError(t, err)
+	assert.Check(t, is.Equal(http.StatusOK, w.Code))
+	assert.Check(t, !strings.Contains(w.Body.String(), `"ArchiveBytes":0`))
+
+	var images []types.ImageCacheEntry
+	assert.NilError(t, json.NewDecoder(w.Body).Decode(&images))
+	assert.Check(t, is.DeepEqual(b.images, images))
+}
+
+func TestGetImagePosition(t *testing.T) {
+	b := &fakeBackend{images: []types.ImageCacheEntry{{ID: "sha256:a"}, {ID: "sha256:b"}}}
+	r := NewRouter(b).(*cacheRouter)
+
+	req := httptest.NewRequest(http.MethodGet, "/cache/images/sha256:b/position", nil)
+	w := httptest.NewRecorder()
+	err := r.getImagePosition(context.Background(), w, req, map[string]string{"name": "sha256:b"})
+	assert.NilError(t, err)
+	assert.Check(t, is.Equal(http.StatusOK, w.Code))
+
+	var position types.ImageCachePosition
+	assert.NilError(t, json.NewDecoder(w.Body).Decode(&position))
+	assert.Check(t, is.DeepEqual(types.ImageCachePosition{ID: "sha256:b", Rank: 1, Total: 2}, position))
+
+	w = httptest.NewRecorder()
+	err = r.getImagePosition(context.Background(), w, req, map[string]string{"name": "missing"})
+	assert.Check(t, errdefs.IsNotFound(err))
+}
+
+func TestGetImageFreeable(t *testing.T) {
+	b := &fakeBackend{images: []types.ImageCacheEntry{{ID: "sha256:a", Size: 10}}}
+	r := NewRouter(b).(*cacheRouter)
+
+	req := httptest.NewRequest(http.MethodGet, "/cache/images/sha256:a/freeable", nil)
+	w := httptest.NewRecorder()
+	err := r.getImageFreeable(context.Background(), w, req, map[string]string{"name": "sha256:a"})
+	assert.NilError(t, err)
+	assert.Check(t, is.Equal(http.StatusOK, w.Code))
+
+	var freeable types.ImageCacheFreeable
+	assert.NilError(t, json.NewDecoder(w.Body).Decode(&freeable))
+	assert.Check(t, is.DeepEqual(types.ImageCacheFreeable{ID: "sha256:a", Bytes: 10}, freeable))
+
+	w = httptest.NewRecorder()
+	err = r.getImageFreeable(context.Background(), w, req, map[string]string{"name": "missing"})
+	assert.Check(t, errdefs.IsNotFound(err))
+}
+
+func TestPostValidate(t *testing.T) {
+	r := NewRouter(&fakeBackend{}).(*cacheRouter)
+
+	req := httptest.NewRequest(http.MethodPost, "/cache/validate", strings.NewReader(`{"Policy": "image-lru", "Capacity": 100}`))
+	req.Header.Set("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+	err := r.postValidate(context.Background(), w, req, nil)
+	assert.NilError(t, err)
+	assert.Check(t, is.Equal(http.StatusOK, w.Code))
+	var validation types.ImageCachePolicyValidation
+	assert.NilError(t, json.NewDecoder(w.Body).Decode(&validation))
+	assert.Check(t, is.DeepEqual([]string{"capacity 100"}, validation.Warnings))
+
+	req = httptest.NewRequest(http.MethodPost, "/cache/validate", strings.NewReader(`{"Policy": "lfu"}`))
+	req.Header.Set("Content-Type", "application/json")
+	err = r.postValidate(context.Background(), httptest.NewRecorder(), req, nil)
+	assert.Check(t, errdefs.IsInvalidParameter(err))
+
+	req = httptest.NewRequest(http.MethodPost, "/cache/validate", nil)
+	req.Header.Set("Content-Type", "application/json")
+	err = r.postValidate(context.Background(), httptest.NewRecorder(), req, nil)
+	assert.Check(t, errdefs.IsInvalidParameter(err))
+}
+
+func TestPins(t *testing.T) {
+	b := &fakeBackend{pins: make(map[string]bool)}
+	r := NewRouter(b).(*cacheRouter)
+
+	req := httptest.NewRequest(http.MethodPost, "/cache/pins", strings.NewReader(`{"Pattern": "registry.internal/base/*"}`))
+	req.Header.Set("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+	err := r.postPin(context.Background(), w, req, nil)
+	assert.NilError(t, err)
+	assert.Check(t, is.Equal(http.StatusNoContent, w.Code))
+	assert.Check(t, b.pins["registry.internal/base/*"])
+
+	req = httptest.NewRequest(http.MethodPost, "/cache/pins", nil)
+	req.Header.Set("Content-Type", "application/json")
+	err = r.postPin(context.Background(), httptest.NewRecorder(), req, nil)
+	assert.Check(t, errdefs.IsInvalidParameter(err))
+
+	req = httptest.NewRequest(http.MethodDelete, "/cache/pins?pattern=registry.internal/base/*", nil)
+	w = httptest.NewRecorder()
+	err = r.deletePin(context.Background(), w, req, nil)
+	assert.NilError(t, err)
+	assert.Check(t, is.Equal(http.StatusNoContent, w.Code))
+	assert.Check(t, is.Len(b.pins, 0))
+
+	err = r.deletePin(context.Background(), httptest.NewRecorder(), req, nil)
+	assert.Check(t, errdefs.IsNotFound(err))
+}
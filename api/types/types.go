@@ -614,3 +614,106 @@ type BuildCachePruneOptions struct {
 	KeepStorage int64
 	Filters     filters.Args
 }
+
+// ImageCacheReclaimable breaks the level of the image cache down by what
+// keeps it from being reclaimed
+type ImageCacheReclaimable struct {
+	// Free is the number of bytes eviction is free to reclaim
+	Free int64
+	// Pinned is the number of bytes of images protected from eviction
+	Pinned int64
+	// InUse is the number of bytes of images used by containers
+	InUse int64
+}
+
+// ImageCacheEfficiency summarizes whether the image cache does its job since
+// the stats were last reset at Since: HitRatio is the fraction of the uses
+// of images which found them cached, EvictionRate the number of images
+// evicted per image inserted in the cache, and RepullRate the fraction of
+// the evictions followed by a re-pull of the image within an hour
+type ImageCacheEfficiency struct {
+	Since        time.Time
+	Hits         int64
+	Misses       int64
+	Inserts      int64
+	Evictions    int64
+	Repulls      int64
+	HitRatio     float64
+	EvictionRate float64
+	RepullRate   float64
+}
+
+// ImageCacheConfig is the configuration of the image cache as resolved by
+// the daemon at startup
+type ImageCacheConfig struct {
+	Policy         string
+	Mode           string
+	Capacity       int64
+	Archive        bool
+	EvictThreshold int
+	RecencyWeight  float64
+	ScanLabel      string `json:",omitempty"`
+	EvictionBatch  int
+	MaxLayers      int
+	RetainRetries  int
+	DiskReserve    int64            `json:",omitempty"`
+	SpillCapacity  int64            `json:",omitempty"`
+	Namespaces     map[string]int64 `json:",omitempty"`
+	IdleTimeout    int              `json:",omitempty"`
+	IdleFloor      int64            `json:",omitempty"`
+	EvictionIORate int64            `json:",omitempty"`
+	// Fallbacks describes the settings of the daemon configuration which
+	// were ignored or replaced
+	Fallbacks []string `json:",omitempty"`
+}
+
+// ImageCacheEntry is an image held by the image cache. Registry is the host
+// of the registry the image was pulled from, if pulled since the daemon
+// started. For the archive-lru policy, ArchivePresent is set if the archives
+// of the layers of the image are all on disk, and ArchiveBytes is the size
+// of those kept.
+type ImageCacheEntry struct {
+	ID             string
+	Size           int64
+	Added          time.Time
+	Accessed       time.Time
+	Registry       string `json:",omitempty"`
+	ArchivePresent bool   `json:",omitempty"`
+	ArchiveBytes   int64  `json:",omitempty"`
+}
+
+// ImageCachePosition is the position of an image in the eviction order of
+// the image cache, Rank being 0 for the most recently used of Total entries.
+// The entries are layers for the layer-lru, layer-lfu and archive-lru
+// policies.
+type ImageCachePosition struct {
+	ID    string
+	Rank  int
+	Total int
+}
+
+// ImageCacheFreeable is the number of bytes that removing an image from
+// the image cache would free, given the layers it shares with other images
+type ImageCacheFreeable struct {
+	ID    string
+	Bytes int64
+}
+
+// ImageCachePolicy is the body of a request validating a switch of the image
+// cache to Policy, at Capacity bytes or at the current capacity if zero
+type ImageCachePolicy struct {
+	Policy   string
+	Capacity int64 `json:",omitempty"`
+}
+
+// ImageCachePolicyValidation is the response of a valid switch of policy,
+// with the warnings of what the switch would change
+type ImageCachePolicyValidation struct {
+	Warnings []string
+}
+
+// ImageCachePin is the body of a request pinning the cached images with a
+// tag matching Pattern
+type ImageCachePin struct {
+	Pattern string
+}
@@ -4,6 +4,7 @@ import (
 	"runtime"
 
 	"github.com/docker/docker/daemon/config"
+	"github.com/docker/docker/distribution/xfer"
 	"github.com/docker/docker/opts"
 	"github.com/docker/docker/registry"
 	"github.com/spf13/pflag"
@@ -55,9 +56,38 @@ func installCommonConfigFlags(conf *config.Config, flags *pflag.FlagSet) error {
 		flags.StringVarP(&conf.GraphDriver, "storage-driver", "s", "", "Storage driver to use")
 	}
 
-	flags.StringVar(&conf.CacheCapacity, "cache-capacity", "200m", "Set cache capacity")
+	flags.StringVar(&conf.CacheCapacity, "cache-capacity", "200m", "Set cache capacity, or the capacity of each tier as hot=size,spill=size with a spill tier")
 	flags.StringVar(&conf.CachePolicy, "cache-policy", "", "Cache policy to use")
 	flags.BoolVar(&conf.CacheArchive, "cache-archive", false, "Cache compressed archive of image layers")
+	flags.BoolVar(&conf.CacheSquash, "cache-squash", false, "Squash pulled images into a single layer before caching")
+	flags.Float64Var(&conf.CacheMemoryPressure, "cache-memory-pressure", 0, "Reclaim cache space when the fraction of host memory in use exceeds this threshold")
+	flags.BoolVar(&conf.CacheHistory, "cache-history", false, "Record the history of cached images for debugging")
+	flags.IntVar(&conf.CacheKeepRecentTags, "cache-keep-recent-tags", 0, "Keep the N most recent tags of each repository in cache")
+	flags.IntVar(&conf.CacheEvictionBatch, "cache-eviction-batch", 0, "Evict at least N layers once an eviction is triggered")
+	flags.IntVar(&conf.CacheEvictThreshold, "cache-evict-threshold", 0, "Only evict once the cache level exceeds this percentage of the capacity (above 100)")
+	flags.DurationVar(&conf.CacheResyncInterval, "cache-resync-interval", 0, "Resync the cache accounting with the image store at this interval")
+	flags.StringVar(&conf.CacheDiskReserve, "cache-disk-reserve", "", "Refuse new images in cache when the free disk space of the data root is below this size")
+	flags.Var(opts.NewNamedMapOpts("cache-namespaces", conf.CacheNamespaces, nil), "cache-namespace", "Cache the images of a repository namespace in a partition of its own, given as namespace=capacity")
+	flags.StringVar(&conf.CacheAuditLog, "cache-audit-log", "", "Append a record of each image evicted from cache to this file")
+	flags.StringVar(&conf.CacheOnEvictCommand, "cache-on-evict-command", "", "Run this shell command for each image evicted from cache, with the image ID, tags and bytes freed in CACHE_EVICTED_IMAGE, CACHE_EVICTED_TAGS and CACHE_EVICTED_BYTES")
+	flags.Float64Var(&conf.CacheRecencyWeight, "cache-recency-weight", 1, "Weight of recency against frequency of use in the eviction order of the image-lru policy, from 1 (LRU) to 0 (LFU)")
+	flags.Float64Var(&conf.CacheMissRateTarget, "cache-miss-rate-target", 0, "Suggest in the cache stats a capacity keeping the rate of misses of evicted images below this fraction")
+	flags.BoolVar(&conf.CacheWarm, "cache-warm", false, "Keep newly cached images from eviction until they are used once")
+	flags.IntVar(&conf.CacheMaxLayers, "cache-max-layers", 0, "Evict once the layer-lru, layer-lfu and archive-lru policies hold more than N layers, whatever the cache level")
+	flags.StringVar(&conf.CacheSpillCapacity, "cache-spill-capacity", "", "Demote the images evicted by the image-lru policy to a spill tier of this capacity instead of deleting them")
+	flags.StringVar(&conf.CacheMode, "cache-mode", "full", `Let the cache take part in pulls ("full"), or only record the pulled images for eviction ("eviction-only")`)
+	flags.IntVar(&conf.CacheRetainRetries, "cache-retain-retries", 0, "Re-acquire an evicted layer no longer retained by the layer store up to N times to release it (default 3)")
+	flags.DurationVar(&conf.CacheIdleTimeout, "cache-idle-timeout", 0, "Reclaim the cache down to the idle floor once no image was pulled or used for this long")
+	flags.StringVar(&conf.CacheIdleFloor, "cache-idle-floor", "", "Size the cache is reclaimed down to once idle")
+	flags.StringVar(&conf.CacheScanLabel, "cache-scan-label", "", "Among images otherwise equal to the image-lru policy, evict first those whose RFC 3339 scan time in this label is the oldest or missing")
+	flags.StringVar(&conf.CacheEvictionIORate, "cache-eviction-io-rate", "", "Limit the layer releases and archive deletions of the layer-lru, layer-lfu and archive-lru evictions to this size per second, unless the cache is critically over capacity")
+	flags.StringVar(&conf.CacheArchiveMemory, "cache-archive-memory", "", "Set the memory budget for serving small layer archives")
+	flags.StringVar(&conf.CacheArchiveShared, "cache-archive-shared", "", "Read layer archives through from a shared directory on local miss")
+	flags.BoolVar(&conf.CacheArchiveUpload, "cache-archive-upload", false, "Upload layer archives to the shared directory in the background")
+	flags.BoolVar(&conf.CacheArchiveDedup, "cache-archive-dedup", false, "Store the layer archives of the shared directory as content-defined chunks, each distinct chunk once")
+	flags.Var(opts.NewNamedListOptsRef("cache-archive-peers", &conf.CacheArchivePeers, xfer.ValidatePeerEndpoint), "cache-archive-peer", "Read layer archives through from the archive cache of a peer daemon on local miss")
+	flags.StringVar(&conf.CacheArchiveMaxSize, "cache-archive-max-size", "", "Never keep layer archives larger than this size")
+	flags.Var(opts.NewNamedListOptsRef("cache-archive-exclude", &conf.CacheArchiveExclude, nil), "cache-archive-exclude", "Never keep the archives of the layers whose diffID matches this pattern")
 
 	flags.IntVar(&conf.Mtu, "mtu", 0, "Set the containers network MTU")
 	flags.BoolVar(&conf.RawLogs, "raw-logs", false, "Full timestamps without ANSI coloring")
@@ -0,0 +1,129 @@
+package cache
+
+import (
+	"sort"
+	"time"
+
+	"github.com/docker/docker/image"
+)
+
+const (
+	// advisorWindow is the sliding window of the accesses the capacity
+	// advisor bases its recommendation on
+	advisorWindow = 24 * time.Hour
+	// maxAdvisorSamples bounds the accesses kept in the window
+	maxAdvisorSamples = 4096
+	// maxAdvisorGhosts bounds the evicted images remembered by the advisor
+	maxAdvisorGhosts = 1024
+)
+
+// advisorSample is an access to the cache. Extra is the capacity the cache
+// would have needed on top of its own for the access to hit: 0 for a hit,
+// and the bytes evicted since the image was evicted for a miss.
+type advisorSample struct {
+	at    time.Time
+	extra int64
+}
+
+// capacityAdvisor recommends a capacity keeping the miss rate of the cache
+// below a target. It remembers the images evicted from the cache as ghosts,
+// along with the bytes evicted so far, so that an evicted image put again
+// tells how much larger the cache should have been to keep it, which is
+// more the more costly the image is to pull again. Misses of images never
+// cached are left out, no capacity avoiding them. It is protected by the
+// cache lock.
+type capacityAdvisor struct {
+	target float64
+
+	samples []advisorSample
+
+	// evicted is the number of bytes evicted so far, and ghosts the number
+	// evicted before each evicted image
+	evicted int64
+	ghosts  map[image.ID]int64
+	order   []image.ID
+}
+
+func newCapacityAdvisor(target float64) *capacityAdvisor {
+	return &capacityAdvisor{
+		target: target,
+		ghosts: make(map[image.ID]int64),
+	}
+}
+
+// hit records an access to a cached image
+func (a *capacityAdvisor) hit() {
+	a.sample(0)
+}
+
+// inserted records an image put in the cache, a miss if the image was
+// evicted before
+func (a *capacityAdvisor) inserted(imgID image.ID) {
+	seq, ok := a.ghosts[imgID]
+	if !ok {
+		return
+	}
+	delete(a.ghosts, imgID)
+	for i, id := range a.order {
+		if id == imgID {
+			a.order = append(a.order[:i], a.order[i+1:]...)
+			break
+		}
+	}
+	a.sample(a.evicted - seq)
+}
+
+// evictedImage records freed bytes evicted with an image. An image losing
+// several layers is remembered from its first one.
+func (a *capacityAdvisor) evictedImage(imgID image.ID, freed int64) {
+	if _, ok := a.ghosts[imgID]; !ok {
+		if len(a.order) >= maxAdvisorGhosts {
+			delete(a.ghosts, a.order[0])
+			a.order = a.order[1:]
+		}
+		a.ghosts[imgID] = a.evicted
+		a.order = append(a.order, imgID)
+	}
+	a.evicted += freed
+}
+
+func (a *capacityAdvisor) sample(extra int64) {
+	now := timeNow()
+	i := 0
+	for i < len(a.samples) && (now.Sub(a.samples[i].at) > advisorWindow || len(a.samples)-i >= maxAdvisorSamples) {
+		i++
+	}
+	a.samples = append(a.samples[i:], advisorSample{at: now, extra: extra})
+}
+
+// recommend returns the smallest capacity keeping the miss rate over the
+// window at most the target, given the current capacity. It never
+// recommends less than the current capacity, the advisor only telling the
+// misses a larger cache would have avoided.
+func (a *capacityAdvisor) recommend(capacity int64) int64 {
+	now := timeNow()
+	var (
+		accesses int
+		extras   []int64
+	)
+	for _, s := range a.samples {
+		if now.Sub(s.at) > advisorWindow {
+			continue
+		}
+		accesses++
+		if s.extra > 0 {
+			extras = append(extras, s.extra)
+		}
+	}
+	allowed := int(a.target * float64(accesses))
+	if len(extras) <= allowed {
+		return capacity
+	}
+	// avoid all but the allowed misses, those needing the most capacity
+	sort.Slice(extras, func(i, j int) bool { return extras[i] < extras[j] })
+	extra := extras[len(extras)-allowed-1]
+	if extra > maxCacheCapacity-capacity {
+		return maxCacheCapacity
+	}
+	return capacity + extra
+}
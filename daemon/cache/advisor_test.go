@@ -0,0 +1,95 @@
+package cache
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/docker/docker/image"
+	"github.com/docker/docker/layer"
+	"gotest.tools/assert"
+	is "gotest.tools/assert/cmp"
+)
+
+// replayCycle puts a working set of three images of the given size in an
+// image LRU cache over and over, and returns the cache and
+// the number of images it evicted
+func replayCycle(t *testing.T, size, capacity int64) (ImageCache, int) {
+	b, cleanup := newFakeBackendForTest(t)
+	defer cleanup()
+
+	now := time.Now()
+	var imgs []*image.Image
+	for i := 0; i < 3; i++ {
+		imgs = append(imgs, b.addImage(t, now, []layer.DiffID{b.layer(fmt.Sprintf("%d-%d", size, i), size)}))
+	}
+	base := newCacheBase(capacity, b)
+	base.advisor = newCapacityAdvisor(0.1)
+	c := newImageLRUCache(base)
+	for i := 0; i < 10; i++ {
+		for _, img := range imgs {
+			if !b.hasImage(img.ID()) {
+				b.mu.Lock()
+				b.registerImage(img)
+				b.mu.Unlock()
+			}
+			c.PutImage(img)
+		}
+	}
+	return c, len(b.deleted)
+}
+
+func TestCapacityAdvisor(t *testing.T) {
+	// the working set fits, nothing to suggest
+	c, evicted := replayCycle(t, 30, 100)
+	assert.Check(t, is.Equal(0, evicted))
+	assert.Check(t, is.Equal(int64(100), c.Stats().SuggestedCapacity))
+
+	// the working set thrashes, every image being evicted before it is
+	// pulled again. The larger the images, the more costly the misses and
+	// the larger the suggested capacity.
+	c, evicted = replayCycle(t, 40, 100)
+	assert.Check(t, evicted > 0)
+	cheap := c.Stats().SuggestedCapacity
+	assert.Check(t, cheap >= 120, "suggested %d", cheap)
+
+	c, _ = replayCycle(t, 45, 100)
+	costly := c.Stats().SuggestedCapacity
+	assert.Check(t, costly > cheap, "suggested %d, then %d", cheap, costly)
+
+	// the suggestion is not applied, but would stop the thrashing
+	assert.Check(t, is.Equal(int64(100), c.Capacity()))
+	_, evicted = replayCycle(t, 45, costly)
+	assert.Check(t, is.Equal(0, evicted))
+}
+
+func TestCapacityAdvisorWindow(t *testing.T) {
+	start := time.Now()
+	now := start
+	timeNow = func() time.Time { return now }
+	defer func() { timeNow = time.Now }()
+
+	a := newCapacityAdvisor(0.5)
+	a.evictedImage("sha256:a", 40)
+	a.evictedImage("sha256:a", 10)
+	a.evictedImage("sha256:b", 40)
+	a.inserted("sha256:a")
+	a.hit()
+	a.hit()
+	// half of the accesses may miss
+	assert.Check(t, is.Equal(int64(100), a.recommend(100)))
+
+	a.inserted("sha256:b")
+	a.inserted("sha256:c")
+	assert.Check(t, is.Equal(int64(100), a.recommend(100)))
+	a.evictedImage("sha256:c", 30)
+	a.inserted("sha256:c")
+	// the misses of a, b and c needed 90, 40 and 30 more bytes, and only
+	// two of the 5 accesses may miss. The put of c before it was ever
+	// evicted is no access to speak of.
+	assert.Check(t, is.Equal(int64(130), a.recommend(100)))
+
+	// the accesses age out of the window
+	now = start.Add(advisorWindow + time.Minute)
+	assert.Check(t, is.Equal(int64(100), a.recommend(100)))
+}
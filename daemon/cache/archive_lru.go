@@ -2,10 +2,13 @@ package cache
 
 import (
 	"container/list"
+	"fmt"
+	"path"
+	"strconv"
 	"strings"
-	"sync"
+	"time"
 
-	"github.com/docker/docker/daemon/images"
+	"github.com/docker/docker/distribution/xfer"
 	"github.com/docker/docker/image"
 	"github.com/docker/docker/layer"
 	"github.com/sirupsen/logrus"
@@ -13,38 +16,153 @@ import (
 
 type archiveLRUCache struct {
 	*layerLRUCache
+
+	// archives holds the layer archives kept for the cached layers. Layers
+	// of different chains may share a diffID, and thus an archive, which is
+	// accounted once in archiveLevel and deleted with its last layer.
+	archives     map[layer.DiffID]*layerArchive
+	archiveLevel int64
+}
+
+type layerArchive struct {
+	size int64
+	refs int
 }
 
 type archiveLayer struct {
 	*cacheLayer
+	// compactSize is the size of the archive of the layer, 0 if the layer
+	// is archive-absent
 	compactSize int64
 }
 
-func newArchiveLRUCache(capacity int64, is *images.ImageService) ImageCache {
+// archived reports whether the archive of al is kept. The layers put
+// without an archive on disk, such as those loaded from the layer store
+// after a switch from the layer-lru policy, are archive-absent until
+// evicted: their archive is only written by a pull, which they skip.
+func (al *archiveLayer) archived() bool {
+	return al.compactSize > 0
+}
+
+func newArchiveLRUCache(base *cacheBase) ImageCache {
 	layerLRU := &layerLRUCache{
-		cacheBase: &cacheBase{
-			imageService: is,
-			capacity:     capacity,
-			mu:           &sync.RWMutex{},
-		},
-		images:    make(map[image.ID]*image.Image),
-		layers:    make(map[layer.ChainID]*list.Element),
-		evictList: list.New(),
-	}
-	return &archiveLRUCache{layerLRU}
+		cacheBase:     base,
+		images:        make(map[image.ID]*image.Image),
+		imageAccessed: make(map[image.ID]time.Time),
+		layers:        make(map[layer.ChainID]*list.Element),
+		evictList:     list.New(),
+	}
+	c := &archiveLRUCache{
+		layerLRUCache: layerLRU,
+		archives:      make(map[layer.DiffID]*layerArchive),
+	}
+	base.takeSnapshot = func() *readSnapshot { return c.snapshot(c.listArchives()) }
+	base.imageOrder = layerLRU.imageOrder
+	base.archiveHeld = func(diffID layer.DiffID) bool {
+		_, ok := c.archives[diffID]
+		return ok
+	}
+	return c
+}
+
+// archiveCloseTimeout bounds how long Close waits for the reads of the layer
+// archives in progress
+const archiveCloseTimeout = 10 * time.Second
+
+// Close implements the ImageCache interface. It waits for the reads of the
+// layer archives in progress to complete, up to archiveCloseTimeout, so
+// that the daemon does not shut down from under a download or an upload
+// served from an archive.
+func (c *archiveLRUCache) Close() error {
+	err := c.cacheBase.Close()
+	if busy := xfer.WaitArchiveReads(nil, archiveCloseTimeout); len(busy) > 0 {
+		logrus.Warnf("Closing the image cache with the layer archives of %v still being read", busy)
+	}
+	return err
+}
+
+// holdArchive accounts the archive of diffID for one more cached layer
+func (c *archiveLRUCache) holdArchive(diffID layer.DiffID, size int64) {
+	if a, ok := c.archives[diffID]; ok {
+		a.refs++
+		return
+	}
+	c.archives[diffID] = &layerArchive{size: size, refs: 1}
+	c.archiveLevel += size
+}
+
+// releaseArchive drops a cached layer's hold on the archive of diffID, and
+// reports whether it was the last one, in which case the archive is no
+// longer accounted and should be deleted
+func (c *archiveLRUCache) releaseArchive(diffID layer.DiffID) bool {
+	a, ok := c.archives[diffID]
+	if !ok {
+		return true
+	}
+	a.refs--
+	if a.refs > 0 {
+		return false
+	}
+	delete(c.archives, diffID)
+	c.archiveLevel -= a.size
+	return true
+}
+
+// retainArchive reports whether the archive of diffID, of the given size,
+// may be kept, that is whether it is neither larger than the maximum size
+// nor excluded by the operator
+func (c *archiveLRUCache) retainArchive(diffID layer.DiffID, size int64) bool {
+	if c.archiveMaxSize > 0 && size > c.archiveMaxSize {
+		logrus.Debugf("Archive of layer %s is larger than %d bytes, not keeping it", diffID, c.archiveMaxSize)
+		return false
+	}
+	for _, pattern := range c.archiveExclude {
+		if ok, _ := path.Match(pattern, diffID.String()); ok {
+			logrus.Debugf("Archive of layer %s is excluded by %q, not keeping it", diffID, pattern)
+			return false
+		}
+	}
+	return true
+}
+
+// noArchiveLabel is the label of the images, such as short-lived ones, whose
+// layers the archive LRU cache keeps no archive of, however compressible
+const noArchiveLabel = "com.company.cache.no-archive"
+
+// noArchive reports whether img is labeled to have no archive kept
+func noArchive(img *image.Image) bool {
+	if img.Config == nil {
+		return false
+	}
+	value, ok := img.Config.Labels[noArchiveLabel]
+	if !ok {
+		return false
+	}
+	set, err := strconv.ParseBool(value)
+	if err != nil {
+		logrus.Warnf("Invalid label %s=%q of image %s, keeping its layer archives", noArchiveLabel, value, img.ID())
+		return false
+	}
+	return set
 }
 
 // PutImage implements the ImageCache interface
 func (c *archiveLRUCache) PutImage(img *image.Image) {
 	c.mu.Lock()
-	defer c.mu.Unlock()
+	defer c.unlock()
+
+	c.putImage(img)
+}
 
+func (c *archiveLRUCache) putImage(img *image.Image) {
 	if img == nil {
 		return
 	}
+	c.evictions.put()
 
 	if err := c.checkImageSize(img); err != nil {
 		logrus.Errorf("error putting image in cache: %v", err)
+		c.dropArchives(img)
 		return
 	}
 
@@ -52,7 +170,20 @@ func (c *archiveLRUCache) PutImage(img *image.Image) {
 		diffIDs  []layer.DiffID
 		chainIDs []layer.ChainID
 	)
+	if _, ok := c.images[img.ID()]; ok {
+		c.touched()
+		c.recordEvent(img.ID(), EventTouch, "put again")
+	} else if !c.fits(img) {
+		c.dropArchives(img)
+		return
+	} else if c.admit(img) {
+		c.inserted(img.ID())
+		c.recordEvent(img.ID(), EventInsert, "")
+	} else {
+		return
+	}
 	c.images[img.ID()] = img
+	c.imageAccessed[img.ID()] = timeNow()
 	for _, diffID := range img.RootFS.DiffIDs {
 		diffIDs = append(diffIDs, diffID)
 		chainID := layer.CreateChainID(diffIDs)
@@ -68,60 +199,158 @@ func (c *archiveLRUCache) PutImage(img *image.Image) {
 func (c *archiveLRUCache) putLayer(chainID layer.ChainID, img *image.Image) {
 	defer c.evict()
 
+	// the diff size of a layer put again is not read again
+	var knownSize int64 = -1
 	if e, ok := c.layers[chainID]; ok {
 		oldLayer := e.Value.(*archiveLayer)
+		knownSize = oldLayer.size
 		c.evictList.Remove(e)
-		c.level -= oldLayer.size
+		delete(c.layers, chainID)
+		c.addLevel(-oldLayer.size)
+		c.layerCount--
+		// the old reference is only released once the new one is taken,
+		// so that the layer never goes unreferenced in between
+		defer c.imageService.ReleaseReadOnlyLayer(oldLayer.layer, oldLayer.os)
+		if oldLayer.archived() {
+			defer c.releaseArchive(oldLayer.layer.DiffID())
+		}
 	}
 
 	l, err := c.imageService.GetReadOnlyLayer(chainID, img.OperatingSystem())
 	if err != nil {
-		logrus.Errorf("error getting layer: %v", err)
+		logrus.Errorf("error getting layer %s of image %s: %v", chainID, img.ID(), err)
+		return
+	}
+	if isForeignLayer(l) {
+		logrus.Debugf("Layer %s is foreign, not caching it", chainID)
+		if _, err := c.imageService.ReleaseReadOnlyLayer(l, img.OperatingSystem()); err != nil {
+			logrus.Errorf("error releasing layer: %v", err)
+		}
 		return
 	}
 
-	size, err := l.DiffSize()
-	if err != nil {
-		logrus.Errorf("error getting layer size: %v", err)
+	size := knownSize
+	if size < 0 {
+		if size, err = l.DiffSize(); err != nil {
+			logrus.Errorf("error getting layer size: %v", err)
+			if _, err := c.imageService.ReleaseReadOnlyLayer(l, img.OperatingSystem()); err != nil {
+				logrus.Errorf("error releasing layer: %v", err)
+			}
+			return
+		}
+	}
+	if err := c.checkAddition(size); err != nil {
+		logrus.Errorf("error putting layer in cache: %v", err)
+		if _, err := c.imageService.ReleaseReadOnlyLayer(l, img.OperatingSystem()); err != nil {
+			logrus.Errorf("error releasing layer: %v", err)
+		}
 		return
 	}
+	now := timeNow()
 	cl := &cacheLayer{
-		layer:  l,
-		size:   size,
-		images: []string{img.ImageID()},
-		os:     img.OperatingSystem(),
+		layer:    l,
+		size:     size,
+		images:   []string{img.ImageID()},
+		os:       img.OperatingSystem(),
+		added:    now,
+		accessed: now,
 	}
 	al := &archiveLayer{cacheLayer: cl}
 
-	if archiveInfo, err := getLayerArchiveInfo(l.DiffID()); archiveInfo != nil {
+	archiveInfo, err := getLayerArchiveInfo(l.DiffID())
+	switch {
+	case err != nil:
+		logrus.Errorf("error getting layer archive info: %v", err)
+	case archiveInfo == nil:
+		logrus.Debugf("Layer %s has no archive on disk, put it archive-absent", chainID)
+	default:
 		al.compactSize = archiveInfo.Size()
 		logrus.Infof("Layer %s, full size: %d, compact size: %d", chainID, al.size, al.compactSize)
-	} else if err != nil {
-		logrus.Errorf("error getting layer archive info: %v", err)
 	}
 
-	if al.compactSize > al.size {
-		if err := deleteArchive(l.DiffID()); err != nil {
-			logrus.Errorf("error deleting layer archive: %v", err)
-		}
+	// the archive of a layer already cached for another image is left to
+	// that image
+	unwanted := knownSize < 0 && noArchive(img)
+	if unwanted && al.archived() {
+		logrus.Debugf("Image %s is labeled %s, not keeping the archive of layer %s", img.ID(), noArchiveLabel, chainID)
+	}
+	if al.compactSize > al.size || (al.archived() && (unwanted || !c.retainArchive(l.DiffID(), al.compactSize))) {
+		c.deleteArchivesLater(l.DiffID())
+		al.compactSize = 0
+	}
+	if al.archived() {
+		c.holdArchive(l.DiffID(), al.compactSize)
 	}
 
 	c.layers[chainID] = c.evictList.PushFront(al)
-	c.level += size
+	c.addLevel(size)
+	c.layerCount++
 
-	logrus.Infof("Put layer %s, %d/%d (%.3f)", chainID, c.level, c.capacity, c.percent())
+	logrus.Infof("Put layer %s, %s", chainID, c.usage())
+}
+
+// fits reports whether the layers of img not cached yet fit in the room the
+// eviction can make, that is the capacity less the layers of the images it
+// protects or containers use. The layers of an image that does not fit
+// would be evicted as soon as put, their archives deleted right after being
+// kept. The caller must hold the write lock.
+func (c *archiveLRUCache) fits(img *image.Image) bool {
+	r := c.reclaimable()
+	if r.Pinned+r.InUse == 0 {
+		// checkImageSize already held the image to the capacity
+		return true
+	}
+	size, err := c.getImageSize(img)
+	if err != nil {
+		return true
+	}
+	for _, chainID := range chainIDsOf(img) {
+		if e, ok := c.layers[chainID]; ok {
+			size -= layerOf(e).size
+		}
+	}
+	room := c.capacity - r.Pinned - r.InUse
+	if size <= room {
+		return true
+	}
+	c.recordEvent(img.ID(), EventSkip, "no room left by the protected layers")
+	logrus.Warnf("Refused image %s, %d bytes of new layers above the %d bytes the eviction can make room for", img.ID(), size, room)
+	return false
+}
+
+// dropArchives queues the deletion of the archives of the layers of img,
+// refused by the cache, which no cached layer holds. The pull writes them
+// ahead of the cache, skipping only the layers larger than the capacity, and
+// they would otherwise be left on disk, never to be evicted. The caller must
+// hold the write lock.
+func (c *archiveLRUCache) dropArchives(img *image.Image) {
+	var diffIDs []layer.DiffID
+	for _, diffID := range img.RootFS.DiffIDs {
+		if _, ok := c.archives[diffID]; !ok {
+			diffIDs = append(diffIDs, diffID)
+		}
+	}
+	c.deleteArchivesLater(diffIDs...)
 }
 
 // UpdateImage implements the ImageCache interface
 func (c *archiveLRUCache) UpdateImage(refOrID string) {
 	c.mu.Lock()
-	defer c.mu.Unlock()
+	defer c.unlock()
 
 	img, err := c.imageService.GetImage(refOrID)
 	if err != nil {
 		logrus.Warnf("error getting image: %v", err)
 		return
 	}
+	_, ok := c.images[img.ID()]
+	c.evictions.used(ok)
+	if ok {
+		c.imageAccessed[img.ID()] = timeNow()
+		c.markUsed(img.ID())
+		c.touched()
+		c.recordEvent(img.ID(), EventTouch, "used")
+	}
 
 	var (
 		diffIDs  []layer.DiffID
@@ -148,25 +377,29 @@ func (c *archiveLRUCache) updateLayer(chainID layer.ChainID, img *image.Image) {
 	}
 	al := e.Value.(*archiveLayer)
 	al.images = append(al.images, img.ImageID())
+	al.accessed = timeNow()
 	c.evictList.MoveToFront(e)
 
-	logrus.Infof("Updated layer %s, %d/%d (%.3f)", chainID, c.level, c.capacity, c.percent())
+	logrus.Infof("Updated layer %s, %s", chainID, c.usage())
 }
 
 // RemoveImage implements the ImageCache interface
 func (c *archiveLRUCache) RemoveImage(imgID image.ID) {
 	c.mu.Lock()
-	defer c.mu.Unlock()
+	defer c.unlock()
 
-	img, ok := c.images[imgID]
-	if !ok {
+	c.removeImage(c.forgetSquashed(imgID))
+}
+
+func (c *archiveLRUCache) removeImage(imgID image.ID) {
+	if _, ok := c.images[imgID]; !ok {
 		return
 	}
-	delete(c.images, imgID)
-	var diffIDs []layer.DiffID
-	for _, diffID := range img.RootFS.DiffIDs {
-		diffIDs = append(diffIDs, diffID)
-		c.removeLayer(layer.CreateChainID(diffIDs))
+	unused := c.dropImage(imgID)
+	c.forget(imgID)
+	c.recordEvent(imgID, EventRemove, "")
+	for _, chainID := range unused {
+		c.removeLayer(chainID)
 	}
 }
 
@@ -178,46 +411,143 @@ func (c *archiveLRUCache) removeLayer(chainID layer.ChainID) {
 	}
 	al := e.Value.(*archiveLayer)
 	released, err := c.imageService.ReleaseReadOnlyLayer(al.layer, al.os)
-	if err != nil {
+	if err != nil && err != layer.ErrLayerNotRetained {
 		logrus.Errorf("error releasing layer: %v", err)
 		return
 	}
-	for _, l := range released {
-		e, ok := c.layers[l.ChainID]
-		if !ok {
-			logrus.Warnf("Layer %s is not in cache", l.ChainID)
+	var stale []layer.DiffID
+	for _, l := range releasedLayers(al.cacheLayer, chainID, released) {
+		if c.dropLayer(l.ChainID) == nil {
+			logrus.Debugf("Layer %s is not in cache", l.ChainID)
 			continue
 		}
-		c.level -= l.DiffSize
-		delete(c.layers, l.ChainID)
-		if err := deleteArchive(l.DiffID); err != nil {
-			logrus.Warnf("error deleting layer archive: %v", err)
+		if c.releaseArchive(l.DiffID) {
+			stale = append(stale, l.DiffID)
 		}
-		c.evictList.Remove(e)
-		logrus.Infof("Removed layer %s, %d/%d (%.3f)", l.ChainID, c.level, c.capacity, c.percent())
+		logrus.Infof("Removed layer %s, %s", l.ChainID, c.usage())
+	}
+
+	// archives are only deleted once the whole chain has been released,
+	// skipping those a pull is writing again
+	c.deleteArchivesLater(stale...)
+}
+
+// Rebuild implements the ImageCache interface. The archives are kept on
+// disk and accounted again as their layers are put back.
+func (c *archiveLRUCache) Rebuild() error {
+	c.mu.Lock()
+	defer c.unlock()
+
+	err := c.releaseLayers()
+	c.archives = make(map[layer.DiffID]*layerArchive)
+	c.archiveLevel = 0
+	c.rebuild(c.putImage)
+	return err
+}
+
+// Resync implements the ImageCache interface. Stale images are pruned
+// along with their archives.
+func (c *archiveLRUCache) Resync() Drift {
+	c.mu.Lock()
+	defer c.unlock()
+
+	c.repairMaps()
+	return c.resync(c.drift(c.entryLevel(), c.cachedImages()), c.removeImage, c.entryLevel)
+}
+
+// List implements the ImageCache interface, reporting whether the archives
+// of the layers of each image are on disk
+func (c *archiveLRUCache) List() []CacheEntry {
+	if s := c.servedSnapshot(); s != nil {
+		return s.list()
 	}
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	return c.listArchives()
+}
 
+// listArchives is List for callers holding the lock
+func (c *archiveLRUCache) listArchives() []CacheEntry {
+	return c.listImages(func(entry *CacheEntry, layers []*list.Element) {
+		entry.ArchivePresent = len(layers) > 0
+		for _, e := range layers {
+			al := e.Value.(*archiveLayer)
+			entry.ArchiveBytes += al.compactSize
+			if !archiveOnDisk(al) {
+				entry.ArchivePresent = false
+			}
+		}
+	})
+}
+
+// archiveOnDisk reports whether the archive of al is kept and still on disk
+func archiveOnDisk(al *archiveLayer) bool {
+	if !al.archived() || al.layer == nil {
+		return false
+	}
+	fi, err := getLayerArchiveInfo(al.layer.DiffID())
+	if err != nil {
+		logrus.Warnf("error getting layer archive info: %v", err)
+	}
+	return fi != nil
+}
+
+// Reserve implements the ImageCache interface
+func (c *archiveLRUCache) Reserve(ref string, size int64) func() {
+	return c.reserve(size, c.evict)
+}
+
+// Reclaim implements the ImageCache interface
+func (c *archiveLRUCache) Reclaim(size int64) int64 {
+	c.mu.Lock()
+	defer c.unlock()
+
+	return c.reclaim(size, c.evictTo)
 }
 
 func (c *archiveLRUCache) evict() {
+	c.runEviction(c.evictTo)
+}
+
+func (c *archiveLRUCache) evictTo(target int64) {
 	if c.evictList.Len() == 0 {
 		logrus.Debug("Empty cache, nothing to evict")
 		return
 	}
+	if target >= c.level && !c.tooManyLayers() {
+		return
+	}
 
-	checkboard := make(map[layer.ChainID]int)
+	imgs := make([]*image.Image, 0, len(c.images))
+	for _, img := range c.images {
+		imgs = append(imgs, img)
+	}
+	plan := c.planEviction(imgs)
 
-	for c.capacity < c.level {
-		e := c.evictList.Back()
+	checkboard := make(map[layer.ChainID]int)
+	batch := newEvictionBatch(c.evictionBatch)
+	batch.throttle = c.throttleIO
+	defer batch.flush(c.deleteArchivesLater)
+
+	for (target < c.level || c.tooManyLayers() || !batch.satisfied()) && c.evictList.Len() > 0 {
+		e := c.nextVictim(plan)
+		if e == nil {
+			logrus.Warnf("No evictable layer left, %s", c.usage())
+			return
+		}
 		al := e.Value.(*archiveLayer)
 		chainID := al.layer.ChainID()
 
-		logrus.Infof("Eviciting %s, %d/%d (%.3f)", chainID, c.level, c.capacity, c.percent())
+		logrus.Infof("Eviciting %s, %s", chainID, c.usage())
 
 		var conflict bool
-		for _, imgID := range al.images {
+		// the images deleted are dropped from al.images meanwhile
+		for _, imgID := range append([]string(nil), al.images...) {
+			tags := c.auditTags(image.ID(imgID))
 			if _, err := c.imageService.ImageDelete(imgID, false, false); err != nil {
 				if strings.Contains(strings.ToLower(err.Error()), "conflict") {
+					c.recordEvent(image.ID(imgID), EventSkip, err.Error())
 					conflict = true
 					break
 				}
@@ -225,7 +555,11 @@ func (c *archiveLRUCache) evict() {
 					logrus.Errorf("error deleting image: %v", err)
 					return
 				}
+				continue
 			}
+			c.dropImage(image.ID(imgID))
+			c.forget(image.ID(imgID))
+			c.recordEviction(image.ID(imgID), tags, al.size, fmt.Sprintf("layer %s evicted, level %d above target %d", chainID, c.level, target))
 		}
 
 		if conflict {
@@ -238,9 +572,10 @@ func (c *archiveLRUCache) evict() {
 			continue
 		}
 
-		released, err := c.imageService.ReleaseReadOnlyLayer(al.layer, al.os)
+		c.throttleIO(al.size)
+		released, err := c.releaseEvicted(al.cacheLayer, chainID)
 		if err != nil {
-			logrus.Errorf("error releasing layer: %v", err)
+			logrus.Errorf("error releasing layer %s: %v", chainID, err)
 			return
 		}
 
@@ -261,10 +596,18 @@ func (c *archiveLRUCache) evict() {
 				logrus.Warnf("Layer %s is not in cache", l.ChainID)
 				continue
 			}
-			c.level -= l.DiffSize
+			c.addLevel(-layerOf(e).size)
 			delete(c.layers, l.ChainID)
+			c.layerCount--
 			c.evictList.Remove(e)
-			logrus.Infof("Evicted layer %s, %d/%d (%.3f)", l.ChainID, c.level, c.capacity, c.percent())
+			observeEviction(layerOf(e).added)
+			c.evictions.freed(layerOf(e).size)
+			var archiveSize int64
+			if a, ok := c.archives[l.DiffID]; ok {
+				archiveSize = a.size
+			}
+			batch.add(l.DiffID, c.releaseArchive(l.DiffID), archiveSize)
+			logrus.Infof("Evicted layer %s, %s", l.ChainID, c.usage())
 		}
 
 	}
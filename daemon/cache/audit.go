@@ -0,0 +1,171 @@
+package cache
+
+import (
+	"encoding/json"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/docker/docker/image"
+	"github.com/sirupsen/logrus"
+)
+
+// auditLogMaxSize is the size beyond which the audit log is rotated
+const auditLogMaxSize = 64 << 20
+
+// AuditRecord is the record of an eviction in the audit log
+type AuditRecord struct {
+	Time   time.Time
+	Image  image.ID
+	Tags   []string `json:",omitempty"`
+	Freed  int64
+	Reason string
+	Policy string `json:",omitempty"`
+}
+
+// auditLogQueue is the number of records waiting to be written beyond
+// which new records are dropped
+const auditLogQueue = 1024
+
+// auditLog appends a JSON line per eviction to a file, independently of the
+// daemon log. Once the file grows beyond maxSize, it is moved aside to
+// path.1, replacing the previous one, and a new file is started. The
+// records are written in the background, as they are recorded under the
+// lock of the cache.
+type auditLog struct {
+	path    string
+	maxSize int64
+
+	mu      sync.Mutex // protects closed, and serializes the writes
+	closed  bool
+	records chan AuditRecord
+	done    chan struct{}
+}
+
+func newAuditLog(path string) *auditLog {
+	l := &auditLog{
+		path:    path,
+		maxSize: auditLogMaxSize,
+		records: make(chan AuditRecord, auditLogQueue),
+		done:    make(chan struct{}),
+	}
+	go l.run()
+	return l
+}
+
+// queue hands rec over to the writer of the log, without waiting for it to
+// be written. The record is dropped if too many are waiting already, and
+// written right away once the log is closed.
+func (l *auditLog) queue(rec AuditRecord) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.closed {
+		if err := l.append(rec); err != nil {
+			logrus.Warnf("error writing the cache audit log: %v", err)
+		}
+		return
+	}
+	select {
+	case l.records <- rec:
+	default:
+		logrus.Warnf("Cache audit log is behind, dropped the record of image %s", rec.Image)
+	}
+}
+
+// run writes the records queued until the log is closed
+func (l *auditLog) run() {
+	defer close(l.done)
+	for rec := range l.records {
+		l.mu.Lock()
+		err := l.append(rec)
+		l.mu.Unlock()
+		if err != nil {
+			logrus.Warnf("error writing the cache audit log: %v", err)
+		}
+	}
+}
+
+// close writes the records queued and stops the writer of the log. It may
+// be called more than once, the log being shared by the partitions.
+func (l *auditLog) close() {
+	l.mu.Lock()
+	if !l.closed {
+		l.closed = true
+		close(l.records)
+	}
+	l.mu.Unlock()
+	<-l.done
+}
+
+// append writes rec to the log and syncs it to disk. Each record is written
+// by a single write to a file opened in append mode, so that records are
+// never interleaved. The caller must hold the lock.
+func (l *auditLog) append(rec AuditRecord) error {
+	line, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+
+	if fi, err := os.Stat(l.path); err == nil && fi.Size() > 0 && fi.Size()+int64(len(line)) > l.maxSize {
+		if err := os.Rename(l.path, l.path+".1"); err != nil {
+			return err
+		}
+	}
+	f, err := os.OpenFile(l.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(line); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// auditTags returns the tags of imgID for its audit record and the
+// on-evict command, which must be looked up before the image is deleted, or
+// nil if neither is enabled
+func (c *cacheBase) auditTags(imgID image.ID) []string {
+	if c.audit == nil && c.evictHook == nil {
+		return nil
+	}
+	return c.tagsOf(imgID)
+}
+
+// recordEviction records the eviction of imgID, which freed the given
+// number of bytes, in the history and the audit log, and runs the on-evict
+// command. The caller must hold the write lock.
+func (c *cacheBase) recordEviction(imgID image.ID, tags []string, freed int64, reason string) {
+	c.recordEvent(imgID, EventEvict, reason)
+	c.evictions.evicted(imgID)
+	if c.advisor != nil {
+		c.advisor.evictedImage(imgID, freed)
+	}
+	if c.evictHook != nil {
+		c.evictHook.run(imgID, tags, freed)
+	}
+	c.appendAudit(imgID, tags, freed, reason)
+}
+
+// appendAudit queues the record of the removal of imgID for the audit log,
+// if enabled
+func (c *cacheBase) appendAudit(imgID image.ID, tags []string, freed int64, reason string) {
+	if c.audit == nil {
+		return
+	}
+	rec := AuditRecord{
+		Time:   timeNow(),
+		Image:  imgID,
+		Tags:   tags,
+		Freed:  freed,
+		Reason: reason,
+		Policy: c.policy,
+	}
+	c.audit.queue(rec)
+}
@@ -0,0 +1,91 @@
+package cache
+
+import (
+	"bufio"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/docker/docker/image"
+	"github.com/docker/docker/layer"
+	"gotest.tools/assert"
+	is "gotest.tools/assert/cmp"
+)
+
+func readAuditLog(t *testing.T, path string) []AuditRecord {
+	t.Helper()
+	f, err := os.Open(path)
+	assert.NilError(t, err)
+	defer f.Close()
+
+	var recs []AuditRecord
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		var rec AuditRecord
+		assert.NilError(t, json.Unmarshal(s.Bytes(), &rec))
+		recs = append(recs, rec)
+	}
+	assert.NilError(t, s.Err())
+	return recs
+}
+
+func TestAuditLogRecordsEviction(t *testing.T) {
+	b, cleanup := newFakeBackendForTest(t)
+	defer cleanup()
+	dir, err := ioutil.TempDir("", "cache-audit")
+	assert.NilError(t, err)
+	defer os.RemoveAll(dir)
+
+	now := time.Now()
+	defer func() { timeNow = time.Now }()
+	timeNow = func() time.Time { return now }
+
+	old := b.addImage(t, now, []layer.DiffID{b.layer("old", 60)}, "busybox:1")
+	recent := b.addImage(t, now, []layer.DiffID{b.layer("recent", 60)}, "busybox:2")
+
+	path := filepath.Join(dir, "audit.log")
+	base := newCacheBase(100, b)
+	base.policy = policyImageLRU
+	base.audit = newAuditLog(path)
+	c := newImageLRUCache(base)
+	c.PutImage(old)
+	c.PutImage(recent)
+
+	// the records are written in the background, until the cache is closed
+	assert.NilError(t, c.Close())
+	recs := readAuditLog(t, path)
+	assert.Assert(t, is.Len(recs, 1))
+	assert.Check(t, recs[0].Time.Equal(now))
+	assert.Check(t, is.Equal(old.ID(), recs[0].Image))
+	assert.Check(t, is.DeepEqual([]string{"busybox:1"}, recs[0].Tags))
+	assert.Check(t, is.Equal(int64(60), recs[0].Freed))
+	assert.Check(t, is.Equal("level 120 above target 100", recs[0].Reason))
+	assert.Check(t, is.Equal(policyImageLRU, recs[0].Policy))
+}
+
+func TestAuditLogRotation(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cache-audit")
+	assert.NilError(t, err)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "audit.log")
+	l := newAuditLog(path)
+	l.maxSize = 200
+	for _, id := range []image.ID{"sha256:a", "sha256:b", "sha256:c"} {
+		l.queue(AuditRecord{Image: id, Freed: 1, Reason: "test"})
+	}
+	l.close()
+	// records are still written once the log is closed
+	l.close()
+	l.queue(AuditRecord{Image: "sha256:d", Freed: 1, Reason: "test"})
+
+	rotated := readAuditLog(t, path+".1")
+	current := readAuditLog(t, path)
+	assert.Check(t, is.Len(rotated, 2))
+	assert.Assert(t, is.Len(current, 2))
+	assert.Check(t, is.Equal(image.ID("sha256:c"), current[0].Image))
+	assert.Check(t, is.Equal(image.ID("sha256:d"), current[1].Image))
+}
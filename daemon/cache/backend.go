@@ -0,0 +1,26 @@
+package cache
+
+import (
+	"github.com/docker/distribution/reference"
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/image"
+	"github.com/docker/docker/layer"
+)
+
+// ImageBackend is the part of the image service the cache relies on to
+// manage images and their layers
+type ImageBackend interface {
+	Map() map[image.ID]*image.Image
+	GetImage(refOrID string) (*image.Image, error)
+	LookupImage(name string) (*types.ImageInspect, error)
+	ImageDelete(imageRef string, force, prune bool) ([]types.ImageDeleteResponseItem, error)
+	// ImageInUse returns whether a container uses the image
+	ImageInUse(imgID image.ID) bool
+	// LiveContainerImages returns the images used by the containers
+	// running, paused or restarting, which need their image to resume
+	LiveContainerImages() map[image.ID]bool
+	SquashImage(id, parent string) (string, error)
+	TagImageWithReference(imageID image.ID, newTag reference.Named) error
+	GetReadOnlyLayer(chainID layer.ChainID, os string) (layer.Layer, error)
+	ReleaseReadOnlyLayer(l layer.Layer, os string) ([]layer.Metadata, error)
+}
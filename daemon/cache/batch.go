@@ -0,0 +1,95 @@
+package cache
+
+import (
+	"github.com/docker/docker/distribution/xfer"
+	"github.com/docker/docker/layer"
+	"github.com/sirupsen/logrus"
+)
+
+// evictionBatch collects the layers evicted during a pass, so that their
+// archives are deleted together once the pass is over rather than one by
+// one. A pass keeps evicting until at least floor layers have been evicted,
+// which spreads the cost of tiny layers over fewer passes.
+type evictionBatch struct {
+	floor   int
+	layers  int
+	diffIDs []layer.DiffID
+	// archiveBytes is the size of the archives to delete, which the
+	// deletion waits to fit the eviction IO rate limit through throttle
+	archiveBytes int64
+	throttle     func(size int64)
+}
+
+func newEvictionBatch(floor int) *evictionBatch {
+	return &evictionBatch{floor: floor}
+}
+
+// add records an evicted layer, and queues the deletion of its archive, of
+// archiveSize bytes, if deleteArchive is set
+func (b *evictionBatch) add(diffID layer.DiffID, deleteArchive bool, archiveSize int64) {
+	b.layers++
+	if deleteArchive {
+		b.diffIDs = append(b.diffIDs, diffID)
+		b.archiveBytes += archiveSize
+	}
+}
+
+// satisfied reports whether the floor of the batch has been reached
+func (b *evictionBatch) satisfied() bool {
+	return b.layers >= b.floor
+}
+
+// flush hands the archives of the layers in the batch over to del, which
+// deletes them once the write lock is released
+func (b *evictionBatch) flush(del func(diffIDs ...layer.DiffID)) {
+	if len(b.diffIDs) > 0 {
+		if b.throttle != nil {
+			b.throttle(b.archiveBytes)
+		}
+		del(b.diffIDs...)
+	}
+	b.diffIDs = nil
+	b.archiveBytes = 0
+	b.layers = 0
+}
+
+// deleteArchivesLater queues the archives of diffIDs for deletion once the
+// write lock is released, as the deletion waits for the reads of the
+// archives. The caller must hold the write lock.
+func (c *cacheBase) deleteArchivesLater(diffIDs ...layer.DiffID) {
+	c.staleArchives = append(c.staleArchives, diffIDs...)
+}
+
+// unlock releases the write lock, then deletes the archives queued for
+// deletion while it was held, but those held by the cache again meanwhile
+func (c *cacheBase) unlock() {
+	stale := c.staleArchives
+	c.staleArchives = nil
+	c.mu.Unlock()
+	if len(stale) == 0 {
+		return
+	}
+	if err := xfer.GuardArchiveDeletion(stale, c.deleteUnheldArchives); err != nil {
+		logrus.Warnf("error deleting layer archives: %v", err)
+	}
+}
+
+// deleteUnheldArchives deletes the archives of diffIDs which the cache does
+// not hold
+func (c *cacheBase) deleteUnheldArchives(diffIDs []layer.DiffID) error {
+	if c.archiveHeld != nil {
+		c.mu.RLock()
+		unheld := diffIDs[:0]
+		for _, diffID := range diffIDs {
+			if !c.archiveHeld(diffID) {
+				unheld = append(unheld, diffID)
+			}
+		}
+		c.mu.RUnlock()
+		diffIDs = unheld
+	}
+	if len(diffIDs) == 0 {
+		return nil
+	}
+	return deleteArchives(diffIDs)
+}
@@ -0,0 +1,105 @@
+package cache
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/docker/docker/layer"
+	"github.com/opencontainers/go-digest"
+	"gotest.tools/assert"
+	is "gotest.tools/assert/cmp"
+)
+
+// withArchiveDir points the archive directory to a fresh temporary directory
+// for the duration of a test
+func withArchiveDir(t testing.TB) func() {
+	dir, err := ioutil.TempDir("", "cache-archives")
+	assert.NilError(t, err)
+	oldTmp := os.Getenv("TMPDIR")
+	os.Setenv("TMPDIR", dir)
+	return func() {
+		os.Setenv("TMPDIR", oldTmp)
+		os.RemoveAll(dir)
+	}
+}
+
+func writeArchives(t testing.TB, prefix string, n int) []layer.DiffID {
+	diffIDs := make([]layer.DiffID, 0, n)
+	for i := 0; i < n; i++ {
+		diffID := layer.DiffID(digest.FromString(fmt.Sprintf("%s-%d", prefix, i)))
+		err := ioutil.WriteFile(createLayerArchivePath(diffID), []byte("x"), 0600)
+		assert.NilError(t, err)
+		diffIDs = append(diffIDs, diffID)
+	}
+	return diffIDs
+}
+
+func TestEvictionBatch(t *testing.T) {
+	defer withArchiveDir(t)()
+
+	diffIDs := writeArchives(t, "batch", 3)
+	b := newEvictionBatch(2)
+	assert.Check(t, !b.satisfied())
+	b.add(diffIDs[0], true, 0)
+	b.add(diffIDs[1], true, 0)
+	assert.Check(t, b.satisfied())
+
+	// archives are only deleted once the batch is flushed
+	fi, err := getLayerArchiveInfo(diffIDs[0])
+	assert.NilError(t, err)
+	assert.Check(t, fi != nil)
+
+	// nor deleted until the write lock is released
+	c := newCacheBase(0, nil)
+	c.mu.Lock()
+	b.flush(c.deleteArchivesLater)
+	fi, err = getLayerArchiveInfo(diffIDs[0])
+	assert.NilError(t, err)
+	assert.Check(t, fi != nil)
+	c.unlock()
+	for i, diffID := range diffIDs {
+		fi, err := getLayerArchiveInfo(diffID)
+		assert.NilError(t, err)
+		assert.Check(t, is.Equal(i == 2, fi != nil), "archive %d", i)
+	}
+	assert.Check(t, !b.satisfied())
+
+	// missing archives are not an error
+	assert.NilError(t, deleteArchives(diffIDs))
+}
+
+func BenchmarkDeleteArchives(b *testing.B) {
+	const layers = 200
+
+	b.Run("one-by-one", func(b *testing.B) {
+		defer withArchiveDir(b)()
+		for i := 0; i < b.N; i++ {
+			b.StopTimer()
+			diffIDs := writeArchives(b, "one-by-one", layers)
+			b.StartTimer()
+			for _, diffID := range diffIDs {
+				if err := deleteArchive(diffID); err != nil {
+					b.Fatal(err)
+				}
+			}
+		}
+	})
+
+	b.Run("batched", func(b *testing.B) {
+		defer withArchiveDir(b)()
+		c := newCacheBase(0, nil)
+		for i := 0; i < b.N; i++ {
+			b.StopTimer()
+			batch := newEvictionBatch(layers)
+			for _, diffID := range writeArchives(b, "batched", layers) {
+				batch.add(diffID, true, 0)
+			}
+			b.StartTimer()
+			c.mu.Lock()
+			batch.flush(c.deleteArchivesLater)
+			c.unlock()
+		}
+	})
+}
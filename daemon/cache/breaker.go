@@ -0,0 +1,60 @@
+package cache
+
+import (
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// maxFruitlessEvictions is the number of consecutive eviction passes
+	// that free nothing before automatic eviction is disabled
+	maxFruitlessEvictions = 5
+	// evictionCooldown is how long automatic eviction stays disabled once
+	// the breaker trips
+	evictionCooldown = 5 * time.Minute
+)
+
+// evictionBreaker disables automatic eviction after repeated fruitless
+// passes, so that a sick daemon isn't hammered with deletions on every put.
+// It is protected by the lock of the cache it belongs to.
+type evictionBreaker struct {
+	failures      int
+	disabledUntil time.Time
+}
+
+// allow reports whether an automatic eviction pass may run at now
+func (b *evictionBreaker) allow(now time.Time) bool {
+	if b.disabledUntil.IsZero() {
+		return true
+	}
+	if now.Before(b.disabledUntil) {
+		return false
+	}
+	logrus.Infof("Eviction cooldown is over, re-enabling eviction")
+	b.reset()
+	return true
+}
+
+// record accounts the outcome of an eviction pass finished at now
+func (b *evictionBreaker) record(freed bool, now time.Time) {
+	if freed {
+		b.failures = 0
+		return
+	}
+	b.failures++
+	if b.failures >= maxFruitlessEvictions {
+		b.disabledUntil = now.Add(evictionCooldown)
+		logrus.Errorf("%d consecutive eviction passes freed nothing, disabling eviction until %s", b.failures, b.disabledUntil.Format(time.RFC3339))
+	}
+}
+
+func (b *evictionBreaker) reset() {
+	b.failures = 0
+	b.disabledUntil = time.Time{}
+}
+
+// tripped reports whether the breaker is disabling eviction at now
+func (b *evictionBreaker) tripped(now time.Time) bool {
+	return !b.disabledUntil.IsZero() && now.Before(b.disabledUntil)
+}
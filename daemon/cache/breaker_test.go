@@ -0,0 +1,56 @@
+package cache
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"gotest.tools/assert"
+)
+
+func TestEvictionBreaker(t *testing.T) {
+	var b evictionBreaker
+	now := time.Now()
+
+	for i := 0; i < maxFruitlessEvictions-1; i++ {
+		assert.Check(t, b.allow(now))
+		b.record(false, now)
+	}
+	assert.Check(t, !b.tripped(now))
+
+	// a successful pass resets the count
+	b.record(true, now)
+	for i := 0; i < maxFruitlessEvictions; i++ {
+		assert.Check(t, b.allow(now))
+		b.record(false, now)
+	}
+	assert.Check(t, b.tripped(now))
+	assert.Check(t, !b.allow(now.Add(evictionCooldown/2)))
+
+	// eviction is re-enabled after the cooldown
+	later := now.Add(evictionCooldown)
+	assert.Check(t, b.allow(later))
+	assert.Check(t, !b.tripped(later))
+	assert.Equal(t, b.failures, 0)
+}
+
+func TestEvictionBreakerReclaim(t *testing.T) {
+	c := &cacheBase{capacity: 10, level: 20, mu: &sync.RWMutex{}}
+	now := time.Now()
+	for i := 0; i < maxFruitlessEvictions; i++ {
+		c.runEviction(func(int64) {})
+	}
+	assert.Check(t, c.breaker.tripped(now))
+	assert.Check(t, c.Stats().EvictionDisabled)
+
+	// a tripped breaker stops automatic eviction
+	var called bool
+	c.runEviction(func(int64) { called = true })
+	assert.Check(t, !called)
+
+	// a successful manual reclaim resets it
+	freed := c.reclaim(15, func(target int64) { c.level = target })
+	assert.Equal(t, freed, int64(15))
+	assert.Check(t, !c.breaker.tripped(now))
+	assert.Check(t, !c.Stats().EvictionDisabled)
+}
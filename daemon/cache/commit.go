@@ -0,0 +1,63 @@
+package cache
+
+import (
+	"github.com/docker/docker/image"
+)
+
+// BeginCommit registers the images of a container commit, its base image
+// and, once known, the committed image. Until the matching EndCommit, they
+// are not evicted, so that the committed image is not evicted before it
+// has been tagged and put in the cache.
+func (c *cacheBase) BeginCommit(imgIDs ...image.ID) {
+	c.mu.Lock()
+	defer c.unlock()
+
+	if c.committing == nil {
+		c.committing = make(map[image.ID]int)
+	}
+	for _, imgID := range imgIDs {
+		c.committing[c.cachedID(imgID)]++
+	}
+	c.touchActivity()
+}
+
+// EndCommit unregisters the images registered by BeginCommit
+func (c *cacheBase) EndCommit(imgIDs ...image.ID) {
+	c.mu.Lock()
+	defer c.unlock()
+
+	for _, imgID := range imgIDs {
+		imgID = c.cachedID(imgID)
+		if c.committing[imgID] <= 1 {
+			delete(c.committing, imgID)
+			continue
+		}
+		c.committing[imgID]--
+	}
+}
+
+// protectCommitting marks the images of the commits in progress as
+// protected in plan. The caller must hold the lock.
+func (c *cacheBase) protectCommitting(plan *evictionPlan, imgs []*image.Image) {
+	for _, img := range imgs {
+		if c.committing[img.ID()] > 0 {
+			plan.protected[img.ID()] = true
+		}
+	}
+}
+
+// BeginCommit implements the ImageCache interface. The images are
+// registered in every partition, as the committed image may be put in
+// another partition than its base.
+func (c *partitionedCache) BeginCommit(imgIDs ...image.ID) {
+	for _, p := range c.partitions {
+		p.BeginCommit(imgIDs...)
+	}
+}
+
+// EndCommit implements the ImageCache interface
+func (c *partitionedCache) EndCommit(imgIDs ...image.ID) {
+	for _, p := range c.partitions {
+		p.EndCommit(imgIDs...)
+	}
+}
@@ -0,0 +1,54 @@
+package cache
+
+import (
+	"testing"
+	"time"
+
+	"github.com/docker/docker/image"
+	"github.com/docker/docker/layer"
+	"gotest.tools/assert"
+	is "gotest.tools/assert/cmp"
+)
+
+func TestCommitNotEvicted(t *testing.T) {
+	for _, tc := range []struct {
+		policy   string
+		newCache func(*cacheBase) ImageCache
+	}{
+		{policy: policyNaive, newCache: newNaiveCache},
+		{policy: policyImageLRU, newCache: newImageLRUCache},
+		{policy: policyLayerLRU, newCache: newLayerLRUCache},
+	} {
+		b, cleanup := newFakeBackendForTest(t)
+
+		now := time.Now()
+		c := tc.newCache(newCacheBase(30, b))
+		base := b.addImage(t, now, []layer.DiffID{b.layer("base", 10)}, "base:latest")
+		c.PutImage(base)
+		c.BeginCommit(base.ID())
+
+		// the cache fills up during the commit
+		var others []*image.Image
+		for i, name := range []string{"a", "b"} {
+			img := b.addImage(t, now.Add(time.Duration(i+1)*time.Minute), []layer.DiffID{b.layer(name, 10)}, name+":latest")
+			others = append(others, img)
+			c.PutImage(img)
+		}
+
+		// the committed image goes over capacity, the other images make
+		// room for it
+		result := b.addImage(t, now.Add(time.Hour), []layer.DiffID{b.layer("result", 20)}, "result:latest")
+		c.BeginCommit(result.ID())
+		c.PutImage(result)
+		assert.Check(t, is.DeepEqual([]image.ID{others[0].ID(), others[1].ID()}, b.deleted), tc.policy)
+		assert.Check(t, is.Equal(int64(30), c.Level()), tc.policy)
+
+		// nothing else can go while the commit is in progress
+		assert.Check(t, is.Equal(int64(0), c.Reclaim(1)), tc.policy)
+
+		c.EndCommit(base.ID(), result.ID())
+		assert.Check(t, is.Equal(int64(10), c.Reclaim(1)), tc.policy)
+		assert.Check(t, is.Equal(base.ID(), b.deleted[len(b.deleted)-1]), tc.policy)
+		cleanup()
+	}
+}
@@ -0,0 +1,114 @@
+package cache
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// CacheConfig is the configuration of the cache as resolved at startup,
+// after the defaults and fallbacks are applied to the daemon configuration
+type CacheConfig struct {
+	Policy   string
+	Mode     string
+	Capacity int64
+	// Archive is set if the layer archives are kept, which only the
+	// archive LRU cache does
+	Archive bool
+	// EvictThreshold is the percentage of the capacity the level must
+	// exceed before an automatic pass evicts
+	EvictThreshold int
+	RecencyWeight  float64
+	EvictionBatch  int
+	MaxLayers      int
+	// RetainRetries is the number of times an evicted layer no longer
+	// retained by the layer store is re-acquired to be released
+	RetainRetries int
+	DiskReserve   int64            `json:",omitempty"`
+	SpillCapacity int64            `json:",omitempty"`
+	Namespaces    map[string]int64 `json:",omitempty"`
+
+	// IdleTimeout is the number of seconds without use after which the
+	// cache is reclaimed down to IdleFloor, 0 if it never is
+	IdleTimeout int   `json:",omitempty"`
+	IdleFloor   int64 `json:",omitempty"`
+
+	// EvictionIORate is the rate in bytes per second of the IO of the
+	// evictions of the layer-based caches, 0 if unlimited
+	EvictionIORate int64 `json:",omitempty"`
+
+	// ScanLabel is the label holding the time of the last vulnerability
+	// scan of the images, the image LRU cache evicting first the images
+	// scanned the longest ago among equals
+	ScanLabel string `json:",omitempty"`
+
+	// Fallbacks describes the settings of the daemon configuration which
+	// were ignored or replaced while resolving it
+	Fallbacks []string `json:",omitempty"`
+}
+
+// resolveConfig returns the configuration resolved from the options of
+// the cache
+func resolveConfig(opts Options) CacheConfig {
+	rc := CacheConfig{
+		Policy:         strings.ToLower(opts.Policy),
+		Mode:           opts.Mode,
+		Capacity:       opts.Capacity,
+		Archive:        opts.archiveEnabled(),
+		EvictThreshold: opts.EvictThreshold,
+		RecencyWeight:  opts.RecencyWeight,
+		ScanLabel:      opts.ScanLabel,
+		EvictionBatch:  opts.EvictionBatch,
+		MaxLayers:      opts.MaxLayers,
+		RetainRetries:  opts.RetainRetries,
+		DiskReserve:    opts.DiskReserve,
+		IdleTimeout:    int(opts.IdleTimeout / time.Second),
+		SpillCapacity:  opts.SpillCapacity,
+		Namespaces:     opts.Namespaces,
+	}
+	if rc.Mode == "" {
+		rc.Mode = ModeFull
+	}
+	if rc.EvictThreshold == 0 {
+		rc.EvictThreshold = 100
+	}
+	if rc.RetainRetries == 0 {
+		rc.RetainRetries = defaultRetainRetries
+	}
+	if opts.IdleTimeout > 0 {
+		rc.IdleFloor = opts.IdleFloor
+	} else if opts.IdleFloor != 0 {
+		rc.Fallbacks = append(rc.Fallbacks, "cache-idle-floor is ignored without cache-idle-timeout")
+	}
+	if opts.Archive && !rc.Archive {
+		rc.Fallbacks = append(rc.Fallbacks, fmt.Sprintf("cache-archive is ignored by the %q cache policy", rc.Policy))
+	}
+	if rc.Policy != policyArchiveLRU {
+		if opts.ArchiveMaxSize != 0 {
+			rc.Fallbacks = append(rc.Fallbacks, fmt.Sprintf("cache-archive-max-size is ignored by the %q cache policy", rc.Policy))
+		}
+		if len(opts.ArchiveExclude) > 0 {
+			rc.Fallbacks = append(rc.Fallbacks, fmt.Sprintf("cache-archive-exclude is ignored by the %q cache policy", rc.Policy))
+		}
+	}
+	if rc.Policy != policyImageLRU && rc.RecencyWeight != 1 {
+		rc.Fallbacks = append(rc.Fallbacks, fmt.Sprintf("cache-recency-weight is ignored by the %q cache policy", rc.Policy))
+	}
+	switch rc.Policy {
+	case policyLayerLRU, policyLayerLFU, policyArchiveLRU:
+		rc.EvictionIORate = opts.EvictionIORate
+	default:
+		if opts.EvictionIORate != 0 {
+			rc.Fallbacks = append(rc.Fallbacks, fmt.Sprintf("cache-eviction-io-rate is ignored by the %q cache policy", rc.Policy))
+		}
+	}
+	if rc.Policy != policyImageLRU && rc.ScanLabel != "" {
+		rc.Fallbacks = append(rc.Fallbacks, fmt.Sprintf("cache-scan-label is ignored by the %q cache policy", rc.Policy))
+	}
+	return rc
+}
+
+// Config implements the ImageCache interface
+func (c *cacheBase) Config() CacheConfig {
+	return c.config
+}
@@ -0,0 +1,69 @@
+package cache
+
+import (
+	"sort"
+	"time"
+
+	"github.com/docker/docker/image"
+	"github.com/sirupsen/logrus"
+)
+
+// Drift describes how the accounting of the cache departs from its entries
+// and from the image store
+type Drift struct {
+	// Recorded is the level tracked by the cache, and Actual the level
+	// recomputed from its entries
+	Recorded int64
+	Actual   int64
+	// Stale lists the cached images no longer in the image store
+	Stale []image.ID `json:",omitempty"`
+}
+
+// Consistent reports whether no drift was found
+func (d Drift) Consistent() bool {
+	return d.Recorded == d.Actual && len(d.Stale) == 0
+}
+
+// drift compares the recorded level with actual, the level recomputed from
+// the entries of the cache, and looks for the images among ids which are
+// no longer in the image store. The caller must hold the lock.
+func (c *cacheBase) drift(actual int64, ids []image.ID) Drift {
+	imgs := c.imageService.Map()
+	var stale []image.ID
+	for _, id := range ids {
+		if _, ok := imgs[id]; !ok {
+			stale = append(stale, id)
+		}
+	}
+	sort.Slice(stale, func(i, j int) bool { return stale[i] < stale[j] })
+	return Drift{Recorded: c.level, Actual: actual, Stale: stale}
+}
+
+// resync corrects drift by pruning the stale images through remove, then
+// resetting the level to the one recomputed by entryLevel. The caller must
+// hold the write lock.
+func (c *cacheBase) resync(drift Drift, remove func(image.ID), entryLevel func() int64) Drift {
+	for _, id := range drift.Stale {
+		remove(id)
+	}
+	c.setLevel(entryLevel())
+	if !drift.Consistent() {
+		logrus.Infof("Resynced cache, level %d corrected to %d, %d stale images pruned, %s",
+			drift.Recorded, drift.Actual, len(drift.Stale), c.usage())
+	}
+	return drift
+}
+
+// runResync resyncs the cache every interval until stop is closed
+func runResync(c ImageCache, interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			c.Resync()
+		}
+	}
+}
@@ -0,0 +1,148 @@
+package cache
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/docker/docker/image"
+	"github.com/docker/docker/layer"
+	"gotest.tools/assert"
+	is "gotest.tools/assert/cmp"
+	"gotest.tools/poll"
+)
+
+func TestResyncCorrectsDrift(t *testing.T) {
+	for _, policy := range []string{policyNaive, policyImageLRU, policyLayerLRU, policyArchiveLRU} {
+		t.Run(policy, func(t *testing.T) {
+			b, cleanup := newFakeBackendForTest(t)
+			defer cleanup()
+
+			now := time.Now()
+			kept := b.addImage(t, now, []layer.DiffID{b.layer("kept", 30)})
+			gone := b.addImage(t, now.Add(time.Second), []layer.DiffID{b.layer("gone", 20)})
+
+			c := newTestCache(t, policy, newCacheBase(1000, b))
+			c.PutImage(kept)
+			c.PutImage(gone)
+			assert.Check(t, c.CheckConsistency().Consistent())
+
+			// the image is deleted behind the back of the cache, whose
+			// level also drifts
+			_, err := b.ImageDelete(gone.ID().String(), true, false)
+			assert.NilError(t, err)
+			setLevel(c, c.Level()+7)
+
+			drift := c.CheckConsistency()
+			assert.Check(t, is.DeepEqual(Drift{Recorded: 57, Actual: 50, Stale: []image.ID{gone.ID()}}, drift))
+			assert.Check(t, is.Equal(int64(57), c.Level()))
+
+			assert.Check(t, is.DeepEqual(drift, c.Resync()))
+			assert.Check(t, is.Equal(int64(30), c.Level()))
+			assert.Check(t, c.CheckConsistency().Consistent())
+		})
+	}
+}
+
+func TestRunResync(t *testing.T) {
+	b, cleanup := newFakeBackendForTest(t)
+	defer cleanup()
+
+	base := newCacheBase(1000, b)
+	c := newImageLRUCache(base)
+	c.PutImage(b.addImage(t, time.Now(), []layer.DiffID{b.layer("a", 30)}))
+	setLevel(c, 100)
+
+	done := make(chan struct{})
+	go func() {
+		runResync(c, time.Millisecond, base.stop)
+		close(done)
+	}()
+	poll.WaitOn(t, func(poll.LogT) poll.Result {
+		if c.Level() != 30 {
+			return poll.Continue("level is %d", c.Level())
+		}
+		return poll.Success()
+	}, poll.WithDelay(time.Millisecond))
+
+	assert.NilError(t, c.Close())
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("resync still running after Close")
+	}
+}
+
+func newTestCache(t *testing.T, policy string, base *cacheBase) ImageCache {
+	t.Helper()
+	switch policy {
+	case policyNaive:
+		return newNaiveCache(base)
+	case policyImageLRU:
+		return newImageLRUCache(base)
+	case policyLayerLRU:
+		return newLayerLRUCache(base)
+	case policyLayerLFU:
+		return newLayerLFUCache(base)
+	case policyArchiveLRU:
+		return newArchiveLRUCache(base)
+	}
+	t.Fatalf("unknown policy %q", policy)
+	return nil
+}
+
+// setLevel overrides the level of c, as drift would
+func setLevel(c ImageCache, level int64) {
+	base := baseOf(c)
+	base.mu.Lock()
+	base.setLevel(level)
+	base.mu.Unlock()
+}
+
+// baseOf returns the cacheBase embedded in c
+func baseOf(c ImageCache) *cacheBase {
+	switch c := c.(type) {
+	case *naiveCache:
+		return c.cacheBase
+	case *imageLRUCache:
+		return c.cacheBase
+	case *layerLRUCache:
+		return c.cacheBase
+	case *layerLFUCache:
+		return c.cacheBase
+	case *archiveLRUCache:
+		return c.cacheBase
+	}
+	return nil
+}
+
+func TestRebuild(t *testing.T) {
+	for _, policy := range []string{policyNaive, policyImageLRU, policyLayerLRU, policyArchiveLRU} {
+		t.Run(policy, func(t *testing.T) {
+			b, cleanup := newFakeBackendForTest(t)
+			defer cleanup()
+
+			now := time.Now()
+			base := b.layer("base", 10)
+			img1 := b.addImage(t, now, []layer.DiffID{base, b.layer("one", 20)})
+			img2 := b.addImage(t, now.Add(time.Second), []layer.DiffID{base, b.layer("two", 30)})
+
+			c := newTestCache(t, policy, newCacheBase(1000, b))
+			assert.NilError(t, loadExistingImages(context.Background(), c, b, nil, nil))
+			level := c.Level()
+			handles := len(b.handles)
+
+			// the index loses an entry and its level drifts
+			c.RemoveImage(img1.ID())
+			setLevel(c, 999)
+
+			assert.NilError(t, c.Rebuild())
+			assert.Check(t, is.Equal(level, c.Level()))
+			assert.Check(t, c.CheckConsistency().Consistent())
+			assert.Check(t, c.Promote(img1.ID()))
+			assert.Check(t, c.Promote(img2.ID()))
+			// no layer reference is leaked by the rebuild
+			assert.Check(t, is.Equal(handles, len(b.handles)))
+		})
+	}
+}
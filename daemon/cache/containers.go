@@ -0,0 +1,22 @@
+package cache
+
+import (
+	"github.com/docker/docker/image"
+)
+
+// protectLiveContainers marks the cached images used by the containers
+// running, paused or restarting as protected in plan. The image LRU cache
+// deletes its victims with force, which only the conflict of a running
+// container stops, so a paused or restarting container could otherwise
+// lose the image it resumes from. The caller must hold the write lock.
+func (c *cacheBase) protectLiveContainers(plan *evictionPlan, imgs []*image.Image) {
+	if c.imageService == nil {
+		return
+	}
+	live := c.imageService.LiveContainerImages()
+	for _, img := range imgs {
+		if live[img.ID()] {
+			plan.protected[img.ID()] = true
+		}
+	}
+}
@@ -0,0 +1,36 @@
+package cache
+
+import (
+	"github.com/docker/docker/image"
+	"github.com/sirupsen/logrus"
+)
+
+// diskSource reports the free space, in bytes, of the filesystem holding
+// the images
+type diskSource func() (int64, error)
+
+// admit reports whether a new image may be put in the cache. Images the
+// user removed are refused. The level of the cache only accounts the images
+// it knows about, so an image is also refused when the free disk space is
+// below the reserve, even if the level leaves room for it. The caller must
+// hold the write lock.
+func (c *cacheBase) admit(img *image.Image) bool {
+	if c.removedByUser(img) {
+		return false
+	}
+	if c.diskReserve <= 0 || c.freeDisk == nil {
+		return true
+	}
+	free, err := c.freeDisk()
+	if err != nil {
+		logrus.Warnf("error getting free disk space, admitting image %s: %v", img.ID(), err)
+		return true
+	}
+	if free >= c.diskReserve {
+		return true
+	}
+	refusedAdmissions.Inc()
+	c.recordEvent(img.ID(), EventSkip, "free disk space below the reserve")
+	logrus.Warnf("Refused image %s, %d bytes of free disk space below the reserve of %d", img.ID(), free, c.diskReserve)
+	return false
+}
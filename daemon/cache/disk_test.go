@@ -0,0 +1,44 @@
+package cache
+
+import (
+	"testing"
+	"time"
+
+	"github.com/docker/docker/layer"
+	"gotest.tools/assert"
+	is "gotest.tools/assert/cmp"
+)
+
+func refusedCount(t *testing.T) float64 {
+	t.Helper()
+	return collectMetric(t, refusedAdmissions).GetCounter().GetValue()
+}
+
+func TestAdmissionRefusedOnLowDisk(t *testing.T) {
+	for _, policy := range []string{policyNaive, policyImageLRU, policyLayerLRU, policyArchiveLRU} {
+		t.Run(policy, func(t *testing.T) {
+			b, cleanup := newFakeBackendForTest(t)
+			defer cleanup()
+
+			img := b.addImage(t, time.Now(), []layer.DiffID{b.layer("a", 30)})
+
+			var free int64 = 50
+			base := newCacheBase(1000, b)
+			base.diskReserve = 100
+			base.freeDisk = func() (int64, error) { return free, nil }
+			c := newTestCache(t, policy, base)
+
+			refused := refusedCount(t)
+			c.PutImage(img)
+			assert.Check(t, is.Equal(int64(0), c.Level()))
+			assert.Check(t, is.Equal(refused+1, refusedCount(t)))
+			assert.Check(t, c.Promote(img.ID()) != nil)
+
+			free = 500
+			c.PutImage(img)
+			assert.Check(t, is.Equal(int64(30), c.Level()))
+			assert.Check(t, is.Equal(refused+1, refusedCount(t)))
+			assert.NilError(t, c.Promote(img.ID()))
+		})
+	}
+}
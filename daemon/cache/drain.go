@@ -0,0 +1,82 @@
+package cache
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/docker/docker/errdefs"
+	"github.com/sirupsen/logrus"
+)
+
+// drainProgressInterval is the minimum interval between two progress logs
+// of a drain
+const drainProgressInterval = 10 * time.Second
+
+// drain evicts from c until its level is at most target. It reclaims a
+// single entry at a time, so that the lock of the cache is released between
+// evictions and the drain can be cancelled through ctx, leaving what it
+// evicted so far evicted. The evictions respect the pins, the pulls and the
+// images in use like any other, and the drain fails once nothing else can
+// be evicted.
+func drain(ctx context.Context, c ImageCache, target int64) error {
+	if target < 0 {
+		return errdefs.InvalidParameter(fmt.Errorf("invalid cache drain target %d, must not be negative", target))
+	}
+	start := c.Level()
+	if start <= target {
+		return nil
+	}
+	logrus.Infof("Draining cache from %d down to %d bytes", start, target)
+	last := timeNow()
+	for {
+		level := c.Level()
+		if level <= target {
+			logrus.Infof("Drained cache down to %d bytes", level)
+			return nil
+		}
+		if err := ctx.Err(); err != nil {
+			logrus.Warnf("Draining cache stopped at %d bytes: %v", level, err)
+			return err
+		}
+		if c.Reclaim(1) == 0 {
+			return errdefs.Conflict(fmt.Errorf("cannot drain cache below %d bytes, the images left are pinned, being pulled or in use", level))
+		}
+		if now := timeNow(); now.Sub(last) >= drainProgressInterval {
+			logrus.Infof("Draining cache, %d/%d bytes freed", start-c.Level(), start-target)
+			last = now
+		}
+	}
+}
+
+// Drain implements the ImageCache interface
+func (c *naiveCache) Drain(ctx context.Context, target int64) error {
+	return drain(ctx, c, target)
+}
+
+// Drain implements the ImageCache interface
+func (c *imageLRUCache) Drain(ctx context.Context, target int64) error {
+	return drain(ctx, c, target)
+}
+
+// Drain implements the ImageCache interface
+func (c *layerLRUCache) Drain(ctx context.Context, target int64) error {
+	return drain(ctx, c, target)
+}
+
+// Drain implements the ImageCache interface
+func (c *archiveLRUCache) Drain(ctx context.Context, target int64) error {
+	return drain(ctx, c, target)
+}
+
+// Drain implements the ImageCache interface, reclaiming the partitions in
+// turn as Reclaim does
+func (c *partitionedCache) Drain(ctx context.Context, target int64) error {
+	return drain(ctx, c, target)
+}
+
+// Drain implements the ImageCache interface. The spill tier is emptied
+// first, as Reclaim does, before the images of the cache are demoted.
+func (c *spillCache) Drain(ctx context.Context, target int64) error {
+	return drain(ctx, c, target)
+}
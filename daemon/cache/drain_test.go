@@ -0,0 +1,62 @@
+package cache
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/docker/docker/errdefs"
+	"github.com/docker/docker/image"
+	"github.com/docker/docker/layer"
+	"gotest.tools/assert"
+	is "gotest.tools/assert/cmp"
+)
+
+func TestDrain(t *testing.T) {
+	for _, tc := range []struct {
+		policy   string
+		newCache func(*cacheBase) ImageCache
+	}{
+		{policy: policyNaive, newCache: newNaiveCache},
+		{policy: policyImageLRU, newCache: newImageLRUCache},
+		{policy: policyLayerLRU, newCache: newLayerLRUCache},
+	} {
+		b, cleanup := newFakeBackendForTest(t)
+
+		now := time.Now()
+		c := tc.newCache(newCacheBase(1000, b))
+		assert.NilError(t, c.PinPattern("base:*"), tc.policy)
+		base := b.addImage(t, now, []layer.DiffID{b.layer("base", 20)}, "base:1")
+		c.PutImage(base)
+		var imgs []*image.Image
+		for i := 0; i < 5; i++ {
+			tag := fmt.Sprintf("app:%d", i)
+			img := b.addImage(t, now.Add(time.Duration(i+1)*time.Minute), []layer.DiffID{b.layer(tag, 20)}, tag)
+			imgs = append(imgs, img)
+			c.PutImage(img)
+		}
+		assert.Check(t, is.Equal(int64(120), c.Level()), tc.policy)
+
+		// the oldest images go first, down to the target rather than by a
+		// number of bytes
+		assert.NilError(t, c.Drain(context.Background(), 70), tc.policy)
+		assert.Check(t, is.Equal(int64(60), c.Level()), tc.policy)
+		assert.Check(t, is.DeepEqual([]image.ID{imgs[0].ID(), imgs[1].ID(), imgs[2].ID()}, b.deleted), tc.policy)
+
+		// a cancelled drain evicts nothing
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		assert.Check(t, is.Equal(context.Canceled, c.Drain(ctx, 0)), tc.policy)
+		assert.Check(t, is.Equal(int64(60), c.Level()), tc.policy)
+
+		// the pinned image stays
+		err := c.Drain(context.Background(), 0)
+		assert.Check(t, errdefs.IsConflict(err), tc.policy)
+		assert.Check(t, is.Equal(int64(20), c.Level()), tc.policy)
+		assert.Check(t, is.Len(b.deleted, len(imgs)), tc.policy)
+
+		assert.Check(t, errdefs.IsInvalidParameter(c.Drain(context.Background(), -1)), tc.policy)
+		cleanup()
+	}
+}
@@ -1,62 +1,649 @@
 package cache
 
 import (
+	"context"
 	"fmt"
+	"math"
+	"sort"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/docker/docker/daemon/config"
-	"github.com/docker/docker/daemon/images"
+	"github.com/docker/docker/errdefs"
 	"github.com/docker/go-units"
 	"github.com/sirupsen/logrus"
 
 	"github.com/docker/docker/image"
+	"github.com/docker/docker/layer"
 )
 
 const (
 	policyNaive      = "naive"
 	policyLayerLRU   = "layer-lru"
+	policyLayerLFU   = "layer-lfu"
 	policyImageLRU   = "image-lru"
 	policyArchiveLRU = "archive-lru"
 )
 
+// The modes of the cache. In full mode, the cache takes part in pulls,
+// protecting the images being pulled and squashing the pulled ones, while in
+// eviction-only mode it only records the pulled images for eviction.
+const (
+	ModeFull         = "full"
+	ModeEvictionOnly = "eviction-only"
+)
+
+// maxCacheCapacity bounds the cache capacity well below the int64 range, so
+// that the level arithmetic has room to spare
+const maxCacheCapacity int64 = 1 << 60
+
 // ImageCache is the interface of the image cache
 type ImageCache interface {
 	Capacity() int64
 	Level() int64
 	PutImage(*image.Image)
+	// UpdateImage records a use of a cached image. The reference or ID is
+	// resolved under the cache lock, along with the lookup of the entry, so
+	// that a concurrent RemoveImage never leaves it a removed entry.
 	UpdateImage(string)
 	RemoveImage(image.ID)
+	// UserRemoveImage is RemoveImage for an image the user deleted, as
+	// opposed to one the image store dropped otherwise. The removal is
+	// audited, and the image is not cached again.
+	UserRemoveImage(image.ID)
+	// Reclaim evicts entries until at least size bytes are freed and
+	// returns the number of bytes actually freed
+	Reclaim(size int64) int64
+	// Drain evicts entries until the level is at most target bytes, an
+	// entry at a time, until ctx is cancelled. Unlike Reclaim, it aims for
+	// a level rather than for a number of bytes freed.
+	Drain(ctx context.Context, target int64) error
+	Stats() Stats
+	// Efficiency summarizes the hits, evictions and re-pulls of the cache
+	// since the last ResetStats, or since its creation
+	Efficiency() Efficiency
+	// ResetStats starts a new window for Efficiency
+	ResetStats()
+	// ReclaimableBreakdown breaks the level down into what eviction is free
+	// to reclaim, what it protects and what containers use, telling why
+	// the cache may be stuck over capacity
+	ReclaimableBreakdown() Reclaimable
+	// OverCapacity reports whether the level exceeds the capacity, that is
+	// whether an eviction is pending
+	OverCapacity() bool
+	// Pressure returns the level relative to the capacity, above 1 when
+	// the cache is over capacity
+	Pressure() float64
+	// Oldest returns the entry next in line for eviction and when it was
+	// last used
+	Oldest() (image.ID, time.Time)
+	// Newest returns the most recently used entry and when it was used
+	Newest() (image.ID, time.Time)
+	// ForEach calls fn on the entries in eviction order, the entry next in
+	// line for eviction first, until fn returns false. fn is called under
+	// the read lock of the cache, so it must not call back into the cache.
+	ForEach(fn func(CacheEntry) bool)
+	// List returns an entry per cached image. The entries of the
+	// layer-based caches are made of the cached layers of each image.
+	List() []CacheEntry
+	// ValidatePolicy checks whether the cache could switch to policy at
+	// capacity, and returns the warnings of what the switch would change
+	ValidatePolicy(policy string, capacity int64) ([]string, error)
+	// Promote moves a cached image to the front of the cache, as if it had
+	// just been used. Unlike pinning, the image ages again from there.
+	Promote(image.ID) error
+	// Position returns the rank of a cached image in the eviction order,
+	// from 0 for the most recently used entry, out of the total number of
+	// entries. The rank of an image of the layer-based caches is that of
+	// its most recently used layer.
+	Position(image.ID) (rank, total int, ok bool)
+	// FreeableBytes returns the bytes that removing a cached image now
+	// would free, the diff size of its layers that no other image of the
+	// image store uses, and 0 if a container uses the image
+	FreeableBytes(image.ID) int64
+	// CheckConsistency compares the accounting of the cache with its
+	// entries and the image store, without changing anything
+	CheckConsistency() Drift
+	// Resync corrects the drift found by CheckConsistency, pruning the
+	// stale entries and resetting the level, and returns it
+	Resync() Drift
+	// Rebuild discards the state of the cache and loads it again from the
+	// image store, as on startup
+	Rebuild() error
+	// History returns the recorded events of an image, if enabled
+	History(image.ID) []CacheEvent
+	// Close stops the background tasks of the cache
+	Close() error
+	// BeginPull protects the images tagged with ref from eviction while
+	// ref is being pulled, until EndPull is called
+	BeginPull(ref string)
+	EndPull(ref string)
+	// BeginCommit protects the base image of a container commit, and the
+	// committed image once known, from eviction until EndCommit is called
+	BeginCommit(imgIDs ...image.ID)
+	EndCommit(imgIDs ...image.ID)
+	// Reserve reserves the expected size of an image about to be pulled
+	// as ref, evicting ahead of the pull to make room for it, until the
+	// returned function is called
+	Reserve(ref string, size int64) func()
+	// SquashImage squashes a freshly pulled image into a single layer
+	// before it is put in the cache, if squashing is enabled
+	SquashImage(*image.Image) (*image.Image, error)
+	// PinPattern keeps the images with a tag matching the glob pattern from
+	// eviction, including those cached later, until UnpinPattern is called
+	PinPattern(pattern string) error
+	UnpinPattern(pattern string) error
+	// Config returns the configuration of the cache as resolved at startup,
+	// including the fallbacks applied to the daemon configuration
+	Config() CacheConfig
+	// Internal reports whether an image is an artifact of the cache rather
+	// than an image of the user, such as the original of a squashed image
+	// which could not be deleted
+	Internal(image.ID) bool
+	// SetRegistry records the host of the registry a cached image was
+	// pulled from, as reported by List and broken down by Stats
+	SetRegistry(imgID image.ID, registry string)
 }
 
-// NewImageCache creates a new image cache
+// NewImageCache creates a new image cache from the daemon configuration,
+// parsing it into the options of NewImageCacheWithOptions
 // defaults to image-level LRU
-func NewImageCache(cfg *config.Config, is *images.ImageService) (ImageCache, error) {
-	capacity, err := units.RAMInBytes(cfg.CacheCapacity)
+func NewImageCache(cfg *config.Config, is ImageBackend) (ImageCache, error) {
+	opts, err := parseOptions(cfg)
 	if err != nil {
 		return nil, err
 	}
-	switch policy := strings.ToLower(cfg.CachePolicy); policy {
+	return NewImageCacheWithOptions(opts, is)
+}
+
+// NewImageCacheWithOptions creates a new image cache of the policy set in
+// opts, or returns nil if none is set
+func NewImageCacheWithOptions(opts Options, is ImageBackend) (ImageCache, error) {
+	if err := opts.validate(); err != nil {
+		return nil, err
+	}
+
+	// the partitions of the cache share the audit log, the on-evict
+	// command, the activity and the eviction IO rate limit
+	var audit *auditLog
+	if opts.AuditLog != "" {
+		audit = newAuditLog(opts.AuditLog)
+	}
+	var hook *evictHook
+	if opts.OnEvictCommand != "" {
+		hook = newEvictHook(opts.OnEvictCommand)
+	}
+	var activity *activityClock
+	if opts.IdleTimeout > 0 {
+		activity = newActivityClock()
+	}
+	var ioLimit *ioLimiter
+	if opts.EvictionIORate > 0 {
+		ioLimit = newIOLimiter(opts.EvictionIORate)
+	}
+	var bases []*cacheBase
+	newBase := func(capacity int64, is ImageBackend) *cacheBase {
+		base := newCacheBase(capacity, is)
+		bases = append(bases, base)
+		if opts.DiskReserve > 0 {
+			base.diskReserve = opts.DiskReserve
+			base.freeDisk = freeDiskSpace(opts.Root)
+		}
+		base.squash = opts.Squash
+		base.archive = opts.Archive
+		base.keepRecentTags = opts.KeepRecentTags
+		base.evictionBatch = opts.EvictionBatch
+		if opts.RetainRetries > 0 {
+			base.retainRetries = opts.RetainRetries
+		}
+		base.evictThreshold = opts.EvictThreshold
+		base.maxLayers = opts.MaxLayers
+		base.archiveMaxSize = opts.ArchiveMaxSize
+		base.archiveExclude = opts.ArchiveExclude
+		base.recencyWeight = opts.RecencyWeight
+		base.scanLabel = opts.ScanLabel
+		if opts.History {
+			base.history = newHistoryLog()
+		}
+		if opts.MissRateTarget > 0 {
+			base.advisor = newCapacityAdvisor(opts.MissRateTarget)
+		}
+		base.audit = audit
+		base.evictHook = hook
+		base.activity = activity
+		base.ioLimit = ioLimit
+		return base
+	}
+
+	backend := is
+	var pc *partitionedCache
+	if len(opts.Namespaces) > 0 {
+		pc = newPartitionedCache(is)
+		backend = pc.backendOf("")
+	}
+	var sc *spillCache
+	if opts.SpillCapacity > 0 {
+		sc = newSpillCache(is)
+		backend = sc.backendOf(false)
+	}
+	base := newBase(opts.Capacity, backend)
+	if opts.Root != "" {
+		base.orderPath = orderPath(opts.Root, "")
+	}
+	c, err := newPolicyCache(opts, base)
+	if c == nil || err != nil {
+		return nil, err
+	}
+	if pc != nil {
+		pc.partitions[""] = c
+		for ns, capacity := range opts.Namespaces {
+			partitionBase := newBase(capacity, pc.backendOf(ns))
+			if opts.Root != "" {
+				partitionBase.orderPath = orderPath(opts.Root, ns)
+			}
+			partition, err := newPolicyCache(opts, partitionBase)
+			if err != nil {
+				return nil, err
+			}
+			pc.partitions[ns] = partition
+		}
+		c = pc
+	}
+	if sc != nil {
+		if base.policy != policyImageLRU {
+			return nil, fmt.Errorf("a cache spill tier requires the %q cache policy", policyImageLRU)
+		}
+		spillBase := newBase(opts.SpillCapacity, sc.backendOf(true))
+		spillBase.policy = policyImageLRU
+		// spilled images are promoted on their first use, none stays warm
+		bases = bases[:len(bases)-1]
+		sc.spill = newImageLRUCache(spillBase).(*imageLRUCache)
+		sc.ImageCache = c
+		base.demote = sc.demote
+		c = sc
+	}
+	base.config = resolveConfig(opts)
+	for _, fallback := range base.config.Fallbacks {
+		logrus.Warnf("Image cache configuration: %s", fallback)
+	}
+	// the partitions are told apart by namespace, the order of each one is
+	// all that matters
+	var order []image.ID
+	for _, base := range bases {
+		order = append(order, restoreOrder(base)...)
+	}
+	for _, base := range bases {
+		base.loading = true
+	}
+	if err := loadExistingImages(context.Background(), c, is, order, logLoadProgress()); err != nil {
+		c.Close()
+		return nil, err
+	}
+	// only the images cached from now on are warm, not those found on disk
+	for _, base := range bases {
+		base.loading = false
+		base.warm = opts.Warm
+		if base.level > base.capacity {
+			logrus.Warnf("Image cache loaded over capacity, evicting on the next put, %s", base.usage())
+		}
+	}
+
+	if opts.MemoryPressure > 0 {
+		pc := &pressureController{
+			source:    hostMemoryPressure,
+			threshold: opts.MemoryPressure,
+			capacity:  c.Capacity,
+			reclaim:   c.Reclaim,
+		}
+		go pc.run(memoryPressureInterval, base.stop)
+	}
+	if opts.ResyncInterval > 0 {
+		go runResync(c, opts.ResyncInterval, base.stop)
+	}
+	if activity != nil {
+		f := &idleFlusher{
+			activity: activity,
+			timeout:  opts.IdleTimeout,
+			floor:    opts.IdleFloor,
+			level:    c.Level,
+			reclaim:  c.Reclaim,
+		}
+		go f.run(base.stop)
+	}
+	return c, nil
+}
+
+// newPolicyCache creates a cache of the policy set in opts on top of base,
+// or nil if no policy is set
+func newPolicyCache(opts Options, base *cacheBase) (ImageCache, error) {
+	policy := strings.ToLower(opts.Policy)
+	base.policy = policy
+	switch policy {
 	case policyNaive:
-		return newNaiveCache(capacity, is), nil
+		return newNaiveCache(base), nil
 	case policyImageLRU:
-		return newImageLRUCache(capacity, is), nil
+		return newImageLRUCache(base), nil
 	case policyLayerLRU:
-		return newLayerLRUCache(capacity, is), nil
+		return newLayerLRUCache(base), nil
+	case policyLayerLFU:
+		return newLayerLFUCache(base), nil
 	case policyArchiveLRU:
-		if !cfg.CacheArchive {
+		if !opts.Archive {
 			return nil, fmt.Errorf(`"--cache-archive" is required for "archive-lru" cache policy`)
 		}
-		return newArchiveLRUCache(capacity, is), nil
+		return newArchiveLRUCache(base), nil
+	default:
+		return nil, nil
+	}
+}
+
+// ArchiveEnabled reports whether layer archives should be kept when pulling
+// images, which is only the case when they are used by the cache policy
+func ArchiveEnabled(cfg *config.Config) bool {
+	return Options{Policy: cfg.CachePolicy, Archive: cfg.CacheArchive}.archiveEnabled()
+}
+
+// ArchiveCapacity returns the size of the largest layer archive the cache
+// could keep, that is the largest capacity of its partitions, bounded by the
+// archive max size. The pulls skip writing the archives of larger layers,
+// which the cache would delete as soon as put. It is 0, for no bound, when
+// the archives are not kept or the settings are invalid.
+func ArchiveCapacity(cfg *config.Config) int64 {
+	opts, err := parseOptions(cfg)
+	if err != nil || !opts.archiveEnabled() {
+		return 0
+	}
+	capacity := opts.Capacity
+	for _, nsCapacity := range opts.Namespaces {
+		if nsCapacity > capacity {
+			capacity = nsCapacity
+		}
+	}
+	if opts.ArchiveMaxSize > 0 && opts.ArchiveMaxSize < capacity {
+		capacity = opts.ArchiveMaxSize
+	}
+	return capacity
+}
+
+// loadProgress is the progress of loadExistingImages
+type loadProgress struct {
+	loaded, total int
+	// bytes is the level of the cache once the images are loaded
+	bytes int64
+}
+
+// loadProgressInterval is the minimum interval between two progress logs of
+// the warm-load
+const loadProgressInterval = 10 * time.Second
+
+// logLoadProgress returns a progress callback of loadExistingImages logging
+// the progress every loadProgressInterval, and once done
+func logLoadProgress() func(loadProgress) {
+	last := timeNow()
+	return func(p loadProgress) {
+		if now := timeNow(); p.loaded == p.total || now.Sub(last) >= loadProgressInterval {
+			last = now
+			logrus.Infof("Loaded %d/%d existing images in cache, %s", p.loaded, p.total, units.BytesSize(float64(p.bytes)))
+		}
+	}
+}
+
+// loadExistingImages warms the cache up with the images already in the
+// image store. Images are put in a deterministic order, oldest first, so
+// that the most recently created ones end up at the front of the cache,
+// unless order holds the eviction order saved on the last shutdown, which
+// is replayed after the images missing from it. progress is called after
+// each image. Once ctx is cancelled, the load
+// stops before the next image and returns the error of ctx, leaving the
+// cache with the images loaded so far.
+//
+// The images may be pulled or deleted while a slow load goes on: an image
+// no longer in the store when its turn comes is skipped, and the load ends
+// with a pass catching up with the changes of the store since it started.
+func loadExistingImages(ctx context.Context, c ImageCache, is ImageBackend, order []image.ID, progress func(loadProgress)) error {
+	imgs := is.Map()
+	ids := orderImageIDs(imgs, order)
+	for i, id := range ids {
+		if err := ctx.Err(); err != nil {
+			logrus.Warnf("Loading existing images in cache stopped at %d/%d: %v", i, len(ids), err)
+			return err
+		}
+		if _, err := is.GetImage(id.String()); err != nil {
+			logrus.Debugf("Skipping image %s gone from the image store while loading the cache: %v", id, err)
+			delete(imgs, id)
+		} else {
+			c.PutImage(imgs[id])
+		}
+		if progress != nil {
+			progress(loadProgress{loaded: i + 1, total: len(ids), bytes: c.Level()})
+		}
 	}
-	return nil, nil
+	reconcileLoad(c, is, imgs)
+	return nil
 }
 
+// reconcileLoad catches up with the changes of the image store since
+// loadExistingImages took the snapshot loaded, removing the images deleted
+// since and putting those added since
+func reconcileLoad(c ImageCache, is ImageBackend, loaded map[image.ID]*image.Image) {
+	imgs := is.Map()
+	var removed int
+	for id := range loaded {
+		if _, ok := imgs[id]; ok {
+			delete(imgs, id)
+			continue
+		}
+		c.RemoveImage(id)
+		removed++
+	}
+	for _, id := range sortImageIDs(imgs) {
+		c.PutImage(imgs[id])
+	}
+	if removed > 0 || len(imgs) > 0 {
+		logrus.Infof("Image store changed while loading the cache, caught up with %d images added and %d deleted since", len(imgs), removed)
+	}
+}
+
+// rebuild puts the images of the image store through put, in the same order
+// as loadExistingImages, once the caller has reset the entries of the
+// cache. The caller must hold the write lock.
+func (c *cacheBase) rebuild(put func(*image.Image)) {
+	c.setLevel(0)
+	c.unused = make(map[image.ID]bool)
+	warm := c.warm
+	c.warm = false
+	defer func() { c.warm = warm }()
+	imgs := c.imageService.Map()
+	// the registries are not in the image store, keep those of the images
+	// still there
+	for id := range c.registries {
+		if _, ok := imgs[id]; !ok {
+			delete(c.registries, id)
+		}
+	}
+	for _, id := range sortImageIDs(imgs) {
+		put(imgs[id])
+	}
+	logrus.Infof("Rebuilt cache from the image store, %s", c.usage())
+}
+
+// sortImageIDs returns the IDs of the images ordered by creation time, with
+// ties broken by image ID.
+func sortImageIDs(imgs map[image.ID]*image.Image) []image.ID {
+	ids := make([]image.ID, 0, len(imgs))
+	for id := range imgs {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool {
+		ci, cj := imgs[ids[i]].Created, imgs[ids[j]].Created
+		if !ci.Equal(cj) {
+			return ci.Before(cj)
+		}
+		return ids[i] < ids[j]
+	})
+	return ids
+}
+
+// timeNow is the clock of the cache, replaceable in tests
+var timeNow = time.Now
+
 type cacheBase struct {
-	imageService *images.ImageService
+	// level is only written under the write lock, but atomically, so that
+	// it can be read without the lock. It comes first to be 64-bit aligned
+	// on 32-bit platforms.
+	level int64
+
+	imageService ImageBackend
 	capacity     int64
-	level        int64
-	mu           *sync.RWMutex
+	breaker      evictionBreaker
+
+	// evictionBatch is the minimum number of layers evicted by a pass of
+	// the layer-based caches
+	evictionBatch int
+	// retainRetries is the number of times the layer-based caches
+	// re-acquire an evicted layer the layer store no longer retains for
+	// them, so as to release it
+	retainRetries int
+	// diskReserve is the free disk space below which new images are
+	// refused, as reported by freeDisk
+	diskReserve int64
+	freeDisk    diskSource
+	// layerCount is the number of layers held by the layer-based caches,
+	// which evict down to maxLayers whatever the level
+	layerCount int64
+	maxLayers  int
+	// evictThreshold is the percentage of the capacity the level must
+	// exceed before an automatic pass evicts back down to the capacity
+	evictThreshold int
+	// archiveMaxSize and archiveExclude keep the archive LRU cache from
+	// retaining the archives larger than archiveMaxSize, or of the layers
+	// whose diffID matches one of the archiveExclude patterns
+	archiveMaxSize int64
+	archiveExclude []string
+	// recencyWeight blends recency and frequency in the order of eviction
+	// of the image LRU cache, from 1 for pure LRU down to 0 for pure LFU
+	recencyWeight float64
+	// scanLabel is the label of the images recording the time of their
+	// last vulnerability scan, which breaks the ties of the image LRU cache
+	scanLabel string
+
+	// mu protects the state of the cache. Exported methods take it for
+	// their whole duration, write lock for any mutation, and never upgrade
+	// a read lock to a write lock: an entry looked up under a read lock
+	// must be looked up again under the write lock before being mutated.
+	// Unexported helpers expect the caller to hold the lock. The write
+	// lock is released through unlock, which deletes the archives queued
+	// for deletion meanwhile.
+	mu *sync.RWMutex
+	// staleArchives are the layer archives queued for deletion by
+	// deleteArchivesLater, and archiveHeld reports whether the cache holds
+	// the archive of a diffID again, for the caches keeping archives
+	staleArchives []layer.DiffID
+	archiveHeld   func(diffID layer.DiffID) bool
+
+	// policy is the name of the policy of the cache, for the audit log
+	policy string
+	// archive is set if layer archives may be kept, as required by the
+	// archive LRU cache
+	archive bool
+	// config is the configuration the cache was created from, only set
+	// on the cache returned by NewImageCache
+	config CacheConfig
+	audit  *auditLog
+	// evictHook runs the on-evict command, if one is set
+	evictHook *evictHook
+
+	squash   bool
+	squashed map[image.ID]image.ID // original image -> squashed image
+
+	history   *historyLog
+	advisor   *capacityAdvisor
+	evictions evictionTracker
+	// activity is the last use of the cache, if the idle flusher is on
+	activity *activityClock
+	// ioLimit paces the IO of the evictions of the layer-based caches, if
+	// an eviction IO rate is set
+	ioLimit *ioLimiter
+
+	keepRecentTags int
+	tagsOf         func(image.ID) []string
+
+	pulling  map[string]int  // references being pulled
+	reserved int64           // bytes reserved for the images being pulled
+	pins     map[string]bool // patterns of the tags pinned
+	// committing counts the commits in progress using each image
+	committing map[image.ID]int
+	// noCache holds the images the user removed
+	noCache noCacheSet
+
+	// loading is set while the images already on disk are loaded, which
+	// evicts nothing
+	loading bool
+
+	// warm is set for newly cached images to be warm, and unused holds the
+	// warm images which have not been used yet
+	warm   bool
+	unused map[image.ID]bool
+
+	// registries holds the host of the registry each cached image was
+	// pulled from, as recorded by SetRegistry
+	registries map[image.ID]string
+
+	// demote hands the images evicted by the image LRU cache over to a
+	// spill tier instead of deleting them, along with the registry they
+	// were pulled from, and reports whether it took them
+	demote func(img *image.Image, registry string) bool
+
+	// takeSnapshot takes the read snapshot of the policy, published at the
+	// end of each eviction pass and served by the read APIs while the next
+	// pass holds the write lock
+	takeSnapshot func() *readSnapshot
+	published    atomic.Value // *readSnapshot
+	// evicting is set while an eviction pass is in progress, so that a
+	// single pass runs at a time, and evictionPasses counts the passes
+	evicting       int32
+	evictionPasses int64
+
+	// imageOrder returns the cached images in eviction order, saved to
+	// orderPath on Close for the LRU policies
+	imageOrder func() []image.ID
+	orderPath  string
+
+	stop      chan struct{}
+	closeOnce sync.Once
+}
+
+func newCacheBase(capacity int64, is ImageBackend) *cacheBase {
+	c := &cacheBase{
+		imageService: is,
+		capacity:     capacity,
+		mu:           &sync.RWMutex{},
+		squashed:     make(map[image.ID]image.ID),
+		unused:       make(map[image.ID]bool),
+		registries:   make(map[image.ID]string),
+		stop:         make(chan struct{}),
+
+		recencyWeight: 1,
+		retainRetries: defaultRetainRetries,
+	}
+	c.tagsOf = c.lookupTags
+	c.evictions.resetWindow(timeNow())
+	return c
+}
+
+// Close stops the background tasks of the cache, and writes the records of
+// the audit log still queued
+func (c *cacheBase) Close() error {
+	c.closeOnce.Do(func() {
+		close(c.stop)
+		c.saveOrder()
+		if c.audit != nil {
+			c.audit.close()
+		}
+	})
+	return nil
 }
 
 // Capacity returns the cache capacity
@@ -66,13 +653,216 @@ func (c *cacheBase) Capacity() int64 {
 
 // Level returns the cache level
 func (c *cacheBase) Level() int64 {
+	return atomic.LoadInt64(&c.level)
+}
+
+// OverCapacity reports whether the cache level exceeds its capacity
+func (c *cacheBase) OverCapacity() bool {
+	return c.Level() > c.capacity
+}
+
+// Pressure returns the cache level relative to its capacity
+func (c *cacheBase) Pressure() float64 {
+	if c.capacity <= 0 || c.Level() <= 0 {
+		return 0
+	}
+	return c.percent()
+}
+
+// addLevel adds delta to the level. The caller must hold the write lock.
+func (c *cacheBase) addLevel(delta int64) {
+	atomic.AddInt64(&c.level, delta)
+}
+
+// setLevel sets the level. The caller must hold the write lock.
+func (c *cacheBase) setLevel(level int64) {
+	atomic.StoreInt64(&c.level, level)
+}
+
+// Stats returns a snapshot of the cache state
+func (c *cacheBase) Stats() Stats {
 	c.mu.RLock()
 	defer c.mu.RUnlock()
-	return c.level
+
+	return c.stats()
+}
+
+// stats is Stats for callers holding the lock
+func (c *cacheBase) stats() Stats {
+	stats := Stats{
+		Capacity:           c.capacity,
+		Level:              c.level,
+		CapacityHuman:      units.BytesSize(float64(c.capacity)),
+		LevelHuman:         units.BytesSize(float64(c.level)),
+		Layers:             c.layerCount,
+		FruitlessEvictions: c.breaker.failures,
+		EvictionPasses:     c.evictionPasses,
+
+		Evictions:          c.evictions.evictions,
+		RepulledEvictions:  c.evictions.repulled,
+		EvictionEfficiency: evictionEfficiency(c.evictions.evictions, c.evictions.repulled),
+		Efficiency:         c.evictions.window().efficiency(),
+
+		Puts:         c.evictions.puts,
+		Hits:         c.evictions.hits,
+		Misses:       c.evictions.misses,
+		BytesEvicted: c.evictions.bytes,
+	}
+	if len(c.pins) > 0 {
+		stats.Pins = c.pinPatterns()
+	}
+	if c.config.Policy != "" {
+		cfg := c.config
+		stats.Config = &cfg
+	}
+	if c.breaker.tripped(timeNow()) {
+		stats.EvictionDisabled = true
+		stats.EvictionDisabledUntil = c.breaker.disabledUntil
+	}
+	if c.advisor != nil {
+		stats.SuggestedCapacity = c.advisor.recommend(c.capacity)
+	}
+	return stats
+}
+
+// runEviction runs an automatic eviction pass down to the capacity left by
+// the reservations through evictTo, unless the breaker has disabled
+// eviction or the images on disk are being loaded. The caller must hold
+// the write lock.
+func (c *cacheBase) runEviction(evictTo func(target int64)) {
+	if c.level <= c.evictionTrigger()-c.reserved && !c.tooManyLayers() {
+		return
+	}
+	if c.loading {
+		// the images already on disk are the user's, which the load only
+		// accounts for, the first put after it evicting as needed
+		return
+	}
+	if c.evictionRunning() {
+		// the pass in progress evicts down to the target as it goes,
+		// whatever was put since it started
+		logrus.Debugf("Eviction pass already in progress, %s", c.usage())
+		return
+	}
+	if !c.breaker.allow(timeNow()) {
+		logrus.Warnf("Eviction is disabled, cache is over capacity, %s", c.usage())
+		return
+	}
+	defer c.beginEviction()()
+	level, layers := c.level, c.layerCount
+	evictTo(c.available())
+	c.breaker.record(c.level < level || c.layerCount < layers, timeNow())
+}
+
+// tooManyLayers reports whether a layer-based cache holds more layers than
+// allowed
+func (c *cacheBase) tooManyLayers() bool {
+	return c.maxLayers > 0 && c.layerCount > int64(c.maxLayers)
+}
+
+// evictionTrigger returns the level above which automatic eviction runs,
+// leaving a grace band above the capacity for transient spikes
+func (c *cacheBase) evictionTrigger() int64 {
+	if c.evictThreshold <= 100 {
+		return c.capacity
+	}
+	percent, margin := c.capacity/100, int64(c.evictThreshold-100)
+	if percent > 0 && margin > (math.MaxInt64-c.capacity)/percent {
+		return math.MaxInt64
+	}
+	return c.capacity + percent*margin
+}
+
+// reclaim frees at least size bytes through evictTo regardless of the
+// breaker, and resets the breaker once something has been freed. The caller
+// must hold the write lock.
+func (c *cacheBase) reclaim(size int64, evictTo func(target int64)) int64 {
+	defer c.beginEviction()()
+	level := c.level
+	evictTo(level - size)
+	freed := level - c.level
+	if freed > 0 {
+		c.breaker.reset()
+	}
+	logrus.Infof("Reclaimed %d bytes, %s", freed, c.usage())
+	return freed
+}
+
+// cachedID returns the ID under which the image is cached, which is the ID
+// of its squashed artifact if it was squashed. The caller must hold the
+// lock.
+func (c *cacheBase) cachedID(imgID image.ID) image.ID {
+	if squashed, ok := c.squashed[imgID]; ok {
+		return squashed
+	}
+	return imgID
+}
+
+// inserted accounts for imgID newly put in the cache: it is warm if newly
+// cached images are, and counts as an insert, and as a re-pull if it was
+// evicted lately. The caller must hold the write lock.
+func (c *cacheBase) inserted(imgID image.ID) {
+	c.markWarm(imgID)
+	c.evictions.inserted(imgID)
+	c.touchActivity()
+	if c.advisor != nil {
+		c.advisor.inserted(imgID)
+	}
+}
+
+// touched accounts for a use of a cached image. The caller must hold the
+// write lock.
+func (c *cacheBase) touched() {
+	c.touchActivity()
+	if c.advisor != nil {
+		c.advisor.hit()
+	}
+}
+
+// forget drops what the cache knows of imgID besides its entry, once
+// evicted or removed. The caller must hold the write lock.
+func (c *cacheBase) forget(imgID image.ID) {
+	delete(c.unused, imgID)
+	delete(c.registries, imgID)
+}
+
+func errNotCached(imgID image.ID) error {
+	return errdefs.NotFound(fmt.Errorf("image %s is not in cache", imgID))
+}
+
+// checkAddition checks that size can be added to the cache level without
+// overflowing
+func (c *cacheBase) checkAddition(size int64) error {
+	if size < 0 {
+		return fmt.Errorf("invalid size %d", size)
+	}
+	if c.level > math.MaxInt64-size {
+		return fmt.Errorf("adding %d bytes to the cache level %d overflows", size, c.level)
+	}
+	return nil
 }
 
 func (c *cacheBase) percent() float64 {
-	return float64(c.level) / float64(c.capacity)
+	return float64(c.Level()) / float64(c.capacity)
+}
+
+// levelUsage is the level of the cache against its capacity, as reported by
+// the log lines
+type levelUsage struct {
+	level    int64
+	capacity int64
+}
+
+func (u levelUsage) String() string {
+	return fmt.Sprintf("%d/%d (%.3f)", u.level, u.capacity, float64(u.level)/float64(u.capacity))
+}
+
+// usage returns the level against the capacity, reading the level once so
+// that the level and the fraction logged agree. The caller must hold the
+// write lock, under which the level changes, for the usage to reflect the
+// change being logged.
+func (c *cacheBase) usage() levelUsage {
+	return levelUsage{level: c.Level(), capacity: c.capacity}
 }
 
 func (c *cacheBase) checkImageSize(img *image.Image) error {
@@ -86,17 +876,24 @@ func (c *cacheBase) checkImageSize(img *image.Image) error {
 	return nil
 }
 
+// getImageSize returns the size of img, leaving out its foreign layers.
+// Images without layers, such as those built from scratch with no
+// filesystem changes, are tracked with zero size, as they have no top layer
+// to look up.
 func (c *cacheBase) getImageSize(img *image.Image) (int64, error) {
+	if len(img.RootFS.DiffIDs) == 0 {
+		return 0, nil
+	}
 	topLayer, err := c.imageService.GetReadOnlyLayer(img.RootFS.ChainID(), img.OperatingSystem())
-	defer c.imageService.ReleaseReadOnlyLayer(topLayer, img.OperatingSystem())
 	if err != nil {
-		logrus.Errorf("error getting the top layer of image: %v", err)
+		logrus.Errorf("error getting the top layer of image %s: %v", img.ID(), err)
 		return 0, err
 	}
+	defer c.imageService.ReleaseReadOnlyLayer(topLayer, img.OperatingSystem())
 	size, err := topLayer.Size()
 	if err != nil {
 		logrus.Errorf("error getting the layer size: %v", err)
 		return 0, err
 	}
-	return size, nil
+	return size - foreignSize(topLayer), nil
 }
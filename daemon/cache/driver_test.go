@@ -0,0 +1,354 @@
+package cache
+
+import (
+	"context"
+	"math"
+	"testing"
+	"time"
+
+	"github.com/docker/docker/daemon/config"
+	"github.com/docker/docker/image"
+	"github.com/docker/docker/layer"
+	"github.com/docker/go-units"
+	gocmp "github.com/google/go-cmp/cmp"
+	"gotest.tools/assert"
+	is "gotest.tools/assert/cmp"
+)
+
+func TestSortImageIDsDeterministic(t *testing.T) {
+	now := time.Now()
+	newImages := func() map[image.ID]*image.Image {
+		imgs := make(map[image.ID]*image.Image)
+		for _, id := range []image.ID{"sha256:d", "sha256:b", "sha256:c", "sha256:a"} {
+			imgs[id] = &image.Image{V1Image: image.V1Image{Created: now}}
+		}
+		imgs["sha256:e"] = &image.Image{V1Image: image.V1Image{Created: now.Add(-time.Hour)}}
+		return imgs
+	}
+
+	expected := []image.ID{"sha256:e", "sha256:a", "sha256:b", "sha256:c", "sha256:d"}
+	for i := 0; i < 10; i++ {
+		assert.Check(t, is.DeepEqual(expected, sortImageIDs(newImages())))
+	}
+}
+
+func TestArchiveEnabled(t *testing.T) {
+	for _, tc := range []struct {
+		policy   string
+		archive  bool
+		expected bool
+	}{
+		{policy: policyArchiveLRU, archive: true, expected: true},
+		{policy: "Archive-LRU", archive: true, expected: true},
+		{policy: policyArchiveLRU, archive: false, expected: false},
+		{policy: policyImageLRU, archive: true, expected: false},
+		{policy: policyLayerLRU, archive: true, expected: false},
+		{policy: "", archive: true, expected: false},
+	} {
+		cfg := &config.Config{}
+		cfg.CachePolicy = tc.policy
+		cfg.CacheArchive = tc.archive
+		assert.Check(t, is.Equal(tc.expected, ArchiveEnabled(cfg)), "policy %q, archive %v", tc.policy, tc.archive)
+	}
+}
+
+func TestArchiveCapacity(t *testing.T) {
+	for _, tc := range []struct {
+		policy     string
+		capacity   string
+		namespaces map[string]string
+		maxSize    string
+		expected   int64
+	}{
+		{policy: policyArchiveLRU, capacity: "80", expected: 80},
+		{policy: policyArchiveLRU, capacity: "80", namespaces: map[string]string{"ns": "200"}, expected: 200},
+		{policy: policyArchiveLRU, capacity: "80", maxSize: "50", expected: 50},
+		{policy: policyArchiveLRU, capacity: "80", maxSize: "100", expected: 80},
+		{policy: policyArchiveLRU, capacity: "invalid", expected: 0},
+		{policy: policyLayerLRU, capacity: "80", expected: 0},
+	} {
+		cfg := &config.Config{}
+		cfg.CachePolicy = tc.policy
+		cfg.CacheArchive = true
+		cfg.CacheCapacity = tc.capacity
+		cfg.CacheNamespaces = tc.namespaces
+		cfg.CacheArchiveMaxSize = tc.maxSize
+		assert.Check(t, is.Equal(tc.expected, ArchiveCapacity(cfg)), "policy %q, capacity %q, namespaces %v, max size %q", tc.policy, tc.capacity, tc.namespaces, tc.maxSize)
+	}
+}
+
+func TestOverCapacityAndPressure(t *testing.T) {
+	c := newCacheBase(100, nil)
+	assert.Check(t, !c.OverCapacity())
+	assert.Check(t, is.Equal(0.0, c.Pressure()))
+
+	c.level = 50
+	assert.Check(t, !c.OverCapacity())
+	assert.Check(t, is.Equal(0.5, c.Pressure()))
+
+	c.level = 100
+	assert.Check(t, !c.OverCapacity())
+	assert.Check(t, is.Equal(1.0, c.Pressure()))
+
+	c.level = 150
+	assert.Check(t, c.OverCapacity())
+	assert.Check(t, is.Equal(1.5, c.Pressure()))
+
+	c.level = -10
+	assert.Check(t, is.Equal(0.0, c.Pressure()))
+}
+
+func TestCapacityBounds(t *testing.T) {
+	for _, capacity := range []string{"0", "2048p", "1g0", ""} {
+		cfg := &config.Config{}
+		cfg.CachePolicy = policyImageLRU
+		cfg.CacheCapacity = capacity
+		_, err := NewImageCache(cfg, nil)
+		assert.Check(t, is.ErrorContains(err, "invalid cache capacity"), "capacity %q", capacity)
+	}
+}
+
+func TestMalformedSizes(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		set      func(*config.Config)
+		expected string
+	}{
+		{
+			name:     "capacity",
+			set:      func(cfg *config.Config) { cfg.CacheCapacity = "1gb!" },
+			expected: `invalid cache capacity "1gb!"`,
+		},
+		{
+			name:     "disk reserve",
+			set:      func(cfg *config.Config) { cfg.CacheDiskReserve = "lots" },
+			expected: `invalid cache disk reserve "lots"`,
+		},
+		{
+			name:     "archive max size",
+			set:      func(cfg *config.Config) { cfg.CacheArchiveMaxSize = "big" },
+			expected: `invalid cache archive max size "big"`,
+		},
+		{
+			name:     "spill capacity",
+			set:      func(cfg *config.Config) { cfg.CacheSpillCapacity = "1x" },
+			expected: `invalid cache spill capacity "1x"`,
+		},
+		{
+			name:     "idle floor",
+			set:      func(cfg *config.Config) { cfg.CacheIdleFloor = "some" },
+			expected: `invalid cache idle floor "some"`,
+		},
+	} {
+		cfg := &config.Config{}
+		cfg.CachePolicy = policyImageLRU
+		cfg.CacheCapacity = "1g"
+		tc.set(cfg)
+		_, err := NewImageCache(cfg, nil)
+		assert.Check(t, is.ErrorContains(err, tc.expected), tc.name)
+	}
+}
+
+func TestCheckAddition(t *testing.T) {
+	c := newCacheBase(maxCacheCapacity, nil)
+	c.level = math.MaxInt64 - 10
+
+	assert.NilError(t, c.checkAddition(10))
+	assert.Check(t, is.ErrorContains(c.checkAddition(11), "overflows"))
+	assert.Check(t, is.ErrorContains(c.checkAddition(math.MaxInt64), "overflows"))
+	assert.Check(t, is.ErrorContains(c.checkAddition(-1), "invalid size"))
+}
+
+func TestStatsHumanSizes(t *testing.T) {
+	c := newCacheBase(3<<30, nil)
+	c.level = 1536 << 20
+
+	stats := c.Stats()
+	assert.Check(t, is.Equal(int64(3<<30), stats.Capacity))
+	assert.Check(t, is.Equal(int64(1536<<20), stats.Level))
+	assert.Check(t, is.Equal("3GiB", stats.CapacityHuman))
+	assert.Check(t, is.Equal("1.5GiB", stats.LevelHuman))
+	assert.Check(t, is.Equal(units.BytesSize(float64(stats.Level)), stats.LevelHuman))
+}
+
+// BenchmarkLevelUnderWrites reads the level while another goroutine keeps
+// taking the write lock, as a metrics scraper does during puts and evictions
+func BenchmarkLevelUnderWrites(b *testing.B) {
+	c := newCacheBase(100, nil)
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			c.mu.Lock()
+			c.addLevel(10)
+			time.Sleep(time.Microsecond)
+			c.addLevel(-10)
+			c.mu.Unlock()
+		}
+	}()
+
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			if level := c.Level(); level != 0 && level != 10 {
+				b.Fatalf("inconsistent level %d", level)
+			}
+		}
+	})
+	b.StopTimer()
+	close(stop)
+	<-done
+}
+
+func TestConfigReportsFallbacks(t *testing.T) {
+	b, cleanup := newFakeBackendForTest(t)
+	defer cleanup()
+
+	cfg := config.New()
+	cfg.CachePolicy = "Image-LRU"
+	cfg.CacheCapacity = "1k"
+	cfg.CacheArchive = true
+	c, err := NewImageCache(cfg, b)
+	assert.NilError(t, err)
+	defer c.Close()
+
+	expected := CacheConfig{
+		Policy:         policyImageLRU,
+		Mode:           ModeFull,
+		Capacity:       1024,
+		EvictThreshold: 100,
+		RecencyWeight:  1,
+		RetainRetries:  defaultRetainRetries,
+		Fallbacks:      []string{`cache-archive is ignored by the "image-lru" cache policy`},
+	}
+	assert.Check(t, is.DeepEqual(expected, c.Config()))
+	stats := c.Stats()
+	assert.Assert(t, stats.Config != nil)
+	assert.Check(t, is.DeepEqual(expected, *stats.Config))
+}
+
+func TestLoadExistingImagesCancelled(t *testing.T) {
+	b, cleanup := newFakeBackendForTest(t)
+	defer cleanup()
+
+	now := time.Now()
+	var imgs []*image.Image
+	for i, name := range []string{"a", "b", "c", "d"} {
+		imgs = append(imgs, b.addImage(t, now.Add(time.Duration(i)*time.Second), []layer.DiffID{b.layer(name, int64(10*(i+1)))}))
+	}
+
+	c := newImageLRUCache(newCacheBase(1000, b)).(*imageLRUCache)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	var reported []loadProgress
+	err := loadExistingImages(ctx, c, b, nil, func(p loadProgress) {
+		reported = append(reported, p)
+		if p.loaded == 2 {
+			cancel()
+		}
+	})
+	assert.Check(t, is.Equal(context.Canceled, err))
+
+	// the images are loaded oldest first, and only those loaded so far stay
+	expected := []loadProgress{{loaded: 1, total: 4, bytes: 10}, {loaded: 2, total: 4, bytes: 30}}
+	assert.Check(t, is.DeepEqual(expected, reported, gocmp.AllowUnexported(loadProgress{})))
+	assert.Check(t, is.Len(c.images, 2))
+	assert.Check(t, c.contains(imgs[0].ID()))
+	assert.Check(t, c.contains(imgs[1].ID()))
+	assert.Check(t, is.Equal(int64(30), c.Level()))
+	assert.Check(t, c.CheckConsistency().Consistent())
+}
+
+func TestInvalidMode(t *testing.T) {
+	cfg := config.New()
+	cfg.CachePolicy = policyImageLRU
+	cfg.CacheCapacity = "1g"
+	cfg.CacheMode = "read-only"
+	_, err := NewImageCache(cfg, nil)
+	assert.Check(t, is.ErrorContains(err, `invalid cache mode "read-only"`))
+}
+
+func TestLoadExistingImagesStoreChanged(t *testing.T) {
+	b, cleanup := newFakeBackendForTest(t)
+	defer cleanup()
+
+	now := time.Now()
+	var imgs []*image.Image
+	for i, name := range []string{"a", "b", "c", "d"} {
+		imgs = append(imgs, b.addImage(t, now.Add(time.Duration(i)*time.Second), []layer.DiffID{b.layer(name, 10)}))
+	}
+
+	c := newImageLRUCache(newCacheBase(1000, b)).(*imageLRUCache)
+	var added *image.Image
+	err := loadExistingImages(context.Background(), c, b, nil, func(p loadProgress) {
+		if p.loaded != 2 {
+			return
+		}
+		// a, already loaded, and c, not yet, are deleted, and e is pulled
+		// in the middle of the load
+		for _, img := range []*image.Image{imgs[0], imgs[2]} {
+			_, err := b.ImageDelete(img.ID().String(), false, false)
+			assert.NilError(t, err)
+		}
+		added = b.addImage(t, now.Add(time.Minute), []layer.DiffID{b.layer("e", 10)})
+	})
+	assert.NilError(t, err)
+
+	// the cache ends up with the images of the store
+	cached := make(map[image.ID]bool)
+	for _, entry := range c.List() {
+		for _, id := range entry.Images {
+			cached[id] = true
+		}
+	}
+	expected := map[image.ID]bool{imgs[1].ID(): true, imgs[3].ID(): true, added.ID(): true}
+	assert.Check(t, is.DeepEqual(expected, cached))
+	assert.Check(t, is.Equal(int64(30), c.Level()))
+	assert.Check(t, c.CheckConsistency().Consistent())
+}
+
+func TestLoadExistingImagesEvictsNothing(t *testing.T) {
+	for _, policy := range []string{policyImageLRU, policyLayerLRU} {
+		t.Run(policy, func(t *testing.T) {
+			now := time.Now()
+			opts := Options{Policy: policy, Capacity: 30, RecencyWeight: 1}
+
+			// the store is over capacity, which each start leaves as it
+			// is, loading the images in the same order every time
+			var orders [][]int
+			for i := 0; i < 2; i++ {
+				b, cleanup := newFakeBackendForTest(t)
+				defer cleanup()
+				var imgs []*image.Image
+				for i, name := range []string{"a", "b", "c", "d"} {
+					imgs = append(imgs, b.addImage(t, now.Add(time.Duration(i)*time.Second), []layer.DiffID{b.layer(name, 10)}))
+				}
+
+				c, err := NewImageCacheWithOptions(opts, b)
+				assert.NilError(t, err)
+				defer c.Close()
+				assert.Check(t, is.Equal(int64(40), c.Level()))
+				assert.Check(t, is.Len(b.deleted, 0))
+				var order []int
+				for _, img := range imgs {
+					rank, _, ok := c.Position(img.ID())
+					assert.Check(t, ok)
+					order = append(order, rank)
+				}
+				orders = append(orders, order)
+
+				// the first put evicts in that order
+				c.PutImage(b.addImage(t, now.Add(time.Hour), []layer.DiffID{b.layer("e", 10)}))
+				assert.Check(t, is.DeepEqual([]image.ID{imgs[0].ID(), imgs[1].ID()}, b.deleted))
+			}
+			assert.Check(t, is.DeepEqual([]int{3, 2, 1, 0}, orders[0]))
+			assert.Check(t, is.DeepEqual(orders[0], orders[1]))
+		})
+	}
+}
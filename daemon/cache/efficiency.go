@@ -0,0 +1,207 @@
+package cache
+
+import (
+	"time"
+
+	"github.com/docker/docker/image"
+)
+
+const (
+	// repullWindow is the time within which an evicted image put in the
+	// cache again counts as re-pulled
+	repullWindow = time.Hour
+	// maxTombstones bounds the evicted images remembered for re-pulls
+	maxTombstones = 4096
+)
+
+// evictionTracker correlates the evictions of the cache with the re-pulls
+// of the same images. It remembers each evicted image in a tombstone, so
+// that the image put in the cache again within the window counts its
+// eviction as re-pulled, the cache having evicted an image still in use.
+// It also counts the accesses and evictions since the cache was created,
+// from which the efficiency since the last reset of the stats is derived.
+// It is protected by the cache lock.
+type evictionTracker struct {
+	evictions int64
+	repulled  int64
+
+	// puts counts the images put, held already or not, and inserts those
+	// not held already, hits and misses the uses of images held or not,
+	// and bytes the bytes evicted
+	puts    int64
+	inserts int64
+	hits    int64
+	misses  int64
+	bytes   int64
+
+	// reset holds the counters as of the last reset of the stats, the
+	// start of the window of the efficiency
+	reset efficiencyCounters
+
+	tombstones map[image.ID]time.Time
+	order      []image.ID
+}
+
+// evicted records the eviction of imgID. An image losing several layers
+// counts as a single eviction.
+func (t *evictionTracker) evicted(imgID image.ID) {
+	if _, ok := t.tombstones[imgID]; ok {
+		return
+	}
+	if t.tombstones == nil {
+		t.tombstones = make(map[image.ID]time.Time)
+	}
+	if len(t.order) >= maxTombstones {
+		delete(t.tombstones, t.order[0])
+		t.order = t.order[1:]
+	}
+	t.tombstones[imgID] = timeNow()
+	t.order = append(t.order, imgID)
+	t.evictions++
+	evictionsTotal.Inc()
+}
+
+// put records an image put in the cache, whether held already or not
+func (t *evictionTracker) put() {
+	t.puts++
+}
+
+// used records a use of an image, found in the cache or not
+func (t *evictionTracker) used(found bool) {
+	if found {
+		t.hits++
+	} else {
+		t.misses++
+	}
+}
+
+// freed records size bytes evicted
+func (t *evictionTracker) freed(size int64) {
+	t.bytes += size
+}
+
+// inserted records imgID put in the cache while not held already, and a
+// re-pull if it was evicted within the window
+func (t *evictionTracker) inserted(imgID image.ID) {
+	t.inserts++
+	at, ok := t.tombstones[imgID]
+	if !ok {
+		return
+	}
+	delete(t.tombstones, imgID)
+	for i, id := range t.order {
+		if id == imgID {
+			t.order = append(t.order[:i], t.order[i+1:]...)
+			break
+		}
+	}
+	if timeNow().Sub(at) <= repullWindow {
+		t.repulled++
+		repulledEvictionsTotal.Inc()
+	}
+}
+
+// counters returns the counters of the efficiency since the cache was
+// created
+func (t *evictionTracker) counters() efficiencyCounters {
+	return efficiencyCounters{
+		hits:      t.hits,
+		misses:    t.misses,
+		inserts:   t.inserts,
+		evictions: t.evictions,
+		repulls:   t.repulled,
+	}
+}
+
+// resetWindow starts a new window for the efficiency at now
+func (t *evictionTracker) resetWindow(now time.Time) {
+	t.reset = t.counters()
+	t.reset.since = now
+}
+
+// window returns the counters of the efficiency since the last reset
+func (t *evictionTracker) window() efficiencyCounters {
+	all := t.counters()
+	return efficiencyCounters{
+		since:     t.reset.since,
+		hits:      all.hits - t.reset.hits,
+		misses:    all.misses - t.reset.misses,
+		inserts:   all.inserts - t.reset.inserts,
+		evictions: all.evictions - t.reset.evictions,
+		repulls:   all.repulls - t.reset.repulls,
+	}
+}
+
+// evictionEfficiency returns the fraction of the evictions not followed by
+// a re-pull, 1 if nothing was evicted
+func evictionEfficiency(evictions, repulled int64) float64 {
+	if evictions == 0 {
+		return 1
+	}
+	return 1 - float64(repulled)/float64(evictions)
+}
+
+// efficiencyCounters counts the accesses and evictions of a cache from
+// since on
+type efficiencyCounters struct {
+	since     time.Time
+	hits      int64
+	misses    int64
+	inserts   int64
+	evictions int64
+	repulls   int64
+}
+
+// add adds the counters of the efficiency of another cache, the window
+// starting at the earliest of the two
+func (e *efficiencyCounters) add(o Efficiency) {
+	if e.since.IsZero() || (!o.Since.IsZero() && o.Since.Before(e.since)) {
+		e.since = o.Since
+	}
+	e.hits += o.Hits
+	e.misses += o.Misses
+	e.inserts += o.Inserts
+	e.evictions += o.Evictions
+	e.repulls += o.Repulls
+}
+
+// efficiency computes the ratios of the counters, each 0 when its
+// denominator is
+func (e efficiencyCounters) efficiency() Efficiency {
+	eff := Efficiency{
+		Since:     e.since,
+		Hits:      e.hits,
+		Misses:    e.misses,
+		Inserts:   e.inserts,
+		Evictions: e.evictions,
+		Repulls:   e.repulls,
+	}
+	if accesses := e.hits + e.misses; accesses > 0 {
+		eff.HitRatio = float64(e.hits) / float64(accesses)
+	}
+	if e.inserts > 0 {
+		eff.EvictionRate = float64(e.evictions) / float64(e.inserts)
+	}
+	if e.evictions > 0 {
+		eff.RepullRate = float64(e.repulls) / float64(e.evictions)
+	}
+	return eff
+}
+
+// Efficiency summarizes how well the cache does its job since the last
+// ResetStats
+func (c *cacheBase) Efficiency() Efficiency {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	return c.evictions.window().efficiency()
+}
+
+// ResetStats starts a new window for Efficiency. The cumulative counters
+// of Stats, such as Evictions, are left as they are.
+func (c *cacheBase) ResetStats() {
+	c.mu.Lock()
+	defer c.unlock()
+
+	c.evictions.resetWindow(timeNow())
+}
@@ -0,0 +1,155 @@
+package cache
+
+import (
+	"testing"
+	"time"
+
+	"github.com/docker/docker/image"
+	"github.com/docker/docker/layer"
+	"gotest.tools/assert"
+	is "gotest.tools/assert/cmp"
+)
+
+func TestEvictionEfficiency(t *testing.T) {
+	start := time.Now()
+	now := start
+	timeNow = func() time.Time { return now }
+	defer func() { timeNow = time.Now }()
+
+	b, cleanup := newFakeBackendForTest(t)
+	defer cleanup()
+	c := newImageLRUCache(newCacheBase(120, b))
+
+	var imgs []*image.Image
+	for _, name := range []string{"a", "b", "c"} {
+		img := b.addImage(t, start, []layer.DiffID{b.layer(name, 40)})
+		imgs = append(imgs, img)
+		c.PutImage(img)
+	}
+	assert.Check(t, is.Equal(1.0, c.Stats().EvictionEfficiency))
+
+	repull := func(img *image.Image) {
+		b.mu.Lock()
+		b.registerImage(img)
+		b.mu.Unlock()
+		c.PutImage(img)
+	}
+
+	// evict a and b, then pull a again: half of the evictions were useless
+	assert.Check(t, is.Equal(int64(80), c.Reclaim(80)))
+	now = now.Add(time.Minute)
+	repull(imgs[0])
+	stats := c.Stats()
+	assert.Check(t, is.Equal(int64(2), stats.Evictions))
+	assert.Check(t, is.Equal(int64(1), stats.RepulledEvictions))
+	assert.Check(t, is.Equal(0.5, stats.EvictionEfficiency))
+
+	// b pulled again past the window does not count as a re-pull
+	now = now.Add(2 * repullWindow)
+	repull(imgs[1])
+	stats = c.Stats()
+	assert.Check(t, is.Equal(int64(1), stats.RepulledEvictions))
+	assert.Check(t, is.Equal(0.5, stats.EvictionEfficiency))
+}
+
+func TestCacheEfficiency(t *testing.T) {
+	start := time.Now()
+	now := start
+	timeNow = func() time.Time { return now }
+	defer func() { timeNow = time.Now }()
+
+	b, cleanup := newFakeBackendForTest(t)
+	defer cleanup()
+	c := newImageLRUCache(newCacheBase(120, b))
+	assert.Check(t, is.DeepEqual(Efficiency{Since: start}, c.Efficiency()))
+
+	// 4 inserts filling the cache, the last one evicting a
+	var imgs []*image.Image
+	for _, name := range []string{"a", "b", "c", "d"} {
+		now = now.Add(time.Minute)
+		img := b.addImage(t, now, []layer.DiffID{b.layer(name, 40)})
+		imgs = append(imgs, img)
+		c.PutImage(img)
+	}
+	// 4 hits and a miss
+	uncached := b.addImage(t, now, []layer.DiffID{b.layer("uncached", 10)})
+	for _, img := range []*image.Image{imgs[1], imgs[2], imgs[3], imgs[3], uncached} {
+		c.UpdateImage(img.ID().String())
+	}
+	// a re-pulled, evicting b
+	b.mu.Lock()
+	b.registerImage(imgs[0])
+	b.mu.Unlock()
+	c.PutImage(imgs[0])
+
+	expected := Efficiency{
+		Since:        start,
+		Hits:         4,
+		Misses:       1,
+		Inserts:      5,
+		Evictions:    2,
+		Repulls:      1,
+		HitRatio:     0.8,
+		EvictionRate: 2.0 / 5,
+		RepullRate:   0.5,
+	}
+	assert.Check(t, is.DeepEqual(expected, c.Efficiency()))
+	stats := c.Stats()
+	assert.Check(t, is.DeepEqual(expected, stats.Efficiency))
+	// until the first reset, the efficiency counts the same as the stats
+	assert.Check(t, is.Equal(stats.Hits, expected.Hits))
+	assert.Check(t, is.Equal(stats.Misses, expected.Misses))
+
+	// the window starts again, the cumulative counters go on
+	now = now.Add(time.Hour)
+	c.ResetStats()
+	assert.Check(t, is.DeepEqual(Efficiency{Since: now}, c.Efficiency()))
+	c.UpdateImage(imgs[0].ID().String())
+	eff := c.Efficiency()
+	assert.Check(t, is.Equal(int64(1), eff.Hits))
+	assert.Check(t, is.Equal(1.0, eff.HitRatio))
+	stats = c.Stats()
+	assert.Check(t, is.Equal(int64(2), stats.Evictions))
+	assert.Check(t, is.Equal(int64(5), stats.Hits))
+}
+
+func TestStatsCounters(t *testing.T) {
+	for _, policy := range []string{policyNaive, policyImageLRU, policyLayerLRU, policyArchiveLRU} {
+		t.Run(policy, func(t *testing.T) {
+			b, cleanup := newFakeBackendForTest(t)
+			defer cleanup()
+
+			now := time.Now()
+			c := newTestCache(t, policy, newCacheBase(100, b))
+			var imgs []*image.Image
+			for i, name := range []string{"a", "b", "c"} {
+				img := b.addImage(t, now.Add(time.Duration(i)*time.Second), []layer.DiffID{b.layer(name, 40)})
+				imgs = append(imgs, img)
+				c.PutImage(img)
+			}
+			// a was evicted to make room for c, along with b by the naive
+			// policy, which flushes the cache
+			evicted := int64(1)
+			if policy == policyNaive {
+				evicted = 2
+			}
+			c.PutImage(imgs[2])
+			c.UpdateImage(imgs[2].ID().String())
+			uncached := b.addImage(t, now, []layer.DiffID{b.layer("uncached", 10)})
+			c.UpdateImage(uncached.ID().String())
+
+			stats := c.Stats()
+			assert.Check(t, is.Equal(int64(4), stats.Puts))
+			assert.Check(t, is.Equal(int64(1), stats.Hits))
+			assert.Check(t, is.Equal(int64(1), stats.Misses))
+			assert.Check(t, is.Equal(evicted, stats.Evictions))
+			assert.Check(t, is.Equal(40*evicted, stats.BytesEvicted))
+			assert.Check(t, is.Equal(120-40*evicted, stats.Level))
+			assert.Check(t, is.Equal(int64(100), stats.Capacity))
+
+			// the counters go on past a reset of the efficiency
+			c.ResetStats()
+			assert.Check(t, is.Equal(int64(4), c.Stats().Puts))
+		})
+	}
+}
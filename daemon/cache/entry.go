@@ -0,0 +1,54 @@
+package cache
+
+import (
+	"sort"
+	"time"
+
+	"github.com/docker/docker/image"
+	"github.com/docker/docker/layer"
+)
+
+// CacheEntry is an entry of the cache as visited by ForEach: an image for
+// the image-based caches, and a layer for the layer-based ones. The entries
+// returned by List are images whatever the cache.
+type CacheEntry struct {
+	// Layer is the chain ID of the layer of the entry, for the layer-based
+	// caches
+	Layer layer.ChainID `json:",omitempty"`
+	// Images are the cached images of the entry
+	Images   []image.ID
+	Size     int64
+	Added    time.Time
+	Accessed time.Time
+	// Registry is the host of the registry the image of the entry was
+	// pulled from, for the entries of a single image pulled since startup
+	Registry string `json:",omitempty"`
+
+	// ArchivePresent is set, for the archive LRU cache, if the archives of
+	// the layers of the entry are all on disk, and ArchiveBytes is the size
+	// of those kept. The archives of the layers which do not compress, or
+	// are excluded, are dropped.
+	ArchivePresent bool  `json:",omitempty"`
+	ArchiveBytes   int64 `json:",omitempty"`
+}
+
+// listEntries returns the entries visited by forEach
+func listEntries(forEach func(func(CacheEntry) bool)) []CacheEntry {
+	var entries []CacheEntry
+	forEach(func(entry CacheEntry) bool {
+		entries = append(entries, entry)
+		return true
+	})
+	return entries
+}
+
+// sortEntries sorts the entries from the least recently accessed, with
+// ties broken by image ID
+func sortEntries(entries []CacheEntry) {
+	sort.Slice(entries, func(i, j int) bool {
+		if !entries[i].Accessed.Equal(entries[j].Accessed) {
+			return entries[i].Accessed.Before(entries[j].Accessed)
+		}
+		return entries[i].Images[0] < entries[j].Images[0]
+	})
+}
@@ -0,0 +1,175 @@
+package cache
+
+import (
+	"context"
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"github.com/docker/docker/image"
+	"github.com/docker/docker/layer"
+	gocmp "github.com/google/go-cmp/cmp"
+	"gotest.tools/assert"
+	is "gotest.tools/assert/cmp"
+)
+
+func TestForEach(t *testing.T) {
+	for _, tc := range []struct {
+		policy   string
+		newCache func(*cacheBase) ImageCache
+	}{
+		{policy: policyNaive, newCache: newNaiveCache},
+		{policy: policyImageLRU, newCache: newImageLRUCache},
+		{policy: policyLayerLRU, newCache: newLayerLRUCache},
+		{policy: policyArchiveLRU, newCache: newArchiveLRUCache},
+	} {
+		b, cleanup := newFakeBackendForTest(t)
+
+		now := time.Now()
+		var ids []image.ID
+		c := tc.newCache(newCacheBase(1000, b))
+		for i, name := range []string{"a", "b", "c"} {
+			img := b.addImage(t, now, []layer.DiffID{b.layer(name, int64(10*(i+1)))})
+			c.PutImage(img)
+			ids = append(ids, img.ID())
+		}
+
+		var visited []image.ID
+		var size int64
+		c.ForEach(func(entry CacheEntry) bool {
+			visited = append(visited, entry.Images...)
+			size += entry.Size
+			return true
+		})
+		assert.Check(t, is.DeepEqual(ids, visited), tc.policy)
+		assert.Check(t, is.Equal(c.Level(), size), tc.policy)
+
+		// the visit stops once fn returns false
+		visited = nil
+		c.ForEach(func(entry CacheEntry) bool {
+			visited = append(visited, entry.Images...)
+			return len(visited) < 2
+		})
+		assert.Check(t, is.DeepEqual(ids[:2], visited), tc.policy)
+		cleanup()
+	}
+}
+
+func TestList(t *testing.T) {
+	for _, tc := range []struct {
+		policy   string
+		newCache func(*cacheBase) ImageCache
+	}{
+		{policy: policyNaive, newCache: newNaiveCache},
+		{policy: policyImageLRU, newCache: newImageLRUCache},
+		{policy: policyLayerLRU, newCache: newLayerLRUCache},
+		{policy: policyArchiveLRU, newCache: newArchiveLRUCache},
+	} {
+		b, cleanup := newFakeBackendForTest(t)
+
+		// the entries of the layer-based caches count the shared base layer
+		// in both images, as do those of the image-based caches
+		now := time.Now()
+		base := b.layer("base", 30)
+		img1 := b.addImage(t, now, []layer.DiffID{base, b.layer("top1", 10)})
+		img2 := b.addImage(t, now, []layer.DiffID{base, b.layer("top2", 20)})
+		c := tc.newCache(newCacheBase(1000, b))
+		c.PutImage(img1)
+		c.PutImage(img2)
+
+		sizes := make(map[image.ID]int64)
+		for _, entry := range c.List() {
+			assert.Assert(t, is.Len(entry.Images, 1), tc.policy)
+			sizes[entry.Images[0]] = entry.Size
+		}
+		assert.Check(t, is.DeepEqual(map[image.ID]int64{img1.ID(): 40, img2.ID(): 50}, sizes), tc.policy)
+		cleanup()
+	}
+}
+
+func TestListArchives(t *testing.T) {
+	b, cleanup := newFakeBackendForTest(t)
+	defer cleanup()
+
+	now := time.Now()
+	archived := b.layer("archived", 100)
+	incompressible := b.layer("incompressible", 4)
+	imgs := map[string]*image.Image{
+		"archived":       b.addImage(t, now, []layer.DiffID{archived}),
+		"incompressible": b.addImage(t, now, []layer.DiffID{incompressible}),
+		"none":           b.addImage(t, now, []layer.DiffID{b.layer("none", 100)}),
+		"mixed":          b.addImage(t, now, []layer.DiffID{archived, incompressible}),
+	}
+	for diffID, content := range map[layer.DiffID]string{
+		archived:       "archive",
+		incompressible: "larger archive",
+	} {
+		assert.NilError(t, ioutil.WriteFile(createLayerArchivePath(diffID), []byte(content), 0600))
+	}
+
+	c := newArchiveLRUCache(newCacheBase(1000, b))
+	for _, img := range imgs {
+		c.PutImage(img)
+	}
+
+	type archive struct {
+		present bool
+		bytes   int64
+	}
+	archives := make(map[image.ID]archive)
+	for _, entry := range c.List() {
+		archives[entry.Images[0]] = archive{present: entry.ArchivePresent, bytes: entry.ArchiveBytes}
+	}
+	assert.Check(t, is.DeepEqual(map[image.ID]archive{
+		imgs["archived"].ID():       {present: true, bytes: int64(len("archive"))},
+		imgs["incompressible"].ID(): {},
+		imgs["none"].ID():           {},
+		imgs["mixed"].ID():          {bytes: int64(len("archive"))},
+	}, archives, gocmp.AllowUnexported(archive{})))
+}
+
+// TestWarmLoadArchivesAbsent loads under the archive-lru policy the images
+// of a layer store filled under the layer-lru one, with the archive of a
+// single layer left on disk
+func TestWarmLoadArchivesAbsent(t *testing.T) {
+	defer withArchiveDir(t)()
+	b, cleanup := newFakeBackendForTest(t)
+	defer cleanup()
+
+	now := time.Now()
+	archived := b.layer("archived", 100)
+	absent := b.layer("absent", 100)
+	imgs := map[string]*image.Image{
+		"archived": b.addImage(t, now, []layer.DiffID{archived}),
+		"absent":   b.addImage(t, now.Add(time.Second), []layer.DiffID{absent}),
+	}
+	assert.NilError(t, ioutil.WriteFile(createLayerArchivePath(archived), []byte("archive"), 0600))
+
+	base := newCacheBase(1000, b)
+	base.warm = true
+	c := newArchiveLRUCache(base).(*archiveLRUCache)
+	assert.NilError(t, loadExistingImages(context.Background(), c, b, nil, nil))
+	assert.Check(t, is.Equal(int64(200), c.Level()))
+
+	present := make(map[image.ID]bool)
+	for _, entry := range c.List() {
+		present[entry.Images[0]] = entry.ArchivePresent
+	}
+	assert.Check(t, is.DeepEqual(map[image.ID]bool{imgs["archived"].ID(): true, imgs["absent"].ID(): false}, present))
+	for _, e := range c.layers {
+		al := e.Value.(*archiveLayer)
+		assert.Check(t, is.Equal(al.layer.DiffID() == archived, al.archived()), al.layer.DiffID())
+	}
+	assert.Check(t, is.Len(c.archives, 1))
+	assert.Check(t, is.Equal(int64(len("archive")), c.archiveLevel))
+
+	// evicting the archive-absent layer, once used, leaves the archive of
+	// the other one
+	c.UpdateImage(imgs["absent"].ID().String())
+	assert.Check(t, is.Equal(int64(100), c.Reclaim(100)))
+	assert.Check(t, is.DeepEqual([]image.ID{imgs["absent"].ID()}, b.deleted))
+	assert.Check(t, is.Equal(int64(len("archive")), c.archiveLevel))
+	fi, err := getLayerArchiveInfo(archived)
+	assert.NilError(t, err)
+	assert.Check(t, fi != nil)
+}
@@ -0,0 +1,102 @@
+package cache
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/docker/docker/image"
+	"github.com/sirupsen/logrus"
+)
+
+// evictHookTimeout is how long the on-evict command may run before it is
+// killed
+const evictHookTimeout = 30 * time.Second
+
+// evictHookQueue is the number of commands waiting to run beyond which the
+// commands of new evictions are dropped
+const evictHookQueue = 64
+
+// evictHook runs a shell command for each image evicted, with the image ID,
+// its tags and the bytes freed in its environment. The commands run one at
+// a time in the background, so that a slow or hanging command never stalls
+// the eviction, nor piles up shells during a large eviction pass.
+type evictHook struct {
+	command string
+	timeout time.Duration
+
+	runs chan evictHookRun
+	wg   sync.WaitGroup // commands queued or running
+}
+
+// evictHookRun is the eviction a command is queued for
+type evictHookRun struct {
+	imgID image.ID
+	env   []string
+}
+
+func newEvictHook(command string) *evictHook {
+	h := &evictHook{
+		command: command,
+		timeout: evictHookTimeout,
+		runs:    make(chan evictHookRun, evictHookQueue),
+	}
+	go h.work()
+	return h
+}
+
+// run queues the command for the eviction of imgID, dropping it if too
+// many commands are waiting already
+func (h *evictHook) run(imgID image.ID, tags []string, freed int64) {
+	env := append(os.Environ(),
+		"CACHE_EVICTED_IMAGE="+imgID.String(),
+		"CACHE_EVICTED_TAGS="+strings.Join(tags, ","),
+		fmt.Sprintf("CACHE_EVICTED_BYTES=%d", freed),
+	)
+	h.wg.Add(1)
+	select {
+	case h.runs <- evictHookRun{imgID: imgID, env: env}:
+	default:
+		h.wg.Done()
+		logrus.Warnf("Cache on-evict command is behind, dropped its run for image %s", imgID)
+	}
+}
+
+// work runs the commands queued, one at a time
+func (h *evictHook) work() {
+	for r := range h.runs {
+		h.exec(r)
+		h.wg.Done()
+	}
+}
+
+// exec runs the command for r, logging its failure
+func (h *evictHook) exec(r evictHookRun) {
+	ctx, cancel := context.WithTimeout(context.Background(), h.timeout)
+	defer cancel()
+	shell, flag := "/bin/sh", "-c"
+	if runtime.GOOS == "windows" {
+		shell, flag = "cmd", "/C"
+	}
+	// the output is discarded rather than piped, as a pipe would be held
+	// open past the timeout by the children of the killed shell
+	cmd := exec.CommandContext(ctx, shell, flag, h.command)
+	cmd.Env = r.env
+	err := cmd.Run()
+	if ctx.Err() == context.DeadlineExceeded {
+		err = fmt.Errorf("timed out after %s", h.timeout)
+	}
+	if err != nil {
+		logrus.Warnf("error running the cache on-evict command for image %s: %v", r.imgID, err)
+	}
+}
+
+// wait waits for the commands queued to complete
+func (h *evictHook) wait() {
+	h.wg.Wait()
+}
@@ -0,0 +1,84 @@
+package cache
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/docker/docker/layer"
+	"gotest.tools/assert"
+	is "gotest.tools/assert/cmp"
+	"gotest.tools/poll"
+	"gotest.tools/skip"
+)
+
+func TestEvictHookRunsOnEviction(t *testing.T) {
+	skip.If(t, runtime.GOOS == "windows", "the on-evict command of the test is a POSIX shell command")
+	b, cleanup := newFakeBackendForTest(t)
+	defer cleanup()
+	dir, err := ioutil.TempDir("", "cache-evict-hook")
+	assert.NilError(t, err)
+	defer os.RemoveAll(dir)
+
+	now := time.Now()
+	old := b.addImage(t, now, []layer.DiffID{b.layer("old", 60)}, "busybox:1", "busybox:old")
+	recent := b.addImage(t, now.Add(time.Second), []layer.DiffID{b.layer("recent", 60)}, "busybox:2")
+
+	path := filepath.Join(dir, "evicted")
+	base := newCacheBase(100, b)
+	base.evictHook = newEvictHook(`echo "$CACHE_EVICTED_IMAGE $CACHE_EVICTED_TAGS $CACHE_EVICTED_BYTES" >> ` + path)
+	c := newImageLRUCache(base)
+	c.PutImage(old)
+	c.PutImage(recent)
+	base.evictHook.wait()
+
+	data, err := ioutil.ReadFile(path)
+	assert.NilError(t, err)
+	assert.Check(t, is.Equal(old.ID().String()+" busybox:1,busybox:old 60\n", string(data)))
+}
+
+func TestEvictHookTimeout(t *testing.T) {
+	skip.If(t, runtime.GOOS == "windows", "the on-evict command of the test is a POSIX shell command")
+
+	h := newEvictHook("sleep 10")
+	h.timeout = 10 * time.Millisecond
+	start := time.Now()
+	h.run("sha256:a", nil, 1)
+	// the eviction does not wait for the command
+	assert.Check(t, time.Since(start) < time.Second)
+	h.wait()
+	assert.Check(t, time.Since(start) < 5*time.Second)
+}
+
+func TestEvictHookDropsWhenBehind(t *testing.T) {
+	skip.If(t, runtime.GOOS == "windows", "the on-evict command of the test is a POSIX shell command")
+	dir, err := ioutil.TempDir("", "cache-evict-hook")
+	assert.NilError(t, err)
+	defer os.RemoveAll(dir)
+
+	started, gate, out := filepath.Join(dir, "started"), filepath.Join(dir, "gate"), filepath.Join(dir, "out")
+	h := newEvictHook("touch " + started + "; while [ ! -e " + gate + " ]; do sleep 0.01; done; echo $CACHE_EVICTED_IMAGE >> " + out)
+	h.run("sha256:a", nil, 1)
+	poll.WaitOn(t, func(poll.LogT) poll.Result {
+		if _, err := os.Stat(started); err != nil {
+			return poll.Continue("the first command has not started")
+		}
+		return poll.Success()
+	})
+
+	// the first command holds up the others, and those beyond the queue
+	// are dropped
+	for i := 0; i < evictHookQueue+3; i++ {
+		h.run("sha256:b", nil, 1)
+	}
+	assert.NilError(t, ioutil.WriteFile(gate, nil, 0600))
+	h.wait()
+
+	data, err := ioutil.ReadFile(out)
+	assert.NilError(t, err)
+	assert.Check(t, is.Len(strings.Split(strings.TrimSpace(string(data)), "\n"), evictHookQueue+1))
+}
@@ -0,0 +1,137 @@
+package cache
+
+import "container/list"
+
+// compactListThreshold is the number of entries above which the image LRU
+// cache switches its evict list to the intrusive one
+var compactListThreshold = 10000
+
+// evictList orders the images of the image LRU cache, from the most
+// recently used one at the front to the least recently used one at the back
+type evictList interface {
+	len() int
+	front() *cacheImage
+	back() *cacheImage
+	next(ci *cacheImage) *cacheImage
+	prev(ci *cacheImage) *cacheImage
+	pushFront(ci *cacheImage)
+	pushBack(ci *cacheImage)
+	moveToFront(ci *cacheImage)
+	remove(ci *cacheImage)
+}
+
+// linkedList is the evict list on top of container/list, which allocates an
+// element per image
+type linkedList struct {
+	l *list.List
+}
+
+func newLinkedList() *linkedList {
+	return &linkedList{l: list.New()}
+}
+
+func (ll *linkedList) len() int { return ll.l.Len() }
+
+func (ll *linkedList) front() *cacheImage { return imageOf(ll.l.Front()) }
+
+func (ll *linkedList) back() *cacheImage { return imageOf(ll.l.Back()) }
+
+func (ll *linkedList) next(ci *cacheImage) *cacheImage { return imageOf(ci.elem.Next()) }
+
+func (ll *linkedList) prev(ci *cacheImage) *cacheImage { return imageOf(ci.elem.Prev()) }
+
+func (ll *linkedList) pushFront(ci *cacheImage) { ci.elem = ll.l.PushFront(ci) }
+
+func (ll *linkedList) pushBack(ci *cacheImage) { ci.elem = ll.l.PushBack(ci) }
+
+func (ll *linkedList) moveToFront(ci *cacheImage) { ll.l.MoveToFront(ci.elem) }
+
+func (ll *linkedList) remove(ci *cacheImage) {
+	ll.l.Remove(ci.elem)
+	ci.elem = nil
+}
+
+func imageOf(e *list.Element) *cacheImage {
+	if e == nil {
+		return nil
+	}
+	return e.Value.(*cacheImage)
+}
+
+// intrusiveList is the evict list linking the images themselves, which
+// allocates nothing and saves a pointer indirection per image on the
+// eviction scans. It is a ring around root, as container/list.
+type intrusiveList struct {
+	root cacheImage
+	n    int
+}
+
+func newIntrusiveList() *intrusiveList {
+	il := &intrusiveList{}
+	il.root.next = &il.root
+	il.root.prev = &il.root
+	return il
+}
+
+func (il *intrusiveList) len() int { return il.n }
+
+func (il *intrusiveList) front() *cacheImage { return il.entry(il.root.next) }
+
+func (il *intrusiveList) back() *cacheImage { return il.entry(il.root.prev) }
+
+func (il *intrusiveList) next(ci *cacheImage) *cacheImage { return il.entry(ci.next) }
+
+func (il *intrusiveList) prev(ci *cacheImage) *cacheImage { return il.entry(ci.prev) }
+
+// entry returns ci, or nil at the root
+func (il *intrusiveList) entry(ci *cacheImage) *cacheImage {
+	if ci == &il.root {
+		return nil
+	}
+	return ci
+}
+
+func (il *intrusiveList) pushFront(ci *cacheImage) { il.insert(ci, &il.root) }
+
+func (il *intrusiveList) pushBack(ci *cacheImage) { il.insert(ci, il.root.prev) }
+
+func (il *intrusiveList) moveToFront(ci *cacheImage) {
+	if il.root.next == ci {
+		return
+	}
+	il.unlink(ci)
+	il.insert(ci, &il.root)
+}
+
+func (il *intrusiveList) remove(ci *cacheImage) {
+	il.unlink(ci)
+	ci.next, ci.prev = nil, nil
+}
+
+// insert links ci after at
+func (il *intrusiveList) insert(ci, at *cacheImage) {
+	ci.prev = at
+	ci.next = at.next
+	at.next.prev = ci
+	at.next = ci
+	il.n++
+}
+
+func (il *intrusiveList) unlink(ci *cacheImage) {
+	ci.prev.next = ci.next
+	ci.next.prev = ci.prev
+	il.n--
+}
+
+// compactList moves the images of l over to an intrusive list, keeping
+// their order
+func compactList(l evictList) *intrusiveList {
+	il := newIntrusiveList()
+	for ci := l.front(); ci != nil; {
+		next := l.next(ci)
+		l.remove(ci)
+		il.pushBack(ci)
+		ci = next
+	}
+	return il
+}
@@ -0,0 +1,129 @@
+package cache
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/docker/docker/image"
+	"github.com/docker/docker/layer"
+	"gotest.tools/assert"
+	is "gotest.tools/assert/cmp"
+)
+
+var evictLists = []struct {
+	name    string
+	newList func() evictList
+}{
+	{name: "linked", newList: func() evictList { return newLinkedList() }},
+	{name: "intrusive", newList: func() evictList { return newIntrusiveList() }},
+}
+
+func listSizes(l evictList) []int64 {
+	var sizes []int64
+	for ci := l.front(); ci != nil; ci = l.next(ci) {
+		sizes = append(sizes, ci.size)
+	}
+	return sizes
+}
+
+func TestEvictList(t *testing.T) {
+	for _, tc := range evictLists {
+		l := tc.newList()
+		assert.Check(t, l.front() == nil, tc.name)
+		assert.Check(t, l.back() == nil, tc.name)
+
+		var cis []*cacheImage
+		for i := 0; i < 4; i++ {
+			ci := &cacheImage{size: int64(i)}
+			cis = append(cis, ci)
+			l.pushFront(ci)
+		}
+		l.pushBack(&cacheImage{size: 4})
+		assert.Check(t, is.DeepEqual([]int64{3, 2, 1, 0, 4}, listSizes(l)), tc.name)
+
+		l.moveToFront(cis[1])
+		l.moveToFront(cis[1])
+		l.remove(cis[2])
+		assert.Check(t, is.DeepEqual([]int64{1, 3, 0, 4}, listSizes(l)), tc.name)
+		assert.Check(t, is.Equal(4, l.len()), tc.name)
+		assert.Check(t, is.Equal(int64(4), l.back().size), tc.name)
+		assert.Check(t, is.Equal(int64(0), l.prev(l.back()).size), tc.name)
+		assert.Check(t, l.next(l.back()) == nil, tc.name)
+		assert.Check(t, l.prev(l.front()) == nil, tc.name)
+
+		il := compactList(l)
+		assert.Check(t, is.DeepEqual([]int64{1, 3, 0, 4}, listSizes(il)), tc.name)
+		assert.Check(t, is.Equal(0, l.len()), tc.name)
+	}
+}
+
+func TestImageLRUCompactsEvictList(t *testing.T) {
+	defer func(threshold int) { compactListThreshold = threshold }(compactListThreshold)
+	compactListThreshold = 3
+
+	b, cleanup := newFakeBackendForTest(t)
+	defer cleanup()
+	c := newImageLRUCache(newCacheBase(100, b)).(*imageLRUCache)
+
+	now := time.Now()
+	var imgs []*image.Image
+	for _, name := range []string{"a", "b", "c", "d", "e", "f"} {
+		imgs = append(imgs, b.addImage(t, now, []layer.DiffID{b.layer(name, 20)}))
+	}
+	for _, img := range imgs[:3] {
+		c.PutImage(img)
+	}
+	_, ok := c.evictList.(*linkedList)
+	assert.Check(t, ok)
+
+	// the cache behaves the same once compacted
+	c.PutImage(imgs[3])
+	_, ok = c.evictList.(*intrusiveList)
+	assert.Assert(t, ok)
+	assert.NilError(t, c.Promote(imgs[0].ID()))
+	c.PutImage(imgs[4])
+	c.PutImage(imgs[5])
+	assert.Check(t, is.DeepEqual([]image.ID{imgs[1].ID()}, b.deleted))
+	assert.Check(t, is.Equal(int64(100), c.Level()))
+
+	var order []image.ID
+	c.ForEach(func(e CacheEntry) bool {
+		order = append(order, e.Images...)
+		return true
+	})
+	assert.Check(t, is.DeepEqual([]image.ID{imgs[2].ID(), imgs[3].ID(), imgs[0].ID(), imgs[4].ID(), imgs[5].ID()}, order))
+	newest, _ := c.Newest()
+	assert.Check(t, is.Equal(imgs[5].ID(), newest))
+}
+
+// BenchmarkEvictList puts 100k images in the evict list, touching every
+// other one, and evicts them all from the back
+func BenchmarkEvictList(b *testing.B) {
+	const entries = 100000
+	ids := make([]image.ID, entries)
+	for i := range ids {
+		ids[i] = image.ID(fmt.Sprintf("sha256:%064d", i))
+	}
+
+	for _, tc := range evictLists {
+		b.Run(tc.name, func(b *testing.B) {
+			b.ReportAllocs()
+			for n := 0; n < b.N; n++ {
+				l := tc.newList()
+				images := make(map[image.ID]*cacheImage)
+				for _, id := range ids {
+					ci := &cacheImage{size: 1}
+					images[id] = ci
+					l.pushFront(ci)
+				}
+				for i := 0; i < entries; i += 2 {
+					l.moveToFront(images[ids[i]])
+				}
+				for ci := l.back(); ci != nil; ci = l.back() {
+					l.remove(ci)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,836 @@
+package cache
+
+import (
+	"fmt"
+	"io/ioutil"
+	"math"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	containertypes "github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/distribution/xfer"
+	"github.com/docker/docker/image"
+	"github.com/docker/docker/layer"
+	"gotest.tools/assert"
+	is "gotest.tools/assert/cmp"
+)
+
+func newFakeBackendForTest(t *testing.T) (*fakeImageBackend, func()) {
+	dir, err := ioutil.TempDir("", "cache-backend")
+	assert.NilError(t, err)
+	restoreArchives := withArchiveDir(t)
+	return newFakeImageBackend(t, dir), func() {
+		restoreArchives()
+		os.RemoveAll(dir)
+	}
+}
+
+// checkLayers checks that the level of a layer-based cache matches the
+// layers it holds, and that these layers still exist
+func checkLayers(t *testing.T, c *layerLRUCache, b *fakeImageBackend) {
+	t.Helper()
+	var level int64
+	for e := c.evictList.Front(); e != nil; e = e.Next() {
+		cl := layerOf(e)
+		level += cl.size
+		assert.Check(t, b.hasLayer(cl.layer.ChainID()), "layer %s", cl.layer.ChainID())
+	}
+	assert.Check(t, is.Equal(level, c.level))
+	assert.Check(t, is.Equal(c.evictList.Len(), len(c.layers)))
+}
+
+func TestImageLRUEviction(t *testing.T) {
+	b, cleanup := newFakeBackendForTest(t)
+	defer cleanup()
+
+	now := time.Now()
+	a := b.addImage(t, now, []layer.DiffID{b.layer("a", 40)})
+	bb := b.addImage(t, now, []layer.DiffID{b.layer("b", 40)})
+	cc := b.addImage(t, now, []layer.DiffID{b.layer("c", 40)})
+
+	c := newImageLRUCache(newCacheBase(100, b)).(*imageLRUCache)
+	c.PutImage(a)
+	c.PutImage(bb)
+	c.UpdateImage(a.ID().String())
+	c.PutImage(cc)
+
+	// b is the least recently used
+	assert.Check(t, is.DeepEqual([]image.ID{bb.ID()}, b.deleted))
+	assert.Check(t, is.Equal(int64(80), c.Level()))
+	assert.Check(t, is.Len(c.images, 2))
+
+	c.RemoveImage(a.ID())
+	assert.Check(t, is.Equal(int64(40), c.Level()))
+}
+
+func TestImageLRUEvictionConflict(t *testing.T) {
+	b, cleanup := newFakeBackendForTest(t)
+	defer cleanup()
+
+	now := time.Now()
+	a := b.addImage(t, now, []layer.DiffID{b.layer("a", 40)})
+	bb := b.addImage(t, now, []layer.DiffID{b.layer("b", 40)})
+	cc := b.addImage(t, now, []layer.DiffID{b.layer("c", 40)})
+	b.inUse[a.ID()] = true
+
+	c := newImageLRUCache(newCacheBase(100, b)).(*imageLRUCache)
+	c.PutImage(a)
+	c.PutImage(bb)
+	c.PutImage(cc)
+
+	// a is used by a container, so b goes instead
+	assert.Check(t, is.DeepEqual([]image.ID{bb.ID()}, b.deleted))
+	assert.Check(t, is.Equal(int64(80), c.Level()))
+}
+
+func TestImageLRUSparesLiveContainerImages(t *testing.T) {
+	b, cleanup := newFakeBackendForTest(t)
+	defer cleanup()
+
+	now := time.Now()
+	paused := b.addImage(t, now, []layer.DiffID{b.layer("paused", 40)})
+	bb := b.addImage(t, now.Add(time.Second), []layer.DiffID{b.layer("b", 40)})
+	cc := b.addImage(t, now.Add(2*time.Second), []layer.DiffID{b.layer("c", 40)})
+	// a paused container uses the image, which its deletion with force
+	// does not conflict with
+	b.live[paused.ID()] = true
+
+	c := newImageLRUCache(newCacheBase(100, b)).(*imageLRUCache)
+	c.PutImage(paused)
+	c.PutImage(bb)
+	c.PutImage(cc)
+
+	assert.Check(t, is.DeepEqual([]image.ID{bb.ID()}, b.deleted))
+	assert.Check(t, c.contains(paused.ID()))
+	assert.Check(t, is.Equal(int64(80), c.Level()))
+}
+
+func TestImageLRUEvictsDependentsFirst(t *testing.T) {
+	for _, childInUse := range []bool{false, true} {
+		b, cleanup := newFakeBackendForTest(t)
+
+		now := time.Now()
+		parent := b.addImage(t, now, []layer.DiffID{b.layer("parent", 40)})
+		child := b.addImage(t, now, []layer.DiffID{b.layer("parent", 40), b.layer("child", 20)})
+		child.Parent = parent.ID()
+		other := b.addImage(t, now, []layer.DiffID{b.layer("other", 30)})
+		b.inUse[child.ID()] = childInUse
+
+		c := newImageLRUCache(newCacheBase(100, b)).(*imageLRUCache)
+		c.PutImage(parent)
+		c.PutImage(child)
+		c.PutImage(other)
+
+		if childInUse {
+			// the parent can't go while the child is used, so the next
+			// image goes instead
+			assert.Check(t, is.DeepEqual([]image.ID{other.ID()}, b.deleted))
+			assert.Check(t, c.contains(parent.ID()))
+			assert.Check(t, c.contains(child.ID()))
+		} else {
+			// the child is evicted first so that the parent can go
+			assert.Check(t, is.DeepEqual([]image.ID{child.ID(), parent.ID()}, b.deleted))
+			assert.Check(t, is.Equal(int64(30), c.Level()))
+			assert.Check(t, is.Len(c.images, 1))
+		}
+		cleanup()
+	}
+}
+
+func TestNaiveEviction(t *testing.T) {
+	b, cleanup := newFakeBackendForTest(t)
+	defer cleanup()
+
+	now := time.Now()
+	a := b.addImage(t, now, []layer.DiffID{b.layer("a", 40)})
+	bb := b.addImage(t, now, []layer.DiffID{b.layer("b", 40)})
+	cc := b.addImage(t, now, []layer.DiffID{b.layer("c", 40)})
+
+	c := newNaiveCache(newCacheBase(100, b)).(*naiveCache)
+	c.PutImage(a)
+	c.PutImage(bb)
+	c.PutImage(cc)
+
+	// the cache is flushed of every image but the one being put
+	assert.Check(t, is.DeepEqual([]image.ID{a.ID(), bb.ID()}, b.deleted))
+	assert.Check(t, is.Equal(int64(40), c.Level()))
+	assert.Check(t, b.hasImage(cc.ID()))
+
+	c.RemoveImage(cc.ID())
+	assert.Check(t, is.Equal(int64(0), c.Level()))
+}
+
+func TestNaiveReclaimStopsAtTarget(t *testing.T) {
+	b, cleanup := newFakeBackendForTest(t)
+	defer cleanup()
+
+	now := time.Now()
+	a := b.addImage(t, now, []layer.DiffID{b.layer("a", 40)})
+	bb := b.addImage(t, now, []layer.DiffID{b.layer("b", 40)})
+
+	c := newNaiveCache(newCacheBase(100, b)).(*naiveCache)
+	c.PutImage(a)
+	c.PutImage(bb)
+
+	// unlike the automatic eviction, a reclaim only frees what it asks for
+	assert.Check(t, is.Equal(int64(40), c.Reclaim(30)))
+	assert.Check(t, is.DeepEqual([]image.ID{a.ID()}, b.deleted))
+	assert.Check(t, is.Equal(int64(40), c.Level()))
+}
+
+func TestNaiveEvictionConflict(t *testing.T) {
+	b, cleanup := newFakeBackendForTest(t)
+	defer cleanup()
+
+	now := time.Now()
+	a := b.addImage(t, now, []layer.DiffID{b.layer("a", 40)})
+	bb := b.addImage(t, now, []layer.DiffID{b.layer("b", 40)})
+	cc := b.addImage(t, now, []layer.DiffID{b.layer("c", 40)})
+	b.inUse[a.ID()] = true
+
+	c := newNaiveCache(newCacheBase(100, b)).(*naiveCache)
+	c.PutImage(a)
+	c.PutImage(bb)
+	c.PutImage(cc)
+
+	// a is used by a container, so it stays cached and is not counted as
+	// evicted
+	assert.Check(t, is.DeepEqual([]image.ID{bb.ID()}, b.deleted))
+	assert.Check(t, is.Equal(int64(80), c.Level()))
+	assert.Check(t, is.Len(c.images, 2))
+	assert.Check(t, is.Equal(int64(1), c.Efficiency().Evictions))
+}
+func TestLayerCachesEviction(t *testing.T) {
+	for _, policy := range []string{policyLayerLRU, policyArchiveLRU} {
+		t.Run(policy, func(t *testing.T) {
+			b, cleanup := newFakeBackendForTest(t)
+			defer cleanup()
+
+			now := time.Now()
+			base := b.layer("base", 30)
+			a := b.addImage(t, now, []layer.DiffID{base, b.layer("a", 30)})
+			bb := b.addImage(t, now, []layer.DiffID{base, b.layer("b", 30)})
+			cc := b.addImage(t, now, []layer.DiffID{b.layer("c", 50)})
+
+			var c ImageCache
+			if policy == policyLayerLRU {
+				c = newLayerLRUCache(newCacheBase(100, b))
+			} else {
+				c = newArchiveLRUCache(newCacheBase(100, b))
+			}
+			lc := layerCacheOf(c)
+
+			c.PutImage(a)
+			c.PutImage(bb)
+			assert.Check(t, is.Equal(int64(90), c.Level()))
+			checkLayers(t, lc, b)
+
+			c.PutImage(cc)
+			assert.Check(t, c.Level() <= c.Capacity(), "level %d", c.Level())
+			assert.Check(t, b.hasImage(cc.ID()))
+			assert.Check(t, len(b.deleted) > 0)
+			checkLayers(t, lc, b)
+		})
+	}
+}
+
+func TestLayerCachesRemoveImage(t *testing.T) {
+	for _, policy := range []string{policyLayerLRU, policyArchiveLRU} {
+		t.Run(policy, func(t *testing.T) {
+			b, cleanup := newFakeBackendForTest(t)
+			defer cleanup()
+
+			now := time.Now()
+			base := b.layer("base", 30)
+			top := b.layer("a", 30)
+			a := b.addImage(t, now, []layer.DiffID{base, top})
+			bb := b.addImage(t, now, []layer.DiffID{base, b.layer("b", 30)})
+
+			var c ImageCache
+			if policy == policyLayerLRU {
+				c = newLayerLRUCache(newCacheBase(100, b))
+			} else {
+				c = newArchiveLRUCache(newCacheBase(100, b))
+			}
+			lc := layerCacheOf(c)
+			c.PutImage(a)
+			c.PutImage(bb)
+
+			// the image is deleted first, then removed from the cache
+			_, err := b.ImageDelete(a.ID().String(), false, false)
+			assert.NilError(t, err)
+			c.RemoveImage(a.ID())
+			c.RemoveImage(a.ID())
+
+			// the shared base layer stays
+			assert.Check(t, is.Equal(int64(60), c.Level()))
+			assert.Check(t, !b.hasLayer(layer.CreateChainID([]layer.DiffID{base, top})))
+			assert.Check(t, b.hasLayer(layer.CreateChainID([]layer.DiffID{base})))
+			checkLayers(t, lc, b)
+		})
+	}
+}
+
+func layerCacheOf(c ImageCache) *layerLRUCache {
+	switch c := c.(type) {
+	case *archiveLRUCache:
+		return c.layerLRUCache
+	case *layerLFUCache:
+		return c.layerLRUCache
+	default:
+		return c.(*layerLRUCache)
+	}
+}
+
+func TestLayerLRUEvictsLeafLayersFirst(t *testing.T) {
+	b, cleanup := newFakeBackendForTest(t)
+	defer cleanup()
+
+	now := time.Now()
+	base := b.layer("base", 50)
+	mid := b.layer("mid", 20)
+	top := b.layer("top", 10)
+	img := b.addImage(t, now, []layer.DiffID{base, mid, top})
+
+	c := newLayerLRUCache(newCacheBase(100, b)).(*layerLRUCache)
+	c.PutImage(img)
+
+	// make the base layer the least recently used one
+	baseChain := layer.CreateChainID([]layer.DiffID{base})
+	c.evictList.MoveToBack(c.layers[baseChain])
+
+	victim := c.nextVictim(&evictionPlan{})
+	assert.Check(t, is.Equal(layer.CreateChainID([]layer.DiffID{base, mid, top}), layerOf(victim).layer.ChainID()))
+
+	c.mu.Lock()
+	c.evictTo("", 75)
+	c.mu.Unlock()
+	assert.Check(t, b.hasLayer(baseChain))
+	assert.Check(t, is.Equal(int64(70), c.Level()))
+	checkLayers(t, c, b)
+}
+
+func TestLayerLRUSkipsDownloadingLayers(t *testing.T) {
+	b, cleanup := newFakeBackendForTest(t)
+	defer cleanup()
+
+	now := time.Now()
+	c := newLayerLRUCache(newCacheBase(1000, b))
+	old := b.addImage(t, now, []layer.DiffID{b.layer("old", 10)})
+	recent := b.addImage(t, now, []layer.DiffID{b.layer("recent", 10)})
+	c.PutImage(old)
+	c.PutImage(recent)
+
+	// a pull registers a layer on top of the least recently used one,
+	// while other downloads come and go
+	endDownload := xfer.BeginLayerDownload(old.RootFS.ChainID())
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+				xfer.BeginLayerDownload(layer.ChainID("sha256:other"))()
+			}
+		}
+	}()
+	defer func() {
+		close(stop)
+		wg.Wait()
+	}()
+
+	freed := make(chan int64)
+	go func() { freed <- c.Reclaim(1) }()
+	select {
+	case n := <-freed:
+		assert.Check(t, is.Equal(int64(10), n))
+	case <-time.After(10 * time.Second):
+		t.Fatal("eviction blocked by the download")
+	}
+	assert.Check(t, is.DeepEqual([]image.ID{recent.ID()}, b.deleted))
+	assert.Check(t, b.hasLayer(old.RootFS.ChainID()))
+
+	// the layer goes once the download is done
+	endDownload()
+	assert.Check(t, is.Equal(int64(10), c.Reclaim(1)))
+	assert.Check(t, is.DeepEqual([]image.ID{recent.ID(), old.ID()}, b.deleted))
+}
+
+func TestArchiveLRUExclusion(t *testing.T) {
+	b, cleanup := newFakeBackendForTest(t)
+	defer cleanup()
+
+	now := time.Now()
+	kept := b.layer("kept", 100)
+	excluded := b.layer("excluded", 100)
+	large := b.layer("large", 100)
+	img := b.addImage(t, now, []layer.DiffID{kept, excluded, large})
+	for diffID, content := range map[layer.DiffID]string{
+		kept:     "archive",
+		excluded: "archive",
+		large:    "larger archive",
+	} {
+		assert.NilError(t, ioutil.WriteFile(createLayerArchivePath(diffID), []byte(content), 0600))
+	}
+
+	base := newCacheBase(1000, b)
+	base.archiveMaxSize = int64(len("archive"))
+	// exclude by a prefix of the diffID, algorithm included
+	base.archiveExclude = []string{excluded.String()[:len("sha256:")+12] + "*"}
+	c := newArchiveLRUCache(base).(*archiveLRUCache)
+	c.PutImage(img)
+
+	assert.Check(t, is.Len(c.archives, 1))
+	assert.Check(t, c.archives[kept] != nil)
+	for diffID, expected := range map[layer.DiffID]bool{kept: true, excluded: false, large: false} {
+		info, err := getLayerArchiveInfo(diffID)
+		assert.Check(t, err)
+		assert.Check(t, is.Equal(expected, info != nil), "archive of %s", diffID)
+	}
+}
+
+func TestArchiveLRUNoArchiveLabel(t *testing.T) {
+	b, cleanup := newFakeBackendForTest(t)
+	defer cleanup()
+
+	now := time.Now()
+	shared := b.layer("shared", 100)
+	unlabeledTop := b.layer("unlabeled", 100)
+	labeledTop := b.layer("labeled", 100)
+	unlabeled := b.addImage(t, now, []layer.DiffID{shared, unlabeledTop})
+	labeled := b.addImage(t, now.Add(time.Second), []layer.DiffID{shared, labeledTop})
+	labeled.Config = &containertypes.Config{Labels: map[string]string{noArchiveLabel: "true"}}
+	for _, diffID := range []layer.DiffID{shared, unlabeledTop, labeledTop} {
+		assert.NilError(t, ioutil.WriteFile(createLayerArchivePath(diffID), []byte("archive"), 0600))
+	}
+
+	c := newArchiveLRUCache(newCacheBase(1000, b)).(*archiveLRUCache)
+	c.PutImage(unlabeled)
+	c.PutImage(labeled)
+
+	// the shared layer was cached for the unlabeled image first, and keeps
+	// its archive
+	assert.Check(t, is.Len(c.archives, 2))
+	for diffID, expected := range map[layer.DiffID]bool{shared: true, unlabeledTop: true, labeledTop: false} {
+		info, err := getLayerArchiveInfo(diffID)
+		assert.Check(t, err)
+		assert.Check(t, is.Equal(expected, info != nil), "archive of %s", diffID)
+		assert.Check(t, is.Equal(expected, c.archives[diffID] != nil), "archive of %s", diffID)
+	}
+}
+
+func TestArchiveLRUSharedDiffID(t *testing.T) {
+	b, cleanup := newFakeBackendForTest(t)
+	defer cleanup()
+
+	now := time.Now()
+	shared := b.layer("shared", 30)
+	img1 := b.addImage(t, now, []layer.DiffID{b.layer("base1", 10), shared})
+	img2 := b.addImage(t, now, []layer.DiffID{b.layer("base2", 10), shared})
+	assert.NilError(t, ioutil.WriteFile(createLayerArchivePath(shared), []byte("shared archive"), 0600))
+
+	c := newArchiveLRUCache(newCacheBase(1000, b)).(*archiveLRUCache)
+	c.PutImage(img1)
+	c.PutImage(img2)
+
+	// the archive is reached through two chains, and accounted once
+	archiveSize := int64(len("shared archive"))
+	assert.Check(t, is.Equal(archiveSize, c.archiveLevel))
+	assert.Check(t, is.Len(c.archives, 1))
+	assert.Check(t, is.Equal(2, c.archives[shared].refs))
+
+	_, err := b.ImageDelete(img1.ID().String(), false, false)
+	assert.NilError(t, err)
+	c.RemoveImage(img1.ID())
+	fi, err := getLayerArchiveInfo(shared)
+	assert.NilError(t, err)
+	assert.Check(t, fi != nil, "archive still used by another chain was deleted")
+	assert.Check(t, is.Equal(archiveSize, c.archiveLevel))
+
+	_, err = b.ImageDelete(img2.ID().String(), false, false)
+	assert.NilError(t, err)
+	c.RemoveImage(img2.ID())
+	fi, err = getLayerArchiveInfo(shared)
+	assert.NilError(t, err)
+	assert.Check(t, fi == nil)
+	assert.Check(t, is.Equal(int64(0), c.archiveLevel))
+	assert.Check(t, is.Len(c.archives, 0))
+}
+
+func TestArchiveLRURefusesImagesNotFitting(t *testing.T) {
+	b, cleanup := newFakeBackendForTest(t)
+	defer cleanup()
+
+	now := time.Now()
+	used := b.addImage(t, now, []layer.DiffID{b.layer("used", 60)})
+	small := b.layer("small", 30)
+	large := b.layer("large", 120)
+	smallImg := b.addImage(t, now.Add(time.Second), []layer.DiffID{small})
+	largeImg := b.addImage(t, now.Add(time.Second), []layer.DiffID{large})
+	// the pull skips the archive of the layer larger than the cache, but
+	// writes that of the other ahead of the cache
+	assert.NilError(t, ioutil.WriteFile(createLayerArchivePath(small), []byte("archive"), 0600))
+
+	c := newArchiveLRUCache(newCacheBase(80, b)).(*archiveLRUCache)
+	c.PutImage(used)
+	b.inUse[used.ID()] = true
+
+	// the layer is larger than the whole cache, and the layer a container
+	// uses leaves no room for the other
+	c.PutImage(largeImg)
+	c.PutImage(smallImg)
+	assert.Check(t, is.Equal(int64(60), c.Level()))
+	assert.Check(t, is.Len(c.archives, 0))
+	assert.Check(t, is.Len(b.deleted, 0))
+	for _, diffID := range []layer.DiffID{small, large} {
+		info, err := getLayerArchiveInfo(diffID)
+		assert.Check(t, err)
+		assert.Check(t, info == nil, "archive of %s", diffID)
+	}
+}
+
+func TestEvictThreshold(t *testing.T) {
+	b, cleanup := newFakeBackendForTest(t)
+	defer cleanup()
+
+	now := time.Now()
+	var imgs []*image.Image
+	for _, name := range []string{"a", "b", "c", "d"} {
+		imgs = append(imgs, b.addImage(t, now, []layer.DiffID{b.layer(name, 40)}))
+	}
+
+	base := newCacheBase(100, b)
+	base.evictThreshold = 150
+	c := newImageLRUCache(base).(*imageLRUCache)
+
+	// a transient spike within the grace band evicts nothing
+	for _, img := range imgs[:3] {
+		c.PutImage(img)
+	}
+	assert.Check(t, is.Equal(int64(120), c.Level()))
+	assert.Check(t, is.Len(b.deleted, 0))
+
+	// beyond it, the cache is evicted back down to its capacity
+	c.PutImage(imgs[3])
+	assert.Check(t, is.Equal(int64(80), c.Level()))
+	assert.Check(t, is.DeepEqual([]image.ID{imgs[0].ID(), imgs[1].ID()}, b.deleted))
+}
+
+func TestEvictionTrigger(t *testing.T) {
+	c := newCacheBase(200, nil)
+	assert.Check(t, is.Equal(int64(200), c.evictionTrigger()))
+	c.evictThreshold = 125
+	assert.Check(t, is.Equal(int64(250), c.evictionTrigger()))
+
+	c = newCacheBase(maxCacheCapacity, nil)
+	c.evictThreshold = 1000
+	assert.Check(t, is.Equal(int64(math.MaxInt64), c.evictionTrigger()))
+}
+
+func TestArchiveLRURemoveLayerDuringArchiveWrite(t *testing.T) {
+	b, cleanup := newFakeBackendForTest(t)
+	defer cleanup()
+
+	diffID := b.layer("archived", 30)
+	writeArchive := func() {
+		defer xfer.BeginArchiveWrite(diffID)()
+		f, err := ioutil.TempFile("", "LayerArchive")
+		assert.Check(t, err)
+		if err != nil {
+			return
+		}
+		f.WriteString("archive")
+		f.Close()
+		assert.Check(t, os.Rename(f.Name(), createLayerArchivePath(diffID)))
+	}
+	writeArchive()
+
+	c := newArchiveLRUCache(newCacheBase(1000, b)).(*archiveLRUCache)
+	for i := 0; i < 20; i++ {
+		img := b.addImage(t, time.Now().Add(time.Duration(i)*time.Second), []layer.DiffID{diffID})
+		c.PutImage(img)
+		_, err := b.ImageDelete(img.ID().String(), false, false)
+		assert.NilError(t, err)
+
+		var wg sync.WaitGroup
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			writeArchive()
+		}()
+		go func() {
+			defer wg.Done()
+			c.RemoveImage(img.ID())
+		}()
+		wg.Wait()
+		assert.Check(t, is.Len(c.layers, 0))
+	}
+
+	// an archive being written survives the removal of its layer
+	writeArchive()
+	img := b.addImage(t, time.Now(), []layer.DiffID{diffID})
+	c.PutImage(img)
+	_, err := b.ImageDelete(img.ID().String(), false, false)
+	assert.NilError(t, err)
+	endWrite := xfer.BeginArchiveWrite(diffID)
+	c.RemoveImage(img.ID())
+	endWrite()
+	fi, err := getLayerArchiveInfo(diffID)
+	assert.NilError(t, err)
+	assert.Check(t, fi != nil)
+	assert.Check(t, is.Equal(int64(0), c.archiveLevel))
+}
+
+func TestArchiveLRUCloseDuringArchiveRead(t *testing.T) {
+	b, cleanup := newFakeBackendForTest(t)
+	defer cleanup()
+
+	diffID := b.layer("read", 30)
+	assert.NilError(t, ioutil.WriteFile(createLayerArchivePath(diffID), []byte("archive"), 0600))
+	img := b.addImage(t, time.Now(), []layer.DiffID{diffID})
+	c := newArchiveLRUCache(newCacheBase(1000, b)).(*archiveLRUCache)
+	c.PutImage(img)
+	_, err := b.ImageDelete(img.ID().String(), false, false)
+	assert.NilError(t, err)
+
+	// the archive is being served while the image is removed and the cache
+	// closed
+	endRead := xfer.BeginArchiveRead(diffID)
+	f, err := os.Open(createLayerArchivePath(diffID))
+	assert.NilError(t, err)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		c.RemoveImage(img.ID())
+		c.Close()
+	}()
+
+	select {
+	case <-done:
+		t.Fatal("the cache closed during an archive read")
+	case <-time.After(100 * time.Millisecond):
+	}
+	data, err := ioutil.ReadAll(f)
+	assert.NilError(t, err)
+	assert.Check(t, is.Equal("archive", string(data)))
+	f.Close()
+	fi, err := getLayerArchiveInfo(diffID)
+	assert.NilError(t, err)
+	assert.Check(t, fi != nil, "archive deleted from under its reader")
+
+	endRead()
+	<-done
+	fi, err = getLayerArchiveInfo(diffID)
+	assert.NilError(t, err)
+	assert.Check(t, fi == nil)
+	assert.Check(t, is.Len(c.archives, 0))
+}
+
+func TestEmptyImage(t *testing.T) {
+	for _, policy := range []string{policyNaive, policyImageLRU, policyLayerLRU, policyArchiveLRU} {
+		t.Run(policy, func(t *testing.T) {
+			b, cleanup := newFakeBackendForTest(t)
+			defer cleanup()
+
+			now := time.Now()
+			empty := b.addImage(t, now, nil)
+			full := b.addImage(t, now.Add(time.Second), []layer.DiffID{b.layer("a", 30)})
+
+			c := newTestCache(t, policy, newCacheBase(100, b))
+			c.PutImage(empty)
+			c.PutImage(full)
+			assert.Check(t, is.Equal(int64(30), c.Level()))
+			assert.Check(t, c.Promote(empty.ID()))
+			assert.Check(t, c.CheckConsistency().Consistent())
+
+			// evicting everything leaves the empty image in place
+			assert.Check(t, is.Equal(int64(30), c.Reclaim(100)))
+			assert.Check(t, is.Equal(int64(0), c.Level()))
+			assert.Check(t, b.hasImage(empty.ID()))
+
+			c.RemoveImage(empty.ID())
+			assert.Check(t, c.Promote(empty.ID()) != nil)
+			assert.Check(t, is.Equal(int64(0), c.Level()))
+		})
+	}
+}
+
+func TestImageLRUEvictionSkipsVanishedImage(t *testing.T) {
+	b, cleanup := newFakeBackendForTest(t)
+	defer cleanup()
+
+	now := time.Now()
+	var imgs []*image.Image
+	for _, name := range []string{"a", "b", "c", "d"} {
+		imgs = append(imgs, b.addImage(t, now, []layer.DiffID{b.layer(name, 40)}))
+	}
+	c := newImageLRUCache(newCacheBase(100, b)).(*imageLRUCache)
+	c.PutImage(imgs[0])
+	c.PutImage(imgs[1])
+
+	// the least recently used image is deleted behind the back of the cache
+	_, err := b.ImageDelete(imgs[0].ID().String(), true, false)
+	assert.NilError(t, err)
+
+	c.PutImage(imgs[2])
+	assert.Check(t, is.Equal(int64(80), c.Level()))
+	assert.Check(t, is.Len(c.images, 2))
+	_, ok := c.images[imgs[0].ID()]
+	assert.Check(t, !ok)
+
+	// eviction goes on with the images still there
+	c.PutImage(imgs[3])
+	assert.Check(t, is.Equal(int64(80), c.Level()))
+	assert.Check(t, is.DeepEqual([]image.ID{imgs[0].ID(), imgs[1].ID()}, b.deleted))
+}
+
+func TestImageLRURecencyWeight(t *testing.T) {
+	for _, tc := range []struct {
+		weight  float64
+		evicted string
+	}{
+		// the frequently used image is the least recently used one
+		{weight: 1, evicted: "frequent"},
+		// its access rate outweighs the single access to the recent image
+		{weight: 0.5, evicted: "recent"},
+		{weight: 0, evicted: "recent"},
+	} {
+		b, cleanup := newFakeBackendForTest(t)
+
+		now := time.Now()
+		imgs := make(map[string]*image.Image)
+		for _, name := range []string{"frequent", "recent", "new"} {
+			imgs[name] = b.addImage(t, now, []layer.DiffID{b.layer(name, 40)})
+		}
+		base := newCacheBase(100, b)
+		base.recencyWeight = tc.weight
+		c := newImageLRUCache(base).(*imageLRUCache)
+
+		c.PutImage(imgs["frequent"])
+		for i := 0; i < 5; i++ {
+			c.UpdateImage(imgs["frequent"].ID().String())
+		}
+		c.PutImage(imgs["recent"])
+		c.PutImage(imgs["new"])
+
+		assert.Check(t, is.DeepEqual([]image.ID{imgs[tc.evicted].ID()}, b.deleted), "weight %.1f", tc.weight)
+		assert.Check(t, is.Equal(int64(80), c.Level()), "weight %.1f", tc.weight)
+		cleanup()
+	}
+}
+
+func TestWarmImageSurvivesUntilUsed(t *testing.T) {
+	for _, tc := range []struct {
+		policy   string
+		newCache func(*cacheBase) ImageCache
+	}{
+		{policy: policyImageLRU, newCache: newImageLRUCache},
+		{policy: policyLayerLRU, newCache: newLayerLRUCache},
+	} {
+		b, cleanup := newFakeBackendForTest(t)
+
+		now := time.Now()
+		imgs := make(map[string]*image.Image)
+		for _, name := range []string{"warm", "used", "new", "newer"} {
+			imgs[name] = b.addImage(t, now, []layer.DiffID{b.layer(name, 40)})
+		}
+		base := newCacheBase(100, b)
+		base.warm = true
+		c := tc.newCache(base)
+
+		// the warm image is the least recently used one, but the used one
+		// goes first
+		c.PutImage(imgs["warm"])
+		c.PutImage(imgs["used"])
+		c.UpdateImage(imgs["used"].ID().String())
+		c.PutImage(imgs["new"])
+		assert.Check(t, is.DeepEqual([]image.ID{imgs["used"].ID()}, b.deleted), tc.policy)
+
+		// once used, the image is evicted as usual
+		c.UpdateImage(imgs["warm"].ID().String())
+		c.PutImage(imgs["newer"])
+		assert.Check(t, is.DeepEqual([]image.ID{imgs["used"].ID(), imgs["warm"].ID()}, b.deleted), tc.policy)
+		assert.Check(t, is.Equal(int64(80), c.Level()), tc.policy)
+		cleanup()
+	}
+}
+
+func TestMaxLayers(t *testing.T) {
+	b, cleanup := newFakeBackendForTest(t)
+	defer cleanup()
+
+	now := time.Now()
+	var imgs []*image.Image
+	for i := 0; i < 3; i++ {
+		var diffIDs []layer.DiffID
+		for j := 0; j < 4; j++ {
+			diffIDs = append(diffIDs, b.layer(fmt.Sprintf("%d-%d", i, j), 1))
+		}
+		imgs = append(imgs, b.addImage(t, now, diffIDs))
+	}
+	base := newCacheBase(1000, b)
+	base.maxLayers = 10
+	c := newLayerLRUCache(base).(*layerLRUCache)
+
+	c.PutImage(imgs[0])
+	c.PutImage(imgs[1])
+	assert.Check(t, is.Equal(int64(8), c.Stats().Layers))
+	assert.Check(t, is.Len(b.deleted, 0))
+
+	// the cache is far below its capacity, but holds too many layers
+	c.PutImage(imgs[2])
+	assert.Check(t, is.Equal(int64(10), c.Stats().Layers))
+	assert.Check(t, is.Len(c.layers, 10))
+	assert.Check(t, is.Equal(int64(10), c.Level()))
+	assert.Check(t, is.DeepEqual([]image.ID{imgs[0].ID()}, b.deleted))
+	assert.Check(t, b.hasImage(imgs[1].ID()))
+	assert.Check(t, b.hasImage(imgs[2].ID()))
+}
+
+func TestEvictionOrderUnderEqualTimestamps(t *testing.T) {
+	now := time.Now()
+	defer func() { timeNow = time.Now }()
+	timeNow = func() time.Time { return now }
+
+	for _, tc := range []struct {
+		policy   string
+		newCache func(*cacheBase) ImageCache
+	}{
+		{policy: policyNaive, newCache: newNaiveCache},
+		{policy: policyImageLRU, newCache: newImageLRUCache},
+		{policy: policyLayerLRU, newCache: newLayerLRUCache},
+	} {
+		for i := 0; i < 5; i++ {
+			b, cleanup := newFakeBackendForTest(t)
+
+			// the images are put at the same instant, so that only the
+			// order they are put in explains the eviction order
+			var imgs []*image.Image
+			for _, name := range []string{"e", "d", "c", "b", "a"} {
+				imgs = append(imgs, b.addImage(t, now, []layer.DiffID{b.layer(name, 10)}))
+			}
+			c := tc.newCache(newCacheBase(20, b))
+			for _, img := range imgs {
+				c.PutImage(img)
+			}
+
+			// the naive policy flushes b along with c
+			evicted := imgs[:3]
+			if tc.policy == policyNaive {
+				evicted = imgs[:4]
+			}
+			var expected []image.ID
+			for _, img := range evicted {
+				expected = append(expected, img.ID())
+			}
+			assert.Check(t, is.DeepEqual(expected, b.deleted), tc.policy)
+			cleanup()
+		}
+	}
+}
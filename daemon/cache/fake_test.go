@@ -0,0 +1,432 @@
+package cache
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/docker/distribution"
+	"github.com/docker/distribution/reference"
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/errdefs"
+	"github.com/docker/docker/image"
+	"github.com/docker/docker/layer"
+	"github.com/opencontainers/go-digest"
+)
+
+// fakeLayer is a layer of the fake image backend. Like in the layer store,
+// a layer is referenced by each reference handed out to the cache, by each
+// image it is the top layer of, and by each of its children.
+type fakeLayer struct {
+	chainID  layer.ChainID
+	diffID   layer.DiffID
+	parent   *fakeLayer
+	diffSize int64
+	refs     int
+	// urls are the URLs of a foreign layer
+	urls []string
+	// diffSizeCalls counts the calls to DiffSize
+	diffSizeCalls int
+}
+
+// fakeLayerRef is a reference to a fake layer, as returned by
+// GetReadOnlyLayer
+type fakeLayerRef struct {
+	*fakeLayer
+}
+
+func (l *fakeLayerRef) TarStream() (io.ReadCloser, error) {
+	return ioutil.NopCloser(strings.NewReader("")), nil
+}
+
+func (l *fakeLayerRef) TarStreamFrom(layer.ChainID) (io.ReadCloser, error) {
+	return l.TarStream()
+}
+
+func (l *fakeLayerRef) ChainID() layer.ChainID {
+	return l.chainID
+}
+
+func (l *fakeLayerRef) DiffID() layer.DiffID {
+	return l.diffID
+}
+
+func (l *fakeLayerRef) Parent() layer.Layer {
+	if l.parent == nil {
+		return nil
+	}
+	return &fakeLayerRef{l.parent}
+}
+
+func (l *fakeLayerRef) Size() (int64, error) {
+	var size int64
+	for fl := l.fakeLayer; fl != nil; fl = fl.parent {
+		size += fl.diffSize
+	}
+	return size, nil
+}
+
+func (l *fakeLayerRef) DiffSize() (int64, error) {
+	l.diffSizeCalls++
+	return l.diffSize, nil
+}
+
+func (l *fakeLayerRef) Metadata() (map[string]string, error) {
+	return nil, nil
+}
+
+func (l *fakeLayerRef) Descriptor() distribution.Descriptor {
+	return distribution.Descriptor{
+		Digest: digest.Digest(l.diffID),
+		Size:   l.diffSize,
+		URLs:   l.urls,
+	}
+}
+
+// fakeImageBackend is an in-memory ImageBackend with layer reference
+// counting modeled after the layer store
+type fakeImageBackend struct {
+	mu      sync.Mutex
+	t       *testing.T
+	store   *testImageStore
+	images  map[image.ID]*image.Image
+	tags    map[string]image.ID
+	layers  map[layer.ChainID]*fakeLayer
+	handles map[*fakeLayerRef]string // operating system of the handles
+	sizes   map[layer.DiffID]int64
+	foreign map[layer.DiffID][]string
+
+	// stores are the operating systems of the layer stores, any operating
+	// system having one if empty
+	stores map[string]bool
+
+	// inUse holds the images used by containers, which cannot be deleted
+	inUse map[image.ID]bool
+	// live holds the images used by containers running, paused or
+	// restarting, which the fake deletes with force all the same
+	live map[image.ID]bool
+	// deleted records the deleted images, in order
+	deleted []image.ID
+
+	// notRetained holds the layers whose releases fail as not retained,
+	// and acquired and releases count the references handed out and the
+	// releases attempted for each layer
+	notRetained map[layer.ChainID]bool
+	acquired    map[layer.ChainID]int
+	releases    map[layer.ChainID]int
+}
+
+func newFakeImageBackend(t *testing.T, root string) *fakeImageBackend {
+	t.Helper()
+	return &fakeImageBackend{
+		t:       t,
+		store:   newTestImageStore(t, root),
+		images:  make(map[image.ID]*image.Image),
+		tags:    make(map[string]image.ID),
+		layers:  make(map[layer.ChainID]*fakeLayer),
+		handles: make(map[*fakeLayerRef]string),
+		sizes:   make(map[layer.DiffID]int64),
+		foreign: make(map[layer.DiffID][]string),
+		inUse:   make(map[image.ID]bool),
+		live:    make(map[image.ID]bool),
+
+		notRetained: make(map[layer.ChainID]bool),
+		acquired:    make(map[layer.ChainID]int),
+		releases:    make(map[layer.ChainID]int),
+	}
+}
+
+// layer returns the diffID of a layer named name, of the given size
+func (b *fakeImageBackend) layer(name string, size int64) layer.DiffID {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	diffID := layer.DiffID(digest.FromString(name))
+	b.sizes[diffID] = size
+	return diffID
+}
+
+// foreignLayer returns the diffID of a foreign layer named name, of the
+// given size
+func (b *fakeImageBackend) foreignLayer(name string, size int64) layer.DiffID {
+	diffID := b.layer(name, size)
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.foreign[diffID] = []string{"https://example.com/" + name}
+	return diffID
+}
+
+// addImage creates an image made of the layers of diffIDs, tagged with
+// tags
+func (b *fakeImageBackend) addImage(t *testing.T, created time.Time, diffIDs []layer.DiffID, tags ...string) *image.Image {
+	t.Helper()
+	return b.addImageFor(t, "", created, diffIDs, tags...)
+}
+
+// addImageFor creates an image of the given operating system
+func (b *fakeImageBackend) addImageFor(t *testing.T, os string, created time.Time, diffIDs []layer.DiffID, tags ...string) *image.Image {
+	t.Helper()
+	img := b.store.newImageFor(t, os, created, diffIDs...)
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.registerImage(img)
+	for _, tag := range tags {
+		b.tags[familiarTag(tag)] = img.ID()
+	}
+	return img
+}
+
+// registerImage adds the layers of img which don't exist yet and takes a
+// reference to its top layer
+func (b *fakeImageBackend) registerImage(img *image.Image) {
+	var (
+		parent *fakeLayer
+		chain  []layer.DiffID
+	)
+	for _, diffID := range img.RootFS.DiffIDs {
+		chain = append(chain, diffID)
+		chainID := layer.CreateChainID(chain)
+		l, ok := b.layers[chainID]
+		if !ok {
+			l = &fakeLayer{chainID: chainID, diffID: diffID, parent: parent, diffSize: b.sizes[diffID], urls: b.foreign[diffID]}
+			b.layers[chainID] = l
+			if parent != nil {
+				parent.refs++
+			}
+		}
+		parent = l
+	}
+	if parent != nil {
+		parent.refs++
+	}
+	b.images[img.ID()] = img
+}
+
+// releaseLayer drops a reference to l, deleting it and releasing its parent
+// once it is no longer referenced
+func (b *fakeImageBackend) releaseLayer(l *fakeLayer) []layer.Metadata {
+	removed := []layer.Metadata{}
+	for l != nil {
+		l.refs--
+		if l.refs > 0 {
+			break
+		}
+		size, _ := (&fakeLayerRef{l}).Size()
+		removed = append(removed, layer.Metadata{ChainID: l.chainID, DiffID: l.diffID, Size: size, DiffSize: l.diffSize})
+		delete(b.layers, l.chainID)
+		l = l.parent
+	}
+	return removed
+}
+
+func (b *fakeImageBackend) resolve(refOrID string) (image.ID, bool) {
+	if _, ok := b.images[image.ID(refOrID)]; ok {
+		return image.ID(refOrID), true
+	}
+	id, ok := b.tags[familiarTag(refOrID)]
+	return id, ok
+}
+
+func (b *fakeImageBackend) tagsOf(id image.ID) []string {
+	var tags []string
+	for tag, tagged := range b.tags {
+		if tagged == id {
+			tags = append(tags, tag)
+		}
+	}
+	sort.Strings(tags)
+	return tags
+}
+
+func (b *fakeImageBackend) hasImage(id image.ID) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	_, ok := b.images[id]
+	return ok
+}
+
+func (b *fakeImageBackend) hasLayer(chainID layer.ChainID) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	_, ok := b.layers[chainID]
+	return ok
+}
+
+func (b *fakeImageBackend) Map() map[image.ID]*image.Image {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	imgs := make(map[image.ID]*image.Image, len(b.images))
+	for id, img := range b.images {
+		imgs[id] = img
+	}
+	return imgs
+}
+
+func (b *fakeImageBackend) GetImage(refOrID string) (*image.Image, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	id, ok := b.resolve(refOrID)
+	if !ok {
+		return nil, errdefs.NotFound(fmt.Errorf("No such image: %s", refOrID))
+	}
+	return b.images[id], nil
+}
+
+func (b *fakeImageBackend) LookupImage(name string) (*types.ImageInspect, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	id, ok := b.resolve(name)
+	if !ok {
+		return nil, errdefs.NotFound(fmt.Errorf("No such image: %s", name))
+	}
+	return &types.ImageInspect{ID: id.String(), RepoTags: b.tagsOf(id)}, nil
+}
+
+func (b *fakeImageBackend) ImageDelete(imageRef string, force, prune bool) ([]types.ImageDeleteResponseItem, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	id, ok := b.resolve(imageRef)
+	if !ok {
+		return nil, errdefs.NotFound(fmt.Errorf("No such image: %s", imageRef))
+	}
+	if tags := b.tagsOf(id); id.String() != imageRef && len(tags) > 1 {
+		// only untag the image while it has other tags
+		tag := familiarTag(imageRef)
+		delete(b.tags, tag)
+		return []types.ImageDeleteResponseItem{{Untagged: tag}}, nil
+	}
+	for _, img := range b.images {
+		if img.Parent == id {
+			return nil, errdefs.Conflict(fmt.Errorf("conflict: unable to delete %s (cannot be forced) - image has dependent child images", id))
+		}
+	}
+	if b.inUse[id] {
+		return nil, errdefs.Conflict(fmt.Errorf("conflict: unable to delete %s (cannot be forced) - image is being used by running container", id))
+	}
+
+	var resps []types.ImageDeleteResponseItem
+	for _, tag := range b.tagsOf(id) {
+		delete(b.tags, tag)
+		resps = append(resps, types.ImageDeleteResponseItem{Untagged: tag})
+	}
+	img := b.images[id]
+	delete(b.images, id)
+	if len(img.RootFS.DiffIDs) > 0 {
+		b.releaseLayer(b.layers[img.RootFS.ChainID()])
+	}
+	b.deleted = append(b.deleted, id)
+	return append(resps, types.ImageDeleteResponseItem{Deleted: id.String()}), nil
+}
+
+func (b *fakeImageBackend) ImageInUse(imgID image.ID) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.inUse[imgID]
+}
+
+func (b *fakeImageBackend) LiveContainerImages() map[image.ID]bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	live := make(map[image.ID]bool, len(b.live))
+	for id := range b.live {
+		live[id] = true
+	}
+	return live
+}
+
+func (b *fakeImageBackend) SquashImage(id, parent string) (string, error) {
+	b.mu.Lock()
+	img, ok := b.images[image.ID(id)]
+	if !ok {
+		b.mu.Unlock()
+		return "", errdefs.NotFound(fmt.Errorf("No such image: %s", id))
+	}
+	var (
+		names []string
+		size  int64
+	)
+	for _, diffID := range img.RootFS.DiffIDs {
+		names = append(names, diffID.String())
+		size += b.sizes[diffID]
+	}
+	diffID := layer.DiffID(digest.FromString(strings.Join(names, ",")))
+	b.sizes[diffID] = size
+	b.mu.Unlock()
+
+	squashed := b.store.newImage(b.t, img.Created, diffID)
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.registerImage(squashed)
+	return squashed.ID().String(), nil
+}
+
+func (b *fakeImageBackend) TagImageWithReference(imageID image.ID, newTag reference.Named) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.tags[familiarTag(newTag.String())] = imageID
+	return nil
+}
+
+func (b *fakeImageBackend) GetReadOnlyLayer(chainID layer.ChainID, os string) (layer.Layer, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if len(b.stores) > 0 && !b.stores[os] {
+		return nil, fmt.Errorf("no layer store for operating system %q", os)
+	}
+	l, ok := b.layers[chainID]
+	if !ok {
+		return nil, layer.ErrLayerDoesNotExist
+	}
+	l.refs++
+	b.acquired[chainID]++
+	ref := &fakeLayerRef{l}
+	b.handles[ref] = os
+	return ref, nil
+}
+
+func (b *fakeImageBackend) ReleaseReadOnlyLayer(l layer.Layer, os string) ([]layer.Metadata, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if l == nil {
+		return nil, nil
+	}
+	ref, ok := l.(*fakeLayerRef)
+	if !ok {
+		return nil, layer.ErrLayerNotRetained
+	}
+	b.releases[ref.chainID]++
+	if b.notRetained[ref.chainID] {
+		return nil, layer.ErrLayerNotRetained
+	}
+	if handleOS, ok := b.handles[ref]; !ok || handleOS != os {
+		return nil, layer.ErrLayerNotRetained
+	}
+	delete(b.handles, ref)
+	if _, ok := b.layers[ref.chainID]; !ok {
+		return []layer.Metadata{}, nil
+	}
+	return b.releaseLayer(ref.fakeLayer), nil
+}
+
+// familiarTag returns the familiar form of a tag, as found in RepoTags
+func familiarTag(tag string) string {
+	named, err := reference.ParseNormalizedNamed(tag)
+	if err != nil {
+		return tag
+	}
+	return reference.FamiliarString(reference.TagNameOnly(named))
+}
@@ -0,0 +1,142 @@
+package cache
+
+import (
+	"github.com/docker/docker/image"
+	"github.com/docker/docker/layer"
+	"github.com/sirupsen/logrus"
+)
+
+// storeImages returns every image of the image store, including those the
+// backend of a partition or a tier leaves out, as the layers are shared
+// across partitions and tiers
+func storeImages(is ImageBackend) map[image.ID]*image.Image {
+	switch b := is.(type) {
+	case *namespaceBackend:
+		return storeImages(b.ImageBackend)
+	case *spillBackend:
+		return storeImages(b.ImageBackend)
+	}
+	return is.Map()
+}
+
+// sharedChains returns the chain IDs of the layers that the images of the
+// image store other than imgID use, which removing imgID leaves referenced.
+// It returns nil if a container uses imgID, as the container then holds all
+// of its layers. The caller must hold the lock.
+func (c *cacheBase) sharedChains(imgID image.ID) map[layer.ChainID]bool {
+	if c.imageService.ImageInUse(imgID) {
+		return nil
+	}
+	shared := make(map[layer.ChainID]bool)
+	for id, img := range storeImages(c.imageService) {
+		if id == imgID {
+			continue
+		}
+		for _, chainID := range chainIDsOf(img) {
+			shared[chainID] = true
+		}
+	}
+	return shared
+}
+
+// freeableBytes returns the diff size of the layers of img which would be
+// left unreferenced by its removal, read from the layer store, leaving out
+// its foreign layers. The caller must hold the lock.
+func (c *cacheBase) freeableBytes(img *image.Image) int64 {
+	shared := c.sharedChains(img.ID())
+	if shared == nil || len(img.RootFS.DiffIDs) == 0 {
+		return 0
+	}
+	topLayer, err := c.imageService.GetReadOnlyLayer(img.RootFS.ChainID(), img.OperatingSystem())
+	if err != nil {
+		logrus.Errorf("error getting the top layer of image %s: %v", img.ID(), err)
+		return 0
+	}
+	defer c.imageService.ReleaseReadOnlyLayer(topLayer, img.OperatingSystem())
+
+	var freeable int64
+	for l := topLayer; l != nil; l = l.Parent() {
+		if shared[l.ChainID()] || isForeignLayer(l) {
+			continue
+		}
+		size, err := l.DiffSize()
+		if err != nil {
+			logrus.Warnf("error getting the size of layer %s: %v", l.ChainID(), err)
+			continue
+		}
+		freeable += size
+	}
+	return freeable
+}
+
+// FreeableBytes implements the ImageCache interface
+func (c *naiveCache) FreeableBytes(imgID image.ID) int64 {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	imgID = c.cachedID(imgID)
+	if _, ok := c.images[imgID.String()]; !ok {
+		return 0
+	}
+	img, err := c.imageService.GetImage(imgID.String())
+	if err != nil {
+		logrus.Debugf("error getting cached image %s: %v", imgID, err)
+		return 0
+	}
+	return c.freeableBytes(img)
+}
+
+// FreeableBytes implements the ImageCache interface
+func (c *imageLRUCache) FreeableBytes(imgID image.ID) int64 {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	ci, ok := c.images[c.cachedID(imgID)]
+	if !ok {
+		return 0
+	}
+	return c.freeableBytes(ci.img)
+}
+
+// FreeableBytes implements the ImageCache interface, with the sizes of the
+// layers as read when they were put. Unlike UniqueFootprint, the layers of
+// the image shared with images the cache does not hold are left out.
+func (c *layerLRUCache) FreeableBytes(imgID image.ID) int64 {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	img, ok := c.images[c.cachedID(imgID)]
+	if !ok {
+		return 0
+	}
+	shared := c.sharedChains(img.ID())
+	if shared == nil {
+		return 0
+	}
+	var freeable int64
+	for _, chainID := range chainIDsOf(img) {
+		if e, ok := c.layers[chainID]; ok && !shared[chainID] {
+			freeable += layerOf(e).size
+		}
+	}
+	return freeable
+}
+
+// FreeableBytes implements the ImageCache interface, within the partition
+// of the image
+func (c *partitionedCache) FreeableBytes(imgID image.ID) int64 {
+	if p, ok := c.partitionOf(imgID); ok {
+		return p.FreeableBytes(imgID)
+	}
+	var freeable int64
+	for _, ns := range c.namespaces() {
+		freeable += c.partitions[ns].FreeableBytes(imgID)
+	}
+	return freeable
+}
+
+// FreeableBytes implements the ImageCache interface, from the tier holding
+// the image
+func (c *spillCache) FreeableBytes(imgID image.ID) int64 {
+	return c.ImageCache.FreeableBytes(imgID) + c.spill.FreeableBytes(imgID)
+}
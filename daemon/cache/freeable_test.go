@@ -0,0 +1,52 @@
+package cache
+
+import (
+	"testing"
+	"time"
+
+	"github.com/docker/docker/layer"
+	"gotest.tools/assert"
+	is "gotest.tools/assert/cmp"
+)
+
+func TestFreeableBytes(t *testing.T) {
+	for _, policy := range []string{policyNaive, policyImageLRU, policyLayerLRU, policyLayerLFU, policyArchiveLRU} {
+		t.Run(policy, func(t *testing.T) {
+			b, cleanup := newFakeBackendForTest(t)
+			defer cleanup()
+
+			now := time.Now()
+			base := b.layer("base", 100)
+			top1 := b.layer("top1", 10)
+			top2 := b.layer("top2", 20)
+			img1 := b.addImage(t, now, []layer.DiffID{base, top1})
+			img2 := b.addImage(t, now.Add(time.Second), []layer.DiffID{base, top2})
+
+			c := newTestCache(t, policy, newCacheBase(1000, b))
+			c.PutImage(img1)
+			c.PutImage(img2)
+
+			// the shared base stays with the other image
+			assert.Check(t, is.Equal(int64(10), c.FreeableBytes(img1.ID())))
+			assert.Check(t, is.Equal(int64(20), c.FreeableBytes(img2.ID())))
+			assert.Check(t, is.Equal(int64(0), c.FreeableBytes("sha256:missing")))
+
+			// an image the cache does not hold shares the top layer
+			child := b.addImage(t, now.Add(2*time.Second), []layer.DiffID{base, top1, b.layer("child", 5)})
+			assert.Check(t, is.Equal(int64(0), c.FreeableBytes(img1.ID())))
+
+			// a container holds the layers of its image
+			b.inUse[img2.ID()] = true
+			assert.Check(t, is.Equal(int64(0), c.FreeableBytes(img2.ID())))
+			b.inUse[img2.ID()] = false
+
+			// once the other images are gone, the base goes as well
+			_, err := b.ImageDelete(child.ID().String(), false, false)
+			assert.NilError(t, err)
+			_, err = b.ImageDelete(img1.ID().String(), false, false)
+			assert.NilError(t, err)
+			c.RemoveImage(img1.ID())
+			assert.Check(t, is.Equal(int64(120), c.FreeableBytes(img2.ID())))
+		})
+	}
+}
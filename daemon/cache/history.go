@@ -0,0 +1,103 @@
+package cache
+
+import (
+	"time"
+
+	"github.com/docker/docker/image"
+)
+
+const (
+	// maxHistoryEvents is the number of events kept per image
+	maxHistoryEvents = 16
+	// maxHistoryImages is the number of images whose history is kept
+	maxHistoryImages = 1024
+)
+
+// Types of cache events
+const (
+	EventInsert = "insert"
+	EventTouch  = "touch"
+	EventSkip   = "skip"
+	EventEvict  = "evict"
+	EventRemove = "remove"
+)
+
+// CacheEvent is an event in the history of a cached image
+type CacheEvent struct {
+	Time   time.Time
+	Type   string
+	Reason string `json:",omitempty"`
+}
+
+// eventRing keeps the most recent events of an image
+type eventRing struct {
+	events []CacheEvent
+	next   int
+}
+
+func (r *eventRing) add(ev CacheEvent) {
+	if len(r.events) < maxHistoryEvents {
+		r.events = append(r.events, ev)
+		return
+	}
+	r.events[r.next] = ev
+	r.next = (r.next + 1) % maxHistoryEvents
+}
+
+func (r *eventRing) list() []CacheEvent {
+	events := make([]CacheEvent, 0, len(r.events))
+	events = append(events, r.events[r.next:]...)
+	return append(events, r.events[:r.next]...)
+}
+
+// historyLog records the events of the cached images, keeping the history
+// of up to maxHistoryImages images. It is protected by the cache lock.
+type historyLog struct {
+	rings map[image.ID]*eventRing
+	order []image.ID
+}
+
+func newHistoryLog() *historyLog {
+	return &historyLog{rings: make(map[image.ID]*eventRing)}
+}
+
+func (h *historyLog) record(imgID image.ID, typ, reason string) {
+	r, ok := h.rings[imgID]
+	if !ok {
+		if len(h.order) >= maxHistoryImages {
+			delete(h.rings, h.order[0])
+			h.order = h.order[1:]
+		}
+		r = &eventRing{}
+		h.rings[imgID] = r
+		h.order = append(h.order, imgID)
+	}
+	r.add(CacheEvent{Time: timeNow(), Type: typ, Reason: reason})
+}
+
+func (h *historyLog) get(imgID image.ID) []CacheEvent {
+	r, ok := h.rings[imgID]
+	if !ok {
+		return nil
+	}
+	return r.list()
+}
+
+// recordEvent records an event of imgID if the history is enabled. The
+// caller must hold the write lock.
+func (c *cacheBase) recordEvent(imgID image.ID, typ, reason string) {
+	if c.history != nil {
+		c.history.record(imgID, typ, reason)
+	}
+}
+
+// History returns the recorded events of an image, oldest first
+func (c *cacheBase) History(imgID image.ID) []CacheEvent {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	if c.history == nil {
+		return nil
+	}
+	return c.history.get(imgID)
+}
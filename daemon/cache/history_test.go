@@ -0,0 +1,50 @@
+package cache
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/docker/docker/image"
+	"gotest.tools/assert"
+	is "gotest.tools/assert/cmp"
+)
+
+func TestHistory(t *testing.T) {
+	c := newCacheBase(100, nil)
+	imgID := image.ID("sha256:a")
+
+	// disabled by default
+	c.recordEvent(imgID, EventInsert, "")
+	assert.Check(t, is.Len(c.History(imgID), 0))
+
+	c.history = newHistoryLog()
+	c.recordEvent(imgID, EventInsert, "")
+	c.recordEvent(imgID, EventTouch, "used")
+	c.recordEvent(imgID, EventEvict, "level 120 above target 100")
+
+	events := c.History(imgID)
+	assert.Assert(t, is.Len(events, 3))
+	assert.Check(t, is.Equal(EventInsert, events[0].Type))
+	assert.Check(t, is.Equal(EventTouch, events[1].Type))
+	assert.Check(t, is.Equal(EventEvict, events[2].Type))
+	assert.Check(t, is.Equal("level 120 above target 100", events[2].Reason))
+	assert.Check(t, !events[2].Time.Before(events[0].Time))
+}
+
+func TestHistoryBounded(t *testing.T) {
+	h := newHistoryLog()
+	imgID := image.ID("sha256:a")
+	for i := 0; i < maxHistoryEvents+5; i++ {
+		h.record(imgID, EventTouch, fmt.Sprint(i))
+	}
+	events := h.get(imgID)
+	assert.Assert(t, is.Len(events, maxHistoryEvents))
+	assert.Check(t, is.Equal("5", events[0].Reason))
+	assert.Check(t, is.Equal(fmt.Sprint(maxHistoryEvents+4), events[maxHistoryEvents-1].Reason))
+
+	for i := 0; i < maxHistoryImages; i++ {
+		h.record(image.ID(fmt.Sprintf("sha256:%d", i)), EventInsert, "")
+	}
+	assert.Check(t, is.Len(h.get(imgID), 0))
+	assert.Check(t, is.Len(h.rings, maxHistoryImages))
+}
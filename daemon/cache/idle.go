@@ -0,0 +1,89 @@
+package cache
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// maxIdleCheckInterval is how often at most the idle flusher checks whether
+// the cache went idle
+const maxIdleCheckInterval = time.Minute
+
+// activityClock records when the cache was last used, by a pull or by the
+// creation of a container, as shared by the partitions of the cache
+type activityClock struct {
+	last int64 // unix nanoseconds
+}
+
+func newActivityClock() *activityClock {
+	a := &activityClock{}
+	a.touch()
+	return a
+}
+
+func (a *activityClock) touch() {
+	atomic.StoreInt64(&a.last, timeNow().UnixNano())
+}
+
+func (a *activityClock) lastActive() time.Time {
+	return time.Unix(0, atomic.LoadInt64(&a.last))
+}
+
+// touchActivity records a use of the cache for the idle flusher
+func (c *cacheBase) touchActivity() {
+	if c.activity != nil {
+		c.activity.touch()
+	}
+}
+
+// idleFlusher reclaims the cache down to a floor once it has not been used
+// for a while, so that an idle machine gets its disk space back. The cache
+// fills up again to its capacity once used, and is flushed at most once
+// per idle period.
+type idleFlusher struct {
+	activity *activityClock
+	timeout  time.Duration
+	floor    int64
+	level    func() int64
+	reclaim  func(size int64) int64
+
+	flushed time.Time // last activity when the cache was last flushed
+}
+
+// check flushes the cache if it has been idle for the timeout, and reports
+// whether it did
+func (f *idleFlusher) check() bool {
+	last := f.activity.lastActive()
+	if timeNow().Sub(last) < f.timeout || !last.After(f.flushed) {
+		return false
+	}
+	f.flushed = last
+	level := f.level()
+	if level <= f.floor {
+		return false
+	}
+	// the level read above may have changed by the time reclaim takes the
+	// lock, which logs the level it leaves
+	freed := f.reclaim(level - f.floor)
+	logrus.Infof("Cache idle since %s, reclaimed %d bytes", last.Format(time.RFC3339), freed)
+	return true
+}
+
+func (f *idleFlusher) run(stop <-chan struct{}) {
+	interval := f.timeout
+	if interval > maxIdleCheckInterval {
+		interval = maxIdleCheckInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			f.check()
+		}
+	}
+}
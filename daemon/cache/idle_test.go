@@ -0,0 +1,68 @@
+package cache
+
+import (
+	"testing"
+	"time"
+
+	"github.com/docker/docker/image"
+	"github.com/docker/docker/layer"
+	"gotest.tools/assert"
+	is "gotest.tools/assert/cmp"
+)
+
+func TestIdleFlusher(t *testing.T) {
+	start := time.Now()
+	now := start
+	timeNow = func() time.Time { return now }
+	defer func() { timeNow = time.Now }()
+
+	b, cleanup := newFakeBackendForTest(t)
+	defer cleanup()
+	base := newCacheBase(100, b)
+	base.activity = newActivityClock()
+	c := newImageLRUCache(base)
+	f := &idleFlusher{
+		activity: base.activity,
+		timeout:  time.Hour,
+		floor:    40,
+		level:    c.Level,
+		reclaim:  c.Reclaim,
+	}
+
+	var imgs []*image.Image
+	for _, name := range []string{"a", "b", "c", "d"} {
+		img := b.addImage(t, start, []layer.DiffID{b.layer(name, 20)})
+		imgs = append(imgs, img)
+		c.PutImage(img)
+	}
+	assert.Check(t, is.Equal(int64(80), c.Level()))
+
+	// the cache is left alone while in use
+	now = now.Add(30 * time.Minute)
+	assert.Check(t, !f.check())
+	c.UpdateImage(imgs[0].ID().String())
+	now = now.Add(45 * time.Minute)
+	assert.Check(t, !f.check())
+	assert.Check(t, is.Equal(int64(80), c.Level()))
+
+	// idle for the timeout, it shrinks down to the floor, once
+	now = now.Add(15 * time.Minute)
+	assert.Check(t, f.check())
+	assert.Check(t, is.Equal(int64(40), c.Level()))
+	assert.Check(t, is.DeepEqual([]image.ID{imgs[1].ID(), imgs[2].ID()}, b.deleted))
+	now = now.Add(2 * time.Hour)
+	assert.Check(t, !f.check())
+
+	// and refills once used again
+	for _, img := range imgs[1:3] {
+		b.mu.Lock()
+		b.registerImage(img)
+		b.mu.Unlock()
+		c.PutImage(img)
+	}
+	assert.Check(t, is.Equal(int64(80), c.Level()))
+	assert.Check(t, !f.check())
+	now = now.Add(time.Hour)
+	assert.Check(t, f.check())
+	assert.Check(t, is.Equal(int64(40), c.Level()))
+}
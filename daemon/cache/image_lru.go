@@ -2,48 +2,83 @@ package cache
 
 import (
 	"container/list"
+	"fmt"
+	"math"
 	"strings"
-	"sync"
+	"time"
 
-	"github.com/docker/docker/daemon/images"
 	"github.com/docker/docker/image"
 	"github.com/sirupsen/logrus"
 )
 
 type imageLRUCache struct {
 	*cacheBase
-	images    map[image.ID]*list.Element
-	evictList *list.List
+	images    map[image.ID]*cacheImage
+	evictList evictList
+
+	// ticks counts the accesses to the cache, as the clock of the access
+	// rates of its entries
+	ticks int64
 }
 
-func newImageLRUCache(capacity int64, is *images.ImageService) ImageCache {
-	return &imageLRUCache{
-		cacheBase: &cacheBase{
-			imageService: is,
-			capacity:     capacity,
-			mu:           &sync.RWMutex{},
-		},
-		images:    make(map[image.ID]*list.Element),
-		evictList: list.New(),
+type cacheImage struct {
+	img      *image.Image
+	size     int64
+	added    time.Time
+	accessed time.Time
+
+	// rate is the exponentially weighted access rate of the image, as of
+	// its last access at tick
+	rate float64
+	tick int64
+
+	// scanned is the time of the last vulnerability scan of the image, if
+	// the cache reads it from a label
+	scanned time.Time
+
+	// the links of the image in the evict list, which is either the element
+	// of a linked list or the neighbours in an intrusive list
+	elem       *list.Element
+	prev, next *cacheImage
+}
+
+func newImageLRUCache(base *cacheBase) ImageCache {
+	c := &imageLRUCache{
+		cacheBase: base,
+		images:    make(map[image.ID]*cacheImage),
+		evictList: newLinkedList(),
 	}
+	base.takeSnapshot = c.snapshot
+	base.imageOrder = c.imageOrder
+	return c
 }
 
 // PutImage implements the ImageCache interface
 func (c *imageLRUCache) PutImage(img *image.Image) {
 	c.mu.Lock()
-	defer c.mu.Unlock()
+	defer c.unlock()
+
+	c.putImage(img)
+}
 
+func (c *imageLRUCache) putImage(img *image.Image) {
 	if img == nil {
 		return
 	}
+	c.evictions.put()
 
 	if err := c.checkImageSize(img); err != nil {
 		logrus.Errorf("error putting image in cache: %v", err)
 		return
 	}
 
-	if e, ok := c.images[img.ID()]; ok {
-		c.evictList.MoveToFront(e)
+	if ci, ok := c.images[img.ID()]; ok {
+		c.touch(ci)
+		c.touched()
+		c.recordEvent(img.ID(), EventTouch, "put again")
+		return
+	}
+	if !c.admit(img) {
 		return
 	}
 
@@ -51,17 +86,28 @@ func (c *imageLRUCache) PutImage(img *image.Image) {
 	if err != nil {
 		return
 	}
+	if err := c.checkAddition(newSize); err != nil {
+		logrus.Errorf("error putting image in cache: %v", err)
+		return
+	}
 
-	c.images[img.ID()] = c.evictList.PushFront(img)
-	c.level += newSize
-	logrus.Infof("Put image %s, %d/%d (%.3f)", img.ID(), c.level, c.capacity, c.percent())
+	now := timeNow()
+	c.ticks++
+	ci := &cacheImage{img: img, size: newSize, added: now, accessed: now, rate: 1, tick: c.ticks, scanned: c.scannedAt(img)}
+	c.images[img.ID()] = ci
+	c.evictList.pushFront(ci)
+	c.compact()
+	c.addLevel(newSize)
+	c.inserted(img.ID())
+	c.recordEvent(img.ID(), EventInsert, "")
+	logrus.Infof("Put image %s, %s", img.ID(), c.usage())
 	c.evict()
 }
 
 // UpdateImage implements the ImageCache interface
 func (c *imageLRUCache) UpdateImage(refOrID string) {
 	c.mu.Lock()
-	defer c.mu.Unlock()
+	defer c.unlock()
 
 	img, err := c.imageService.GetImage(refOrID)
 	if err != nil {
@@ -69,68 +115,436 @@ func (c *imageLRUCache) UpdateImage(refOrID string) {
 		return
 	}
 
-	if e, ok := c.images[img.ID()]; ok {
-		c.evictList.MoveToFront(e)
-		logrus.Infof("Updated image %s, %d/%d (%.3f)", img.ID(), c.level, c.capacity, c.percent())
+	ci, ok := c.images[img.ID()]
+	c.evictions.used(ok)
+	if ok {
+		c.touch(ci)
+		c.markUsed(img.ID())
+		c.touched()
+		c.recordEvent(img.ID(), EventTouch, "used")
+		logrus.Infof("Updated image %s, %s", img.ID(), c.usage())
 		return
 	}
 	logrus.Infof("Image %s is not in cache", img.ID())
 }
 
+// Promote implements the ImageCache interface
+func (c *imageLRUCache) Promote(imgID image.ID) error {
+	c.mu.Lock()
+	defer c.unlock()
+
+	imgID = c.cachedID(imgID)
+	ci, ok := c.images[imgID]
+	if !ok {
+		return errNotCached(imgID)
+	}
+	c.touch(ci)
+	c.touched()
+	c.recordEvent(imgID, EventTouch, "promoted")
+	logrus.Infof("Promoted image %s", imgID)
+	return nil
+}
+
+// touch records an access to ci, moving it to the front of the cache and
+// bumping its access rate
+func (c *imageLRUCache) touch(ci *cacheImage) {
+	c.ticks++
+	ci.rate = 1 + ci.rate*c.decay(c.ticks-ci.tick)
+	ci.tick = c.ticks
+	ci.accessed = timeNow()
+	c.evictList.moveToFront(ci)
+}
+
+// compact switches the evict list to the intrusive one once the cache holds
+// more than compactListThreshold images, so as not to allocate an element
+// per image in the large caches
+func (c *imageLRUCache) compact() {
+	if _, ok := c.evictList.(*linkedList); ok && c.evictList.len() > compactListThreshold {
+		c.evictList = compactList(c.evictList)
+		logrus.Debugf("Compacted the evict list of %d images", c.evictList.len())
+	}
+}
+
+// decay returns the factor applied to an access rate after the given number
+// of ticks. As in LRFU, a weight of 1 halves the rate on every tick, so that
+// the most recent access always outweighs all the former ones and the order
+// is the LRU one, while a weight of 0 never decays, so that the rate is the
+// number of accesses and the order is the LFU one.
+func (c *imageLRUCache) decay(ticks int64) float64 {
+	return math.Pow(0.5, c.recencyWeight*float64(ticks))
+}
+
+// score returns the current access rate of ci, the lower the sooner it is
+// evicted
+func (c *imageLRUCache) score(ci *cacheImage) float64 {
+	return ci.rate * c.decay(c.ticks-ci.tick)
+}
+
+// contains reports whether the image is cached
+func (c *imageLRUCache) contains(imgID image.ID) bool {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	_, ok := c.images[imgID]
+	return ok
+}
+
 // RemoveImage implements the ImageCache interface
 func (c *imageLRUCache) RemoveImage(imgID image.ID) {
 	c.mu.Lock()
-	defer c.mu.Unlock()
+	defer c.unlock()
 
-	if e, ok := c.images[imgID]; ok {
-		img := e.Value.(*image.Image)
-		size, err := c.getImageSize(img)
-		if err != nil {
-			return
-		}
+	c.removeImage(c.forgetSquashed(imgID))
+}
+
+func (c *imageLRUCache) removeImage(imgID image.ID) {
+	if ci, ok := c.images[imgID]; ok {
 		delete(c.images, imgID)
-		c.evictList.Remove(e)
-		c.level -= size
-		logrus.Infof("Removed image %s, %d/%d (%.3f)", imgID, c.level, c.capacity, c.percent())
+		c.evictList.remove(ci)
+		c.addLevel(-ci.size)
+		c.forget(imgID)
+		c.recordEvent(imgID, EventRemove, "")
+		logrus.Infof("Removed image %s, %s", imgID, c.usage())
 		return
 	}
 	logrus.Warnf("Image %s is not in cache", imgID)
 }
 
+// Rebuild implements the ImageCache interface
+func (c *imageLRUCache) Rebuild() error {
+	c.mu.Lock()
+	defer c.unlock()
+
+	c.images = make(map[image.ID]*cacheImage)
+	c.evictList = newLinkedList()
+	c.ticks = 0
+	c.rebuild(c.putImage)
+	return nil
+}
+
+// CheckConsistency implements the ImageCache interface
+func (c *imageLRUCache) CheckConsistency() Drift {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	return c.drift(c.entryLevel(), c.cachedImages())
+}
+
+// Resync implements the ImageCache interface
+func (c *imageLRUCache) Resync() Drift {
+	c.mu.Lock()
+	defer c.unlock()
+
+	return c.resync(c.drift(c.entryLevel(), c.cachedImages()), c.removeImage, c.entryLevel)
+}
+
+func (c *imageLRUCache) entryLevel() int64 {
+	var level int64
+	for ci := c.evictList.front(); ci != nil; ci = c.evictList.next(ci) {
+		level += ci.size
+	}
+	return level
+}
+
+func (c *imageLRUCache) cachedImages() []image.ID {
+	ids := make([]image.ID, 0, len(c.images))
+	for id := range c.images {
+		ids = append(ids, id)
+	}
+	return ids
+}
+
+// Oldest implements the ImageCache interface
+func (c *imageLRUCache) Oldest() (image.ID, time.Time) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	return c.entryAt(c.evictList.back())
+}
+
+// ForEach implements the ImageCache interface, from the least recently used
+// image. At a recency weight below 1, the eviction order also depends on the
+// access rates.
+func (c *imageLRUCache) ForEach(fn func(CacheEntry) bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	c.forEach(fn)
+}
+
+// forEach is ForEach for callers holding the lock
+func (c *imageLRUCache) forEach(fn func(CacheEntry) bool) {
+	for ci := c.evictList.back(); ci != nil; ci = c.evictList.prev(ci) {
+		if !fn(CacheEntry{Images: []image.ID{ci.img.ID()}, Size: ci.size, Added: ci.added, Accessed: ci.accessed, Registry: c.registryOf(ci.img.ID())}) {
+			return
+		}
+	}
+}
+
+// List implements the ImageCache interface, in the order of ForEach
+func (c *imageLRUCache) List() []CacheEntry {
+	if s := c.servedSnapshot(); s != nil {
+		return s.list()
+	}
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	return listEntries(c.forEach)
+}
+
+// Newest implements the ImageCache interface
+func (c *imageLRUCache) Newest() (image.ID, time.Time) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	return c.entryAt(c.evictList.front())
+}
+
+func (c *imageLRUCache) entryAt(ci *cacheImage) (image.ID, time.Time) {
+	if ci == nil {
+		return "", time.Time{}
+	}
+	return ci.img.ID(), ci.accessed
+}
+
+// Reserve implements the ImageCache interface
+func (c *imageLRUCache) Reserve(ref string, size int64) func() {
+	return c.reserve(size, c.evict)
+}
+
+// Reclaim implements the ImageCache interface
+func (c *imageLRUCache) Reclaim(size int64) int64 {
+	c.mu.Lock()
+	defer c.unlock()
+
+	return c.reclaim(size, c.evictTo)
+}
+
 func (c *imageLRUCache) evict() {
-	if c.evictList.Len() == 0 {
+	c.runEviction(c.evictTo)
+}
+
+func (c *imageLRUCache) evictTo(target int64) {
+	if c.evictList.len() == 0 {
 		logrus.Debug("Empty cache, nothing to evict")
 		return
 	}
 
-	for c.capacity < c.level {
-		e := c.evictList.Back()
-		img := e.Value.(*image.Image)
-		size, err := c.getImageSize(img)
-		if err != nil {
+	imgs := make([]*image.Image, 0, c.evictList.len())
+	for ci := c.evictList.front(); ci != nil; ci = c.evictList.next(ci) {
+		imgs = append(imgs, ci.img)
+	}
+	plan := c.planEviction(imgs)
+
+	for target < c.level && c.evictList.len() > 0 {
+		ci := c.nextVictim(plan)
+		if ci == nil {
+			logrus.Warnf("No evictable image left, %s", c.usage())
+			return
+		}
+		img, size := ci.img, ci.size
+		// images without layers free nothing and are never evicted, as in
+		// the layer-based caches
+		if size == 0 {
+			plan.protected[img.ID()] = true
 			continue
 		}
 
 		logrus.Infof("Evicting image %s ...", img.ID())
 
-		if _, err := c.imageService.ImageDelete(img.ImageID(), true, false); err != nil {
-			if strings.Contains(strings.ToLower(err.Error()), "conflict") {
-				logrus.Debugf("Image deletion conflict detected, skip")
-				continue
-			}
-			if strings.Contains(strings.ToLower(err.Error()), "no such image") {
-				logrus.Warnf("Image %s no longer exists", img.ID())
-				continue
+		tags := c.auditTags(img.ID())
+		demoted := c.demote != nil && c.demote(img, c.registryOf(img.ID()))
+		if !demoted {
+			err := c.deleteImage(img, plan, map[image.ID]bool{img.ID(): true})
+			if err != nil {
+				if strings.Contains(strings.ToLower(err.Error()), "conflict") {
+					logrus.Debugf("Image deletion conflict detected, skip")
+					c.recordEvent(img.ID(), EventSkip, err.Error())
+					plan.protected[img.ID()] = true
+					continue
+				}
+				if strings.Contains(strings.ToLower(err.Error()), "no such image") {
+					// the image was deleted behind the back of the cache, drop
+					// its entry so that the eviction makes progress
+					logrus.Warnf("Image %s no longer exists", img.ID())
+					c.removeImage(img.ID())
+					continue
+				}
+				logrus.Errorf("error deleting image: %v", err)
+				return
 			}
-			logrus.Errorf("error deleting image: %v", err)
-			return
 		}
 
 		delete(c.images, img.ID())
-		c.evictList.Remove(e)
-		c.level -= size
+		c.evictList.remove(ci)
+		c.addLevel(-size)
+		observeEviction(ci.added)
+		c.evictions.freed(size)
+		reason := fmt.Sprintf("level %d above target %d", c.level+size, target)
+		if demoted {
+			reason += ", demoted to the spill tier"
+		}
+		c.forget(img.ID())
+		c.recordEviction(img.ID(), tags, size, reason)
+
+		logrus.Infof("Evicted image %s, %s", img.ID(), c.usage())
+
+	}
+}
+
+// maxDependentDepth bounds the generations of dependent images evicted
+// ahead of a victim
+const maxDependentDepth = 8
+
+// isDependentConflict reports whether err is the conflict of deleting an
+// image with dependent child images
+func isDependentConflict(err error) bool {
+	return strings.Contains(strings.ToLower(err.Error()), "dependent child")
+}
+
+// deleteImage deletes img. If child images depend on img, the cached ones
+// are evicted first and the deletion retried, down to maxDependentDepth
+// generations; seen holds the images being deleted, which are skipped so
+// as not to loop. The caller must hold the lock.
+func (c *imageLRUCache) deleteImage(img *image.Image, plan *evictionPlan, seen map[image.ID]bool) error {
+	_, err := c.imageService.ImageDelete(img.ImageID(), true, false)
+	if err == nil || !isDependentConflict(err) || len(seen) > maxDependentDepth {
+		return err
+	}
+	if !c.evictDependents(img.ID(), plan, seen) {
+		return err
+	}
+	_, err = c.imageService.ImageDelete(img.ImageID(), true, false)
+	return err
+}
+
+// evictDependents evicts the cached images depending on parent, and
+// reports whether it evicted them all. The caller must hold the lock.
+func (c *imageLRUCache) evictDependents(parent image.ID, plan *evictionPlan, seen map[image.ID]bool) bool {
+	var children []*cacheImage
+	for ci := c.evictList.back(); ci != nil; ci = c.evictList.prev(ci) {
+		if ci.img.Parent == parent {
+			children = append(children, ci)
+		}
+	}
+	if len(children) == 0 {
+		return false
+	}
+
+	for _, ci := range children {
+		id := ci.img.ID()
+		if plan.protected[id] || seen[id] {
+			return false
+		}
+
+		logrus.Infof("Evicting image %s, which depends on %s ...", id, parent)
+		tags := c.auditTags(id)
+		seen[id] = true
+		err := c.deleteImage(ci.img, plan, seen)
+		delete(seen, id)
+		if err != nil {
+			logrus.Debugf("error deleting dependent image %s: %v", id, err)
+			c.recordEvent(id, EventSkip, err.Error())
+			plan.protected[id] = true
+			return false
+		}
+
+		delete(c.images, id)
+		c.evictList.remove(ci)
+		c.addLevel(-ci.size)
+		observeEviction(ci.added)
+		c.evictions.freed(ci.size)
+		c.forget(id)
+		c.recordEviction(id, tags, ci.size, fmt.Sprintf("depends on %s being evicted", parent))
+	}
+	return true
+}
+
+// nextVictim returns the image with the lowest access rate that is not
+// protected, favoring the images preferred by the plan. Ties go to the image
+// with the stalest vulnerability scan, then to the least recently used
+// image, so that the order is the LRU one at full recency weight.
+func (c *imageLRUCache) nextVictim(plan *evictionPlan) *cacheImage {
+	var (
+		victim, preferred           *cacheImage
+		victimScore, preferredScore float64
+	)
+	// at full recency weight, with no image preferred and no scan to break
+	// the ties, the victim is the first image from the tail of the list
+	lru := c.recencyWeight >= 1 && len(plan.preferred) == 0 && c.scanLabel == ""
+	for ci := c.evictList.back(); ci != nil; ci = c.evictList.prev(ci) {
+		id := ci.img.ID()
+		if plan.protected[id] {
+			continue
+		}
+		if lru {
+			return ci
+		}
+		if c.recencyWeight >= 1 {
+			// the images are listed by access time, past the ties of the
+			// preferred image none is evicted before it
+			if preferred != nil && !ci.accessed.Equal(preferred.accessed) {
+				return preferred
+			}
+			if plan.preferred[id] && (preferred == nil || c.staler(ci, preferred)) {
+				preferred = ci
+			}
+			if victim == nil || ci.accessed.Equal(victim.accessed) && c.staler(ci, victim) {
+				victim = ci
+			}
+			continue
+		}
+		score := c.score(ci)
+		if plan.preferred[id] && (preferred == nil || score < preferredScore || score == preferredScore && c.staler(ci, preferred)) {
+			preferred, preferredScore = ci, score
+		}
+		if victim == nil || score < victimScore || score == victimScore && c.staler(ci, victim) {
+			victim, victimScore = ci, score
+		}
+	}
+	if preferred != nil {
+		return preferred
+	}
+	return victim
+}
+
+// Stats implements the ImageCache interface
+func (c *imageLRUCache) Stats() Stats {
+	if s := c.servedSnapshot(); s != nil {
+		return s.inProgressStats()
+	}
+	c.mu.RLock()
+	defer c.mu.RUnlock()
 
-		logrus.Infof("Evicted image %s, %d/%d (%.3f)", img.ID(), c.level, c.capacity, c.percent())
+	return c.fullStats()
+}
+
+// fullStats is Stats for callers holding the lock
+func (c *imageLRUCache) fullStats() Stats {
+	stats := c.stats()
+	stats.Registries = registryBytes(listEntries(c.forEach))
+	return stats
+}
+
+// ReclaimableBreakdown implements the ImageCache interface
+func (c *imageLRUCache) ReclaimableBreakdown() Reclaimable {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	return c.reclaimable()
+}
+
+func (c *imageLRUCache) reclaimable() Reclaimable {
+	imgs := make([]*image.Image, 0, c.evictList.len())
+	for ci := c.evictList.front(); ci != nil; ci = c.evictList.next(ci) {
+		imgs = append(imgs, ci.img)
+	}
+	ec := c.newEntryClassifier(imgs)
 
+	var r Reclaimable
+	for ci := c.evictList.front(); ci != nil; ci = c.evictList.next(ci) {
+		pinned, inUse := ec.classify(ci.img.ID())
+		r.addEntry(ci.size, pinned, inUse)
 	}
+	return r
 }
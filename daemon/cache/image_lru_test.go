@@ -0,0 +1,116 @@
+package cache
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/docker/docker/errdefs"
+	"github.com/docker/docker/image"
+	"gotest.tools/assert"
+	is "gotest.tools/assert/cmp"
+)
+
+func TestImageLRUOldestNewest(t *testing.T) {
+	dir, err := ioutil.TempDir("", "image-lru")
+	assert.NilError(t, err)
+	defer os.RemoveAll(dir)
+	store := newTestImageStore(t, dir)
+
+	c := newImageLRUCache(newCacheBase(100, nil)).(*imageLRUCache)
+
+	id, ts := c.Oldest()
+	assert.Check(t, is.Equal(image.ID(""), id))
+	assert.Check(t, ts.IsZero())
+
+	start := time.Now()
+	put := func(img *image.Image, at time.Time) {
+		ci := &cacheImage{img: img, added: at, accessed: at}
+		c.images[img.ID()] = ci
+		c.evictList.pushFront(ci)
+	}
+	touch := func(img *image.Image, at time.Time) {
+		ci := c.images[img.ID()]
+		ci.accessed = at
+		c.evictList.moveToFront(ci)
+	}
+
+	a := store.newImage(t, start)
+	b := store.newImage(t, start)
+	d := store.newImage(t, start)
+	put(a, start)
+	put(b, start.Add(time.Second))
+	put(d, start.Add(2*time.Second))
+	touch(a, start.Add(3*time.Second))
+
+	id, ts = c.Oldest()
+	assert.Check(t, is.Equal(b.ID(), id))
+	assert.Check(t, ts.Equal(start.Add(time.Second)))
+
+	id, ts = c.Newest()
+	assert.Check(t, is.Equal(a.ID(), id))
+	assert.Check(t, ts.Equal(start.Add(3*time.Second)))
+}
+
+func TestNaiveOldestNewest(t *testing.T) {
+	c := newNaiveCache(newCacheBase(100, nil)).(*naiveCache)
+	start := time.Now()
+	c.images["sha256:b"] = &naiveImage{size: 1, added: start, seq: 1}
+	c.images["sha256:a"] = &naiveImage{size: 1, added: start, seq: 2}
+	c.images["sha256:c"] = &naiveImage{size: 1, added: start.Add(time.Second), seq: 3}
+
+	// images put at the same instant are ordered as they were put
+	id, ts := c.Oldest()
+	assert.Check(t, is.Equal(image.ID("sha256:b"), id))
+	assert.Check(t, ts.Equal(start))
+
+	id, ts = c.Newest()
+	assert.Check(t, is.Equal(image.ID("sha256:c"), id))
+	assert.Check(t, ts.Equal(start.Add(time.Second)))
+}
+
+func TestNaiveRemoveImageIdempotent(t *testing.T) {
+	c := newNaiveCache(newCacheBase(100, nil)).(*naiveCache)
+	c.images["sha256:a"] = &naiveImage{size: 30}
+	c.images["sha256:b"] = &naiveImage{size: 20}
+	c.level = 50
+
+	for _, id := range []image.ID{"sha256:a", "sha256:a", "sha256:c", "sha256:a"} {
+		c.RemoveImage(id)
+	}
+	assert.Check(t, is.Equal(int64(20), c.Level()))
+	assert.Check(t, is.Len(c.images, 1))
+}
+
+func TestImageLRUPromote(t *testing.T) {
+	c := newImageLRUCache(newCacheBase(100, nil)).(*imageLRUCache)
+	start := time.Now()
+	defer func() { timeNow = time.Now }()
+	timeNow = func() time.Time { return start.Add(time.Minute) }
+
+	for _, id := range []image.ID{"sha256:a", "sha256:b", "sha256:c"} {
+		img := &image.Image{}
+		ci := &cacheImage{img: img, accessed: start}
+		c.images[id] = ci
+		c.evictList.pushFront(ci)
+	}
+
+	assert.NilError(t, c.Promote("sha256:a"))
+	ci := c.evictList.front()
+	assert.Check(t, is.Equal(c.images["sha256:a"], ci))
+	assert.Check(t, ci.accessed.Equal(start.Add(time.Minute)))
+
+	err := c.Promote("sha256:missing")
+	assert.Check(t, errdefs.IsNotFound(err))
+}
+
+func TestNaivePromote(t *testing.T) {
+	c := newNaiveCache(newCacheBase(100, nil)).(*naiveCache)
+	c.images["sha256:a"] = &naiveImage{size: 1}
+	c.squashed["sha256:orig"] = "sha256:a"
+
+	assert.NilError(t, c.Promote("sha256:a"))
+	assert.NilError(t, c.Promote("sha256:orig"))
+	assert.Check(t, errdefs.IsNotFound(c.Promote("sha256:missing")))
+}
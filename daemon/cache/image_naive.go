@@ -1,36 +1,53 @@
 package cache
 
 import (
-	"sync"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
 
-	"github.com/docker/docker/daemon/images"
 	"github.com/docker/docker/image"
 	"github.com/sirupsen/logrus"
 )
 
+// naiveCache evicts images in the order they were put, regardless of their
+// use
 type naiveCache struct {
 	*cacheBase
-	images map[string]int64
+	images map[string]*naiveImage
+
+	// seq numbers the images in the order they are put, as timestamps may
+	// collide at coarse clock resolution
+	seq int64
+}
+
+type naiveImage struct {
+	size  int64
+	added time.Time
+	seq   int64
 }
 
-func newNaiveCache(capacity int64, is *images.ImageService) ImageCache {
-	return &naiveCache{
-		cacheBase: &cacheBase{
-			imageService: is,
-			capacity:     capacity,
-			mu:           &sync.RWMutex{},
-		},
-		images: make(map[string]int64),
+func newNaiveCache(base *cacheBase) ImageCache {
+	c := &naiveCache{
+		cacheBase: base,
+		images:    make(map[string]*naiveImage),
 	}
+	base.takeSnapshot = c.snapshot
+	return c
 }
 
 func (c *naiveCache) PutImage(img *image.Image) {
 	c.mu.Lock()
-	defer c.mu.Unlock()
+	defer c.unlock()
 
+	c.putImage(img)
+}
+
+func (c *naiveCache) putImage(img *image.Image) {
 	if img == nil {
 		return
 	}
+	c.evictions.put()
 
 	if err := c.checkImageSize(img); err != nil {
 		logrus.Errorf("error putting image in cache: %v", err)
@@ -40,45 +57,308 @@ func (c *naiveCache) PutImage(img *image.Image) {
 	if _, ok := c.images[img.ImageID()]; ok {
 		return
 	}
+	if !c.admit(img) {
+		return
+	}
 
 	size, err := c.getImageSize(img)
 	if err != nil {
 		return
 	}
+	if err := c.checkAddition(size); err != nil {
+		logrus.Errorf("error putting image in cache: %v", err)
+		return
+	}
 
-	c.images[img.ImageID()] = size
-	c.level += size
-	logrus.Infof("Put image %s, %d/%d (%.3f)", img.ID(), c.level, c.capacity, c.percent())
+	c.seq++
+	c.images[img.ImageID()] = &naiveImage{size: size, added: timeNow(), seq: c.seq}
+	c.addLevel(size)
+	c.inserted(img.ID())
+	c.recordEvent(img.ID(), EventInsert, "")
+	logrus.Infof("Put image %s, %s", img.ID(), c.usage())
 	c.evict(img.ImageID())
 }
 
-func (c *naiveCache) UpdateImage(refOrID string) {}
+// UpdateImage implements the ImageCache interface. The naive cache has no
+// notion of use, besides images no longer being warm.
+func (c *naiveCache) UpdateImage(refOrID string) {
+	c.mu.Lock()
+	defer c.unlock()
+
+	img, err := c.imageService.GetImage(refOrID)
+	if err != nil {
+		logrus.Warnf("error getting image: %v", err)
+		return
+	}
+	_, ok := c.images[img.ImageID()]
+	c.evictions.used(ok)
+	c.markUsed(img.ID())
+}
 
 func (c *naiveCache) RemoveImage(imgID image.ID) {
 	c.mu.Lock()
-	defer c.mu.Unlock()
+	defer c.unlock()
+
+	c.removeImage(c.forgetSquashed(imgID))
+}
 
-	size, ok := c.images[imgID.String()]
+func (c *naiveCache) removeImage(imgID image.ID) {
+	ni, ok := c.images[imgID.String()]
 	if !ok {
 		return
 	}
 	delete(c.images, imgID.String())
-	c.level -= size
-	logrus.Infof("Removed image %s, %d/%d (%.3f)", imgID, c.level, c.capacity, c.percent())
+	c.addLevel(-ni.size)
+	c.forget(imgID)
+	c.recordEvent(imgID, EventRemove, "")
+	logrus.Infof("Removed image %s, %s", imgID, c.usage())
+}
+
+// Rebuild implements the ImageCache interface
+func (c *naiveCache) Rebuild() error {
+	c.mu.Lock()
+	defer c.unlock()
+
+	c.images = make(map[string]*naiveImage)
+	c.seq = 0
+	c.rebuild(c.putImage)
+	return nil
+}
+
+// CheckConsistency implements the ImageCache interface
+func (c *naiveCache) CheckConsistency() Drift {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	return c.drift(c.entryLevel(), c.cachedImages())
+}
+
+// Resync implements the ImageCache interface
+func (c *naiveCache) Resync() Drift {
+	c.mu.Lock()
+	defer c.unlock()
+
+	return c.resync(c.drift(c.entryLevel(), c.cachedImages()), c.removeImage, c.entryLevel)
+}
+
+func (c *naiveCache) entryLevel() int64 {
+	var level int64
+	for _, ni := range c.images {
+		level += ni.size
+	}
+	return level
+}
+
+func (c *naiveCache) cachedImages() []image.ID {
+	ids := make([]image.ID, 0, len(c.images))
+	for id := range c.images {
+		ids = append(ids, image.ID(id))
+	}
+	return ids
+}
+
+// Promote implements the ImageCache interface. The eviction order of the
+// naive cache ignores use, so promoting an image only checks that it is
+// cached.
+func (c *naiveCache) Promote(imgID image.ID) error {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	imgID = c.cachedID(imgID)
+	if _, ok := c.images[imgID.String()]; !ok {
+		return errNotCached(imgID)
+	}
+	return nil
+}
+
+// Oldest implements the ImageCache interface
+func (c *naiveCache) Oldest() (image.ID, time.Time) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	ids := c.evictionOrder(nil)
+	if len(ids) == 0 {
+		return "", time.Time{}
+	}
+	oldest := ids[0]
+	return image.ID(oldest), c.images[oldest].added
+}
+
+// Newest implements the ImageCache interface
+func (c *naiveCache) Newest() (image.ID, time.Time) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	ids := c.evictionOrder(nil)
+	if len(ids) == 0 {
+		return "", time.Time{}
+	}
+	newest := ids[len(ids)-1]
+	return image.ID(newest), c.images[newest].added
+}
+
+// ForEach implements the ImageCache interface
+func (c *naiveCache) ForEach(fn func(CacheEntry) bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	c.forEach(fn)
+}
+
+// forEach is ForEach for callers holding the lock
+func (c *naiveCache) forEach(fn func(CacheEntry) bool) {
+	for _, id := range c.evictionOrder(nil) {
+		ni := c.images[id]
+		if !fn(CacheEntry{Images: []image.ID{image.ID(id)}, Size: ni.size, Added: ni.added, Accessed: ni.added, Registry: c.registryOf(image.ID(id))}) {
+			return
+		}
+	}
+}
+
+// List implements the ImageCache interface, in the order of ForEach
+func (c *naiveCache) List() []CacheEntry {
+	if s := c.servedSnapshot(); s != nil {
+		return s.list()
+	}
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	return listEntries(c.forEach)
 }
 
+// Reserve implements the ImageCache interface
+func (c *naiveCache) Reserve(ref string, size int64) func() {
+	return c.reserve(size, func() { c.evict("") })
+}
+
+// Reclaim implements the ImageCache interface
+func (c *naiveCache) Reclaim(size int64) int64 {
+	c.mu.Lock()
+	defer c.unlock()
+
+	return c.reclaim(size, func(target int64) {
+		c.evictTo("", target)
+	})
+}
+
+// evict flushes the cache once over capacity: as ever with the naive
+// policy, every image but current goes, whatever the target of the pass.
+// Only Reclaim stops at its target.
 func (c *naiveCache) evict(current string) {
-	if c.level > c.capacity {
-		for imgID, size := range c.images {
-			if imgID == current {
+	c.runEviction(func(int64) {
+		c.evictTo(current, 0)
+	})
+}
+
+func (c *naiveCache) evictTo(current string, target int64) {
+	if c.level > target {
+		imgs := make([]*image.Image, 0, len(c.images))
+		for imgID := range c.images {
+			if img, err := c.imageService.GetImage(imgID); err == nil {
+				imgs = append(imgs, img)
+			}
+		}
+		plan := c.planEviction(imgs)
+
+		for _, imgID := range c.evictionOrder(plan) {
+			ni := c.images[imgID]
+			// images without layers free nothing and are never evicted,
+			// as in the layer-based caches
+			if imgID == current || plan.protected[image.ID(imgID)] || ni.size == 0 {
 				continue
 			}
+			if c.level <= target {
+				break
+			}
+			tags := c.auditTags(image.ID(imgID))
 			if _, err := c.imageService.ImageDelete(imgID, true, true); err != nil {
+				if strings.Contains(strings.ToLower(err.Error()), "no such image") {
+					// the image was deleted behind the back of the cache, drop
+					// its entry so that the eviction makes progress
+					logrus.Warnf("Image %s no longer exists", imgID)
+					c.removeImage(image.ID(imgID))
+					continue
+				}
+				// the image is still there, so it stays cached and nothing
+				// is recorded as evicted
 				logrus.Errorf("error deleting image: %v", err)
+				c.recordEvent(image.ID(imgID), EventSkip, err.Error())
+				continue
 			}
 			delete(c.images, imgID)
-			c.level -= size
+			c.addLevel(-ni.size)
+			observeEviction(ni.added)
+			c.evictions.freed(ni.size)
+			c.forget(image.ID(imgID))
+			c.recordEviction(image.ID(imgID), tags, ni.size, fmt.Sprintf("level %d above target %d", c.level+ni.size, target))
+		}
+		logrus.Infof("Evicted images, %s", c.usage())
+	}
+}
+
+// evictionOrder returns the cached images in the order they are evicted,
+// the images preferred by plan first if given, then in the order they were
+// put
+func (c *naiveCache) evictionOrder(plan *evictionPlan) []string {
+	ids := make([]string, 0, len(c.images))
+	for imgID := range c.images {
+		ids = append(ids, imgID)
+	}
+	sort.Slice(ids, func(i, j int) bool {
+		if plan != nil {
+			pi, pj := plan.preferred[image.ID(ids[i])], plan.preferred[image.ID(ids[j])]
+			if pi != pj {
+				return pi
+			}
+		}
+		si, sj := c.images[ids[i]].seq, c.images[ids[j]].seq
+		if si != sj {
+			return si < sj
 		}
-		logrus.Infof("Evicted images, %d/%d (%.3f)", c.level, c.capacity, c.percent())
+		return ids[i] < ids[j]
+	})
+	return ids
+}
+
+// Stats implements the ImageCache interface
+func (c *naiveCache) Stats() Stats {
+	if s := c.servedSnapshot(); s != nil {
+		return s.inProgressStats()
+	}
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	return c.fullStats()
+}
+
+// fullStats is Stats for callers holding the lock
+func (c *naiveCache) fullStats() Stats {
+	stats := c.stats()
+	stats.Registries = registryBytes(listEntries(c.forEach))
+	return stats
+}
+
+// ReclaimableBreakdown implements the ImageCache interface
+func (c *naiveCache) ReclaimableBreakdown() Reclaimable {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	return c.reclaimable()
+}
+
+func (c *naiveCache) reclaimable() Reclaimable {
+	imgs := make([]*image.Image, 0, len(c.images))
+	for imgID := range c.images {
+		if img, err := c.imageService.GetImage(imgID); err == nil {
+			imgs = append(imgs, img)
+		}
+	}
+	ec := c.newEntryClassifier(imgs)
+
+	var r Reclaimable
+	for imgID, ni := range c.images {
+		pinned, inUse := ec.classify(image.ID(imgID))
+		r.addEntry(ni.size, pinned, inUse)
 	}
+	return r
 }
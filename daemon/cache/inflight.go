@@ -0,0 +1,72 @@
+package cache
+
+import (
+	"github.com/docker/distribution/reference"
+	"github.com/docker/docker/image"
+)
+
+// BeginPull registers ref as being pulled. Until the matching EndPull, the
+// cached images tagged with ref are not evicted, so that the layers the
+// pull may be reusing stay in place, and the pulled image is not evicted
+// before it has been put in the cache.
+func (c *cacheBase) BeginPull(ref string) {
+	c.mu.Lock()
+	defer c.unlock()
+
+	if c.pulling == nil {
+		c.pulling = make(map[string]int)
+	}
+	c.pulling[normalizeRef(ref)]++
+	c.touchActivity()
+}
+
+// EndPull unregisters a pull registered by BeginPull
+func (c *cacheBase) EndPull(ref string) {
+	c.mu.Lock()
+	defer c.unlock()
+
+	ref = normalizeRef(ref)
+	if c.pulling[ref] <= 1 {
+		delete(c.pulling, ref)
+		return
+	}
+	c.pulling[ref]--
+}
+
+// isPulling reports whether one of tags is being pulled. The caller must
+// hold the lock.
+func (c *cacheBase) isPulling(tags []string) bool {
+	for _, tag := range tags {
+		if c.pulling[normalizeRef(tag)] > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// protectPulling marks the images tagged with a reference being pulled as
+// protected in plan. The caller must hold the lock.
+func (c *cacheBase) protectPulling(plan *evictionPlan, imgs []*image.Image, tags map[image.ID][]string) {
+	if len(c.pulling) == 0 {
+		return
+	}
+	for _, img := range imgs {
+		t, ok := tags[img.ID()]
+		if !ok {
+			t = c.tagsOf(img.ID())
+		}
+		if c.isPulling(t) {
+			plan.protected[img.ID()] = true
+		}
+	}
+}
+
+// normalizeRef returns the fully qualified form of ref, so that references
+// can be compared regardless of how they are spelled
+func normalizeRef(ref string) string {
+	named, err := reference.ParseNormalizedNamed(ref)
+	if err != nil {
+		return ref
+	}
+	return reference.TagNameOnly(named).String()
+}
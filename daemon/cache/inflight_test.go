@@ -0,0 +1,82 @@
+package cache
+
+import (
+	"io/ioutil"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/docker/docker/image"
+	"gotest.tools/assert"
+	is "gotest.tools/assert/cmp"
+)
+
+func TestNormalizeRef(t *testing.T) {
+	assert.Check(t, is.Equal("docker.io/library/busybox:latest", normalizeRef("busybox")))
+	assert.Check(t, is.Equal("docker.io/library/busybox:latest", normalizeRef("docker.io/library/busybox:latest")))
+	assert.Check(t, is.Equal("registry.local/app:1", normalizeRef("registry.local/app:1")))
+}
+
+func TestConcurrentPullsNotEvicted(t *testing.T) {
+	dir, err := ioutil.TempDir("", "concurrent-pulls")
+	assert.NilError(t, err)
+	defer os.RemoveAll(dir)
+	store := newTestImageStore(t, dir)
+
+	start := time.Now()
+	a := store.newImage(t, start)
+	b := store.newImage(t, start.Add(time.Minute))
+	other := store.newImage(t, start.Add(2*time.Minute))
+	tags := map[image.ID][]string{
+		a.ID():     {"registry.local/app-a:1"},
+		b.ID():     {"registry.local/app-b:1"},
+		other.ID(): {"busybox"},
+	}
+
+	// a tight cache holding the images at the previous tags, least
+	// recently used at the back
+	c := newImageLRUCache(newCacheBase(1, nil)).(*imageLRUCache)
+	c.tagsOf = func(id image.ID) []string { return tags[id] }
+	imgs := []*image.Image{a, b, other}
+	for _, img := range imgs {
+		ci := &cacheImage{img: img}
+		c.images[img.ID()] = ci
+		c.evictList.pushFront(ci)
+	}
+
+	refs := []string{"registry.local/app-a:1", "registry.local/app-b:1"}
+	var started, done sync.WaitGroup
+	evicted := make(chan struct{})
+	for _, ref := range refs {
+		started.Add(1)
+		done.Add(1)
+		go func(ref string) {
+			defer done.Done()
+			c.BeginPull(ref)
+			started.Done()
+			<-evicted
+			c.EndPull(ref)
+		}(ref)
+	}
+	started.Wait()
+
+	c.mu.Lock()
+	plan := c.planEviction(imgs)
+	var victims []image.ID
+	for ci := c.nextVictim(plan); ci != nil; ci = c.nextVictim(plan) {
+		victims = append(victims, ci.img.ID())
+		c.evictList.remove(ci)
+	}
+	c.mu.Unlock()
+	close(evicted)
+	done.Wait()
+
+	assert.Check(t, is.DeepEqual([]image.ID{other.ID()}, victims))
+	assert.Check(t, is.Len(c.pulling, 0))
+
+	c.mu.Lock()
+	plan = c.planEviction(imgs)
+	c.mu.Unlock()
+	assert.Check(t, is.Len(plan.protected, 0))
+}
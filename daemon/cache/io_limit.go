@@ -0,0 +1,63 @@
+package cache
+
+import (
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// criticalPressure is the pressure of the cache from which eviction ignores
+// the IO rate limit, the cache being too far over capacity to wait
+const criticalPressure = 1.5
+
+// sleep is the sleep of the IO rate limiter, replaceable in tests
+var sleep = time.Sleep
+
+// ioLimiter paces the IO of eviction, the layer releases and the archive
+// deletions, at rate bytes per second, so that a mass eviction does not
+// saturate the disk of the co-located workloads. Each IO waits for the
+// earlier ones to be paid off at the rate, the first one going at once. It
+// is shared by the partitions of a cache.
+type ioLimiter struct {
+	rate int64
+
+	mu   sync.Mutex
+	next time.Time // when the IO done so far is paid off
+}
+
+func newIOLimiter(rate int64) *ioLimiter {
+	return &ioLimiter{rate: rate}
+}
+
+// wait blocks until an IO of size bytes fits the rate, and accounts for it
+func (l *ioLimiter) wait(size int64) {
+	l.mu.Lock()
+	now := timeNow()
+	if l.next.Before(now) {
+		l.next = now
+	}
+	delay := l.next.Sub(now)
+	l.next = l.next.Add(time.Duration(float64(size) / float64(l.rate) * float64(time.Second)))
+	l.mu.Unlock()
+
+	if delay > 0 {
+		logrus.Debugf("Eviction IO rate limit reached, waiting %s", delay)
+		sleep(delay)
+	}
+}
+
+// throttleIO waits for the IO of size bytes of an eviction to fit the IO
+// rate limit, if any, unless the cache is critically over capacity. The
+// caller must hold the write lock, which the wait keeps, the reads being
+// served from the snapshot of the eviction meanwhile.
+func (c *cacheBase) throttleIO(size int64) {
+	if c.ioLimit == nil || size <= 0 {
+		return
+	}
+	if c.percent() >= criticalPressure {
+		logrus.Debugf("Cache critically over capacity, bypassing the eviction IO rate limit, %s", c.usage())
+		return
+	}
+	c.ioLimit.wait(size)
+}
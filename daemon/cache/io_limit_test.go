@@ -0,0 +1,63 @@
+package cache
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/docker/docker/layer"
+	"gotest.tools/assert"
+	is "gotest.tools/assert/cmp"
+)
+
+func TestEvictionIORateLimit(t *testing.T) {
+	now := time.Now()
+	timeNow = func() time.Time { return now }
+	var slept []time.Duration
+	sleep = func(d time.Duration) {
+		slept = append(slept, d)
+		now = now.Add(d)
+	}
+	defer func() {
+		timeNow = time.Now
+		sleep = time.Sleep
+	}()
+
+	newCache := func(b *fakeImageBackend) *layerLRUCache {
+		c := layerCacheOf(newLayerLRUCache(newCacheBase(100, b)))
+		// 10 bytes per second, a layer per second
+		c.ioLimit = newIOLimiter(10)
+		for i := 0; i < 10; i++ {
+			c.PutImage(b.addImage(t, now.Add(time.Duration(i)*time.Second), []layer.DiffID{b.layer(fmt.Sprintf("layer%d", i), 10)}))
+		}
+		assert.Assert(t, is.Equal(int64(100), c.Level()))
+		return c
+	}
+
+	b, cleanup := newFakeBackendForTest(t)
+	defer cleanup()
+	c := newCache(b)
+
+	// the bulk eviction releases a layer per second, the first one at once
+	assert.Check(t, is.Equal(int64(50), c.Reclaim(50)))
+	assert.Check(t, is.DeepEqual([]time.Duration{time.Second, time.Second, time.Second, time.Second}, slept))
+	checkLayers(t, c, b)
+
+	// once the IO is paid off, the next eviction goes at once again
+	now = now.Add(time.Minute)
+	slept = nil
+	assert.Check(t, is.Equal(int64(10), c.Reclaim(10)))
+	assert.Check(t, is.Len(slept, 0))
+
+	// a cache shrunk critically over capacity evicts without waiting while
+	// at the critical pressure or above, 30 bytes here
+	b2, cleanup2 := newFakeBackendForTest(t)
+	defer cleanup2()
+	c = newCache(b2)
+	c.capacity = 20
+	slept = nil
+	assert.Check(t, is.Equal(int64(60), c.Reclaim(60)))
+	assert.Check(t, is.Len(slept, 0))
+	assert.Check(t, is.Equal(int64(40), c.Reclaim(40)))
+	assert.Check(t, is.DeepEqual([]time.Duration{time.Second}, slept))
+}
@@ -0,0 +1,36 @@
+package cache
+
+import (
+	"math"
+	"time"
+)
+
+// frequencyHalfLife is the time it takes the access count of a layer to
+// decay by half, so that a layer no longer used is eventually evicted
+// however often it was used before
+const frequencyHalfLife = 24 * time.Hour
+
+// frequency returns the access count of the layer decayed as of now
+func (cl *cacheLayer) frequency(now time.Time) float64 {
+	if cl.hits == 0 {
+		return 0
+	}
+	elapsed := now.Sub(cl.hitsAt)
+	if elapsed <= 0 {
+		return cl.hits
+	}
+	return cl.hits * math.Exp2(-float64(elapsed)/float64(frequencyHalfLife))
+}
+
+// layerLFUCache is the layer LRU cache evicting the least frequently used
+// layer first, so that the base layers used by many pulls outlive a burst
+// of layers pulled once. The access counts decay over time.
+type layerLFUCache struct {
+	*layerLRUCache
+}
+
+func newLayerLFUCache(base *cacheBase) ImageCache {
+	c := newLayerLRUCache(base).(*layerLRUCache)
+	c.byFrequency = true
+	return &layerLFUCache{layerLRUCache: c}
+}
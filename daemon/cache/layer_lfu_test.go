@@ -0,0 +1,68 @@
+package cache
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/docker/docker/image"
+	"github.com/docker/docker/layer"
+	"gotest.tools/assert"
+	is "gotest.tools/assert/cmp"
+)
+
+// floodLayerCache puts a hot image, used a few times, then a flood of
+// images used once into a layer cache of the given policy holding four
+// images, and returns the hot image along with the images deleted
+func floodLayerCache(t *testing.T, policy string, idle time.Duration) (*image.Image, []image.ID) {
+	b, cleanup := newFakeBackendForTest(t)
+	defer cleanup()
+
+	now := time.Now()
+	timeNow = func() time.Time { return now }
+	defer func() { timeNow = time.Now }()
+
+	c := newTestCache(t, policy, newCacheBase(100, b))
+	hot := b.addImage(t, now, []layer.DiffID{b.layer("hot", 25)}, "hot:latest")
+	c.PutImage(hot)
+	for i := 0; i < 5; i++ {
+		now = now.Add(time.Second)
+		c.UpdateImage(hot.ID().String())
+	}
+	now = now.Add(idle)
+	for i := 0; i < 6; i++ {
+		now = now.Add(time.Second)
+		img := b.addImage(t, now, []layer.DiffID{b.layer(fmt.Sprintf("once%d", i), 25)}, fmt.Sprintf("once:%d", i))
+		c.PutImage(img)
+	}
+	assert.Check(t, is.Equal(int64(100), c.Level()), policy)
+	return hot, b.deleted
+}
+
+func TestLayerLFUKeepsFrequentlyUsedLayers(t *testing.T) {
+	// the least recently used hot image goes first to the layer LRU cache
+	hot, deleted := floodLayerCache(t, policyLayerLRU, 0)
+	assert.Check(t, is.Contains(deleted, hot.ID()))
+
+	// the layer LFU cache evicts the images used once instead
+	hot, deleted = floodLayerCache(t, policyLayerLFU, 0)
+	assert.Check(t, is.Len(deleted, 3))
+	for _, id := range deleted {
+		assert.Check(t, id != hot.ID())
+	}
+}
+
+func TestLayerLFUFrequencyDecays(t *testing.T) {
+	// unused for a week, the hot image is no longer used more than the
+	// images used once
+	hot, deleted := floodLayerCache(t, policyLayerLFU, 7*24*time.Hour)
+	assert.Assert(t, is.Len(deleted, 3))
+	assert.Check(t, is.Equal(hot.ID(), deleted[0]))
+
+	start := time.Now()
+	cl := &cacheLayer{}
+	cl.touch(start)
+	cl.touch(start)
+	assert.Check(t, is.Equal(2.0, cl.frequency(start)))
+	assert.Check(t, is.Equal(1.0, cl.frequency(start.Add(frequencyHalfLife))))
+}
@@ -2,10 +2,11 @@ package cache
 
 import (
 	"container/list"
+	"fmt"
 	"strings"
-	"sync"
+	"time"
 
-	"github.com/docker/docker/daemon/images"
+	"github.com/docker/docker/distribution/xfer"
 	"github.com/docker/docker/image"
 	"github.com/docker/docker/layer"
 	"github.com/sirupsen/logrus"
@@ -13,39 +14,78 @@ import (
 
 type layerLRUCache struct {
 	*cacheBase
-	images    map[image.ID]*image.Image
-	layers    map[layer.ChainID]*list.Element
-	evictList *list.List
+	images map[image.ID]*image.Image
+	// imageAccessed is the last use of each cached image, on its own: the
+	// layers of an image are also bumped by the images sharing them, so
+	// the whole-image decisions go by it, and the reclamation of layers by
+	// the recency of the layers
+	imageAccessed map[image.ID]time.Time
+	layers        map[layer.ChainID]*list.Element
+	evictList     *list.List
+	// byFrequency is set for the layer LFU cache, which evicts the least
+	// frequently used layer first rather than the least recently used
+	byFrequency bool
 }
 
 type cacheLayer struct {
-	layer  layer.Layer
-	size   int64
-	images []string
-	os     string
+	layer layer.Layer
+	// size is the diff size of the layer, read once when it is put, and
+	// taken off the level when it goes whatever the layer store reports
+	size     int64
+	images   []string
+	os       string
+	added    time.Time
+	accessed time.Time
+	// hits is the access count of the layer as of hitsAt, decaying by half
+	// every frequencyHalfLife
+	hits   float64
+	hitsAt time.Time
 }
 
-func newLayerLRUCache(capacity int64, is *images.ImageService) ImageCache {
-	return &layerLRUCache{
-		cacheBase: &cacheBase{
-			imageService: is,
-			capacity:     capacity,
-			mu:           &sync.RWMutex{},
-		},
-		images:    make(map[image.ID]*image.Image),
-		layers:    make(map[layer.ChainID]*list.Element),
-		evictList: list.New(),
+// touch records an access to the layer at now
+func (cl *cacheLayer) touch(now time.Time) {
+	cl.hits = cl.frequency(now) + 1
+	cl.hitsAt = now
+	cl.accessed = now
+}
+
+// layerOf returns the cache layer held by an element of the evict list of
+// the layer-based caches
+func layerOf(e *list.Element) *cacheLayer {
+	switch v := e.Value.(type) {
+	case *archiveLayer:
+		return v.cacheLayer
+	default:
+		return v.(*cacheLayer)
+	}
+}
+
+func newLayerLRUCache(base *cacheBase) ImageCache {
+	c := &layerLRUCache{
+		cacheBase:     base,
+		images:        make(map[image.ID]*image.Image),
+		imageAccessed: make(map[image.ID]time.Time),
+		layers:        make(map[layer.ChainID]*list.Element),
+		evictList:     list.New(),
 	}
+	base.takeSnapshot = func() *readSnapshot { return c.snapshot(c.listImages(nil)) }
+	base.imageOrder = c.imageOrder
+	return c
 }
 
 // PutImage implements the ImageCache interface
 func (c *layerLRUCache) PutImage(img *image.Image) {
 	c.mu.Lock()
-	defer c.mu.Unlock()
+	defer c.unlock()
+
+	c.putImage(img)
+}
 
+func (c *layerLRUCache) putImage(img *image.Image) {
 	if img == nil {
 		return
 	}
+	c.evictions.put()
 
 	if err := c.checkImageSize(img); err != nil {
 		logrus.Errorf("error putting image in cache: %v", err)
@@ -56,7 +96,17 @@ func (c *layerLRUCache) PutImage(img *image.Image) {
 		diffIDs  []layer.DiffID
 		chainIDs []layer.ChainID
 	)
+	if _, ok := c.images[img.ID()]; ok {
+		c.touched()
+		c.recordEvent(img.ID(), EventTouch, "put again")
+	} else if c.admit(img) {
+		c.inserted(img.ID())
+		c.recordEvent(img.ID(), EventInsert, "")
+	} else {
+		return
+	}
 	c.images[img.ID()] = img
+	c.imageAccessed[img.ID()] = timeNow()
 	for _, diffID := range img.RootFS.DiffIDs {
 		diffIDs = append(diffIDs, diffID)
 		chainID := layer.CreateChainID(diffIDs)
@@ -72,45 +122,75 @@ func (c *layerLRUCache) PutImage(img *image.Image) {
 func (c *layerLRUCache) putLayer(chainID layer.ChainID, img *image.Image) {
 
 	if e, ok := c.layers[chainID]; ok {
+		layerOf(e).touch(timeNow())
 		c.evictList.MoveToFront(e)
 		return
 	}
 
 	l, err := c.imageService.GetReadOnlyLayer(chainID, img.OperatingSystem())
 	if err != nil {
-		logrus.Errorf("error getting layer: %v", err)
+		logrus.Errorf("error getting layer %s of image %s: %v", chainID, img.ID(), err)
+		return
+	}
+	if isForeignLayer(l) {
+		logrus.Debugf("Layer %s is foreign, not caching it", chainID)
+		if _, err := c.imageService.ReleaseReadOnlyLayer(l, img.OperatingSystem()); err != nil {
+			logrus.Errorf("error releasing layer: %v", err)
+		}
 		return
 	}
 
 	size, err := l.DiffSize()
 	if err != nil {
 		logrus.Errorf("error getting layer size: %v", err)
+		if _, err := c.imageService.ReleaseReadOnlyLayer(l, img.OperatingSystem()); err != nil {
+			logrus.Errorf("error releasing layer: %v", err)
+		}
 		return
 	}
+	if err := c.checkAddition(size); err != nil {
+		logrus.Errorf("error putting layer in cache: %v", err)
+		if _, err := c.imageService.ReleaseReadOnlyLayer(l, img.OperatingSystem()); err != nil {
+			logrus.Errorf("error releasing layer: %v", err)
+		}
+		return
+	}
+	now := timeNow()
 	cl := &cacheLayer{
 		layer:  l,
 		size:   size,
 		images: []string{img.ImageID()},
 		os:     img.OperatingSystem(),
+		added:  now,
 	}
+	cl.touch(now)
 
 	c.layers[chainID] = c.evictList.PushFront(cl)
-	c.level += size
+	c.addLevel(size)
+	c.layerCount++
 	c.evict(img.ID())
 
-	logrus.Infof("Put layer %s, %d/%d (%.3f)", chainID, c.level, c.capacity, c.percent())
+	logrus.Infof("Put layer %s, %s", chainID, c.usage())
 }
 
 // UpdateImage implements the ImageCache interface
 func (c *layerLRUCache) UpdateImage(refOrID string) {
 	c.mu.Lock()
-	defer c.mu.Unlock()
+	defer c.unlock()
 
 	img, err := c.imageService.GetImage(refOrID)
 	if err != nil {
 		logrus.Warnf("error getting image: %v", err)
 		return
 	}
+	_, ok := c.images[img.ID()]
+	c.evictions.used(ok)
+	if ok {
+		c.imageAccessed[img.ID()] = timeNow()
+		c.markUsed(img.ID())
+		c.touched()
+		c.recordEvent(img.ID(), EventTouch, "used")
+	}
 
 	var (
 		diffIDs  []layer.DiffID
@@ -136,26 +216,134 @@ func (c *layerLRUCache) updateLayer(chainID layer.ChainID, img *image.Image) {
 	}
 	cl := e.Value.(*cacheLayer)
 	cl.images = append(cl.images, img.ImageID())
+	cl.touch(timeNow())
 	c.evictList.MoveToFront(e)
 
-	logrus.Infof("Updated layer %s, %d/%d (%.3f)", chainID, c.level, c.capacity, c.percent())
+	logrus.Infof("Updated layer %s, %s", chainID, c.usage())
+}
+
+// Promote implements the ImageCache interface. The layers of the image are
+// moved to the front, base layer first.
+func (c *layerLRUCache) Promote(imgID image.ID) error {
+	c.mu.Lock()
+	defer c.unlock()
+
+	imgID = c.cachedID(imgID)
+	img, ok := c.images[imgID]
+	if !ok {
+		return errNotCached(imgID)
+	}
+
+	var (
+		diffIDs  []layer.DiffID
+		chainIDs []layer.ChainID
+	)
+	for _, diffID := range img.RootFS.DiffIDs {
+		diffIDs = append(diffIDs, diffID)
+		chainID := layer.CreateChainID(diffIDs)
+		chainIDs = append([]layer.ChainID{chainID}, chainIDs...)
+	}
+
+	now := timeNow()
+	c.imageAccessed[imgID] = now
+	for _, chainID := range chainIDs {
+		if e, ok := c.layers[chainID]; ok {
+			layerOf(e).touch(now)
+			c.evictList.MoveToFront(e)
+		}
+	}
+	c.touched()
+	c.recordEvent(imgID, EventTouch, "promoted")
+	logrus.Infof("Promoted image %s", imgID)
+	return nil
 }
 
 // RemoveImage implements the ImageCache interface
 func (c *layerLRUCache) RemoveImage(imgID image.ID) {
 	c.mu.Lock()
-	defer c.mu.Unlock()
+	defer c.unlock()
+
+	c.removeImage(c.forgetSquashed(imgID))
+}
+
+func (c *layerLRUCache) removeImage(imgID image.ID) {
+	if _, ok := c.images[imgID]; !ok {
+		return
+	}
+	unused := c.dropImage(imgID)
+	c.forget(imgID)
+	c.recordEvent(imgID, EventRemove, "")
+	for _, chainID := range unused {
+		c.removeLayer(chainID)
+	}
+}
 
+// dropImage deletes imgID from the maps of the cache and from the images of
+// its layers, and returns those of its layers that no other cached image
+// uses, leaving them in cache. The caller must hold the lock.
+func (c *layerLRUCache) dropImage(imgID image.ID) []layer.ChainID {
 	img, ok := c.images[imgID]
 	if !ok {
-		return
+		return nil
 	}
 	delete(c.images, imgID)
-	var diffIDs []layer.DiffID
+	delete(c.imageAccessed, imgID)
+	return c.unusedLayers(img)
+}
+
+// unusedLayers forgets img on the layers it used, and returns those of its
+// layers that no other cached image uses, top layer first, so that
+// releasing them in order deletes each one. The caller must hold the lock,
+// and have deleted img from the cache.
+func (c *layerLRUCache) unusedLayers(img *image.Image) []layer.ChainID {
+	users := c.layerUsers()
+	var unused []layer.ChainID
+	for _, chainID := range chainIDsOf(img) {
+		e, ok := c.layers[chainID]
+		if !ok {
+			continue
+		}
+		cl := layerOf(e)
+		images := cl.images[:0]
+		for _, id := range cl.images {
+			if id != img.ImageID() {
+				images = append(images, id)
+			}
+		}
+		cl.images = images
+		if len(users[chainID]) == 0 {
+			unused = append(unused, chainID)
+		}
+	}
+	return unused
+}
+
+// layerUsers returns the cached images using each layer. The caller must
+// hold the lock.
+func (c *layerLRUCache) layerUsers() map[layer.ChainID]map[image.ID]bool {
+	users := make(map[layer.ChainID]map[image.ID]bool)
+	for id, img := range c.images {
+		for _, chainID := range chainIDsOf(img) {
+			if users[chainID] == nil {
+				users[chainID] = make(map[image.ID]bool)
+			}
+			users[chainID][id] = true
+		}
+	}
+	return users
+}
+
+// chainIDsOf returns the chain IDs of the layers of img, top layer first
+func chainIDsOf(img *image.Image) []layer.ChainID {
+	var (
+		diffIDs  []layer.DiffID
+		chainIDs []layer.ChainID
+	)
 	for _, diffID := range img.RootFS.DiffIDs {
 		diffIDs = append(diffIDs, diffID)
-		c.removeLayer(layer.CreateChainID(diffIDs))
+		chainIDs = append([]layer.ChainID{layer.CreateChainID(diffIDs)}, chainIDs...)
 	}
+	return chainIDs
 }
 
 func (c *layerLRUCache) removeLayer(chainID layer.ChainID) {
@@ -164,52 +352,268 @@ func (c *layerLRUCache) removeLayer(chainID layer.ChainID) {
 		logrus.Debugf("Layer %s is not in cache", chainID)
 		return
 	}
-	cl := e.Value.(*cacheLayer)
+	cl := layerOf(e)
 	released, err := c.imageService.ReleaseReadOnlyLayer(cl.layer, cl.os)
-	if err != nil {
+	if err != nil && err != layer.ErrLayerNotRetained {
 		logrus.Errorf("error releasing layer: %v", err)
 		return
 	}
-	for _, l := range released {
-		e, ok := c.layers[l.ChainID]
-		if !ok {
-			logrus.Warnf("Layer %s is not in cache", l.ChainID)
+	for _, l := range releasedLayers(cl, chainID, released) {
+		if c.dropLayer(l.ChainID) == nil {
+			logrus.Debugf("Layer %s is not in cache", l.ChainID)
 			continue
 		}
-		c.level -= l.DiffSize
-		delete(c.layers, l.ChainID)
-		if err := deleteArchive(l.DiffID); err != nil {
-			logrus.Warnf("error deleting layer archive: %v", err)
+		logrus.Infof("Removed layer %s, %s", l.ChainID, c.usage())
+	}
+}
+
+// releasedLayers returns the layers the cache no longer holds once the
+// layer of chainID, held by cl, has been released: those deleted by the
+// release, and the layer itself, which other holders may keep
+func releasedLayers(cl *cacheLayer, chainID layer.ChainID, released []layer.Metadata) []layer.Metadata {
+	for _, l := range released {
+		if l.ChainID == chainID {
+			return released
+		}
+	}
+	self := layer.Metadata{ChainID: chainID}
+	if cl.layer != nil {
+		self.DiffID = cl.layer.DiffID()
+	}
+	return append([]layer.Metadata{self}, released...)
+}
+
+// dropLayer drops the entry of chainID, whose reference the cache no
+// longer holds, and returns it, or nil if the layer is not cached. The
+// caller must hold the lock.
+func (c *layerLRUCache) dropLayer(chainID layer.ChainID) *list.Element {
+	e, ok := c.layers[chainID]
+	if !ok {
+		return nil
+	}
+	c.addLevel(-layerOf(e).size)
+	delete(c.layers, chainID)
+	c.layerCount--
+	c.evictList.Remove(e)
+	return e
+}
+
+// Rebuild implements the ImageCache interface. The layers held by the
+// discarded entries are released before the new ones are taken, so that
+// layers only kept alive by the cache are deleted.
+func (c *layerLRUCache) Rebuild() error {
+	c.mu.Lock()
+	defer c.unlock()
+
+	err := c.releaseLayers()
+	c.rebuild(c.putImage)
+	return err
+}
+
+// releaseLayers releases the layers held by the cache and resets its
+// entries, returning the first error met. Entries whose layer was already
+// released, as left by the removal of a shared layer, are skipped.
+func (c *layerLRUCache) releaseLayers() error {
+	var firstErr error
+	for e := c.evictList.Front(); e != nil; e = e.Next() {
+		cl := layerOf(e)
+		_, err := c.imageService.ReleaseReadOnlyLayer(cl.layer, cl.os)
+		if err != nil && err != layer.ErrLayerNotRetained && firstErr == nil {
+			firstErr = err
+		}
+	}
+	c.images = make(map[image.ID]*image.Image)
+	c.imageAccessed = make(map[image.ID]time.Time)
+	c.layers = make(map[layer.ChainID]*list.Element)
+	c.layerCount = 0
+	c.evictList = list.New()
+	return firstErr
+}
+
+// CheckConsistency implements the ImageCache interface
+func (c *layerLRUCache) CheckConsistency() Drift {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	return c.drift(c.entryLevel(), c.cachedImages())
+}
+
+// Resync implements the ImageCache interface
+func (c *layerLRUCache) Resync() Drift {
+	c.mu.Lock()
+	defer c.unlock()
+
+	c.repairMaps()
+	return c.resync(c.drift(c.entryLevel(), c.cachedImages()), c.removeImage, c.entryLevel)
+}
+
+func (c *layerLRUCache) entryLevel() int64 {
+	var level int64
+	for e := c.evictList.Front(); e != nil; e = e.Next() {
+		level += layerOf(e).size
+	}
+	return level
+}
+
+func (c *layerLRUCache) cachedImages() []image.ID {
+	ids := make([]image.ID, 0, len(c.images))
+	for id := range c.images {
+		ids = append(ids, id)
+	}
+	return ids
+}
+
+// Oldest implements the ImageCache interface
+func (c *layerLRUCache) Oldest() (image.ID, time.Time) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	return c.entryAt(c.evictList.Back())
+}
+
+// Newest implements the ImageCache interface
+func (c *layerLRUCache) Newest() (image.ID, time.Time) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	return c.entryAt(c.evictList.Front())
+}
+
+// ForEach implements the ImageCache interface, from the least recently used
+// layer
+func (c *layerLRUCache) ForEach(fn func(CacheEntry) bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	for e := c.evictList.Back(); e != nil; e = e.Prev() {
+		cl := layerOf(e)
+		entry := CacheEntry{Layer: cl.layer.ChainID(), Size: cl.size, Added: cl.added, Accessed: cl.accessed}
+		for _, id := range cl.images {
+			entry.Images = append(entry.Images, image.ID(id))
+		}
+		if !fn(entry) {
+			return
 		}
-		c.evictList.Remove(e)
-		logrus.Infof("Removed layer %s, %d/%d (%.3f)", l.ChainID, c.level, c.capacity, c.percent())
 	}
+}
+
+// List implements the ImageCache interface, from the least recently
+// accessed image
+func (c *layerLRUCache) List() []CacheEntry {
+	if s := c.servedSnapshot(); s != nil {
+		return s.list()
+	}
+	c.mu.RLock()
+	defer c.mu.RUnlock()
 
+	return c.listImages(nil)
+}
+
+// listImages returns the entries of the cached images, made of their cached
+// layers, from the least recently accessed image, whatever the use of the
+// layers it shares with other images. If set, visit is called on each
+// entry along with the elements of its layers. The caller must hold the
+// lock.
+func (c *layerLRUCache) listImages(visit func(entry *CacheEntry, layers []*list.Element)) []CacheEntry {
+	entries := make([]CacheEntry, 0, len(c.images))
+	for id, img := range c.images {
+		entry := CacheEntry{Images: []image.ID{id}, Accessed: c.imageAccessed[id], Registry: c.registryOf(id)}
+		var layers []*list.Element
+		for _, chainID := range chainIDsOf(img) {
+			e, ok := c.layers[chainID]
+			if !ok {
+				continue
+			}
+			cl := layerOf(e)
+			entry.Size += cl.size
+			if entry.Added.IsZero() || cl.added.Before(entry.Added) {
+				entry.Added = cl.added
+			}
+			layers = append(layers, e)
+		}
+		if visit != nil {
+			visit(&entry, layers)
+		}
+		entries = append(entries, entry)
+	}
+	sortEntries(entries)
+	return entries
+}
+
+// entryAt returns the image that last used the layer held by e
+func (c *layerLRUCache) entryAt(e *list.Element) (image.ID, time.Time) {
+	if e == nil {
+		return "", time.Time{}
+	}
+	cl := layerOf(e)
+	if len(cl.images) == 0 {
+		return "", cl.accessed
+	}
+	return image.ID(cl.images[len(cl.images)-1]), cl.accessed
+}
+
+// Reserve implements the ImageCache interface
+func (c *layerLRUCache) Reserve(ref string, size int64) func() {
+	return c.reserve(size, func() { c.evict("") })
+}
+
+// Reclaim implements the ImageCache interface
+func (c *layerLRUCache) Reclaim(size int64) int64 {
+	c.mu.Lock()
+	defer c.unlock()
+
+	return c.reclaim(size, func(target int64) {
+		c.evictTo("", target)
+	})
 }
 
 func (c *layerLRUCache) evict(current image.ID) {
+	c.runEviction(func(target int64) {
+		c.evictTo(current, target)
+	})
+}
+
+func (c *layerLRUCache) evictTo(current image.ID, target int64) {
 	if c.evictList.Len() == 0 {
 		logrus.Debug("Empty cache, nothing to evict")
 		return
 	}
+	if target >= c.level && !c.tooManyLayers() {
+		return
+	}
 
-	checkboard := make(map[layer.ChainID]int)
+	imgs := make([]*image.Image, 0, len(c.images))
+	for _, img := range c.images {
+		imgs = append(imgs, img)
+	}
+	plan := c.planEviction(imgs)
 
-	for c.capacity < c.level {
-		e := c.evictList.Back()
+	checkboard := make(map[layer.ChainID]int)
+	batch := newEvictionBatch(c.evictionBatch)
+	defer batch.flush(c.deleteArchivesLater)
+
+	for (target < c.level || c.tooManyLayers() || !batch.satisfied()) && c.evictList.Len() > 0 {
+		e := c.nextVictim(plan)
+		if e == nil {
+			logrus.Warnf("No evictable layer left, %s", c.usage())
+			return
+		}
 		cl := e.Value.(*cacheLayer)
 		chainID := cl.layer.ChainID()
 
-		logrus.Infof("Eviciting %s, %d/%d (%.3f)", chainID, c.level, c.capacity, c.percent())
+		logrus.Infof("Eviciting %s, %s", chainID, c.usage())
 
 		var conflict bool
-		for _, imgID := range cl.images {
+		// the images deleted are dropped from cl.images meanwhile
+		for _, imgID := range append([]string(nil), cl.images...) {
 			if imgID == current.String() {
 				conflict = true
 				break
 			}
+			tags := c.auditTags(image.ID(imgID))
 			if _, err := c.imageService.ImageDelete(imgID, false, false); err != nil {
 				if strings.Contains(strings.ToLower(err.Error()), "conflict") {
+					c.recordEvent(image.ID(imgID), EventSkip, err.Error())
 					conflict = true
 					break
 				}
@@ -217,7 +621,11 @@ func (c *layerLRUCache) evict(current image.ID) {
 					logrus.Errorf("error deleting image: %v", err)
 					return
 				}
+				continue
 			}
+			c.dropImage(image.ID(imgID))
+			c.forget(image.ID(imgID))
+			c.recordEviction(image.ID(imgID), tags, cl.size, fmt.Sprintf("layer %s evicted, level %d above target %d", chainID, c.level, target))
 		}
 
 		if conflict {
@@ -231,12 +639,11 @@ func (c *layerLRUCache) evict(current image.ID) {
 			continue
 		}
 
-		released, err := c.imageService.ReleaseReadOnlyLayer(cl.layer, cl.os)
-		if err != nil {
-			if strings.Contains(strings.ToLower(err.Error()), "layer not retained") {
-				logrus.Errorf("error releasing layer: %v", err)
-				return
-			}
+		c.throttleIO(cl.size)
+		released, err := c.releaseEvicted(cl, chainID)
+		if err != nil && isNotRetained(err) {
+			logrus.Errorf("error releasing layer %s, giving up: %v", chainID, err)
+			return
 		}
 
 		if len(released) == 0 {
@@ -256,12 +663,250 @@ func (c *layerLRUCache) evict(current image.ID) {
 				logrus.Warnf("Layer %s is not in cache", l.ChainID)
 				continue
 			}
-			c.level -= l.DiffSize
+			c.addLevel(-layerOf(e).size)
 			delete(c.layers, l.ChainID)
+			c.layerCount--
 			c.evictList.Remove(e)
-			logrus.Infof("Evicted layer %s, %d/%d (%.3f)", l.ChainID, c.level, c.capacity, c.percent())
+			observeEviction(layerOf(e).added)
+			c.evictions.freed(layerOf(e).size)
+			batch.add(l.DiffID, false, 0)
+			logrus.Infof("Evicted layer %s, %s", l.ChainID, c.usage())
+		}
+
+	}
+
+}
+
+// defaultRetainRetries is the number of times an evicted layer no longer
+// retained by the layer store is re-acquired by default
+const defaultRetainRetries = 3
+
+// isNotRetained reports whether err is the error of releasing a layer the
+// layer store does not retain for the cache
+func isNotRetained(err error) bool {
+	return strings.Contains(strings.ToLower(err.Error()), "layer not retained")
+}
+
+// releaseEvicted releases the reference of the cache to the evicted layer
+// of cl. A layer the layer store no longer retains for the cache, as left
+// by an earlier release, is re-acquired and released again, up to
+// retainRetries times. Every reference re-acquired is released whatever
+// the outcome, so that the recovery never holds on to one.
+func (c *layerLRUCache) releaseEvicted(cl *cacheLayer, chainID layer.ChainID) ([]layer.Metadata, error) {
+	released, err := c.imageService.ReleaseReadOnlyLayer(cl.layer, cl.os)
+	for attempt := 1; err != nil && isNotRetained(err) && attempt <= c.retainRetries; attempt++ {
+		logrus.Warnf("Layer %s is not retained, re-acquiring it (%d/%d)", chainID, attempt, c.retainRetries)
+		l, getErr := c.imageService.GetReadOnlyLayer(chainID, cl.os)
+		if getErr == layer.ErrLayerDoesNotExist {
+			// the layer was deleted along with the reference of the cache
+			return releasedLayers(cl, chainID, nil), nil
 		}
+		if getErr != nil {
+			logrus.Errorf("error re-acquiring layer %s: %v", chainID, getErr)
+			return nil, err
+		}
+		cl.layer = l
+		released, err = c.imageService.ReleaseReadOnlyLayer(l, cl.os)
+	}
+	return released, err
+}
 
+// nextVictim returns the least recently used layer not used by a protected
+// image, favoring the layers only used by images preferred by the plan. The
+// layer LFU cache returns the least frequently used layer instead, the least
+// recently used going first among equals. Among layers last used at the
+// same time, the one whose images free the most unique bytes goes first.
+// The leaf layers of an image go before its base layers.
+func (c *layerLRUCache) nextVictim(plan *evictionPlan) *list.Element {
+	var (
+		victim          *list.Element
+		victimPreferred bool
+		victimFrequency float64
+		now             = timeNow()
+	)
+	for e := c.evictList.Back(); e != nil; e = e.Prev() {
+		cl := layerOf(e)
+		protected, preferred := classifyLayer(cl, plan)
+		if protected {
+			continue
+		}
+		if downloading(cl) {
+			logrus.Debugf("Layer %s is being used by a download, skip", cl.layer.ChainID())
+			continue
+		}
+		frequency := cl.frequency(now)
+		switch {
+		case victim == nil, preferred && !victimPreferred:
+			victim, victimPreferred, victimFrequency = e, preferred, frequency
+		case preferred != victimPreferred:
+			// a layer not preferred never goes before a preferred one
+		case c.byFrequency && frequency != victimFrequency:
+			if frequency < victimFrequency {
+				victim, victimFrequency = e, frequency
+			}
+		case cl.accessed.Equal(layerOf(victim).accessed):
+			if c.layerFootprint(cl) > c.layerFootprint(layerOf(victim)) {
+				victim, victimFrequency = e, frequency
+			}
+		}
 	}
+	return c.leafmost(victim, plan)
+}
 
+// classifyLayer tells whether a layer is used by a protected image, and
+// whether it is only used by images preferred by the plan
+func classifyLayer(cl *cacheLayer, plan *evictionPlan) (protected, preferred bool) {
+	preferred = len(cl.images) > 0
+	for _, id := range cl.images {
+		if plan.protected[image.ID(id)] {
+			return true, false
+		}
+		if !plan.preferred[image.ID(id)] {
+			preferred = false
+		}
+	}
+	return false, preferred
+}
+
+// downloading reports whether a pull in progress uses the layer held by cl,
+// registering it or a layer on top of it. Releasing the layer would contend
+// with the registration in the layer store, so eviction moves on to another
+// layer.
+func downloading(cl *cacheLayer) bool {
+	return cl.layer != nil && xfer.LayerDownloading(cl.layer.ChainID())
+}
+
+// leafmost descends from the layer held by e to its least recently used
+// cached child until reaching a leaf. Base layers are the most widely
+// reused, so evicting the leaves first keeps the cost of a re-pull down to
+// the small top layers.
+func (c *layerLRUCache) leafmost(e *list.Element, plan *evictionPlan) *list.Element {
+	if e == nil {
+		return nil
+	}
+	children := make(map[layer.ChainID][]*list.Element)
+	for ce := c.evictList.Back(); ce != nil; ce = ce.Prev() {
+		cl := layerOf(ce)
+		if cl.layer == nil {
+			continue
+		}
+		if parent := cl.layer.Parent(); parent != nil {
+			children[parent.ChainID()] = append(children[parent.ChainID()], ce)
+		}
+	}
+
+	for layerOf(e).layer != nil {
+		var next *list.Element
+		for _, ce := range children[layerOf(e).layer.ChainID()] {
+			if protected, _ := classifyLayer(layerOf(ce), plan); !protected && !downloading(layerOf(ce)) {
+				next = ce
+				break
+			}
+		}
+		if next == nil {
+			break
+		}
+		e = next
+	}
+	return e
+}
+
+// UniqueFootprint returns the number of bytes that removing the image would
+// free, that is the size of its layers not used by any other cached image
+func (c *layerLRUCache) UniqueFootprint(imgID image.ID) int64 {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	return c.uniqueFootprint(imgID)
+}
+
+// uniqueFootprint is UniqueFootprint for callers holding the lock
+func (c *layerLRUCache) uniqueFootprint(imgID image.ID) int64 {
+	img, ok := c.images[imgID]
+	if !ok {
+		return 0
+	}
+
+	var (
+		footprint int64
+		diffIDs   []layer.DiffID
+	)
+	for _, diffID := range img.RootFS.DiffIDs {
+		diffIDs = append(diffIDs, diffID)
+		e, ok := c.layers[layer.CreateChainID(diffIDs)]
+		if !ok {
+			continue
+		}
+		cl := layerOf(e)
+		unique := len(cl.images) > 0
+		for _, id := range cl.images {
+			if id != imgID.String() {
+				unique = false
+				break
+			}
+		}
+		if unique {
+			footprint += cl.size
+		}
+	}
+	return footprint
+}
+
+// layerFootprint returns the largest unique footprint of the images using
+// the layer
+func (c *layerLRUCache) layerFootprint(cl *cacheLayer) int64 {
+	var footprint int64
+	for _, id := range cl.images {
+		if f := c.uniqueFootprint(image.ID(id)); f > footprint {
+			footprint = f
+		}
+	}
+	return footprint
+}
+
+// Stats implements the ImageCache interface
+func (c *layerLRUCache) Stats() Stats {
+	if s := c.servedSnapshot(); s != nil {
+		return s.inProgressStats()
+	}
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	return c.fullStats()
+}
+
+// fullStats is Stats for callers holding the lock
+func (c *layerLRUCache) fullStats() Stats {
+	stats := c.stats()
+	stats.Registries = c.layerRegistryBytes()
+	return stats
+}
+
+// ReclaimableBreakdown implements the ImageCache interface. A layer is
+// pinned or in use as soon as one of the images using it is.
+func (c *layerLRUCache) ReclaimableBreakdown() Reclaimable {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	return c.reclaimable()
+}
+
+func (c *layerLRUCache) reclaimable() Reclaimable {
+	imgs := make([]*image.Image, 0, len(c.images))
+	for _, img := range c.images {
+		imgs = append(imgs, img)
+	}
+	ec := c.newEntryClassifier(imgs)
+
+	var r Reclaimable
+	for e := c.evictList.Front(); e != nil; e = e.Next() {
+		cl := layerOf(e)
+		ids := make([]image.ID, 0, len(cl.images))
+		for _, id := range cl.images {
+			ids = append(ids, image.ID(id))
+		}
+		pinned, inUse := ec.classify(ids...)
+		r.addEntry(cl.size, pinned, inUse)
+	}
+	return r
 }
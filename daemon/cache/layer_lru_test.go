@@ -0,0 +1,317 @@
+package cache
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/docker/docker/errdefs"
+	"github.com/docker/docker/image"
+	"github.com/docker/docker/layer"
+	"github.com/opencontainers/go-digest"
+	"gotest.tools/assert"
+	is "gotest.tools/assert/cmp"
+)
+
+func TestLayerLRUOldestNewest(t *testing.T) {
+	c := newLayerLRUCache(newCacheBase(100, nil)).(*layerLRUCache)
+	start := time.Now()
+
+	base := c.evictList.PushFront(&cacheLayer{images: []string{"sha256:a", "sha256:b"}, added: start, accessed: start})
+	c.evictList.PushFront(&cacheLayer{images: []string{"sha256:a"}, added: start, accessed: start.Add(time.Second)})
+	c.evictList.PushFront(&cacheLayer{images: []string{"sha256:b"}, added: start, accessed: start.Add(2 * time.Second)})
+
+	id, ts := c.Oldest()
+	assert.Check(t, is.Equal(image.ID("sha256:b"), id))
+	assert.Check(t, ts.Equal(start))
+
+	layerOf(base).accessed = start.Add(3 * time.Second)
+	c.evictList.MoveToFront(base)
+
+	id, ts = c.Oldest()
+	assert.Check(t, is.Equal(image.ID("sha256:a"), id))
+	assert.Check(t, ts.Equal(start.Add(time.Second)))
+
+	id, ts = c.Newest()
+	assert.Check(t, is.Equal(image.ID("sha256:b"), id))
+	assert.Check(t, ts.Equal(start.Add(3*time.Second)))
+}
+
+func TestUniqueFootprint(t *testing.T) {
+	dir, err := ioutil.TempDir("", "unique-footprint")
+	assert.NilError(t, err)
+	defer os.RemoveAll(dir)
+	store := newTestImageStore(t, dir)
+
+	base := layer.DiffID(digest.FromString("base"))
+	top1 := layer.DiffID(digest.FromString("top1"))
+	top2 := layer.DiffID(digest.FromString("top2"))
+	start := time.Now()
+	img1 := store.newImage(t, start, base, top1)
+	img2 := store.newImage(t, start, base, top2)
+
+	c := newLayerLRUCache(newCacheBase(1000, nil)).(*layerLRUCache)
+	putLayer := func(size int64, accessed time.Time, diffIDs []layer.DiffID, imgs ...*image.Image) {
+		cl := &cacheLayer{size: size, accessed: accessed}
+		for _, img := range imgs {
+			c.images[img.ID()] = img
+			cl.images = append(cl.images, img.ImageID())
+		}
+		c.layers[layer.CreateChainID(diffIDs)] = c.evictList.PushFront(cl)
+	}
+	putLayer(100, start, []layer.DiffID{base}, img1, img2)
+	putLayer(10, start.Add(time.Second), []layer.DiffID{base, top1}, img1)
+	putLayer(20, start.Add(time.Second), []layer.DiffID{base, top2}, img2)
+
+	assert.Check(t, is.Equal(int64(10), c.UniqueFootprint(img1.ID())))
+	assert.Check(t, is.Equal(int64(20), c.UniqueFootprint(img2.ID())))
+	assert.Check(t, is.Equal(int64(0), c.UniqueFootprint("sha256:missing")))
+
+	// once the shared base is gone, the top layers were last used at the
+	// same time, and the one freeing the most goes first
+	c.evictList.Remove(c.evictList.Back())
+	victim := c.nextVictim(&evictionPlan{})
+	assert.Check(t, is.Equal(int64(20), layerOf(victim).size))
+}
+
+func TestLayerLRUPromote(t *testing.T) {
+	dir, err := ioutil.TempDir("", "layer-promote")
+	assert.NilError(t, err)
+	defer os.RemoveAll(dir)
+	store := newTestImageStore(t, dir)
+
+	base := layer.DiffID(digest.FromString("base"))
+	top := layer.DiffID(digest.FromString("top"))
+	start := time.Now()
+	img := store.newImage(t, start, base, top)
+
+	c := newLayerLRUCache(newCacheBase(1000, nil)).(*layerLRUCache)
+	c.images[img.ID()] = img
+	baseChain := layer.CreateChainID([]layer.DiffID{base})
+	topChain := layer.CreateChainID([]layer.DiffID{base, top})
+	c.layers[baseChain] = c.evictList.PushFront(&cacheLayer{images: []string{img.ImageID()}, accessed: start})
+	c.layers[topChain] = c.evictList.PushFront(&cacheLayer{images: []string{img.ImageID()}, accessed: start})
+	other := c.evictList.PushFront(&cacheLayer{images: []string{"sha256:other"}, accessed: start})
+
+	assert.NilError(t, c.Promote(img.ID()))
+	assert.Check(t, is.Equal(c.layers[baseChain], c.evictList.Front()))
+	assert.Check(t, is.Equal(c.layers[topChain], c.evictList.Front().Next()))
+	assert.Check(t, is.Equal(other, c.evictList.Back()))
+	assert.Check(t, layerOf(c.layers[topChain]).accessed.After(start))
+
+	assert.Check(t, errdefs.IsNotFound(c.Promote("sha256:missing")))
+}
+
+func TestForeignLayersAreNotCached(t *testing.T) {
+	for _, tc := range []struct {
+		policy   string
+		newCache func(*cacheBase) ImageCache
+	}{
+		{policy: policyImageLRU, newCache: newImageLRUCache},
+		{policy: policyLayerLRU, newCache: newLayerLRUCache},
+		{policy: policyArchiveLRU, newCache: newArchiveLRUCache},
+	} {
+		b, cleanup := newFakeBackendForTest(t)
+
+		// the foreign base layer is larger than the cache
+		now := time.Now()
+		base := b.foreignLayer("windows/servercore", 1000)
+		app := b.addImage(t, now, []layer.DiffID{base, b.layer("app", 40)})
+		other := b.addImage(t, now, []layer.DiffID{base, b.layer("other", 80)})
+		c := tc.newCache(newCacheBase(100, b))
+
+		c.PutImage(app)
+		assert.Check(t, is.Equal(int64(40), c.Level()), tc.policy)
+		if tc.policy != policyImageLRU {
+			assert.Check(t, is.Equal(int64(1), c.Stats().Layers), tc.policy)
+		}
+
+		// evicting the image leaves the foreign layer to the image store
+		c.PutImage(other)
+		assert.Check(t, is.DeepEqual([]image.ID{app.ID()}, b.deleted), tc.policy)
+		assert.Check(t, is.Equal(int64(80), c.Level()), tc.policy)
+		assert.Check(t, b.hasLayer(layer.CreateChainID([]layer.DiffID{base})), tc.policy)
+		cleanup()
+	}
+}
+
+func TestMultipleLayerStores(t *testing.T) {
+	for _, tc := range []struct {
+		policy   string
+		newCache func(*cacheBase) ImageCache
+	}{
+		{policy: policyNaive, newCache: newNaiveCache},
+		{policy: policyImageLRU, newCache: newImageLRUCache},
+		{policy: policyLayerLRU, newCache: newLayerLRUCache},
+		{policy: policyArchiveLRU, newCache: newArchiveLRUCache},
+	} {
+		b, cleanup := newFakeBackendForTest(t)
+		b.stores = map[string]bool{"linux": true, "windows": true}
+
+		now := time.Now()
+		linux := b.addImageFor(t, "linux", now, []layer.DiffID{b.layer("linux", 40)})
+		windows := b.addImageFor(t, "windows", now, []layer.DiffID{b.layer("windows", 30)})
+		// the daemon has no layer store for the images of this one
+		absent := b.addImageFor(t, "solaris", now, []layer.DiffID{b.layer("solaris", 20)})
+		c := tc.newCache(newCacheBase(1000, b))
+
+		for _, img := range []*image.Image{linux, windows, absent} {
+			c.PutImage(img)
+		}
+		assert.Check(t, is.Equal(int64(70), c.Level()), tc.policy)
+
+		// the layers are released to the store they were taken from
+		for _, img := range []*image.Image{windows, linux} {
+			_, err := b.ImageDelete(img.ID().String(), false, false)
+			assert.NilError(t, err)
+			c.RemoveImage(img.ID())
+		}
+		assert.Check(t, is.Equal(int64(0), c.Level()), tc.policy)
+		assert.Check(t, is.Len(b.handles, 0), tc.policy)
+		cleanup()
+	}
+}
+
+func TestLayerSizeReadOnce(t *testing.T) {
+	for _, tc := range []struct {
+		policy   string
+		newCache func(*cacheBase) ImageCache
+	}{
+		{policy: policyLayerLRU, newCache: newLayerLRUCache},
+		{policy: policyArchiveLRU, newCache: newArchiveLRUCache},
+	} {
+		b, cleanup := newFakeBackendForTest(t)
+
+		now := time.Now()
+		base := b.layer("base", 30)
+		a := b.addImage(t, now, []layer.DiffID{base, b.layer("a", 30)})
+		bb := b.addImage(t, now.Add(time.Second), []layer.DiffID{base, b.layer("b", 30)})
+		cc := b.addImage(t, now.Add(2*time.Second), []layer.DiffID{b.layer("c", 50)})
+		layers := make(map[layer.ChainID]*fakeLayer, len(b.layers))
+		for chainID, l := range b.layers {
+			layers[chainID] = l
+		}
+		c := tc.newCache(newCacheBase(100, b))
+
+		c.PutImage(a)
+		c.PutImage(bb)
+		c.PutImage(a)
+		// the layer store reports other sizes from now on, which the cache
+		// ignores in favor of the sizes it read
+		for _, l := range layers {
+			l.diffSize++
+		}
+		c.PutImage(cc)
+		for _, img := range []*image.Image{a, bb, cc} {
+			if b.hasImage(img.ID()) {
+				_, err := b.ImageDelete(img.ID().String(), false, false)
+				assert.NilError(t, err)
+			}
+			c.RemoveImage(img.ID())
+		}
+		// the layers the eviction kept once their images were deleted
+		c.Reclaim(c.Level())
+
+		assert.Check(t, is.Equal(int64(0), c.Level()), tc.policy)
+		for chainID, l := range layers {
+			assert.Check(t, is.Equal(1, l.diffSizeCalls), "%s: layer %s", tc.policy, chainID)
+		}
+		cleanup()
+	}
+}
+
+func TestLayerLRURetainRetries(t *testing.T) {
+	for _, tc := range []struct {
+		policy   string
+		newCache func(*cacheBase) ImageCache
+	}{
+		{policy: policyLayerLRU, newCache: newLayerLRUCache},
+		{policy: policyArchiveLRU, newCache: newArchiveLRUCache},
+	} {
+		b, cleanup := newFakeBackendForTest(t)
+
+		now := time.Now()
+		diffA := b.layer("a", 60)
+		a := b.addImage(t, now, []layer.DiffID{diffA})
+		bb := b.addImage(t, now, []layer.DiffID{b.layer("b", 60)})
+		chainA := layer.CreateChainID([]layer.DiffID{diffA})
+		base := newCacheBase(100, b)
+		base.retainRetries = 2
+		c := tc.newCache(base)
+		lc := layerCacheOf(c)
+
+		// a persistent failure gives up after the retries, having released
+		// every reference it re-acquired
+		c.PutImage(a)
+		b.notRetained[chainA] = true
+		c.PutImage(bb)
+		assert.Check(t, is.Equal(4, b.acquired[chainA]), tc.policy)
+		assert.Check(t, is.Equal(b.acquired[chainA], b.releases[chainA]), tc.policy)
+		_, ok := lc.layers[chainA]
+		assert.Check(t, ok, tc.policy)
+		cleanup()
+	}
+}
+
+func TestLayerLRUReleasesLostLayer(t *testing.T) {
+	b, cleanup := newFakeBackendForTest(t)
+	defer cleanup()
+
+	now := time.Now()
+	diffA := b.layer("a", 60)
+	a := b.addImage(t, now, []layer.DiffID{diffA})
+	bb := b.addImage(t, now, []layer.DiffID{b.layer("b", 60)})
+	chainA := layer.CreateChainID([]layer.DiffID{diffA})
+	c := newLayerLRUCache(newCacheBase(100, b)).(*layerLRUCache)
+
+	// the reference of the cache is released behind its back, so that the
+	// layer is deleted along with its image, and the cache only has to
+	// forget it
+	c.PutImage(a)
+	cl := layerOf(c.layers[chainA])
+	_, err := b.ReleaseReadOnlyLayer(cl.layer, cl.os)
+	assert.NilError(t, err)
+	c.PutImage(bb)
+	_, ok := c.layers[chainA]
+	assert.Check(t, !ok)
+	assert.Check(t, !b.hasLayer(chainA))
+	assert.Check(t, is.Equal(int64(60), c.Level()))
+	assert.Check(t, is.Len(b.handles, 1))
+}
+
+func TestLayerCacheImageRecency(t *testing.T) {
+	for _, policy := range []string{policyLayerLRU, policyArchiveLRU} {
+		b, cleanup := newFakeBackendForTest(t)
+
+		now := time.Now()
+		timeNow = func() time.Time { return now }
+		base := b.layer("base", 100)
+		cold := b.addImage(t, now, []layer.DiffID{base, b.layer("cold", 10)}, "cold:latest")
+		hot := b.addImage(t, now, []layer.DiffID{base, b.layer("hot", 10)}, "hot:latest")
+
+		c := newTestCache(t, policy, newCacheBase(1000, b))
+		c.PutImage(cold)
+		now = now.Add(time.Minute)
+		c.PutImage(hot)
+		now = now.Add(time.Minute)
+		c.UpdateImage(hot.ID().String())
+
+		// the hot image keeps the shared base recent, which does not make
+		// the cold image any more recent
+		entries := c.List()
+		assert.Assert(t, is.Len(entries, 2), policy)
+		assert.Check(t, is.DeepEqual([]image.ID{cold.ID()}, entries[0].Images), policy)
+		assert.Check(t, entries[0].Accessed.Equal(now.Add(-2*time.Minute)), policy)
+		assert.Check(t, is.DeepEqual([]image.ID{hot.ID()}, entries[1].Images), policy)
+		assert.Check(t, entries[1].Accessed.Equal(now), policy)
+
+		// the layers still go by their own recency
+		lc := layerCacheOf(c)
+		assert.Check(t, is.Equal(lc.layers[layer.CreateChainID([]layer.DiffID{base})], lc.evictList.Front()), policy)
+		assert.Check(t, layerOf(lc.evictList.Front()).accessed.Equal(now), policy)
+
+		timeNow = time.Now
+		cleanup()
+	}
+}
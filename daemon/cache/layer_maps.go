@@ -0,0 +1,97 @@
+package cache
+
+import (
+	"container/list"
+	"fmt"
+	"sort"
+
+	"github.com/docker/docker/image"
+	"github.com/docker/docker/layer"
+	"github.com/sirupsen/logrus"
+)
+
+// checkMaps checks that the layers map of the cache agrees with its evict
+// list and with its images map, and returns the violations found: the
+// layers missing from the evict list or from the map, which the cache would
+// hold forever, and the images listed by a layer which are no longer
+// cached. A listed layer no cached image uses is no violation, as the
+// eviction of an image keeps its layers below the one evicted. The caller
+// must hold the lock.
+func (c *layerLRUCache) checkMaps() []string {
+	var violations []string
+	listed := make(map[*list.Element]bool)
+	for e := c.evictList.Front(); e != nil; e = e.Next() {
+		listed[e] = true
+	}
+	mapped := make(map[*list.Element]bool)
+	for chainID, e := range c.layers {
+		mapped[e] = true
+		if !listed[e] {
+			violations = append(violations, fmt.Sprintf("layer %s is not in the evict list", chainID))
+		}
+		for _, id := range layerOf(e).images {
+			if _, ok := c.images[image.ID(id)]; !ok {
+				violations = append(violations, fmt.Sprintf("layer %s lists image %s which is not cached", chainID, id))
+			}
+		}
+	}
+	for e := range listed {
+		if !mapped[e] {
+			violations = append(violations, fmt.Sprintf("layer %s is not in the layers map", chainIDOf(e)))
+		}
+	}
+	sort.Strings(violations)
+	return violations
+}
+
+// repairMaps reconciles the layers map of the cache with its evict list and
+// its images map, as checked by checkMaps: the layers missing from the
+// evict list are listed again and those missing from the map are released.
+// The images no longer cached are dropped from the layers listing them,
+// which stay in cache to be evicted in turn. The caller must hold the write
+// lock, and resync the level afterwards.
+func (c *layerLRUCache) repairMaps() {
+	violations := c.checkMaps()
+	if len(violations) == 0 {
+		return
+	}
+	for _, v := range violations {
+		logrus.Warnf("Inconsistent cache: %s", v)
+	}
+
+	listed := make(map[*list.Element]bool)
+	for e := c.evictList.Front(); e != nil; e = e.Next() {
+		listed[e] = true
+	}
+	for chainID, e := range c.layers {
+		if !listed[e] {
+			c.layers[chainID] = c.evictList.PushBack(e.Value)
+		}
+		delete(listed, e)
+		cl := layerOf(e)
+		images := cl.images[:0]
+		for _, id := range cl.images {
+			if _, ok := c.images[image.ID(id)]; ok {
+				images = append(images, id)
+			}
+		}
+		cl.images = images
+	}
+	for e := range listed {
+		cl := layerOf(e)
+		if _, err := c.imageService.ReleaseReadOnlyLayer(cl.layer, cl.os); err != nil && err != layer.ErrLayerNotRetained {
+			logrus.Errorf("error releasing layer: %v", err)
+		}
+		c.evictList.Remove(e)
+		c.layerCount--
+	}
+	logrus.Infof("Repaired %d inconsistencies of the cache", len(violations))
+}
+
+// chainIDOf returns the chain ID of the layer held by e
+func chainIDOf(e *list.Element) layer.ChainID {
+	if cl := layerOf(e); cl.layer != nil {
+		return cl.layer.ChainID()
+	}
+	return ""
+}
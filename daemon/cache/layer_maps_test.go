@@ -0,0 +1,183 @@
+package cache
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/docker/docker/image"
+	"github.com/docker/docker/layer"
+	"gotest.tools/assert"
+	is "gotest.tools/assert/cmp"
+)
+
+func TestLayerLRURemoveSharedLayers(t *testing.T) {
+	b, cleanup := newFakeBackendForTest(t)
+	defer cleanup()
+	c := newLayerLRUCache(newCacheBase(1000, b)).(*layerLRUCache)
+
+	now := time.Now()
+	base := b.layer("base", 30)
+	img1 := b.addImage(t, now, []layer.DiffID{base, b.layer("top1", 10)})
+	img2 := b.addImage(t, now, []layer.DiffID{base, b.layer("top2", 20)})
+	c.PutImage(img1)
+	c.PutImage(img2)
+	baseID := layer.CreateChainID([]layer.DiffID{base})
+
+	// the base layer stays cached, and held, while img2 uses it
+	_, err := b.ImageDelete(img1.ImageID(), true, false)
+	assert.NilError(t, err)
+	c.RemoveImage(img1.ID())
+	assert.Check(t, is.Len(c.checkMaps(), 0))
+	assert.Check(t, is.Len(c.layers, 2))
+	assert.Check(t, is.Equal(int64(50), c.Level()))
+	assert.Check(t, b.hasLayer(baseID))
+
+	// removing the last image releases all the references of the cache
+	_, err = b.ImageDelete(img2.ImageID(), true, false)
+	assert.NilError(t, err)
+	c.RemoveImage(img2.ID())
+	assert.Check(t, is.Len(c.checkMaps(), 0))
+	assert.Check(t, is.Len(c.layers, 0))
+	assert.Check(t, is.Equal(int64(0), c.Level()))
+	assert.Check(t, is.Len(b.layers, 0))
+}
+
+func TestLayerLRURemoveImageScrubsLayers(t *testing.T) {
+	for _, tc := range []struct {
+		policy   string
+		newCache func(*cacheBase) ImageCache
+	}{
+		{policy: policyLayerLRU, newCache: newLayerLRUCache},
+		{policy: policyArchiveLRU, newCache: newArchiveLRUCache},
+	} {
+		b, cleanup := newFakeBackendForTest(t)
+
+		now := time.Now()
+		base := b.layer("base", 30)
+		img1 := b.addImage(t, now, []layer.DiffID{base, b.layer("top1", 10)})
+		img2 := b.addImage(t, now, []layer.DiffID{base, b.layer("top2", 20)})
+		c := tc.newCache(newCacheBase(1000, b))
+		lc := layerCacheOf(c)
+		c.PutImage(img1)
+		c.PutImage(img2)
+		// the shared layer lists the images using it, once per use
+		c.UpdateImage(img2.ImageID())
+		c.UpdateImage(img1.ImageID())
+		shared := layerOf(lc.layers[layer.CreateChainID([]layer.DiffID{base})])
+		assert.Check(t, is.Contains(shared.images, img1.ImageID()), tc.policy)
+		assert.Check(t, is.Contains(shared.images, img2.ImageID()), tc.policy)
+
+		// the shared layer stays, listing only the image left
+		_, err := b.ImageDelete(img1.ImageID(), true, false)
+		assert.NilError(t, err, tc.policy)
+		c.RemoveImage(img1.ID())
+		assert.Check(t, is.Len(lc.layers, 2), tc.policy)
+		for _, id := range shared.images {
+			assert.Check(t, is.Equal(img2.ImageID(), id), tc.policy)
+		}
+		assert.Check(t, is.Len(lc.checkMaps(), 0), tc.policy)
+
+		// an image dropped behind the back of the layers is scrubbed by a
+		// resync, its layers staying in cache to be evicted in turn
+		delete(lc.images, img2.ID())
+		assert.Check(t, is.Contains(lc.checkMaps(), fmt.Sprintf("layer %s lists image %s which is not cached", layer.CreateChainID([]layer.DiffID{base}), img2.ImageID())), tc.policy)
+		c.Resync()
+		assert.Check(t, is.Len(lc.checkMaps(), 0), tc.policy)
+		assert.Check(t, is.Len(lc.layers, 2), tc.policy)
+		for _, e := range lc.layers {
+			assert.Check(t, is.Len(layerOf(e).images, 0), tc.policy)
+		}
+		cleanup()
+	}
+}
+
+func TestLayerLRURepairMaps(t *testing.T) {
+	for _, tc := range []struct {
+		policy     string
+		newCache   func(*cacheBase) ImageCache
+		violations int
+	}{
+		{policy: policyLayerLRU, newCache: newLayerLRUCache, violations: 2},
+		// the archive LRU cache lists img2 on the shared layer as well
+		{policy: policyArchiveLRU, newCache: newArchiveLRUCache, violations: 3},
+	} {
+		b, cleanup := newFakeBackendForTest(t)
+
+		now := time.Now()
+		base := b.layer("base", 30)
+		top1, top2 := b.layer("top1", 10), b.layer("top2", 20)
+		img1 := b.addImage(t, now, []layer.DiffID{base, top1})
+		img2 := b.addImage(t, now, []layer.DiffID{base, top2})
+		c := tc.newCache(newCacheBase(1000, b))
+		lc := layerCacheOf(c)
+		c.PutImage(img1)
+		c.PutImage(img2)
+
+		// drop img2 behind the back of its layers, and the top layer of img1
+		// from the evict list
+		delete(lc.images, img2.ID())
+		lc.evictList.Remove(lc.layers[layer.CreateChainID([]layer.DiffID{base, top1})])
+		assert.Check(t, is.Len(lc.checkMaps(), tc.violations), tc.policy)
+
+		// the top layer of img2 stays in cache, used by no image
+		drift := c.Resync()
+		assert.Check(t, is.Len(lc.checkMaps(), 0), tc.policy)
+		assert.Check(t, is.Equal(int64(60), drift.Actual), tc.policy)
+		assert.Check(t, is.Equal(int64(60), c.Level()), tc.policy)
+		assert.Check(t, is.Len(lc.layers, 3), tc.policy)
+
+		// the references of the cache are balanced: once the images are
+		// gone, removing img1 and evicting the layer left deletes every
+		// layer
+		for _, img := range []string{img1.ImageID(), img2.ImageID()} {
+			_, err := b.ImageDelete(img, true, false)
+			assert.NilError(t, err, tc.policy)
+		}
+		c.RemoveImage(img1.ID())
+		assert.Check(t, is.Equal(int64(20), c.Reclaim(20)), tc.policy)
+		assert.Check(t, is.Len(b.layers, 0), tc.policy)
+		assert.Check(t, is.Len(b.handles, 0), tc.policy)
+		cleanup()
+	}
+}
+
+func TestLayerEvictionDropsImages(t *testing.T) {
+	for _, policy := range []string{policyLayerLRU, policyLayerLFU, policyArchiveLRU} {
+		t.Run(policy, func(t *testing.T) {
+			b, cleanup := newFakeBackendForTest(t)
+			defer cleanup()
+
+			now := time.Now()
+			base := b.layer("base", 30)
+			img1 := b.addImage(t, now, []layer.DiffID{base, b.layer("top1", 10)})
+			img2 := b.addImage(t, now.Add(time.Second), []layer.DiffID{base, b.layer("top2", 20)})
+			img3 := b.addImage(t, now.Add(2*time.Second), []layer.DiffID{b.layer("other", 60)})
+			c := newTestCache(t, policy, newCacheBase(100, b))
+			lc := layerCacheOf(c)
+			c.PutImage(img1)
+			c.PutImage(img2)
+			c.PutImage(img3)
+			assert.Assert(t, len(b.deleted) > 0)
+
+			// the images evicted are gone from the cache and from the
+			// layers they used
+			listed := make(map[image.ID]bool)
+			for _, entry := range c.List() {
+				for _, id := range entry.Images {
+					listed[id] = true
+				}
+			}
+			for _, e := range lc.layers {
+				for _, id := range layerOf(e).images {
+					listed[image.ID(id)] = true
+				}
+			}
+			for _, id := range b.deleted {
+				assert.Check(t, !listed[id], "image %s", id)
+			}
+			assert.Check(t, c.CheckConsistency().Consistent())
+			assert.Check(t, is.Len(lc.checkMaps(), 0))
+		})
+	}
+}
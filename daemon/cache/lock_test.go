@@ -0,0 +1,275 @@
+package cache
+
+import (
+	"bytes"
+	"fmt"
+	"regexp"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/docker/docker/daemon/config"
+	"github.com/docker/docker/image"
+	"github.com/docker/docker/layer"
+	"github.com/sirupsen/logrus"
+	"gotest.tools/assert"
+	is "gotest.tools/assert/cmp"
+)
+
+// TestConcurrentAccess is meant to be run with -race
+func TestConcurrentAccess(t *testing.T) {
+	base := newCacheBase(100, nil)
+	base.history = newHistoryLog()
+	c := newImageLRUCache(base).(*imageLRUCache)
+	imgID := image.ID("sha256:a")
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(4)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				c.Reclaim(10)
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				c.mu.Lock()
+				c.recordEvent(imgID, EventTouch, "")
+				c.mu.Unlock()
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				c.History(imgID)
+				c.Oldest()
+				c.Newest()
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				c.Stats()
+				c.Level()
+			}
+		}()
+	}
+	wg.Wait()
+	assert.Equal(t, len(c.History(imgID)), maxHistoryEvents)
+}
+
+// TestUpdateImageRacingRemoveImage is meant to be run with -race. The image
+// is resolved and its entry moved under the same lock as its removal, so
+// that an update never touches a removed entry.
+func TestUpdateImageRacingRemoveImage(t *testing.T) {
+	for _, policy := range []string{policyNaive, policyImageLRU, policyLayerLRU, policyArchiveLRU} {
+		b, cleanup := newFakeBackendForTest(t)
+		img := b.addImage(t, time.Now(), []layer.DiffID{b.layer("a", 10)}, "a:latest")
+		c := newTestCache(t, policy, newCacheBase(100, b))
+		c.PutImage(img)
+
+		var wg sync.WaitGroup
+		for i := 0; i < 4; i++ {
+			wg.Add(2)
+			go func() {
+				defer wg.Done()
+				for j := 0; j < 100; j++ {
+					c.UpdateImage("a:latest")
+					c.UpdateImage(img.ID().String())
+				}
+			}()
+			go func() {
+				defer wg.Done()
+				for j := 0; j < 100; j++ {
+					c.RemoveImage(img.ID())
+					c.PutImage(img)
+				}
+			}()
+		}
+		wg.Wait()
+
+		assert.Check(t, is.Equal(int64(10), c.Level()), policy)
+		cleanup()
+	}
+}
+
+// TestRebuildRacingPutImage is meant to be run with -race. The images put
+// or removed while the cache is rebuilt are either accounted once or not at
+// all, whichever of the rebuild and the operation comes first.
+func TestRebuildRacingPutImage(t *testing.T) {
+	for _, policy := range []string{policyNaive, policyImageLRU, policyLayerLRU, policyArchiveLRU, "partitioned"} {
+		b, cleanup := newFakeBackendForTest(t)
+		var c ImageCache
+		if policy == "partitioned" {
+			cfg := config.New()
+			cfg.CachePolicy = policyImageLRU
+			cfg.CacheCapacity = "1000"
+			cfg.CacheNamespaces = map[string]string{"alice": "1000"}
+			var err error
+			c, err = NewImageCache(cfg, b)
+			assert.NilError(t, err)
+		} else {
+			c = newTestCache(t, policy, newCacheBase(1000, b))
+		}
+
+		now := time.Now()
+		var imgs []*image.Image
+		for i := 0; i < 8; i++ {
+			tag := fmt.Sprintf("alice/app:%d", i)
+			imgs = append(imgs, b.addImage(t, now.Add(time.Duration(i)*time.Second), []layer.DiffID{b.layer(tag, 10)}, tag))
+		}
+		for _, img := range imgs[:4] {
+			c.PutImage(img)
+		}
+
+		var wg sync.WaitGroup
+		wg.Add(3)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 20; i++ {
+				assert.Check(t, is.Nil(c.Rebuild()), policy)
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			for _, img := range imgs[4:] {
+				c.PutImage(img)
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			for _, img := range imgs[:2] {
+				_, err := b.ImageDelete(img.ID().String(), true, false)
+				assert.Check(t, is.Nil(err), policy)
+				c.RemoveImage(img.ID())
+			}
+		}()
+		wg.Wait()
+
+		assert.Check(t, is.Equal(int64(60), c.Level()), policy)
+		if pc, ok := c.(*partitionedCache); ok {
+			assert.Check(t, is.Len(pc.owners, 6), policy)
+		}
+		c.Close()
+		cleanup()
+	}
+}
+
+// TestLoggedUsageIsConsistent is meant to be run with -race. The usage of
+// each log line is read under the lock of the change it logs, so that the
+// log lines replay the changes of the level in order, and the fraction
+// logged agrees with the level.
+func TestLoggedUsageIsConsistent(t *testing.T) {
+	var buf bytes.Buffer
+	logger := logrus.StandardLogger()
+	out, level := logger.Out, logrus.GetLevel()
+	logrus.SetOutput(&buf)
+	logrus.SetLevel(logrus.InfoLevel)
+	defer func() {
+		logrus.SetOutput(out)
+		logrus.SetLevel(level)
+	}()
+	usageLine := regexp.MustCompile(`msg="(Put|Removed) (?:image|layer) \S+, (\d+)/(\d+) \(([\d.]+)\)"`)
+
+	for _, policy := range []string{policyNaive, policyImageLRU, policyLayerLRU} {
+		b, cleanup := newFakeBackendForTest(t)
+		c := newTestCache(t, policy, newCacheBase(1000, b))
+
+		var wg sync.WaitGroup
+		for i := 0; i < 8; i++ {
+			img := b.addImage(t, time.Now(), []layer.DiffID{b.layer(fmt.Sprintf("img%d", i), 10)})
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for j := 0; j < 50; j++ {
+					c.PutImage(img)
+					c.RemoveImage(img.ID())
+				}
+			}()
+		}
+		wg.Wait()
+		cleanup()
+
+		var replayed int64
+		matches := usageLine.FindAllStringSubmatch(buf.String(), -1)
+		assert.Check(t, is.Len(matches, 2*8*50), policy)
+		for _, m := range matches {
+			if m[1] == "Put" {
+				replayed += 10
+			} else {
+				replayed -= 10
+			}
+			assert.Check(t, is.Equal(strconv.FormatInt(replayed, 10), m[2]), policy)
+			assert.Check(t, is.Equal("1000", m[3]), policy)
+			assert.Check(t, is.Equal(fmt.Sprintf("%.3f", float64(replayed)/1000), m[4]), policy)
+		}
+		buf.Reset()
+	}
+}
+
+// TestConcurrentEvictionTriggers is meant to be run with -race
+func TestConcurrentEvictionTriggers(t *testing.T) {
+	for _, policy := range []string{policyNaive, policyImageLRU, policyLayerLRU} {
+		b, cleanup := newFakeBackendForTest(t)
+		// the puts go over capacity, but only the last one past the
+		// threshold triggers a pass
+		base := newCacheBase(100, b)
+		base.evictThreshold = 200
+		c := newTestCache(t, policy, base)
+
+		var imgs []*image.Image
+		for i := 0; i < 21; i++ {
+			imgs = append(imgs, b.addImage(t, time.Now(), []layer.DiffID{b.layer(fmt.Sprintf("img%d", i), 10)}))
+		}
+		var wg sync.WaitGroup
+		for _, img := range imgs {
+			wg.Add(1)
+			go func(img *image.Image) {
+				defer wg.Done()
+				c.PutImage(img)
+			}(img)
+		}
+		wg.Wait()
+
+		// the naive policy flushes every image but the last one put
+		level, deleted := int64(100), 11
+		if policy == policyNaive {
+			level, deleted = 10, 20
+		}
+		stats := c.Stats()
+		assert.Check(t, is.Equal(int64(1), stats.EvictionPasses), policy)
+		assert.Check(t, !stats.EvictionInProgress, policy)
+		assert.Check(t, is.Equal(level, c.Level()), policy)
+		assert.Check(t, is.Len(b.deleted, deleted), policy)
+
+		assert.Check(t, is.Equal(0.0, collectMetric(t, evictionInProgress).GetGauge().GetValue()), policy)
+		cleanup()
+	}
+}
+
+func TestEvictionPassNotNested(t *testing.T) {
+	b, cleanup := newFakeBackendForTest(t)
+	defer cleanup()
+	base := newCacheBase(10, b)
+	c := newImageLRUCache(base).(*imageLRUCache)
+
+	// a trigger during a pass leaves the eviction to the pass
+	c.mu.Lock()
+	endPass := c.beginEviction()
+	for _, name := range []string{"a", "b"} {
+		c.putImage(b.addImage(t, time.Now(), []layer.DiffID{b.layer(name, 10)}))
+	}
+	assert.Check(t, is.Len(b.deleted, 0))
+	endPass()
+	c.mu.Unlock()
+	assert.Check(t, is.Equal(int64(1), c.Stats().EvictionPasses))
+
+	c.mu.Lock()
+	c.evict()
+	c.mu.Unlock()
+	assert.Check(t, is.Len(b.deleted, 1))
+	assert.Check(t, is.Equal(int64(2), c.Stats().EvictionPasses))
+}
@@ -0,0 +1,52 @@
+package cache
+
+import (
+	"time"
+
+	"github.com/docker/go-metrics"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	// entryLifetime is the distribution of the time entries spend in cache
+	// before being evicted. Lifetimes skewed toward the lowest buckets are a
+	// sign of an undersized cache.
+	entryLifetime prometheus.Histogram
+	// refusedAdmissions counts the images refused by the cache for lack of
+	// free disk space
+	refusedAdmissions metrics.Counter
+	// evictionsTotal counts the images evicted from the cache, and
+	// repulledEvictionsTotal those of them put in the cache again within
+	// the re-pull window. A large share of re-pulled evictions is a sign of
+	// a cache evicting its working set.
+	evictionsTotal         metrics.Counter
+	repulledEvictionsTotal metrics.Counter
+	// evictionInProgress is the number of eviction passes in progress, one
+	// at most per cache or partition
+	evictionInProgress metrics.Gauge
+)
+
+func init() {
+	ns := metrics.NewNamespace("engine", "daemon", nil)
+	// the timers of go-metrics have buckets of up to 10 seconds, far too
+	// short for the lifetime of an entry
+	entryLifetime = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Namespace: "engine",
+		Subsystem: "daemon",
+		Name:      "cache_entry_lifetime_seconds",
+		Help:      "The time cache entries lived before being evicted",
+		// from a second up to about 48 days
+		Buckets: prometheus.ExponentialBuckets(1, 4, 12),
+	})
+	ns.Add(entryLifetime)
+	refusedAdmissions = ns.NewCounter("cache_admissions_refused", "The number of images refused by the cache for lack of free disk space")
+	evictionsTotal = ns.NewCounter("cache_evictions", "The number of images evicted from the cache")
+	repulledEvictionsTotal = ns.NewCounter("cache_evictions_repulled", "The number of evicted images put in the cache again within an hour")
+	evictionInProgress = ns.NewGauge("cache_eviction_in_progress", "The number of eviction passes in progress", "")
+	metrics.Register(ns)
+}
+
+// observeEviction records the lifetime of an evicted entry inserted at added
+func observeEviction(added time.Time) {
+	entryLifetime.Observe(timeNow().Sub(added).Seconds())
+}
@@ -0,0 +1,57 @@
+package cache
+
+import (
+	"math"
+	"testing"
+	"time"
+
+	"github.com/docker/docker/image"
+	"github.com/docker/docker/layer"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"gotest.tools/assert"
+	is "gotest.tools/assert/cmp"
+)
+
+// collectMetric returns the current value of the metric m, a counter, gauge
+// or histogram of the cache
+func collectMetric(t *testing.T, m interface{}) *dto.Metric {
+	t.Helper()
+	ch := make(chan prometheus.Metric, 1)
+	m.(prometheus.Collector).Collect(ch)
+	var out dto.Metric
+	assert.NilError(t, (<-ch).Write(&out))
+	return &out
+}
+
+func lifetimeSamples(t *testing.T) (uint64, float64) {
+	t.Helper()
+	m := collectMetric(t, entryLifetime)
+	return m.GetHistogram().GetSampleCount(), m.GetHistogram().GetSampleSum()
+}
+
+func TestEntryLifetimeObserved(t *testing.T) {
+	b, cleanup := newFakeBackendForTest(t)
+	defer cleanup()
+
+	now := time.Now()
+	defer func() { timeNow = time.Now }()
+	timeNow = func() time.Time { return now }
+
+	var imgs []*image.Image
+	for _, name := range []string{"a", "b", "c"} {
+		imgs = append(imgs, b.addImage(t, now, []layer.DiffID{b.layer(name, 40)}))
+	}
+	c := newImageLRUCache(newCacheBase(100, b)).(*imageLRUCache)
+
+	count, sum := lifetimeSamples(t)
+	c.PutImage(imgs[0])
+	now = now.Add(3 * time.Second)
+	c.PutImage(imgs[1])
+	c.PutImage(imgs[2])
+	assert.Check(t, is.DeepEqual([]image.ID{imgs[0].ID()}, b.deleted))
+
+	newCount, newSum := lifetimeSamples(t)
+	assert.Check(t, is.Equal(count+1, newCount))
+	assert.Check(t, math.Abs(newSum-sum-3) < 1e-6, "lifetime %f", newSum-sum)
+}
@@ -0,0 +1,239 @@
+package cache
+
+import (
+	"fmt"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/docker/docker/daemon/config"
+	"github.com/docker/go-units"
+)
+
+// Options are the settings of an image cache, as parsed from the daemon
+// configuration by NewImageCache. Sizes are in bytes, and the zero value of
+// a setting turns it off or leaves it at its default, except for
+// RecencyWeight which is 1 for a pure LRU order.
+type Options struct {
+	Policy   string
+	Mode     string
+	Capacity int64
+
+	// Archive keeps the layer archives, as required by the archive LRU
+	// cache, except those larger than ArchiveMaxSize or of the layers whose
+	// diffID matches one of the ArchiveExclude patterns
+	Archive        bool
+	ArchiveMaxSize int64
+	ArchiveExclude []string
+
+	Squash         bool
+	History        bool
+	Warm           bool
+	KeepRecentTags int
+	EvictionBatch  int
+	EvictThreshold int
+	MaxLayers      int
+	RetainRetries  int
+	RecencyWeight  float64
+	MissRateTarget float64
+	MemoryPressure float64
+	ScanLabel      string
+	AuditLog       string
+	// OnEvictCommand is the shell command run for each image evicted, one
+	// at a time in the background
+	OnEvictCommand string
+
+	// DiskReserve is the free disk space of Root below which the cache
+	// refuses new images
+	DiskReserve int64
+	Root        string
+
+	ResyncInterval time.Duration
+	IdleTimeout    time.Duration
+	IdleFloor      int64
+
+	SpillCapacity int64
+	Namespaces    map[string]int64
+
+	// EvictionIORate is the rate in bytes per second the layer-based
+	// caches release layers and delete archives at while evicting, unless
+	// critically over capacity
+	EvictionIORate int64
+}
+
+// parseOptions parses the cache settings of the daemon configuration
+func parseOptions(cfg *config.Config) (Options, error) {
+	opts := Options{
+		Policy:         cfg.CachePolicy,
+		Mode:           cfg.CacheMode,
+		Archive:        cfg.CacheArchive,
+		ArchiveExclude: cfg.CacheArchiveExclude,
+		Squash:         cfg.CacheSquash,
+		History:        cfg.CacheHistory,
+		Warm:           cfg.CacheWarm,
+		KeepRecentTags: cfg.CacheKeepRecentTags,
+		EvictionBatch:  cfg.CacheEvictionBatch,
+		EvictThreshold: cfg.CacheEvictThreshold,
+		MaxLayers:      cfg.CacheMaxLayers,
+		RetainRetries:  cfg.CacheRetainRetries,
+		RecencyWeight:  cfg.CacheRecencyWeight,
+		MissRateTarget: cfg.CacheMissRateTarget,
+		MemoryPressure: cfg.CacheMemoryPressure,
+		ScanLabel:      cfg.CacheScanLabel,
+		AuditLog:       cfg.CacheAuditLog,
+		OnEvictCommand: cfg.CacheOnEvictCommand,
+		Root:           cfg.Root,
+		ResyncInterval: cfg.CacheResyncInterval,
+		IdleTimeout:    cfg.CacheIdleTimeout,
+	}
+	var err error
+	if strings.Contains(cfg.CacheCapacity, "=") {
+		if cfg.CacheSpillCapacity != "" {
+			return Options{}, fmt.Errorf("the capacity of the cache spill tier is set both in the cache capacity %q and the cache spill capacity", cfg.CacheCapacity)
+		}
+		tiers, err := parseTierCapacities(cfg.CacheCapacity)
+		if err != nil {
+			return Options{}, err
+		}
+		opts.Capacity, opts.SpillCapacity = tiers[tierHot], tiers[tierSpill]
+	} else if opts.Capacity, err = units.RAMInBytes(cfg.CacheCapacity); err != nil {
+		return Options{}, fmt.Errorf("invalid cache capacity %q: %v", cfg.CacheCapacity, err)
+	}
+	for _, size := range []struct {
+		name  string
+		value string
+		size  *int64
+	}{
+		{name: "archive max size", value: cfg.CacheArchiveMaxSize, size: &opts.ArchiveMaxSize},
+		{name: "disk reserve", value: cfg.CacheDiskReserve, size: &opts.DiskReserve},
+		{name: "idle floor", value: cfg.CacheIdleFloor, size: &opts.IdleFloor},
+		{name: "spill capacity", value: cfg.CacheSpillCapacity, size: &opts.SpillCapacity},
+		{name: "eviction IO rate", value: cfg.CacheEvictionIORate, size: &opts.EvictionIORate},
+	} {
+		if size.value == "" {
+			continue
+		}
+		if *size.size, err = units.RAMInBytes(size.value); err != nil {
+			return Options{}, fmt.Errorf("invalid cache %s %q: %v", size.name, size.value, err)
+		}
+	}
+	if len(cfg.CacheNamespaces) > 0 {
+		opts.Namespaces = make(map[string]int64, len(cfg.CacheNamespaces))
+		for ns, nsCapacity := range cfg.CacheNamespaces {
+			capacity, err := units.RAMInBytes(nsCapacity)
+			if err != nil {
+				return Options{}, fmt.Errorf("invalid cache capacity %q of namespace %s: %v", nsCapacity, ns, err)
+			}
+			opts.Namespaces[ns] = capacity
+		}
+	}
+	return opts, nil
+}
+
+// tierHot and tierSpill are the tiers of a cache with a spill tier, as
+// named in the per-tier form of the cache capacity
+const (
+	tierHot   = "hot"
+	tierSpill = "spill"
+)
+
+// parseTierCapacities parses the per-tier form of the cache capacity, a
+// comma-separated list of tier=size such as "hot=2GB,spill=10GB", which
+// must set the capacity of every tier
+func parseTierCapacities(value string) (map[string]int64, error) {
+	tiers := make(map[string]int64)
+	for _, field := range strings.Split(value, ",") {
+		kv := strings.SplitN(strings.TrimSpace(field), "=", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("invalid cache capacity %q: %q is not of the form tier=size", value, field)
+		}
+		tier := strings.TrimSpace(kv[0])
+		switch tier {
+		case tierHot, tierSpill:
+		default:
+			return nil, fmt.Errorf("invalid cache capacity %q: unknown tier %q, must be %q or %q", value, tier, tierHot, tierSpill)
+		}
+		if _, ok := tiers[tier]; ok {
+			return nil, fmt.Errorf("invalid cache capacity %q: tier %q is set twice", value, tier)
+		}
+		capacity, err := units.RAMInBytes(strings.TrimSpace(kv[1]))
+		if err != nil {
+			return nil, fmt.Errorf("invalid cache capacity %q of tier %s: %v", kv[1], tier, err)
+		}
+		tiers[tier] = capacity
+	}
+	for _, tier := range []string{tierHot, tierSpill} {
+		if _, ok := tiers[tier]; !ok {
+			return nil, fmt.Errorf("invalid cache capacity %q: the capacity of tier %q is missing", value, tier)
+		}
+	}
+	return tiers, nil
+}
+
+// validate checks that the options are within bounds
+func (opts Options) validate() error {
+	if opts.Capacity <= 0 || opts.Capacity > maxCacheCapacity {
+		return fmt.Errorf("invalid cache capacity %d, must be between 1 and %d bytes", opts.Capacity, maxCacheCapacity)
+	}
+	if opts.MemoryPressure < 0 || opts.MemoryPressure > 1 {
+		return fmt.Errorf("invalid cache memory pressure threshold %.3f, must be between 0 and 1", opts.MemoryPressure)
+	}
+	if opts.EvictThreshold != 0 && opts.EvictThreshold < 100 {
+		return fmt.Errorf("invalid cache evict threshold %d%%, must be at least 100%%", opts.EvictThreshold)
+	}
+	if opts.RecencyWeight < 0 || opts.RecencyWeight > 1 {
+		return fmt.Errorf("invalid cache recency weight %.3f, must be between 0 and 1", opts.RecencyWeight)
+	}
+	if opts.MissRateTarget < 0 || opts.MissRateTarget >= 1 {
+		return fmt.Errorf("invalid cache miss rate target %.3f, must be between 0 and 1", opts.MissRateTarget)
+	}
+	if opts.MaxLayers < 0 {
+		return fmt.Errorf("invalid cache max layers %d, must not be negative", opts.MaxLayers)
+	}
+	if opts.ResyncInterval < 0 {
+		return fmt.Errorf("invalid cache resync interval %s, must not be negative", opts.ResyncInterval)
+	}
+	if opts.SpillCapacity != 0 && len(opts.Namespaces) > 0 {
+		return fmt.Errorf("a cache spill tier cannot be used with cache namespaces")
+	}
+	switch opts.Mode {
+	case "", ModeFull, ModeEvictionOnly:
+	default:
+		return fmt.Errorf("invalid cache mode %q, must be %q or %q", opts.Mode, ModeFull, ModeEvictionOnly)
+	}
+	if opts.EvictionBatch < 0 {
+		return fmt.Errorf("invalid cache eviction batch %d, must not be negative", opts.EvictionBatch)
+	}
+	if opts.RetainRetries < 0 {
+		return fmt.Errorf("invalid cache retain retries %d, must not be negative", opts.RetainRetries)
+	}
+	if opts.IdleTimeout < 0 {
+		return fmt.Errorf("invalid cache idle timeout %s, must not be negative", opts.IdleTimeout)
+	}
+	if opts.EvictionIORate < 0 {
+		return fmt.Errorf("invalid cache eviction IO rate %d, must not be negative", opts.EvictionIORate)
+	}
+	if opts.IdleFloor < 0 || opts.IdleFloor > opts.Capacity {
+		return fmt.Errorf("invalid cache idle floor %d, must be between 0 and the cache capacity", opts.IdleFloor)
+	}
+	for _, pattern := range opts.ArchiveExclude {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("invalid cache archive exclusion %q: %v", pattern, err)
+		}
+	}
+	if opts.SpillCapacity < 0 || opts.SpillCapacity > maxCacheCapacity {
+		return fmt.Errorf("invalid cache spill capacity %d, must be between 1 and %d bytes", opts.SpillCapacity, maxCacheCapacity)
+	}
+	for ns, capacity := range opts.Namespaces {
+		if capacity <= 0 || capacity > maxCacheCapacity {
+			return fmt.Errorf("invalid cache capacity %d of namespace %s, must be between 1 and %d bytes", capacity, ns, maxCacheCapacity)
+		}
+	}
+	return nil
+}
+
+// archiveEnabled reports whether the layer archives are kept, which is only
+// the case when they are used by the cache policy
+func (opts Options) archiveEnabled() bool {
+	return opts.Archive && strings.ToLower(opts.Policy) == policyArchiveLRU
+}
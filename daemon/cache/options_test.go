@@ -0,0 +1,119 @@
+package cache
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/docker/docker/daemon/config"
+	"github.com/docker/docker/image"
+	"github.com/docker/docker/layer"
+	"gotest.tools/assert"
+	is "gotest.tools/assert/cmp"
+)
+
+func TestNewImageCacheWithOptions(t *testing.T) {
+	for _, tc := range []struct {
+		policy   string
+		archive  bool
+		expected interface{}
+	}{
+		{policy: policyNaive, expected: &naiveCache{}},
+		{policy: policyImageLRU, expected: &imageLRUCache{}},
+		{policy: policyLayerLRU, expected: &layerLRUCache{}},
+		{policy: policyLayerLFU, expected: &layerLFUCache{}},
+		{policy: policyArchiveLRU, archive: true, expected: &archiveLRUCache{}},
+	} {
+		b, cleanup := newFakeBackendForTest(t)
+		img := b.addImage(t, time.Now(), []layer.DiffID{b.layer("a", 10)})
+
+		c, err := NewImageCacheWithOptions(Options{Policy: tc.policy, Capacity: 100, Archive: tc.archive, RecencyWeight: 1}, b)
+		assert.NilError(t, err, tc.policy)
+		assert.Check(t, is.Equal(fmt.Sprintf("%T", tc.expected), fmt.Sprintf("%T", c)), tc.policy)
+		// the images already in the store are loaded
+		assert.Check(t, is.Equal(int64(10), c.Level()), tc.policy)
+		assert.Check(t, is.Len(c.List(), 1), tc.policy)
+		assert.Check(t, is.DeepEqual([]image.ID{img.ID()}, c.List()[0].Images), tc.policy)
+
+		cfg := c.Config()
+		assert.Check(t, is.Equal(tc.policy, cfg.Policy), tc.policy)
+		assert.Check(t, is.Equal(int64(100), cfg.Capacity), tc.policy)
+		assert.Check(t, is.Equal(tc.archive, cfg.Archive), tc.policy)
+		assert.Check(t, is.Len(cfg.Fallbacks, 0), tc.policy)
+		c.Close()
+		cleanup()
+	}
+}
+
+func TestNewImageCacheWithOptionsValidates(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		opts     Options
+		expected string
+	}{
+		{name: "no capacity", opts: Options{Policy: policyImageLRU}, expected: "invalid cache capacity 0"},
+		{name: "idle floor", opts: Options{Policy: policyImageLRU, Capacity: 100, IdleFloor: 200}, expected: "invalid cache idle floor 200"},
+		{name: "idle timeout", opts: Options{Policy: policyImageLRU, Capacity: 100, IdleTimeout: -time.Second}, expected: "invalid cache idle timeout -1s"},
+		{name: "namespace", opts: Options{Policy: policyImageLRU, Capacity: 100, Namespaces: map[string]int64{"alice": 0}}, expected: "invalid cache capacity 0 of namespace alice"},
+		{name: "archive", opts: Options{Policy: policyArchiveLRU, Capacity: 100}, expected: `"--cache-archive" is required`},
+	} {
+		_, err := NewImageCacheWithOptions(tc.opts, nil)
+		assert.Check(t, is.ErrorContains(err, tc.expected), tc.name)
+	}
+
+	// without a policy, there is no cache
+	c, err := NewImageCacheWithOptions(Options{Capacity: 100}, nil)
+	assert.Check(t, is.Nil(err))
+	assert.Check(t, c == nil)
+}
+
+func TestParseOptionsCapacity(t *testing.T) {
+	for _, tc := range []struct {
+		capacity      string
+		spillCapacity string
+		expected      Options
+		err           string
+	}{
+		{capacity: "200m", expected: Options{Capacity: 200 << 20}},
+		{capacity: "200m", spillCapacity: "1g", expected: Options{Capacity: 200 << 20, SpillCapacity: 1 << 30}},
+		{capacity: "hot=2GB,spill=10GB", expected: Options{Capacity: 2 << 30, SpillCapacity: 10 << 30}},
+		{capacity: " spill = 10GB , hot = 2GB ", expected: Options{Capacity: 2 << 30, SpillCapacity: 10 << 30}},
+		{capacity: "lots", err: `invalid cache capacity "lots"`},
+		{capacity: "hot=2GB,archive=10GB", err: `unknown tier "archive"`},
+		{capacity: "hot=2GB", err: `the capacity of tier "spill" is missing`},
+		{capacity: "hot=2GB,hot=1GB,spill=10GB", err: `tier "hot" is set twice`},
+		{capacity: "hot=2GB,10GB", err: `"10GB" is not of the form tier=size`},
+		{capacity: "hot=lots,spill=10GB", err: `invalid cache capacity "lots" of tier hot`},
+		{capacity: "hot=2GB,spill=10GB", spillCapacity: "1g", err: "set both in the cache capacity"},
+	} {
+		opts, err := parseOptions(&config.Config{CacheCapacity: tc.capacity, CacheSpillCapacity: tc.spillCapacity})
+		if tc.err != "" {
+			assert.Check(t, is.ErrorContains(err, tc.err), tc.capacity)
+			continue
+		}
+		assert.Check(t, is.Nil(err), tc.capacity)
+		assert.Check(t, is.Equal(tc.expected.Capacity, opts.Capacity), tc.capacity)
+		assert.Check(t, is.Equal(tc.expected.SpillCapacity, opts.SpillCapacity), tc.capacity)
+	}
+}
+
+func TestNewImageCacheTierCapacities(t *testing.T) {
+	b, cleanup := newFakeBackendForTest(t)
+	defer cleanup()
+
+	opts, err := parseOptions(&config.Config{CachePolicy: policyImageLRU, CacheCapacity: "hot=100,spill=300", CacheRecencyWeight: 1})
+	assert.NilError(t, err)
+	c, err := NewImageCacheWithOptions(opts, b)
+	assert.NilError(t, err)
+	defer c.Close()
+	sc, ok := c.(*spillCache)
+	assert.Assert(t, ok, "%T", c)
+	assert.Check(t, is.Equal(int64(100), sc.Capacity()))
+	assert.Check(t, is.Equal(int64(300), sc.spill.Capacity()))
+
+	// the tiers map to the tiers of a spill cache, which other policies
+	// do not have
+	opts.Policy = policyLayerLRU
+	_, err = NewImageCacheWithOptions(opts, b)
+	assert.Check(t, is.ErrorContains(err, "a cache spill tier requires"))
+}
@@ -0,0 +1,140 @@
+package cache
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+
+	"github.com/docker/docker/image"
+	"github.com/docker/docker/pkg/ioutils"
+	"github.com/sirupsen/logrus"
+)
+
+// savedOrder is the eviction order of a cache saved on a clean shutdown, so
+// that the next start loads the images in the order they were used rather
+// than in the order they were created. The file is removed once loaded, so
+// that it is never replayed after an unclean shutdown.
+type savedOrder struct {
+	// Images are the cached images, the next in line for eviction first
+	Images []image.ID
+}
+
+// orderPath returns the path of the file the cache of the partition of ns
+// saves its eviction order to, under the daemon root
+func orderPath(root, ns string) string {
+	name := "order.json"
+	if ns != "" {
+		name = "order-" + url.PathEscape(ns) + ".json"
+	}
+	return filepath.Join(root, "image-cache", name)
+}
+
+// saveOrder writes the eviction order of the cache to its order file, if the
+// policy keeps one
+func (c *cacheBase) saveOrder() {
+	if c.orderPath == "" || c.imageOrder == nil {
+		return
+	}
+	c.mu.RLock()
+	order := savedOrder{Images: c.imageOrder()}
+	c.mu.RUnlock()
+
+	data, err := json.Marshal(order)
+	if err == nil {
+		err = os.MkdirAll(filepath.Dir(c.orderPath), 0700)
+	}
+	if err == nil {
+		err = ioutils.AtomicWriteFile(c.orderPath, data, 0600)
+	}
+	if err != nil {
+		logrus.Warnf("error saving the image cache order: %v", err)
+		return
+	}
+	logrus.Debugf("Saved the order of %d cached images to %s", len(order.Images), c.orderPath)
+}
+
+// restoreOrder reads and removes the order file of base, and returns the
+// images saved in it, none if the file is missing or unreadable
+func restoreOrder(base *cacheBase) []image.ID {
+	if base.orderPath == "" {
+		return nil
+	}
+	data, err := ioutil.ReadFile(base.orderPath)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err := os.Remove(base.orderPath); err != nil && !os.IsNotExist(err) {
+		logrus.Warnf("error removing the image cache order: %v", err)
+	}
+	var order savedOrder
+	if err == nil {
+		err = json.Unmarshal(data, &order)
+	}
+	if err != nil {
+		logrus.Warnf("error reading the image cache order, loading the images in the order they were created: %v", err)
+		return nil
+	}
+	return order.Images
+}
+
+// orderImageIDs returns the IDs of imgs in the order to load them: the
+// images missing from order first, in the order of sortImageIDs, then
+// those of order, in its order. The IDs of order no longer in imgs are
+// skipped.
+func orderImageIDs(imgs map[image.ID]*image.Image, order []image.ID) []image.ID {
+	if len(order) == 0 {
+		return sortImageIDs(imgs)
+	}
+	saved := make(map[image.ID]bool, len(order))
+	var ids []image.ID
+	for _, id := range order {
+		if _, ok := imgs[id]; ok && !saved[id] {
+			saved[id] = true
+			ids = append(ids, id)
+		}
+	}
+	var unsaved []image.ID
+	for _, id := range sortImageIDs(imgs) {
+		if !saved[id] {
+			unsaved = append(unsaved, id)
+		}
+	}
+	return append(unsaved, ids...)
+}
+
+// imageOrder returns the cached images, the next in line for eviction
+// first. The caller must hold the lock.
+func (c *imageLRUCache) imageOrder() []image.ID {
+	var ids []image.ID
+	for ci := c.evictList.front(); ci != nil; ci = c.evictList.next(ci) {
+		ids = append(ids, ci.img.ID())
+	}
+	return reverseImageIDs(ids)
+}
+
+// imageOrder returns the cached images in the order of their most recently
+// used layer, the next in line for eviction first. Loading the images in
+// that order puts the layers they share back at about the same rank. The
+// caller must hold the lock.
+func (c *layerLRUCache) imageOrder() []image.ID {
+	seen := make(map[string]bool, len(c.images))
+	var ids []image.ID
+	for e := c.evictList.Front(); e != nil; e = e.Next() {
+		for _, id := range layerOf(e).images {
+			if !seen[id] {
+				seen[id] = true
+				ids = append(ids, image.ID(id))
+			}
+		}
+	}
+	return reverseImageIDs(ids)
+}
+
+func reverseImageIDs(ids []image.ID) []image.ID {
+	for i, j := 0, len(ids)-1; i < j; i, j = i+1, j-1 {
+		ids[i], ids[j] = ids[j], ids[i]
+	}
+	return ids
+}
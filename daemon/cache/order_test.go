@@ -0,0 +1,73 @@
+package cache
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/docker/docker/image"
+	"github.com/docker/docker/layer"
+	"gotest.tools/assert"
+	is "gotest.tools/assert/cmp"
+)
+
+func TestOrderSavedAcrossRestarts(t *testing.T) {
+	for _, policy := range []string{policyImageLRU, policyLayerLRU} {
+		t.Run(policy, func(t *testing.T) {
+			b, cleanup := newFakeBackendForTest(t)
+			defer cleanup()
+			root, err := ioutil.TempDir("", "cache-order")
+			assert.NilError(t, err)
+			defer os.RemoveAll(root)
+
+			now := time.Now()
+			var imgs []*image.Image
+			for i, name := range []string{"a", "b", "c", "d"} {
+				imgs = append(imgs, b.addImage(t, now.Add(time.Duration(i)*time.Second), []layer.DiffID{b.layer(name, 10)}))
+			}
+			opts := Options{Policy: policy, Capacity: 1000, RecencyWeight: 1, Root: root}
+
+			c, err := NewImageCacheWithOptions(opts, b)
+			assert.NilError(t, err)
+			c.UpdateImage(imgs[1].ID().String())
+			c.UpdateImage(imgs[0].ID().String())
+			assert.NilError(t, c.Close())
+			_, err = os.Stat(orderPath(root, ""))
+			assert.NilError(t, err)
+
+			// the order survives the restart, d gone meanwhile, and an
+			// image added meanwhile is next in line for eviction
+			_, err = b.ImageDelete(imgs[3].ID().String(), false, false)
+			assert.NilError(t, err)
+			added := b.addImage(t, now.Add(time.Hour), []layer.DiffID{b.layer("added", 10)})
+			c, err = NewImageCacheWithOptions(opts, b)
+			assert.NilError(t, err)
+			defer c.Close()
+			for rank, img := range []*image.Image{imgs[0], imgs[1], imgs[2], added} {
+				r, _, ok := c.Position(img.ID())
+				assert.Check(t, ok)
+				assert.Check(t, is.Equal(rank, r), "image %d", rank)
+			}
+
+			// the order is only replayed once, after a clean shutdown
+			_, err = os.Stat(orderPath(root, ""))
+			assert.Check(t, os.IsNotExist(err))
+		})
+	}
+}
+
+func TestOrderImageIDs(t *testing.T) {
+	b, cleanup := newFakeBackendForTest(t)
+	defer cleanup()
+
+	now := time.Now()
+	old := b.addImage(t, now, []layer.DiffID{b.layer("old", 10)})
+	recent := b.addImage(t, now.Add(time.Second), []layer.DiffID{b.layer("recent", 10)})
+	unsaved := b.addImage(t, now.Add(time.Hour), []layer.DiffID{b.layer("unsaved", 10)})
+	imgs := b.Map()
+
+	assert.Check(t, is.DeepEqual([]image.ID{old.ID(), recent.ID(), unsaved.ID()}, orderImageIDs(imgs, nil)))
+	order := []image.ID{recent.ID(), "sha256:gone", old.ID(), recent.ID()}
+	assert.Check(t, is.DeepEqual([]image.ID{unsaved.ID(), recent.ID(), old.ID()}, orderImageIDs(imgs, order)))
+}
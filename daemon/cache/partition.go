@@ -0,0 +1,518 @@
+package cache
+
+import (
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/docker/distribution/reference"
+	"github.com/docker/docker/image"
+	"github.com/docker/go-units"
+	"github.com/sirupsen/logrus"
+)
+
+// partitionedCache splits the cache by repository namespace, the first
+// path component of the repositories an image is tagged in, so that the
+// tenants of a shared daemon neither evict each other's images nor observe
+// each other's pulls through the eviction order. Each configured namespace
+// has a partition of its own capacity, and the other images go to the
+// global partition, under the empty namespace.
+type partitionedCache struct {
+	imageService ImageBackend
+	partitions   map[string]ImageCache
+
+	mu     sync.Mutex
+	owners map[image.ID]string // namespace of the partition of the images put
+
+	// rebuilding is held for writing by Rebuild, and for reading by the
+	// operations changing the owners, so that the owners Rebuild resets and
+	// recomputes from the image store match the partitions once rebuilt
+	rebuilding sync.RWMutex
+}
+
+func newPartitionedCache(is ImageBackend) *partitionedCache {
+	return &partitionedCache{
+		imageService: is,
+		partitions:   make(map[string]ImageCache),
+		owners:       make(map[image.ID]string),
+	}
+}
+
+// namespaceBackend is the image store as seen by the partition of a
+// namespace, which only lists the images of the namespace
+type namespaceBackend struct {
+	ImageBackend
+	pc *partitionedCache
+	ns string
+}
+
+func (b *namespaceBackend) Map() map[image.ID]*image.Image {
+	imgs := make(map[image.ID]*image.Image)
+	for id, img := range b.ImageBackend.Map() {
+		if b.pc.namespaceOf(id) == b.ns {
+			imgs[id] = img
+		}
+	}
+	return imgs
+}
+
+// backendOf returns the image backend of the partition of ns
+func (c *partitionedCache) backendOf(ns string) ImageBackend {
+	return &namespaceBackend{ImageBackend: c.imageService, pc: c, ns: ns}
+}
+
+// namespaceOf returns the namespace of the partition of an image, the first
+// one of its tags falling in a configured namespace
+func (c *partitionedCache) namespaceOf(imgID image.ID) string {
+	inspect, err := c.imageService.LookupImage(imgID.String())
+	if err != nil {
+		logrus.Debugf("error looking up image %s: %v", imgID, err)
+		return ""
+	}
+	tags := append([]string(nil), inspect.RepoTags...)
+	sort.Strings(tags)
+	for _, tag := range tags {
+		if ns := repositoryNamespace(tag); ns != "" {
+			if _, ok := c.partitions[ns]; ok {
+				return ns
+			}
+		}
+	}
+	return ""
+}
+
+// repositoryNamespace returns the first path component of the repository
+// of ref, e.g. "library" for "busybox"
+func repositoryNamespace(ref string) string {
+	named, err := reference.ParseNormalizedNamed(ref)
+	if err != nil {
+		return ""
+	}
+	path := reference.Path(named)
+	i := strings.IndexByte(path, '/')
+	if i < 0 {
+		return ""
+	}
+	return path[:i]
+}
+
+// partitionOf returns the partition holding imgID, and whether it is known
+func (c *partitionedCache) partitionOf(imgID image.ID) (ImageCache, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	ns, ok := c.owners[imgID]
+	return c.partitions[ns], ok
+}
+
+// namespaces returns the namespaces of the partitions in order, the global
+// partition first
+func (c *partitionedCache) namespaces() []string {
+	namespaces := make([]string, 0, len(c.partitions))
+	for ns := range c.partitions {
+		namespaces = append(namespaces, ns)
+	}
+	sort.Strings(namespaces)
+	return namespaces
+}
+
+// Capacity implements the ImageCache interface
+func (c *partitionedCache) Capacity() int64 {
+	var capacity int64
+	for _, p := range c.partitions {
+		capacity += p.Capacity()
+	}
+	return capacity
+}
+
+// Level implements the ImageCache interface
+func (c *partitionedCache) Level() int64 {
+	var level int64
+	for _, p := range c.partitions {
+		level += p.Level()
+	}
+	return level
+}
+
+// PutImage implements the ImageCache interface
+func (c *partitionedCache) PutImage(img *image.Image) {
+	if img == nil {
+		return
+	}
+	c.rebuilding.RLock()
+	defer c.rebuilding.RUnlock()
+
+	c.mu.Lock()
+	ns, ok := c.owners[img.ID()]
+	if !ok {
+		ns = c.namespaceOf(img.ID())
+		c.owners[img.ID()] = ns
+	}
+	c.mu.Unlock()
+	c.partitions[ns].PutImage(img)
+}
+
+// UpdateImage implements the ImageCache interface. The partition resolves
+// refOrID again under its lock, in case the image is removed meanwhile.
+func (c *partitionedCache) UpdateImage(refOrID string) {
+	img, err := c.imageService.GetImage(refOrID)
+	if err != nil {
+		logrus.Warnf("error getting image: %v", err)
+		return
+	}
+	if p, ok := c.partitionOf(img.ID()); ok {
+		p.UpdateImage(refOrID)
+		return
+	}
+	logrus.Infof("Image %s is not in cache", img.ID())
+}
+
+// RemoveImage implements the ImageCache interface. Images put under
+// another ID, such as squashed images, are removed from every partition.
+func (c *partitionedCache) RemoveImage(imgID image.ID) {
+	c.rebuilding.RLock()
+	defer c.rebuilding.RUnlock()
+
+	p, ok := c.partitionOf(imgID)
+	if ok {
+		c.mu.Lock()
+		delete(c.owners, imgID)
+		c.mu.Unlock()
+		p.RemoveImage(imgID)
+		return
+	}
+	for _, p := range c.partitions {
+		p.RemoveImage(imgID)
+	}
+}
+
+// Reclaim implements the ImageCache interface. Partitions are reclaimed
+// in turn, the global partition first, until size bytes are freed.
+func (c *partitionedCache) Reclaim(size int64) int64 {
+	var freed int64
+	for _, ns := range c.namespaces() {
+		if freed >= size {
+			break
+		}
+		freed += c.partitions[ns].Reclaim(size - freed)
+	}
+	return freed
+}
+
+// Stats implements the ImageCache interface. The stats of the partitions
+// are added up, and reported by namespace.
+func (c *partitionedCache) Stats() Stats {
+	stats := Stats{Namespaces: make(map[string]Stats, len(c.partitions))}
+	var eff efficiencyCounters
+	for ns, p := range c.partitions {
+		ps := p.Stats()
+		stats.Namespaces[ns] = ps
+		eff.add(ps.Efficiency)
+		stats.Capacity += ps.Capacity
+		stats.Level += ps.Level
+		stats.Layers += ps.Layers
+		stats.FruitlessEvictions += ps.FruitlessEvictions
+		stats.EvictionPasses += ps.EvictionPasses
+		stats.EvictionInProgress = stats.EvictionInProgress || ps.EvictionInProgress
+		stats.Evictions += ps.Evictions
+		stats.RepulledEvictions += ps.RepulledEvictions
+		stats.Puts += ps.Puts
+		stats.Hits += ps.Hits
+		stats.Misses += ps.Misses
+		stats.BytesEvicted += ps.BytesEvicted
+		stats.SuggestedCapacity += ps.SuggestedCapacity
+		for registry, bytes := range ps.Registries {
+			if stats.Registries == nil {
+				stats.Registries = make(map[string]int64)
+			}
+			stats.Registries[registry] += bytes
+		}
+		if ns == "" {
+			stats.Config = ps.Config
+			stats.Pins = ps.Pins
+		}
+		if ps.EvictionDisabled {
+			stats.EvictionDisabled = true
+			if ps.EvictionDisabledUntil.After(stats.EvictionDisabledUntil) {
+				stats.EvictionDisabledUntil = ps.EvictionDisabledUntil
+			}
+		}
+	}
+	stats.CapacityHuman = units.BytesSize(float64(stats.Capacity))
+	stats.LevelHuman = units.BytesSize(float64(stats.Level))
+	stats.EvictionEfficiency = evictionEfficiency(stats.Evictions, stats.RepulledEvictions)
+	stats.Efficiency = eff.efficiency()
+	return stats
+}
+
+// Efficiency implements the ImageCache interface, adding up the counters
+// of the partitions
+func (c *partitionedCache) Efficiency() Efficiency {
+	var eff efficiencyCounters
+	for _, p := range c.partitions {
+		eff.add(p.Efficiency())
+	}
+	return eff.efficiency()
+}
+
+// ResetStats implements the ImageCache interface
+func (c *partitionedCache) ResetStats() {
+	for _, p := range c.partitions {
+		p.ResetStats()
+	}
+}
+
+// ReclaimableBreakdown implements the ImageCache interface, adding up the
+// breakdowns of the partitions
+func (c *partitionedCache) ReclaimableBreakdown() Reclaimable {
+	var r Reclaimable
+	for _, p := range c.partitions {
+		r.add(p.ReclaimableBreakdown())
+	}
+	return r
+}
+
+// OverCapacity implements the ImageCache interface, reporting whether any
+// partition is over its capacity
+func (c *partitionedCache) OverCapacity() bool {
+	for _, p := range c.partitions {
+		if p.OverCapacity() {
+			return true
+		}
+	}
+	return false
+}
+
+// Pressure implements the ImageCache interface, returning the highest
+// pressure among the partitions
+func (c *partitionedCache) Pressure() float64 {
+	var pressure float64
+	for _, p := range c.partitions {
+		if pp := p.Pressure(); pp > pressure {
+			pressure = pp
+		}
+	}
+	return pressure
+}
+
+// Oldest implements the ImageCache interface
+func (c *partitionedCache) Oldest() (image.ID, time.Time) {
+	var (
+		oldest image.ID
+		at     time.Time
+	)
+	for _, ns := range c.namespaces() {
+		id, t := c.partitions[ns].Oldest()
+		if id != "" && (oldest == "" || t.Before(at)) {
+			oldest, at = id, t
+		}
+	}
+	return oldest, at
+}
+
+// Newest implements the ImageCache interface
+func (c *partitionedCache) Newest() (image.ID, time.Time) {
+	var (
+		newest image.ID
+		at     time.Time
+	)
+	for _, ns := range c.namespaces() {
+		id, t := c.partitions[ns].Newest()
+		if id != "" && (newest == "" || t.After(at)) {
+			newest, at = id, t
+		}
+	}
+	return newest, at
+}
+
+// Promote implements the ImageCache interface
+func (c *partitionedCache) Promote(imgID image.ID) error {
+	if p, ok := c.partitionOf(imgID); ok {
+		return p.Promote(imgID)
+	}
+	for _, p := range c.partitions {
+		if err := p.Promote(imgID); err == nil {
+			return nil
+		}
+	}
+	return errNotCached(imgID)
+}
+
+// CheckConsistency implements the ImageCache interface
+func (c *partitionedCache) CheckConsistency() Drift {
+	return c.combineDrift(ImageCache.CheckConsistency)
+}
+
+// Resync implements the ImageCache interface
+func (c *partitionedCache) Resync() Drift {
+	return c.combineDrift(ImageCache.Resync)
+}
+
+// combineDrift adds up the drift of the partitions, as returned by check
+func (c *partitionedCache) combineDrift(check func(ImageCache) Drift) Drift {
+	var drift Drift
+	for _, ns := range c.namespaces() {
+		d := check(c.partitions[ns])
+		drift.Recorded += d.Recorded
+		drift.Actual += d.Actual
+		drift.Stale = append(drift.Stale, d.Stale...)
+	}
+	return drift
+}
+
+// Rebuild implements the ImageCache interface. Each partition is rebuilt
+// from the images of its namespace, the images put or removed meanwhile
+// waiting for the end of the rebuild.
+func (c *partitionedCache) Rebuild() error {
+	c.rebuilding.Lock()
+	defer c.rebuilding.Unlock()
+
+	c.mu.Lock()
+	c.owners = make(map[image.ID]string)
+	c.mu.Unlock()
+
+	var firstErr error
+	for _, ns := range c.namespaces() {
+		if err := c.partitions[ns].Rebuild(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	imgs := c.imageService.Map()
+	c.mu.Lock()
+	for id := range imgs {
+		c.owners[id] = c.namespaceOf(id)
+	}
+	c.mu.Unlock()
+	return firstErr
+}
+
+// History implements the ImageCache interface
+func (c *partitionedCache) History(imgID image.ID) []CacheEvent {
+	if p, ok := c.partitionOf(imgID); ok {
+		return p.History(imgID)
+	}
+	return c.partitions[""].History(imgID)
+}
+
+// Close implements the ImageCache interface
+func (c *partitionedCache) Close() error {
+	var firstErr error
+	for _, p := range c.partitions {
+		if err := p.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// BeginPull implements the ImageCache interface. The partition of the
+// images of ref is only known once pulled, so all of them are told.
+func (c *partitionedCache) BeginPull(ref string) {
+	for _, p := range c.partitions {
+		p.BeginPull(ref)
+	}
+}
+
+// EndPull implements the ImageCache interface
+func (c *partitionedCache) EndPull(ref string) {
+	for _, p := range c.partitions {
+		p.EndPull(ref)
+	}
+}
+
+// SquashImage implements the ImageCache interface
+func (c *partitionedCache) SquashImage(img *image.Image) (*image.Image, error) {
+	return c.partitions[""].SquashImage(img)
+}
+
+// Internal implements the ImageCache interface. Images are squashed by the
+// global partition.
+func (c *partitionedCache) Internal(imgID image.ID) bool {
+	return c.partitions[""].Internal(imgID)
+}
+
+// PinPattern implements the ImageCache interface, pinning the pattern in
+// every partition
+func (c *partitionedCache) PinPattern(pattern string) error {
+	for _, p := range c.partitions {
+		if err := p.PinPattern(pattern); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// UnpinPattern implements the ImageCache interface
+func (c *partitionedCache) UnpinPattern(pattern string) error {
+	var firstErr error
+	for _, p := range c.partitions {
+		if err := p.UnpinPattern(pattern); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// ValidatePolicy implements the ImageCache interface. The capacity is the
+// one of the global partition, and the warnings of all the partitions are
+// merged.
+func (c *partitionedCache) ValidatePolicy(policy string, capacity int64) ([]string, error) {
+	var warnings []string
+	seen := make(map[string]bool)
+	for _, ns := range c.namespaces() {
+		nsCapacity := capacity
+		if ns != "" {
+			nsCapacity = 0
+		}
+		nsWarnings, err := c.partitions[ns].ValidatePolicy(policy, nsCapacity)
+		if err != nil {
+			return nil, err
+		}
+		for _, w := range nsWarnings {
+			if !seen[w] {
+				seen[w] = true
+				warnings = append(warnings, w)
+			}
+		}
+	}
+	return warnings, nil
+}
+
+// Config implements the ImageCache interface
+func (c *partitionedCache) Config() CacheConfig {
+	return c.partitions[""].Config()
+}
+
+// ForEach implements the ImageCache interface, visiting the partitions in
+// the order of their namespaces
+func (c *partitionedCache) ForEach(fn func(CacheEntry) bool) {
+	more := true
+	for _, ns := range c.namespaces() {
+		c.partitions[ns].ForEach(func(entry CacheEntry) bool {
+			more = fn(entry)
+			return more
+		})
+		if !more {
+			return
+		}
+	}
+}
+
+// List implements the ImageCache interface, listing the partitions in the
+// order of their namespaces
+func (c *partitionedCache) List() []CacheEntry {
+	var entries []CacheEntry
+	for _, ns := range c.namespaces() {
+		entries = append(entries, c.partitions[ns].List()...)
+	}
+	return entries
+}
+
+// Reserve implements the ImageCache interface, reserving in the partition
+// of the namespace of ref
+func (c *partitionedCache) Reserve(ref string, size int64) func() {
+	if p, ok := c.partitions[repositoryNamespace(ref)]; ok {
+		return p.Reserve(ref, size)
+	}
+	return c.partitions[""].Reserve(ref, size)
+}
@@ -0,0 +1,79 @@
+package cache
+
+import (
+	"testing"
+	"time"
+
+	"github.com/docker/docker/daemon/config"
+	"github.com/docker/docker/image"
+	"github.com/docker/docker/layer"
+	"gotest.tools/assert"
+	is "gotest.tools/assert/cmp"
+)
+
+func TestRepositoryNamespace(t *testing.T) {
+	for ref, expected := range map[string]string{
+		"busybox":                           "library",
+		"alice/app:1":                       "alice",
+		"registry.example.com/team/app:1":   "team",
+		"registry.example.com/team/sub/app": "team",
+		"registry.example.com:5000/app:1":   "",
+		"not a reference":                   "",
+	} {
+		assert.Check(t, is.Equal(expected, repositoryNamespace(ref)), "ref %q", ref)
+	}
+}
+
+func TestPartitionedCacheIsolatesEviction(t *testing.T) {
+	b, cleanup := newFakeBackendForTest(t)
+	defer cleanup()
+
+	cfg := config.New()
+	cfg.CachePolicy = policyImageLRU
+	cfg.CacheCapacity = "1000"
+	cfg.CacheNamespaces = map[string]string{"alice": "100", "bob": "100"}
+	c, err := NewImageCache(cfg, b)
+	assert.NilError(t, err)
+	defer c.Close()
+
+	now := time.Now()
+	shared := b.addImage(t, now, []layer.DiffID{b.layer("busybox", 50)}, "busybox:latest")
+	bob := b.addImage(t, now, []layer.DiffID{b.layer("bob", 60)}, "bob/app:1")
+	var alice []*image.Image
+	for i, tag := range []string{"alice/app:1", "alice/app:2", "alice/app:3"} {
+		alice = append(alice, b.addImage(t, now.Add(time.Duration(i)*time.Second), []layer.DiffID{b.layer(tag, 40)}, tag))
+	}
+
+	c.PutImage(shared)
+	c.PutImage(bob)
+	for _, img := range alice {
+		c.PutImage(img)
+	}
+
+	// alice only evicts her own images, although bob's image is older
+	assert.Check(t, is.DeepEqual([]image.ID{alice[0].ID()}, b.deleted))
+	assert.NilError(t, c.Promote(bob.ID()))
+
+	stats := c.Stats()
+	assert.Check(t, is.Equal(int64(1200), stats.Capacity))
+	assert.Check(t, is.Equal(int64(190), stats.Level))
+	assert.Check(t, is.Len(stats.Namespaces, 3))
+	assert.Check(t, is.Equal(int64(80), stats.Namespaces["alice"].Level))
+	assert.Check(t, is.Equal(int64(60), stats.Namespaces["bob"].Level))
+	assert.Check(t, is.Equal(int64(50), stats.Namespaces[""].Level))
+	assert.Check(t, c.CheckConsistency().Consistent())
+
+	// the efficiency adds up the partitions
+	eff := c.Efficiency()
+	assert.Check(t, is.Equal(int64(5), eff.Inserts))
+	assert.Check(t, is.Equal(int64(1), eff.Evictions))
+	assert.Check(t, is.Equal(0.2, eff.EvictionRate))
+	assert.Check(t, is.DeepEqual(eff, stats.Efficiency))
+	c.ResetStats()
+	assert.Check(t, is.Equal(int64(0), c.Efficiency().Inserts))
+	assert.Check(t, is.Equal(int64(0), c.Efficiency().Evictions))
+
+	assert.NilError(t, c.Rebuild())
+	assert.Check(t, is.Equal(int64(190), c.Level()))
+	assert.Check(t, is.Equal(int64(80), c.Stats().Namespaces["alice"].Level))
+}
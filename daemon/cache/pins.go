@@ -0,0 +1,88 @@
+package cache
+
+import (
+	"fmt"
+	"path"
+	"sort"
+
+	"github.com/docker/docker/errdefs"
+	"github.com/docker/docker/image"
+	"github.com/sirupsen/logrus"
+)
+
+// PinPattern pins the cached images with a tag matching the glob pattern,
+// such as "registry.internal/base/*", so that they are not evicted. The
+// pattern is kept, and matched against the tags of the cached images on
+// every eviction, so that the images cached later are pinned as well.
+func (c *cacheBase) PinPattern(pattern string) error {
+	if _, err := path.Match(pattern, ""); err != nil || pattern == "" {
+		return errdefs.InvalidParameter(fmt.Errorf("invalid pin pattern %q", pattern))
+	}
+
+	c.mu.Lock()
+	defer c.unlock()
+
+	if c.pins == nil {
+		c.pins = make(map[string]bool)
+	}
+	c.pins[pattern] = true
+	logrus.Infof("Pinned images matching %s", pattern)
+	return nil
+}
+
+// UnpinPattern drops a pattern pinned by PinPattern
+func (c *cacheBase) UnpinPattern(pattern string) error {
+	c.mu.Lock()
+	defer c.unlock()
+
+	if !c.pins[pattern] {
+		return errdefs.NotFound(fmt.Errorf("pattern %q is not pinned", pattern))
+	}
+	delete(c.pins, pattern)
+	logrus.Infof("Unpinned images matching %s", pattern)
+	return nil
+}
+
+// pinPatterns returns the pinned patterns in order. The caller must hold
+// the lock.
+func (c *cacheBase) pinPatterns() []string {
+	patterns := make([]string, 0, len(c.pins))
+	for pattern := range c.pins {
+		patterns = append(patterns, pattern)
+	}
+	sort.Strings(patterns)
+	return patterns
+}
+
+// isPinned reports whether one of tags matches a pinned pattern, in its
+// familiar or fully qualified form. The caller must hold the lock.
+func (c *cacheBase) isPinned(tags []string) bool {
+	for pattern := range c.pins {
+		for _, tag := range tags {
+			if ok, _ := path.Match(pattern, tag); ok {
+				return true
+			}
+			if ok, _ := path.Match(pattern, normalizeRef(tag)); ok {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// protectPinned marks the images with a tag matching a pinned pattern as
+// protected in plan. The caller must hold the lock.
+func (c *cacheBase) protectPinned(plan *evictionPlan, imgs []*image.Image, tags map[image.ID][]string) {
+	if len(c.pins) == 0 {
+		return
+	}
+	for _, img := range imgs {
+		t, ok := tags[img.ID()]
+		if !ok {
+			t = c.tagsOf(img.ID())
+		}
+		if c.isPinned(t) {
+			plan.protected[img.ID()] = true
+		}
+	}
+}
@@ -0,0 +1,52 @@
+package cache
+
+import (
+	"testing"
+	"time"
+
+	"github.com/docker/docker/errdefs"
+	"github.com/docker/docker/image"
+	"github.com/docker/docker/layer"
+	"gotest.tools/assert"
+	is "gotest.tools/assert/cmp"
+)
+
+func TestPinPattern(t *testing.T) {
+	for _, tc := range []struct {
+		policy   string
+		newCache func(*cacheBase) ImageCache
+	}{
+		{policy: policyNaive, newCache: newNaiveCache},
+		{policy: policyImageLRU, newCache: newImageLRUCache},
+		{policy: policyLayerLRU, newCache: newLayerLRUCache},
+	} {
+		b, cleanup := newFakeBackendForTest(t)
+
+		now := time.Now()
+		c := tc.newCache(newCacheBase(100, b))
+		assert.NilError(t, c.PinPattern("registry.internal/base/*"), tc.policy)
+
+		// the images cached after the pattern is pinned are pinned as well
+		base := b.addImage(t, now, []layer.DiffID{b.layer("base", 40)}, "registry.internal/base/debian:10")
+		c.PutImage(base)
+		app := b.addImage(t, now.Add(time.Minute), []layer.DiffID{b.layer("app", 40)}, "app:1")
+		c.PutImage(app)
+		other := b.addImage(t, now.Add(2*time.Minute), []layer.DiffID{b.layer("other", 40)}, "other:1")
+		c.PutImage(other)
+		assert.Check(t, is.DeepEqual([]image.ID{app.ID()}, b.deleted), tc.policy)
+		assert.Check(t, is.DeepEqual([]string{"registry.internal/base/*"}, c.Stats().Pins), tc.policy)
+
+		// and are evicted as usual once unpinned
+		assert.NilError(t, c.UnpinPattern("registry.internal/base/*"), tc.policy)
+		c.Reclaim(c.Level())
+		assert.Check(t, is.Contains(b.deleted, base.ID()), tc.policy)
+		cleanup()
+	}
+}
+
+func TestPinPatternErrors(t *testing.T) {
+	c := newImageLRUCache(newCacheBase(100, nil))
+	assert.Check(t, errdefs.IsInvalidParameter(c.PinPattern("")))
+	assert.Check(t, errdefs.IsInvalidParameter(c.PinPattern("registry.internal/[")))
+	assert.Check(t, errdefs.IsNotFound(c.UnpinPattern("busybox")))
+}
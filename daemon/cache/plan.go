@@ -0,0 +1,97 @@
+package cache
+
+import (
+	"sort"
+
+	"github.com/docker/distribution/reference"
+	"github.com/docker/docker/image"
+	"github.com/sirupsen/logrus"
+)
+
+// evictionPlan is computed at the start of an eviction pass. It tells which
+// cached images must not be evicted, and which should be evicted first.
+type evictionPlan struct {
+	protected map[image.ID]bool
+	preferred map[image.ID]bool
+}
+
+// planEviction computes the eviction plan for the given cached images. It
+// changes nothing, so the caller only needs to hold the read lock.
+func (c *cacheBase) planEviction(imgs []*image.Image) *evictionPlan {
+	plan := &evictionPlan{
+		protected: make(map[image.ID]bool),
+		preferred: make(map[image.ID]bool),
+	}
+	tags := make(map[image.ID][]string)
+	if c.keepRecentTags > 0 {
+		for _, img := range imgs {
+			tags[img.ID()] = c.tagsOf(img.ID())
+		}
+		keep, stale := classifyRecentTags(imgs, tags, c.keepRecentTags)
+		for id := range keep {
+			plan.protected[id] = true
+		}
+		for id := range stale {
+			plan.preferred[id] = true
+		}
+	}
+	c.protectPinned(plan, imgs, tags)
+	c.protectPulling(plan, imgs, tags)
+	c.protectCommitting(plan, imgs)
+	c.protectLiveContainers(plan, imgs)
+	c.protectWarm(plan, imgs)
+	return plan
+}
+
+// lookupTags returns the tags of an image from the image service
+func (c *cacheBase) lookupTags(imgID image.ID) []string {
+	inspect, err := c.imageService.LookupImage(imgID.String())
+	if err != nil {
+		logrus.Debugf("error looking up image %s: %v", imgID, err)
+		return nil
+	}
+	return inspect.RepoTags
+}
+
+// classifyRecentTags groups the tags of the images by repository. Images
+// holding one of the n most recently created tags of a repository are kept,
+// while images whose tags are all older are stale.
+func classifyRecentTags(imgs []*image.Image, tags map[image.ID][]string, n int) (keep, stale map[image.ID]bool) {
+	type repoTag struct {
+		img *image.Image
+		tag string
+	}
+	repos := make(map[string][]repoTag)
+	for _, img := range imgs {
+		for _, tag := range tags[img.ID()] {
+			ref, err := reference.ParseNormalizedNamed(tag)
+			if err != nil {
+				continue
+			}
+			repos[ref.Name()] = append(repos[ref.Name()], repoTag{img: img, tag: tag})
+		}
+	}
+
+	keep = make(map[image.ID]bool)
+	stale = make(map[image.ID]bool)
+	for _, rts := range repos {
+		sort.Slice(rts, func(i, j int) bool {
+			ci, cj := rts[i].img.Created, rts[j].img.Created
+			if !ci.Equal(cj) {
+				return ci.After(cj)
+			}
+			return rts[i].tag < rts[j].tag
+		})
+		for i, rt := range rts {
+			if i < n {
+				keep[rt.img.ID()] = true
+			} else {
+				stale[rt.img.ID()] = true
+			}
+		}
+	}
+	for id := range keep {
+		delete(stale, id)
+	}
+	return keep, stale
+}
@@ -0,0 +1,60 @@
+package cache
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/docker/docker/image"
+	"gotest.tools/assert"
+	is "gotest.tools/assert/cmp"
+)
+
+func TestKeepRecentTags(t *testing.T) {
+	dir, err := ioutil.TempDir("", "keep-recent-tags")
+	assert.NilError(t, err)
+	defer os.RemoveAll(dir)
+	store := newTestImageStore(t, dir)
+
+	start := time.Now()
+	tags := make(map[image.ID][]string)
+	var imgs []*image.Image
+	for i := 0; i < 5; i++ {
+		img := store.newImage(t, start.Add(time.Duration(i)*time.Minute))
+		tags[img.ID()] = []string{fmt.Sprintf("registry.local/ci/app:build-%d", i)}
+		imgs = append(imgs, img)
+	}
+	other := store.newImage(t, start)
+	tags[other.ID()] = []string{"busybox:latest"}
+	imgs = append(imgs, other)
+
+	c := newImageLRUCache(newCacheBase(100, nil)).(*imageLRUCache)
+	c.keepRecentTags = 2
+	c.tagsOf = func(id image.ID) []string { return tags[id] }
+
+	// the oldest builds are the most recently used, and the newest builds
+	// are the least recently used
+	for i := 4; i >= 0; i-- {
+		ci := &cacheImage{img: imgs[i]}
+		c.images[imgs[i].ID()] = ci
+		c.evictList.pushFront(ci)
+	}
+	c.images[other.ID()] = &cacheImage{img: other}
+	c.evictList.pushBack(c.images[other.ID()])
+
+	plan := c.planEviction(imgs)
+	assert.Check(t, is.DeepEqual(map[image.ID]bool{imgs[3].ID(): true, imgs[4].ID(): true, other.ID(): true}, plan.protected))
+	assert.Check(t, is.DeepEqual(map[image.ID]bool{imgs[0].ID(): true, imgs[1].ID(): true, imgs[2].ID(): true}, plan.preferred))
+
+	// the stale builds go first, oldest used first, and the two newest
+	// builds survive
+	var evicted []image.ID
+	for ci := c.nextVictim(plan); ci != nil; ci = c.nextVictim(plan) {
+		evicted = append(evicted, ci.img.ID())
+		c.evictList.remove(ci)
+	}
+	assert.Check(t, is.DeepEqual([]image.ID{imgs[2].ID(), imgs[1].ID(), imgs[0].ID()}, evicted))
+	assert.Check(t, is.Equal(3, c.evictList.len()))
+}
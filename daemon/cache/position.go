@@ -0,0 +1,102 @@
+package cache
+
+import (
+	"github.com/docker/docker/image"
+	"github.com/docker/docker/layer"
+)
+
+// Position implements the ImageCache interface, walking the evict list from
+// the most recently used image. At a recency weight below 1, the access
+// rates also weigh on the eviction order, which the rank ignores.
+func (c *imageLRUCache) Position(imgID image.ID) (rank, total int, ok bool) {
+	if s := c.servedSnapshot(); s != nil {
+		return s.position(imgID)
+	}
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	imgID = c.cachedID(imgID)
+	if _, ok := c.images[imgID]; !ok {
+		return 0, c.evictList.len(), false
+	}
+	for ci := c.evictList.front(); ci != nil; ci = c.evictList.next(ci) {
+		if ci.img.ID() == imgID {
+			return rank, c.evictList.len(), true
+		}
+		rank++
+	}
+	return 0, c.evictList.len(), false
+}
+
+// Position implements the ImageCache interface, in the order of
+// evictionOrder, which ignores use
+func (c *naiveCache) Position(imgID image.ID) (rank, total int, ok bool) {
+	if s := c.servedSnapshot(); s != nil {
+		return s.position(imgID)
+	}
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	imgID = c.cachedID(imgID)
+	ids := c.evictionOrder(nil)
+	for i, id := range ids {
+		if id == imgID.String() {
+			return len(ids) - 1 - i, len(ids), true
+		}
+	}
+	return 0, len(ids), false
+}
+
+// Position implements the ImageCache interface. The rank is that of the
+// most recently used layer of the image, which is the last to go, out of
+// the cached layers. The layer LFU cache evicts by access count first,
+// which the rank ignores.
+func (c *layerLRUCache) Position(imgID image.ID) (rank, total int, ok bool) {
+	if s := c.servedSnapshot(); s != nil {
+		return s.position(imgID)
+	}
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	imgID = c.cachedID(imgID)
+	img, ok := c.images[imgID]
+	if !ok {
+		return 0, c.evictList.Len(), false
+	}
+	layers := make(map[layer.ChainID]bool)
+	for _, chainID := range chainIDsOf(img) {
+		layers[chainID] = true
+	}
+	for e := c.evictList.Front(); e != nil; e = e.Next() {
+		if layers[layerOf(e).layer.ChainID()] {
+			return rank, c.evictList.Len(), true
+		}
+		rank++
+	}
+	return 0, c.evictList.Len(), false
+}
+
+// Position implements the ImageCache interface, within the partition of
+// the image
+func (c *partitionedCache) Position(imgID image.ID) (rank, total int, ok bool) {
+	if p, ok := c.partitionOf(imgID); ok {
+		return p.Position(imgID)
+	}
+	for _, ns := range c.namespaces() {
+		if rank, total, ok := c.partitions[ns].Position(imgID); ok {
+			return rank, total, true
+		}
+	}
+	return 0, 0, false
+}
+
+// Position implements the ImageCache interface. The entries of the spill
+// tier rank after those of the cache, as demoted from it.
+func (c *spillCache) Position(imgID image.ID) (rank, total int, ok bool) {
+	rank, total, ok = c.ImageCache.Position(imgID)
+	spillRank, spillTotal, spilled := c.spill.Position(imgID)
+	if spilled {
+		rank, ok = total+spillRank, true
+	}
+	return rank, total + spillTotal, ok
+}
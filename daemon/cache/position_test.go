@@ -0,0 +1,110 @@
+package cache
+
+import (
+	"testing"
+	"time"
+
+	"github.com/docker/docker/daemon/config"
+	"github.com/docker/docker/image"
+	"github.com/docker/docker/layer"
+	"gotest.tools/assert"
+	is "gotest.tools/assert/cmp"
+)
+
+type position struct {
+	rank, total int
+	ok          bool
+}
+
+func positionOf(c ImageCache, imgID image.ID) position {
+	rank, total, ok := c.Position(imgID)
+	return position{rank: rank, total: total, ok: ok}
+}
+
+func TestImageLRUPosition(t *testing.T) {
+	b, cleanup := newFakeBackendForTest(t)
+	defer cleanup()
+	c := newImageLRUCache(newCacheBase(1000, b))
+
+	now := time.Now()
+	var imgs []*image.Image
+	for _, name := range []string{"a", "b", "c"} {
+		img := b.addImage(t, now, []layer.DiffID{b.layer(name, 10)})
+		imgs = append(imgs, img)
+		c.PutImage(img)
+	}
+	assert.Check(t, is.Equal(position{rank: 0, total: 3, ok: true}, positionOf(c, imgs[2].ID())))
+	assert.Check(t, is.Equal(position{rank: 2, total: 3, ok: true}, positionOf(c, imgs[0].ID())))
+
+	// a used, then b promoted: b, a, c
+	c.UpdateImage(imgs[0].ID().String())
+	assert.NilError(t, c.Promote(imgs[1].ID()))
+	assert.Check(t, is.Equal(position{rank: 0, total: 3, ok: true}, positionOf(c, imgs[1].ID())))
+	assert.Check(t, is.Equal(position{rank: 1, total: 3, ok: true}, positionOf(c, imgs[0].ID())))
+	assert.Check(t, is.Equal(position{rank: 2, total: 3, ok: true}, positionOf(c, imgs[2].ID())))
+
+	c.RemoveImage(imgs[0].ID())
+	assert.Check(t, is.Equal(position{rank: 0, total: 2, ok: false}, positionOf(c, imgs[0].ID())))
+	assert.Check(t, is.Equal(position{rank: 1, total: 2, ok: true}, positionOf(c, imgs[2].ID())))
+}
+
+func TestLayerLRUPosition(t *testing.T) {
+	for _, policy := range []string{policyLayerLRU, policyArchiveLRU} {
+		t.Run(policy, func(t *testing.T) {
+			b, cleanup := newFakeBackendForTest(t)
+			defer cleanup()
+			c := newTestCache(t, policy, newCacheBase(1000, b))
+
+			now := time.Now()
+			base := b.layer("base", 50)
+			one := b.addImage(t, now, []layer.DiffID{base, b.layer("one", 10)})
+			two := b.addImage(t, now, []layer.DiffID{base, b.layer("two", 10)})
+			other := b.addImage(t, now, []layer.DiffID{b.layer("other", 10)})
+			for _, img := range []*image.Image{one, two, other} {
+				c.PutImage(img)
+			}
+			assert.Check(t, is.Equal(position{rank: 0, total: 4, ok: true}, positionOf(c, other.ID())))
+
+			// using one moves the shared base layer to the front, and two
+			// with it
+			c.UpdateImage(one.ID().String())
+			assert.Check(t, is.Equal(position{rank: 0, total: 4, ok: true}, positionOf(c, one.ID())))
+			assert.Check(t, is.Equal(position{rank: 0, total: 4, ok: true}, positionOf(c, two.ID())))
+			assert.Check(t, is.Equal(position{rank: 2, total: 4, ok: true}, positionOf(c, other.ID())))
+
+			assert.NilError(t, c.Promote(other.ID()))
+			assert.Check(t, is.Equal(position{rank: 0, total: 4, ok: true}, positionOf(c, other.ID())))
+			assert.Check(t, is.Equal(position{rank: 1, total: 4, ok: true}, positionOf(c, two.ID())))
+		})
+	}
+}
+
+func TestPartitionedPosition(t *testing.T) {
+	b, cleanup := newFakeBackendForTest(t)
+	defer cleanup()
+
+	cfg := config.New()
+	cfg.CachePolicy = policyImageLRU
+	cfg.CacheCapacity = "1000"
+	cfg.CacheNamespaces = map[string]string{"alice": "100"}
+	c, err := NewImageCache(cfg, b)
+	assert.NilError(t, err)
+	defer c.Close()
+
+	now := time.Now()
+	shared := b.addImage(t, now, []layer.DiffID{b.layer("busybox", 10)}, "busybox:latest")
+	var alice []*image.Image
+	for _, tag := range []string{"alice/app:1", "alice/app:2"} {
+		img := b.addImage(t, now, []layer.DiffID{b.layer(tag, 10)}, tag)
+		alice = append(alice, img)
+	}
+	c.PutImage(shared)
+	for _, img := range alice {
+		c.PutImage(img)
+	}
+
+	// the position is within the partition of the image
+	assert.Check(t, is.Equal(position{rank: 0, total: 1, ok: true}, positionOf(c, shared.ID())))
+	assert.Check(t, is.Equal(position{rank: 1, total: 2, ok: true}, positionOf(c, alice[0].ID())))
+	assert.Check(t, !positionOf(c, "sha256:missing").ok)
+}
@@ -0,0 +1,101 @@
+package cache
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// memoryPressureInterval is how often the memory pressure is checked
+	memoryPressureInterval = 30 * time.Second
+	// pressureReclaimDivisor sets the share of the capacity reclaimed each
+	// time the memory pressure is above the threshold
+	pressureReclaimDivisor = 10
+)
+
+// memorySource reports the memory pressure as the fraction of memory in use
+type memorySource func() (float64, error)
+
+// hostMemoryPressure reports the memory pressure of the host, counting
+// reclaimable memory such as the page cache as available
+func hostMemoryPressure() (float64, error) {
+	f, err := os.Open("/proc/meminfo")
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	return parseMemoryPressure(f)
+}
+
+func parseMemoryPressure(r io.Reader) (float64, error) {
+	var total, available int64
+	s := bufio.NewScanner(r)
+	for s.Scan() {
+		fields := strings.Fields(s.Text())
+		if len(fields) < 2 {
+			continue
+		}
+		v, err := strconv.ParseInt(fields[1], 10, 64)
+		if err != nil {
+			continue
+		}
+		switch fields[0] {
+		case "MemTotal:":
+			total = v
+		case "MemAvailable:":
+			available = v
+		}
+	}
+	if err := s.Err(); err != nil {
+		return 0, err
+	}
+	if total <= 0 {
+		return 0, fmt.Errorf("invalid memory info, total memory: %d", total)
+	}
+	return 1 - float64(available)/float64(total), nil
+}
+
+// pressureController reclaims cache space when the memory pressure exceeds
+// a threshold, regardless of the cache level
+type pressureController struct {
+	source    memorySource
+	threshold float64
+	capacity  func() int64
+	reclaim   func(size int64) int64
+}
+
+// check reclaims part of the cache if the memory pressure is above the
+// threshold, and reports whether it did
+func (p *pressureController) check() bool {
+	pressure, err := p.source()
+	if err != nil {
+		logrus.Debugf("error getting memory pressure: %v", err)
+		return false
+	}
+	if pressure <= p.threshold {
+		return false
+	}
+	freed := p.reclaim(p.capacity() / pressureReclaimDivisor)
+	logrus.Infof("Memory pressure %.3f is above %.3f, reclaimed %d bytes", pressure, p.threshold, freed)
+	return true
+}
+
+func (p *pressureController) run(interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			p.check()
+		}
+	}
+}
@@ -0,0 +1,76 @@
+package cache
+
+import (
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"gotest.tools/assert"
+	is "gotest.tools/assert/cmp"
+)
+
+func TestParseMemoryPressure(t *testing.T) {
+	meminfo := `MemTotal:       1000 kB
+MemFree:         100 kB
+MemAvailable:    250 kB
+Buffers:          10 kB
+`
+	pressure, err := parseMemoryPressure(strings.NewReader(meminfo))
+	assert.NilError(t, err)
+	assert.Check(t, is.Equal(0.75, pressure))
+
+	_, err = parseMemoryPressure(strings.NewReader("MemFree: 100 kB\n"))
+	assert.Check(t, err != nil)
+}
+
+func TestPressureController(t *testing.T) {
+	var (
+		pressure  = 0.5
+		reclaimed []int64
+	)
+	pc := &pressureController{
+		source:    func() (float64, error) { return pressure, nil },
+		threshold: 0.8,
+		capacity:  func() int64 { return 1000 },
+		reclaim: func(size int64) int64 {
+			reclaimed = append(reclaimed, size)
+			return size
+		},
+	}
+
+	assert.Check(t, !pc.check())
+	assert.Check(t, is.Len(reclaimed, 0))
+
+	pressure = 0.9
+	assert.Check(t, pc.check())
+	assert.Check(t, is.DeepEqual([]int64{100}, reclaimed))
+}
+
+func TestPressureControllerRun(t *testing.T) {
+	var calls int32
+	pc := &pressureController{
+		source:    func() (float64, error) { return 1, nil },
+		threshold: 0.8,
+		capacity:  func() int64 { return 1000 },
+		reclaim: func(size int64) int64 {
+			atomic.AddInt32(&calls, 1)
+			return 0
+		},
+	}
+
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		pc.run(time.Millisecond, stop)
+		close(done)
+	}()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for atomic.LoadInt32(&calls) == 0 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	close(stop)
+	<-done
+	assert.Check(t, atomic.LoadInt32(&calls) > 0)
+}
@@ -0,0 +1,73 @@
+package cache
+
+import (
+	"github.com/docker/docker/image"
+)
+
+// Reclaimable breaks the level of the cache down by what keeps it from
+// being reclaimed. Its fields add up to the level.
+type Reclaimable struct {
+	// Free is held by entries eviction is free to reclaim
+	Free int64
+	// Pinned is held by entries of images the eviction protects, such as
+	// the recent tags kept, the images being pulled and the warm images
+	Pinned int64
+	// InUse is held by entries of images used by containers, which cannot
+	// be deleted
+	InUse int64
+}
+
+// addEntry adds the size of an entry to the breakdown, pinned entries
+// counting as pinned whether in use or not
+func (r *Reclaimable) addEntry(size int64, pinned, inUse bool) {
+	switch {
+	case pinned:
+		r.Pinned += size
+	case inUse:
+		r.InUse += size
+	default:
+		r.Free += size
+	}
+}
+
+func (r *Reclaimable) add(o Reclaimable) {
+	r.Free += o.Free
+	r.Pinned += o.Pinned
+	r.InUse += o.InUse
+}
+
+// entryClassifier classifies an entry of the cache by the images using it.
+// It is pinned if one of them is protected, and in use if one of them is
+// used by a container.
+type entryClassifier struct {
+	plan   *evictionPlan
+	usedBy func(image.ID) bool
+	inUse  map[image.ID]bool
+}
+
+// newEntryClassifier returns a classifier of the entries of the given
+// cached images. The caller must hold the lock, the read lock being enough.
+func (c *cacheBase) newEntryClassifier(imgs []*image.Image) *entryClassifier {
+	return &entryClassifier{
+		plan:   c.planEviction(imgs),
+		usedBy: func(id image.ID) bool { return c.imageService.ImageInUse(id) },
+		inUse:  make(map[image.ID]bool),
+	}
+}
+
+func (ec *entryClassifier) classify(ids ...image.ID) (pinned, inUse bool) {
+	for _, id := range ids {
+		if ec.plan.protected[id] {
+			pinned = true
+		}
+		used, ok := ec.inUse[id]
+		if !ok {
+			used = ec.usedBy(id)
+			ec.inUse[id] = used
+		}
+		if used {
+			inUse = true
+		}
+	}
+	return pinned, inUse
+}
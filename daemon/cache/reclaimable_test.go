@@ -0,0 +1,46 @@
+package cache
+
+import (
+	"testing"
+	"time"
+
+	"github.com/docker/docker/image"
+	"github.com/docker/docker/layer"
+	"gotest.tools/assert"
+	is "gotest.tools/assert/cmp"
+)
+
+func TestReclaimableBreakdown(t *testing.T) {
+	for _, tc := range []struct {
+		policy   string
+		newCache func(*cacheBase) ImageCache
+	}{
+		{policy: policyNaive, newCache: newNaiveCache},
+		{policy: policyImageLRU, newCache: newImageLRUCache},
+		{policy: policyLayerLRU, newCache: newLayerLRUCache},
+	} {
+		b, cleanup := newFakeBackendForTest(t)
+
+		now := time.Now()
+		imgs := make(map[string]*image.Image)
+		for i, name := range []string{"warm", "used", "free", "other"} {
+			imgs[name] = b.addImage(t, now, []layer.DiffID{b.layer(name, int64(10*(i+1)))})
+		}
+		base := newCacheBase(1000, b)
+		base.warm = true
+		c := tc.newCache(base)
+
+		c.PutImage(imgs["warm"])
+		base.warm = false
+		for _, name := range []string{"used", "free", "other"} {
+			c.PutImage(imgs[name])
+		}
+		b.inUse[imgs["used"].ID()] = true
+
+		expected := Reclaimable{Free: 70, Pinned: 10, InUse: 20}
+		r := c.ReclaimableBreakdown()
+		assert.Check(t, is.DeepEqual(expected, r), tc.policy)
+		assert.Check(t, is.Equal(c.Level(), r.Free+r.Pinned+r.InUse), tc.policy)
+		cleanup()
+	}
+}
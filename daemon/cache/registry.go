@@ -0,0 +1,82 @@
+package cache
+
+import (
+	"github.com/docker/docker/image"
+	"github.com/docker/docker/layer"
+	"github.com/sirupsen/logrus"
+)
+
+// SetRegistry records the host of the registry a cached image was pulled
+// from, replacing the one of a previous pull. The record is dropped once the
+// image is evicted or removed.
+func (c *cacheBase) SetRegistry(imgID image.ID, registry string) {
+	c.mu.Lock()
+	defer c.unlock()
+
+	c.registries[c.cachedID(imgID)] = registry
+}
+
+// registryOf returns the registry a cached image was pulled from, empty for
+// the images the cache found on disk or built locally. The caller must hold
+// the lock.
+func (c *cacheBase) registryOf(imgID image.ID) string {
+	return c.registries[imgID]
+}
+
+// registryBytes adds up the size of the entries by the registry their
+// image was pulled from, leaving out the images of no known registry
+func registryBytes(entries []CacheEntry) map[string]int64 {
+	var bytes map[string]int64
+	for _, entry := range entries {
+		if entry.Registry == "" {
+			continue
+		}
+		if bytes == nil {
+			bytes = make(map[string]int64)
+		}
+		bytes[entry.Registry] += entry.Size
+	}
+	return bytes
+}
+
+// layerRegistryBytes adds up the size of the cached layers by the registry
+// of the images using them. A layer shared by images pulled from several
+// registries counts towards each of them. The caller must hold the lock.
+func (c *layerLRUCache) layerRegistryBytes() map[string]int64 {
+	registries := make(map[layer.ChainID]map[string]bool)
+	for id, img := range c.images {
+		registry := c.registryOf(id)
+		if registry == "" {
+			continue
+		}
+		for _, chainID := range chainIDsOf(img) {
+			if _, ok := c.layers[chainID]; !ok {
+				continue
+			}
+			if registries[chainID] == nil {
+				registries[chainID] = make(map[string]bool)
+			}
+			registries[chainID][registry] = true
+		}
+	}
+	var bytes map[string]int64
+	for chainID, layerRegistries := range registries {
+		if bytes == nil {
+			bytes = make(map[string]int64)
+		}
+		for registry := range layerRegistries {
+			bytes[registry] += layerOf(c.layers[chainID]).size
+		}
+	}
+	return bytes
+}
+
+// SetRegistry implements the ImageCache interface, recording the registry
+// in the partition of the image
+func (c *partitionedCache) SetRegistry(imgID image.ID, registry string) {
+	if p, ok := c.partitionOf(imgID); ok {
+		p.SetRegistry(imgID, registry)
+		return
+	}
+	logrus.Debugf("Image %s is not in cache, not recording its registry", imgID)
+}
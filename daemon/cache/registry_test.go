@@ -0,0 +1,104 @@
+package cache
+
+import (
+	"testing"
+	"time"
+
+	"github.com/docker/docker/image"
+	"github.com/docker/docker/layer"
+	"gotest.tools/assert"
+	is "gotest.tools/assert/cmp"
+)
+
+// registriesOf returns the registry of each listed image
+func registriesOf(c ImageCache) map[image.ID]string {
+	registries := make(map[image.ID]string)
+	for _, entry := range c.List() {
+		registries[entry.Images[0]] = entry.Registry
+	}
+	return registries
+}
+
+func TestRegistryBytes(t *testing.T) {
+	for _, tc := range []struct {
+		policy   string
+		newCache func(*cacheBase) ImageCache
+	}{
+		{policy: policyNaive, newCache: newNaiveCache},
+		{policy: policyImageLRU, newCache: newImageLRUCache},
+		{policy: policyLayerLRU, newCache: newLayerLRUCache},
+	} {
+		b, cleanup := newFakeBackendForTest(t)
+
+		now := time.Now()
+		c := tc.newCache(newCacheBase(1000, b))
+		hub := b.addImage(t, now, []layer.DiffID{b.layer("hub", 10)}, "busybox:latest")
+		quay := b.addImage(t, now.Add(time.Minute), []layer.DiffID{b.layer("quay", 20)}, "quay.io/app:1")
+		quay2 := b.addImage(t, now.Add(2*time.Minute), []layer.DiffID{b.layer("quay2", 30)}, "quay.io/app:2")
+		local := b.addImage(t, now.Add(3*time.Minute), []layer.DiffID{b.layer("local", 40)}, "local:latest")
+		for _, img := range []*image.Image{hub, quay, quay2, local} {
+			c.PutImage(img)
+		}
+		c.SetRegistry(hub.ID(), "docker.io")
+		c.SetRegistry(quay.ID(), "quay.io")
+		c.SetRegistry(quay2.ID(), "quay.io")
+
+		// the image built locally belongs to no registry
+		assert.Check(t, is.DeepEqual(map[string]int64{"docker.io": 10, "quay.io": 50}, c.Stats().Registries), tc.policy)
+		expected := map[image.ID]string{hub.ID(): "docker.io", quay.ID(): "quay.io", quay2.ID(): "quay.io", local.ID(): ""}
+		assert.Check(t, is.DeepEqual(expected, registriesOf(c)), tc.policy)
+
+		c.RemoveImage(quay2.ID())
+		assert.Check(t, is.DeepEqual(map[string]int64{"docker.io": 10, "quay.io": 20}, c.Stats().Registries), tc.policy)
+
+		// the evicted image takes its registry along
+		assert.Check(t, is.Equal(int64(10), c.Reclaim(1)), tc.policy)
+		assert.Check(t, is.DeepEqual(map[string]int64{"quay.io": 20}, c.Stats().Registries), tc.policy)
+		cleanup()
+	}
+}
+
+func TestLayerRegistryBytesSharedLayers(t *testing.T) {
+	b, cleanup := newFakeBackendForTest(t)
+	defer cleanup()
+
+	now := time.Now()
+	c := newLayerLRUCache(newCacheBase(1000, b))
+	base := b.layer("base", 50)
+	hub := b.addImage(t, now, []layer.DiffID{base, b.layer("hub", 10)})
+	mirror := b.addImage(t, now, []layer.DiffID{base, b.layer("mirror", 20)})
+	c.PutImage(hub)
+	c.PutImage(mirror)
+	c.SetRegistry(hub.ID(), "docker.io")
+	c.SetRegistry(mirror.ID(), "mirror.example.com:5000")
+
+	// the shared base layer counts towards both registries
+	assert.Check(t, is.DeepEqual(map[string]int64{"docker.io": 60, "mirror.example.com:5000": 70}, c.Stats().Registries))
+	assert.Check(t, is.Equal(int64(80), c.Level()))
+}
+
+func TestSpillKeepsRegistry(t *testing.T) {
+	b, cleanup := newFakeBackendForTest(t)
+	defer cleanup()
+	c := newSpillCacheForTest(t, b)
+	defer c.Close()
+
+	now := time.Now()
+	var imgs []*image.Image
+	for _, name := range []string{"a", "b", "c"} {
+		img := b.addImage(t, now, []layer.DiffID{b.layer(name, 40)}, name+":latest")
+		imgs = append(imgs, img)
+		c.PutImage(img)
+		c.SetRegistry(img.ID(), "quay.io")
+	}
+
+	// the demoted image is accounted to its registry in the spill tier
+	stats := c.Stats()
+	assert.Check(t, is.DeepEqual(map[string]int64{"quay.io": 80}, stats.Registries))
+	assert.Assert(t, stats.Spill != nil)
+	assert.Check(t, is.DeepEqual(map[string]int64{"quay.io": 40}, stats.Spill.Registries))
+
+	// and back in the cache once promoted
+	c.UpdateImage("a:latest")
+	assert.Check(t, is.Equal("quay.io", registriesOf(c)[imgs[0].ID()]))
+}
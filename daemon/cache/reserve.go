@@ -0,0 +1,43 @@
+package cache
+
+import (
+	"sync"
+
+	"github.com/sirupsen/logrus"
+)
+
+// reserve reserves size bytes of the capacity for an image being pulled,
+// evicting through evict right away to make room for it, and returns the
+// function releasing the reservation. The reservations lower the capacity
+// the automatic eviction passes evict down to, so that concurrent pulls
+// don't overshoot the capacity together before they are put in cache.
+func (c *cacheBase) reserve(size int64, evict func()) func() {
+	if size <= 0 {
+		return func() {}
+	}
+
+	c.mu.Lock()
+	defer c.unlock()
+
+	c.reserved += size
+	logrus.Debugf("Reserved %d bytes for a pull, %d reserved, %s", size, c.reserved, c.usage())
+	evict()
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			c.mu.Lock()
+			defer c.unlock()
+			c.reserved -= size
+		})
+	}
+}
+
+// available returns the capacity left once the reservations are taken off.
+// The caller must hold the lock.
+func (c *cacheBase) available() int64 {
+	if c.reserved >= c.capacity {
+		return 0
+	}
+	return c.capacity - c.reserved
+}
@@ -0,0 +1,98 @@
+package cache
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/docker/docker/image"
+	"github.com/docker/docker/layer"
+	"gotest.tools/assert"
+	is "gotest.tools/assert/cmp"
+)
+
+func TestReserveBoundsConcurrentPulls(t *testing.T) {
+	for _, tc := range []struct {
+		policy   string
+		newCache func(*cacheBase) ImageCache
+	}{
+		{policy: policyNaive, newCache: newNaiveCache},
+		{policy: policyImageLRU, newCache: newImageLRUCache},
+		{policy: policyLayerLRU, newCache: newLayerLRUCache},
+		{policy: policyArchiveLRU, newCache: newArchiveLRUCache},
+	} {
+		b, cleanup := newFakeBackendForTest(t)
+
+		now := time.Now()
+		base := newCacheBase(100, b)
+		c := tc.newCache(base)
+		for i := 0; i < 4; i++ {
+			c.PutImage(b.addImage(t, now, []layer.DiffID{b.layer(fmt.Sprintf("old%d", i), 25)}))
+		}
+		var pulled []*image.Image
+		for i := 0; i < 4; i++ {
+			pulled = append(pulled, b.addImage(t, now.Add(time.Minute), []layer.DiffID{b.layer(fmt.Sprintf("new%d", i), 25)}))
+		}
+
+		// the level and the images being pulled together, that is the disk
+		// space used, never exceed the capacity
+		var (
+			mu       sync.Mutex
+			inflight int64
+			peak     int64
+		)
+		sample := func() {
+			level := c.Level()
+			mu.Lock()
+			if level+inflight > peak {
+				peak = level + inflight
+			}
+			mu.Unlock()
+		}
+		pull := func(delta int64) {
+			mu.Lock()
+			inflight += delta
+			mu.Unlock()
+		}
+
+		var wg sync.WaitGroup
+		for _, img := range pulled {
+			wg.Add(1)
+			go func(img *image.Image) {
+				defer wg.Done()
+				release := c.Reserve("busybox:latest", 25)
+				pull(25)
+				sample()
+				pull(-25)
+				release()
+				c.PutImage(img)
+				sample()
+			}(img)
+		}
+		wg.Wait()
+
+		assert.Check(t, peak <= 100, "%s: peak %d", tc.policy, peak)
+		assert.Check(t, is.Equal(int64(100), c.Level()), tc.policy)
+		assert.Check(t, is.Equal(int64(0), base.reserved), tc.policy)
+		assert.Check(t, is.Len(b.deleted, 4), tc.policy)
+		cleanup()
+	}
+}
+
+func TestReserveEvictsAhead(t *testing.T) {
+	b, cleanup := newFakeBackendForTest(t)
+	defer cleanup()
+
+	now := time.Now()
+	old := b.addImage(t, now, []layer.DiffID{b.layer("old", 60)})
+	c := newImageLRUCache(newCacheBase(100, b)).(*imageLRUCache)
+	c.PutImage(old)
+
+	release := c.Reserve("busybox:latest", 50)
+	assert.Check(t, is.DeepEqual([]image.ID{old.ID()}, b.deleted))
+	assert.Check(t, is.Equal(int64(50), c.reserved))
+	release()
+	release()
+	assert.Check(t, is.Equal(int64(0), c.reserved))
+}
@@ -0,0 +1,29 @@
+package cache
+
+import (
+	"time"
+
+	"github.com/docker/docker/image"
+)
+
+// scannedAt returns the time of the last vulnerability scan of img, as
+// recorded by a scanner in the scan label of its config. Images without a
+// scan label, or with a value other than an RFC 3339 time such as a failed
+// scan, are as stale as can be.
+func (c *cacheBase) scannedAt(img *image.Image) time.Time {
+	if c.scanLabel == "" || img.Config == nil {
+		return time.Time{}
+	}
+	at, err := time.Parse(time.RFC3339, img.Config.Labels[c.scanLabel])
+	if err != nil {
+		return time.Time{}
+	}
+	return at
+}
+
+// staler reports whether a was scanned before b, breaking the ties of the
+// eviction order of the image LRU cache in favor of evicting the images
+// most likely to be vulnerable. It is always false without a scan label.
+func (c *imageLRUCache) staler(a, b *cacheImage) bool {
+	return c.scanLabel != "" && a.scanned.Before(b.scanned)
+}
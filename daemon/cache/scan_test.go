@@ -0,0 +1,67 @@
+package cache
+
+import (
+	"testing"
+	"time"
+
+	containertypes "github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/image"
+	"github.com/docker/docker/layer"
+	"gotest.tools/assert"
+	is "gotest.tools/assert/cmp"
+)
+
+func TestImageLRUEvictsStaleScansFirst(t *testing.T) {
+	now := time.Now()
+	timeNow = func() time.Time { return now }
+	defer func() { timeNow = time.Now }()
+
+	scans := map[string]string{
+		"old":     now.Add(-90 * 24 * time.Hour).Format(time.RFC3339),
+		"recent":  now.Add(-time.Hour).Format(time.RFC3339),
+		"failed":  "failed",
+		"missing": "",
+	}
+	for _, tc := range []struct {
+		name     string
+		scans    []string
+		label    string
+		weight   float64
+		expected int
+	}{
+		// the ties go to the least recently used image without a label
+		{name: "no label", scans: []string{"recent", "old"}, weight: 1, expected: 0},
+		{name: "lru", scans: []string{"recent", "old"}, label: "scanned", weight: 1, expected: 1},
+		{name: "lru recent first", scans: []string{"old", "recent"}, label: "scanned", weight: 1, expected: 0},
+		{name: "failed", scans: []string{"recent", "failed"}, label: "scanned", weight: 1, expected: 1},
+		{name: "missing", scans: []string{"recent", "missing"}, label: "scanned", weight: 1, expected: 1},
+		{name: "lfu", scans: []string{"recent", "old"}, label: "scanned", weight: 0, expected: 1},
+	} {
+		b, cleanup := newFakeBackendForTest(t)
+		base := newCacheBase(100, b)
+		base.scanLabel = tc.label
+		base.recencyWeight = tc.weight
+		c := newImageLRUCache(base)
+
+		addImage := func(name, scan string) *image.Image {
+			img := b.addImage(t, now, []layer.DiffID{b.layer(tc.name+name, 40)})
+			img.Config = &containertypes.Config{Labels: map[string]string{}}
+			if scans[scan] != "" {
+				img.Config.Labels["scanned"] = scans[scan]
+			}
+			return img
+		}
+
+		// all the images are put at the same time and never used again,
+		// equal to the base policy
+		var imgs []*image.Image
+		for i, scan := range tc.scans {
+			imgs = append(imgs, addImage(scan, scan))
+			c.PutImage(imgs[i])
+		}
+		assert.Assert(t, is.Len(b.deleted, 0), tc.name)
+		c.PutImage(addImage("new", "recent"))
+		assert.Check(t, is.DeepEqual([]image.ID{imgs[tc.expected].ID()}, b.deleted), tc.name)
+		cleanup()
+	}
+}
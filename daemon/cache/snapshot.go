@@ -0,0 +1,138 @@
+package cache
+
+import (
+	"sync/atomic"
+
+	"github.com/docker/docker/image"
+	"github.com/docker/docker/layer"
+)
+
+// readSnapshot is an immutable view of a cache for its read APIs. A long
+// eviction pass holds the write lock, which would block List, Stats and
+// Position when a monitoring tool needs them most, so each pass publishes
+// a snapshot once done and the reads of the next pass serve it instead,
+// as of the end of the previous pass. The snapshot only holds what those
+// reads serve, taking it under the lock at the end of every pass: the stats
+// leave out the breakdown by registry, and the reclaimable bytes are not
+// served at all.
+type readSnapshot struct {
+	entries  []CacheEntry // in the order of List
+	stats    Stats
+	ranks    map[image.ID]int // as returned by Position
+	total    int
+	squashed map[image.ID]image.ID
+}
+
+// newSnapshot returns a snapshot of entries and of the stats of the cache,
+// along with the squashed images. The caller must hold the write lock.
+func (c *cacheBase) newSnapshot(entries []CacheEntry) *readSnapshot {
+	s := &readSnapshot{
+		entries:  entries,
+		stats:    c.stats(),
+		ranks:    make(map[image.ID]int),
+		squashed: make(map[image.ID]image.ID, len(c.squashed)),
+	}
+	for original, squashed := range c.squashed {
+		s.squashed[original] = squashed
+	}
+	return s
+}
+
+// inProgressStats returns the stats of the snapshot, served while an
+// eviction pass is in progress
+func (s *readSnapshot) inProgressStats() Stats {
+	stats := s.stats
+	stats.EvictionInProgress = true
+	return stats
+}
+
+func (s *readSnapshot) list() []CacheEntry {
+	return append([]CacheEntry(nil), s.entries...)
+}
+
+func (s *readSnapshot) position(imgID image.ID) (rank, total int, ok bool) {
+	if squashed, ok := s.squashed[imgID]; ok {
+		imgID = squashed
+	}
+	rank, ok = s.ranks[imgID]
+	return rank, s.total, ok
+}
+
+// beginEviction marks the start of an eviction pass, and returns the
+// function publishing the snapshot of the cache at its end. A pass begun
+// within the pass in progress is part of it. The caller must hold the write
+// lock.
+func (c *cacheBase) beginEviction() func() {
+	if !atomic.CompareAndSwapInt32(&c.evicting, 0, 1) {
+		return func() {}
+	}
+	c.evictionPasses++
+	evictionInProgress.Inc()
+	return func() {
+		if c.takeSnapshot != nil {
+			c.published.Store(c.takeSnapshot())
+		}
+		atomic.StoreInt32(&c.evicting, 0)
+		evictionInProgress.Dec()
+	}
+}
+
+// evictionRunning reports whether an eviction pass is in progress
+func (c *cacheBase) evictionRunning() bool {
+	return atomic.LoadInt32(&c.evicting) == 1
+}
+
+// servedSnapshot returns the snapshot the read APIs serve while an eviction
+// pass holds the write lock, nil otherwise or before the end of the first
+// pass, the read APIs then taking the lock
+func (c *cacheBase) servedSnapshot() *readSnapshot {
+	if !c.evictionRunning() {
+		return nil
+	}
+	s, _ := c.published.Load().(*readSnapshot)
+	return s
+}
+
+// snapshot takes the read snapshot of the image LRU cache
+func (c *imageLRUCache) snapshot() *readSnapshot {
+	s := c.newSnapshot(listEntries(c.forEach))
+	for ci := c.evictList.front(); ci != nil; ci = c.evictList.next(ci) {
+		s.ranks[ci.img.ID()] = s.total
+		s.total++
+	}
+	return s
+}
+
+// snapshot takes the read snapshot of the naive cache
+func (c *naiveCache) snapshot() *readSnapshot {
+	s := c.newSnapshot(listEntries(c.forEach))
+	ids := c.evictionOrder(nil)
+	for i, id := range ids {
+		s.ranks[image.ID(id)] = len(ids) - 1 - i
+	}
+	s.total = len(ids)
+	return s
+}
+
+// snapshot takes the read snapshot of the layer-based caches, which list
+// their images as entries
+func (c *layerLRUCache) snapshot(entries []CacheEntry) *readSnapshot {
+	s := c.newSnapshot(entries)
+	layers := make(map[layer.ChainID]int, len(c.layers))
+	for e := c.evictList.Front(); e != nil; e = e.Next() {
+		layers[layerOf(e).layer.ChainID()] = s.total
+		s.total++
+	}
+	for id, img := range c.images {
+		for _, chainID := range chainIDsOf(img) {
+			rank, ok := layers[chainID]
+			if !ok {
+				continue
+			}
+			if min, ok := s.ranks[id]; !ok || rank < min {
+				s.ranks[id] = rank
+			}
+		}
+	}
+	return s
+}
@@ -0,0 +1,97 @@
+package cache
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/image"
+	"github.com/docker/docker/layer"
+	"gotest.tools/assert"
+	is "gotest.tools/assert/cmp"
+)
+
+// slowDeleteBackend blocks the deletion of images, once deleting is set,
+// until release is closed
+type slowDeleteBackend struct {
+	*fakeImageBackend
+	deleting chan struct{}
+	release  chan struct{}
+}
+
+func (b *slowDeleteBackend) ImageDelete(imageRef string, force, prune bool) ([]types.ImageDeleteResponseItem, error) {
+	if b.deleting != nil {
+		close(b.deleting)
+		b.deleting = nil
+		<-b.release
+	}
+	return b.fakeImageBackend.ImageDelete(imageRef, force, prune)
+}
+
+func TestReadsDuringSlowEviction(t *testing.T) {
+	for _, tc := range []struct {
+		policy   string
+		newCache func(*cacheBase) ImageCache
+	}{
+		{policy: policyNaive, newCache: newNaiveCache},
+		{policy: policyImageLRU, newCache: newImageLRUCache},
+		{policy: policyLayerLRU, newCache: newLayerLRUCache},
+		{policy: policyArchiveLRU, newCache: newArchiveLRUCache},
+	} {
+		fb, cleanup := newFakeBackendForTest(t)
+		b := &slowDeleteBackend{fakeImageBackend: fb}
+		c := tc.newCache(newCacheBase(1000, b))
+
+		now := time.Now()
+		var imgs []*image.Image
+		for i := 0; i < 4; i++ {
+			name := fmt.Sprintf("img%d", i)
+			img := fb.addImage(t, now.Add(time.Duration(i)*time.Minute), []layer.DiffID{fb.layer(name, 20)})
+			imgs = append(imgs, img)
+			c.PutImage(img)
+		}
+		// a first pass publishes the snapshot
+		assert.Check(t, is.Equal(int64(20), c.Reclaim(20)), tc.policy)
+
+		// the next pass holds the write lock until released
+		b.deleting = make(chan struct{})
+		b.release = make(chan struct{})
+		deleting := b.deleting
+		evicted := make(chan int64)
+		go func() {
+			evicted <- c.Reclaim(20)
+		}()
+		<-deleting
+
+		read := make(chan struct{})
+		var (
+			entries []CacheEntry
+			stats   Stats
+			rank    int
+			ok      bool
+		)
+		go func() {
+			defer close(read)
+			entries = c.List()
+			stats = c.Stats()
+			rank, _, ok = c.Position(imgs[3].ID())
+		}()
+		select {
+		case <-read:
+		case <-time.After(10 * time.Second):
+			t.Fatalf("%s: reads blocked by the eviction", tc.policy)
+		}
+		// the reads are as of the end of the first pass
+		assert.Check(t, is.Len(entries, 3), tc.policy)
+		assert.Check(t, is.Equal(int64(60), stats.Level), tc.policy)
+		assert.Check(t, ok, tc.policy)
+		assert.Check(t, is.Equal(0, rank), tc.policy)
+
+		close(b.release)
+		assert.Check(t, is.Equal(int64(20), <-evicted), tc.policy)
+		assert.Check(t, is.Len(c.List(), 2), tc.policy)
+		assert.Check(t, is.Equal(int64(40), c.Stats().Level), tc.policy)
+		cleanup()
+	}
+}
@@ -0,0 +1,261 @@
+package cache
+
+import (
+	"sort"
+	"sync"
+
+	"github.com/docker/docker/image"
+	"github.com/sirupsen/logrus"
+)
+
+// spillCache puts a spill tier behind the cache, for operators with a
+// larger and slower tier of storage: the images the cache evicts are
+// demoted to the spill tier instead of being deleted, and promoted back to
+// the cache when pulled or used again. The spill tier is an image LRU cache
+// of its own capacity and image backend, and deletes the images it evicts.
+type spillCache struct {
+	ImageCache
+	imageService ImageBackend
+	spill        *imageLRUCache
+
+	mu      sync.Mutex
+	spilled map[image.ID]bool // images demoted to the spill tier
+}
+
+func newSpillCache(is ImageBackend) *spillCache {
+	return &spillCache{
+		imageService: is,
+		spilled:      make(map[image.ID]bool),
+	}
+}
+
+// spillBackend is the image store as seen by one of the tiers, which only
+// lists the images of the tier
+type spillBackend struct {
+	ImageBackend
+	sc      *spillCache
+	spilled bool
+}
+
+func (b *spillBackend) Map() map[image.ID]*image.Image {
+	imgs := b.ImageBackend.Map()
+	b.sc.mu.Lock()
+	defer b.sc.mu.Unlock()
+	// forget the spilled images the spill tier has deleted since
+	for id := range b.sc.spilled {
+		if _, ok := imgs[id]; !ok {
+			delete(b.sc.spilled, id)
+		}
+	}
+	for id := range imgs {
+		if b.sc.spilled[id] != b.spilled {
+			delete(imgs, id)
+		}
+	}
+	return imgs
+}
+
+// backendOf returns the image backend of the spill tier if spilled is set,
+// and of the cache otherwise
+func (c *spillCache) backendOf(spilled bool) ImageBackend {
+	return &spillBackend{ImageBackend: c.imageService, sc: c, spilled: spilled}
+}
+
+// demote hands an image evicted by the cache over to the spill tier, along
+// with the registry it was pulled from, and reports whether the tier took
+// it. It is called under the lock of the cache, and only takes the lock of
+// the spill tier.
+func (c *spillCache) demote(img *image.Image, registry string) bool {
+	c.spill.PutImage(img)
+	if !c.spill.contains(img.ID()) {
+		return false
+	}
+	if registry != "" {
+		c.spill.SetRegistry(img.ID(), registry)
+	}
+	c.mu.Lock()
+	c.spilled[img.ID()] = true
+	c.mu.Unlock()
+	logrus.Infof("Demoted image %s to the spill tier", img.ID())
+	return true
+}
+
+// unspill forgets that imgID is spilled, removing it from the spill tier,
+// and reports whether it was
+func (c *spillCache) unspill(imgID image.ID) bool {
+	c.mu.Lock()
+	spilled := c.spilled[imgID]
+	delete(c.spilled, imgID)
+	c.mu.Unlock()
+	if spilled {
+		c.spill.RemoveImage(imgID)
+	}
+	return spilled
+}
+
+// promote moves a spilled image back to the cache, along with the registry
+// it was pulled from, and reports whether it was spilled
+func (c *spillCache) promote(img *image.Image) bool {
+	c.spill.mu.RLock()
+	registry := c.spill.registryOf(img.ID())
+	c.spill.mu.RUnlock()
+	if !c.unspill(img.ID()) {
+		return false
+	}
+	logrus.Infof("Promoting image %s from the spill tier", img.ID())
+	c.ImageCache.PutImage(img)
+	if registry != "" {
+		c.ImageCache.SetRegistry(img.ID(), registry)
+	}
+	return true
+}
+
+// PutImage implements the ImageCache interface, promoting the image if it
+// was spilled
+func (c *spillCache) PutImage(img *image.Image) {
+	if img == nil {
+		return
+	}
+	if !c.promote(img) {
+		c.ImageCache.PutImage(img)
+	}
+}
+
+// UpdateImage implements the ImageCache interface. A use of a spilled
+// image promotes it back to the cache.
+func (c *spillCache) UpdateImage(refOrID string) {
+	img, err := c.imageService.GetImage(refOrID)
+	if err != nil {
+		logrus.Warnf("error getting image: %v", err)
+		return
+	}
+	c.promote(img)
+	c.ImageCache.UpdateImage(refOrID)
+}
+
+// RemoveImage implements the ImageCache interface
+func (c *spillCache) RemoveImage(imgID image.ID) {
+	if c.unspill(imgID) {
+		return
+	}
+	c.ImageCache.RemoveImage(imgID)
+}
+
+// Promote implements the ImageCache interface, moving a spilled image back
+// to the front of the cache
+func (c *spillCache) Promote(imgID image.ID) error {
+	if img, err := c.imageService.GetImage(imgID.String()); err == nil {
+		c.promote(img)
+	}
+	return c.ImageCache.Promote(imgID)
+}
+
+// Reclaim implements the ImageCache interface. The spill tier is reclaimed
+// first, as demoting the images of the cache deletes nothing.
+func (c *spillCache) Reclaim(size int64) int64 {
+	freed := c.spill.Reclaim(size)
+	if freed < size {
+		freed += c.ImageCache.Reclaim(size - freed)
+	}
+	return freed
+}
+
+// Stats implements the ImageCache interface, reporting the stats of the
+// spill tier along with those of the cache
+func (c *spillCache) Stats() Stats {
+	stats := c.ImageCache.Stats()
+	spill := c.spill.Stats()
+	stats.Spill = &spill
+	return stats
+}
+
+// ResetStats implements the ImageCache interface, resetting the stats of
+// both tiers. The efficiency of the cache is that of the first tier, and
+// that of the spill tier is reported with its stats.
+func (c *spillCache) ResetStats() {
+	c.ImageCache.ResetStats()
+	c.spill.ResetStats()
+}
+
+// CheckConsistency implements the ImageCache interface
+func (c *spillCache) CheckConsistency() Drift {
+	return c.combineDrift(ImageCache.CheckConsistency)
+}
+
+// Resync implements the ImageCache interface
+func (c *spillCache) Resync() Drift {
+	return c.combineDrift(ImageCache.Resync)
+}
+
+// combineDrift adds up the drift of the tiers, as returned by check
+func (c *spillCache) combineDrift(check func(ImageCache) Drift) Drift {
+	drift := check(c.ImageCache)
+	d := check(c.spill)
+	drift.Recorded += d.Recorded
+	drift.Actual += d.Actual
+	drift.Stale = append(drift.Stale, d.Stale...)
+	return drift
+}
+
+// Rebuild implements the ImageCache interface. The spilled images stay in
+// the spill tier, which is rebuilt last so as to take the images the cache
+// demotes while rebuilt.
+func (c *spillCache) Rebuild() error {
+	if err := c.ImageCache.Rebuild(); err != nil {
+		return err
+	}
+	return c.spill.Rebuild()
+}
+
+// History implements the ImageCache interface, merging the events of both
+// tiers
+func (c *spillCache) History(imgID image.ID) []CacheEvent {
+	events := append(c.ImageCache.History(imgID), c.spill.History(imgID)...)
+	sort.SliceStable(events, func(i, j int) bool { return events[i].Time.Before(events[j].Time) })
+	return events
+}
+
+// ForEach implements the ImageCache interface, visiting the entries of the
+// spill tier after those of the cache
+func (c *spillCache) ForEach(fn func(CacheEntry) bool) {
+	more := true
+	c.ImageCache.ForEach(func(entry CacheEntry) bool {
+		more = fn(entry)
+		return more
+	})
+	if more {
+		c.spill.ForEach(fn)
+	}
+}
+
+// List implements the ImageCache interface, listing the images of the spill
+// tier after those of the cache
+func (c *spillCache) List() []CacheEntry {
+	return append(c.ImageCache.List(), c.spill.List()...)
+}
+
+// PinPattern implements the ImageCache interface, pinning the pattern in
+// both tiers
+func (c *spillCache) PinPattern(pattern string) error {
+	if err := c.ImageCache.PinPattern(pattern); err != nil {
+		return err
+	}
+	return c.spill.PinPattern(pattern)
+}
+
+// UnpinPattern implements the ImageCache interface
+func (c *spillCache) UnpinPattern(pattern string) error {
+	if err := c.ImageCache.UnpinPattern(pattern); err != nil {
+		return err
+	}
+	return c.spill.UnpinPattern(pattern)
+}
+
+// Close implements the ImageCache interface
+func (c *spillCache) Close() error {
+	err := c.ImageCache.Close()
+	if spillErr := c.spill.Close(); err == nil {
+		err = spillErr
+	}
+	return err
+}
@@ -0,0 +1,97 @@
+package cache
+
+import (
+	"testing"
+	"time"
+
+	"github.com/docker/docker/daemon/config"
+	"github.com/docker/docker/image"
+	"github.com/docker/docker/layer"
+	"gotest.tools/assert"
+	is "gotest.tools/assert/cmp"
+)
+
+func newSpillCacheForTest(t *testing.T, b *fakeImageBackend) *spillCache {
+	t.Helper()
+	cfg := config.New()
+	cfg.CachePolicy = policyImageLRU
+	cfg.CacheCapacity = "100"
+	cfg.CacheSpillCapacity = "100"
+	c, err := NewImageCache(cfg, b)
+	assert.NilError(t, err)
+	return c.(*spillCache)
+}
+
+func TestSpillDemotesOnEvict(t *testing.T) {
+	b, cleanup := newFakeBackendForTest(t)
+	defer cleanup()
+	c := newSpillCacheForTest(t, b)
+	defer c.Close()
+
+	now := time.Now()
+	var imgs []*image.Image
+	for _, name := range []string{"a", "b", "c", "d", "e"} {
+		imgs = append(imgs, b.addImage(t, now, []layer.DiffID{b.layer(name, 40)}))
+	}
+
+	// the oldest image is demoted rather than deleted
+	for _, img := range imgs[:3] {
+		c.PutImage(img)
+	}
+	assert.Check(t, is.Len(b.deleted, 0))
+	assert.Check(t, is.Equal(int64(80), c.Level()))
+	assert.Check(t, c.spill.contains(imgs[0].ID()))
+	stats := c.Stats()
+	assert.Assert(t, stats.Spill != nil)
+	assert.Check(t, is.Equal(int64(40), stats.Spill.Level))
+
+	// the spill tier deletes the images it evicts in turn
+	c.PutImage(imgs[3])
+	c.PutImage(imgs[4])
+	assert.Check(t, is.DeepEqual([]image.ID{imgs[0].ID()}, b.deleted))
+	assert.Check(t, c.spill.contains(imgs[1].ID()))
+	assert.Check(t, c.spill.contains(imgs[2].ID()))
+	assert.Check(t, is.Equal(int64(80), c.spill.Level()))
+}
+
+func TestSpillPromotesOnHit(t *testing.T) {
+	b, cleanup := newFakeBackendForTest(t)
+	defer cleanup()
+	c := newSpillCacheForTest(t, b)
+	defer c.Close()
+
+	now := time.Now()
+	var imgs []*image.Image
+	for _, name := range []string{"a", "b", "c"} {
+		imgs = append(imgs, b.addImage(t, now, []layer.DiffID{b.layer(name, 40)}, name+":latest"))
+	}
+	for _, img := range imgs {
+		c.PutImage(img)
+	}
+	assert.Assert(t, c.spill.contains(imgs[0].ID()))
+
+	// a use promotes the spilled image, demoting the least recently used
+	// one in its place
+	c.UpdateImage("a:latest")
+	assert.Check(t, !c.spill.contains(imgs[0].ID()))
+	assert.Check(t, c.spill.contains(imgs[1].ID()))
+	newest, _ := c.Newest()
+	assert.Check(t, is.Equal(imgs[0].ID(), newest))
+
+	// so does a pull, which puts the image again
+	c.PutImage(imgs[1])
+	assert.Check(t, !c.spill.contains(imgs[1].ID()))
+	assert.Check(t, c.spill.contains(imgs[2].ID()))
+	assert.Check(t, is.Len(b.deleted, 0))
+	assert.Check(t, is.Equal(int64(80), c.Level()))
+	assert.Check(t, is.Equal(int64(40), c.spill.Level()))
+}
+
+func TestSpillRequiresImageLRU(t *testing.T) {
+	cfg := config.New()
+	cfg.CachePolicy = policyLayerLRU
+	cfg.CacheCapacity = "100"
+	cfg.CacheSpillCapacity = "100"
+	_, err := NewImageCache(cfg, nil)
+	assert.Check(t, is.ErrorContains(err, "requires"))
+}
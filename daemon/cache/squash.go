@@ -0,0 +1,83 @@
+package cache
+
+import (
+	"github.com/docker/distribution/reference"
+	"github.com/docker/docker/image"
+	"github.com/sirupsen/logrus"
+)
+
+// SquashImage implements the ImageCache interface. The tags of the original
+// image are moved to the squashed one and the original image is deleted, so
+// that only the squashed image takes up space.
+func (c *cacheBase) SquashImage(img *image.Image) (*image.Image, error) {
+	if !c.squash || img == nil || len(img.RootFS.DiffIDs) < 2 {
+		return img, nil
+	}
+
+	inspect, err := c.imageService.LookupImage(img.ImageID())
+	if err != nil {
+		return nil, err
+	}
+
+	id, err := c.imageService.SquashImage(img.ImageID(), "")
+	if err != nil {
+		return nil, err
+	}
+
+	for _, tag := range inspect.RepoTags {
+		ref, err := reference.ParseNormalizedNamed(tag)
+		if err != nil {
+			logrus.Warnf("error parsing tag %s: %v", tag, err)
+			continue
+		}
+		if err := c.imageService.TagImageWithReference(image.ID(id), ref); err != nil {
+			logrus.Warnf("error moving tag %s to squashed image: %v", tag, err)
+		}
+	}
+
+	squashed, err := c.imageService.GetImage(id)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := c.imageService.ImageDelete(img.ImageID(), true, true); err != nil {
+		logrus.Warnf("error deleting the original of squashed image %s: %v", squashed.ID(), err)
+	}
+
+	c.mu.Lock()
+	c.squashed[img.ID()] = squashed.ID()
+	c.mu.Unlock()
+
+	logrus.Infof("Squashed image %s (%d layers) into %s", img.ID(), len(img.RootFS.DiffIDs), squashed.ID())
+	return squashed, nil
+}
+
+// Internal implements the ImageCache interface. The originals of the
+// squashed images are internal to the cache, their tags having moved to
+// the squashed images.
+func (c *cacheBase) Internal(imgID image.ID) bool {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	_, ok := c.squashed[imgID]
+	return ok
+}
+
+// forgetSquashed drops the squash records involving imgID, and returns the
+// ID of the cached image to remove. When imgID is an original image, its
+// squashed artifact is deleted as well. The caller must hold the write lock.
+func (c *cacheBase) forgetSquashed(imgID image.ID) image.ID {
+	if squashed, ok := c.squashed[imgID]; ok {
+		delete(c.squashed, imgID)
+		if _, err := c.imageService.ImageDelete(squashed.String(), true, true); err != nil {
+			logrus.Warnf("error deleting squashed image %s: %v", squashed, err)
+		}
+		return squashed
+	}
+	for original, squashed := range c.squashed {
+		if squashed == imgID {
+			delete(c.squashed, original)
+		}
+	}
+	return imgID
+}
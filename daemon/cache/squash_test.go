@@ -0,0 +1,36 @@
+package cache
+
+import (
+	"testing"
+	"time"
+
+	"github.com/docker/docker/layer"
+	"gotest.tools/assert"
+	is "gotest.tools/assert/cmp"
+)
+
+func TestSquashedOriginalIsInternal(t *testing.T) {
+	b, cleanup := newFakeBackendForTest(t)
+	defer cleanup()
+
+	now := time.Now()
+	img := b.addImage(t, now, []layer.DiffID{b.layer("base", 10), b.layer("app", 20)}, "app:latest")
+	// the original cannot be deleted while a container uses it
+	b.inUse[img.ID()] = true
+
+	base := newCacheBase(1000, b)
+	base.squash = true
+	c := newImageLRUCache(base)
+
+	squashed, err := c.SquashImage(img)
+	assert.NilError(t, err)
+	assert.Check(t, squashed.ID() != img.ID())
+	assert.Check(t, b.hasImage(img.ID()))
+	assert.Check(t, c.Internal(img.ID()))
+	assert.Check(t, !c.Internal(squashed.ID()))
+
+	// the original is no longer internal once forgotten
+	c.RemoveImage(img.ID())
+	assert.Check(t, !c.Internal(img.ID()))
+	assert.Check(t, is.Len(b.deleted, 1))
+}
@@ -0,0 +1,98 @@
+package cache
+
+import "time"
+
+// Stats is a point-in-time snapshot of the cache state
+type Stats struct {
+	Capacity int64
+	Level    int64
+	// CapacityHuman and LevelHuman are Capacity and Level in binary units,
+	// as accepted by the cache capacity option
+	CapacityHuman string
+	LevelHuman    string
+	// Layers is the number of layers held by the layer-based caches
+	Layers int64 `json:",omitempty"`
+
+	// EvictionDisabled is set when automatic eviction has been disabled
+	// after repeated fruitless passes, until EvictionDisabledUntil.
+	EvictionDisabled      bool
+	EvictionDisabledUntil time.Time `json:",omitempty"`
+	FruitlessEvictions    int
+
+	// EvictionPasses is the number of eviction passes run, and
+	// EvictionInProgress is set in the stats served during a pass, as of
+	// the end of the previous one and without Registries
+	EvictionPasses     int64
+	EvictionInProgress bool `json:",omitempty"`
+
+	// Evictions is the number of images evicted, and RepulledEvictions
+	// those of them put in the cache again within an hour.
+	// EvictionEfficiency is the fraction of the evictions not followed by
+	// a re-pull, 1 if nothing was evicted: a low efficiency means the cache
+	// evicts images still in use.
+	Evictions          int64
+	RepulledEvictions  int64
+	EvictionEfficiency float64
+
+	// Puts is the number of images put in the cache, held already or not,
+	// Hits and Misses the number of uses of images held by the cache or
+	// not, and BytesEvicted the size of the entries evicted. They are never
+	// reset, the counters of Efficiency being the same ones counted since
+	// the last reset.
+	Puts         int64
+	Hits         int64
+	Misses       int64
+	BytesEvicted int64
+
+	// Efficiency summarizes the cache since the last reset of the stats
+	Efficiency Efficiency
+
+	// SuggestedCapacity is the capacity which would have kept the miss
+	// rate of the cache below the target over the last day, if a target
+	// is set. It is only a recommendation, not applied to the cache.
+	SuggestedCapacity int64 `json:",omitempty"`
+
+	// Config is the configuration the cache was created from
+	Config *CacheConfig `json:",omitempty"`
+
+	// Registries breaks the level down by the registry the images were
+	// pulled from, leaving out those found on disk or built locally. For
+	// the layer-based caches, a layer shared by images pulled from several
+	// registries counts towards each.
+	Registries map[string]int64 `json:",omitempty"`
+
+	// Pins are the patterns of the tags pinned in cache
+	Pins []string `json:",omitempty"`
+
+	// Namespaces holds the stats of each partition of a cache partitioned
+	// by namespace, the global partition being under the empty namespace
+	Namespaces map[string]Stats `json:",omitempty"`
+
+	// Spill holds the stats of the spill tier the evicted images are
+	// demoted to, if any
+	Spill *Stats `json:",omitempty"`
+}
+
+// Efficiency summarizes whether the cache does its job over the window
+// since Since, when the stats were last reset. Hits and Misses are the uses
+// of images held by the cache or not, as counted by Stats, and Inserts the
+// images put in the cache while not held already. Each ratio is 0 when its
+// denominator is.
+type Efficiency struct {
+	Since     time.Time
+	Hits      int64
+	Misses    int64
+	Inserts   int64
+	Evictions int64
+	Repulls   int64
+
+	// HitRatio is the fraction of the uses which were hits
+	HitRatio float64
+	// EvictionRate is the number of images evicted per image inserted in
+	// the cache, close to 1 for a full cache and above when large images
+	// evict several small ones
+	EvictionRate float64
+	// RepullRate is the fraction of the evictions followed by a re-pull
+	// of the image within an hour
+	RepullRate float64
+}
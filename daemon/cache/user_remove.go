@@ -0,0 +1,125 @@
+package cache
+
+import (
+	"github.com/docker/docker/image"
+	"github.com/sirupsen/logrus"
+)
+
+// maxNoCacheImages is the number of images removed by the user which are
+// remembered not to be cached again
+const maxNoCacheImages = 1024
+
+// reasonRemovedByUser is the reason recorded for the images removed by the
+// user, and for their refusal once put again
+const reasonRemovedByUser = "removed by the user"
+
+// noCacheSet holds the images the user removed, which are not cached again,
+// keeping up to maxNoCacheImages of them. It is protected by the cache lock.
+type noCacheSet struct {
+	ids   map[image.ID]bool
+	order []image.ID
+}
+
+func (s *noCacheSet) add(imgID image.ID) {
+	if s.ids[imgID] {
+		return
+	}
+	if s.ids == nil {
+		s.ids = make(map[image.ID]bool)
+	}
+	if len(s.order) >= maxNoCacheImages {
+		delete(s.ids, s.order[0])
+		s.order = s.order[1:]
+	}
+	s.ids[imgID] = true
+	s.order = append(s.order, imgID)
+}
+
+func (s *noCacheSet) contains(imgID image.ID) bool {
+	return s.ids[imgID]
+}
+
+// removeByUser removes imgID through remove, the removal of the policy, as
+// removed by the user rather than evicted: imgID and cachedID, the ID it is
+// cached under, are not cached again, and the removal is audited. The
+// caller must hold the write lock.
+func (c *cacheBase) removeByUser(imgID, cachedID image.ID, remove func(image.ID)) {
+	c.noCache.add(imgID)
+	c.noCache.add(cachedID)
+	level := c.level
+	remove(cachedID)
+	if freed := level - c.level; freed > 0 {
+		c.appendAudit(cachedID, nil, freed, reasonRemovedByUser)
+	}
+}
+
+// removedByUser reports whether the user removed img, in which case it is
+// not cached again. The caller must hold the write lock.
+func (c *cacheBase) removedByUser(img *image.Image) bool {
+	if !c.noCache.contains(img.ID()) {
+		return false
+	}
+	c.recordEvent(img.ID(), EventSkip, reasonRemovedByUser)
+	logrus.Infof("Refused image %s, %s", img.ID(), reasonRemovedByUser)
+	return true
+}
+
+// UserRemoveImage implements the ImageCache interface
+func (c *naiveCache) UserRemoveImage(imgID image.ID) {
+	c.mu.Lock()
+	defer c.unlock()
+
+	c.removeByUser(imgID, c.forgetSquashed(imgID), c.removeImage)
+}
+
+// UserRemoveImage implements the ImageCache interface
+func (c *imageLRUCache) UserRemoveImage(imgID image.ID) {
+	c.mu.Lock()
+	defer c.unlock()
+
+	c.removeByUser(imgID, c.forgetSquashed(imgID), c.removeImage)
+}
+
+// UserRemoveImage implements the ImageCache interface
+func (c *layerLRUCache) UserRemoveImage(imgID image.ID) {
+	c.mu.Lock()
+	defer c.unlock()
+
+	c.removeByUser(imgID, c.forgetSquashed(imgID), c.removeImage)
+}
+
+// UserRemoveImage implements the ImageCache interface
+func (c *archiveLRUCache) UserRemoveImage(imgID image.ID) {
+	c.mu.Lock()
+	defer c.unlock()
+
+	c.removeByUser(imgID, c.forgetSquashed(imgID), c.removeImage)
+}
+
+// UserRemoveImage implements the ImageCache interface. Images whose
+// partition is unknown are removed from every partition, and are not cached
+// again in any of them.
+func (c *partitionedCache) UserRemoveImage(imgID image.ID) {
+	c.rebuilding.RLock()
+	defer c.rebuilding.RUnlock()
+
+	p, ok := c.partitionOf(imgID)
+	if ok {
+		c.mu.Lock()
+		delete(c.owners, imgID)
+		c.mu.Unlock()
+		p.UserRemoveImage(imgID)
+		return
+	}
+	for _, p := range c.partitions {
+		p.UserRemoveImage(imgID)
+	}
+}
+
+// UserRemoveImage implements the ImageCache interface. A spilled image is
+// removed from the spill tier, and is not cached again by the cache, which
+// the spill tier only takes images from.
+func (c *spillCache) UserRemoveImage(imgID image.ID) {
+	c.unspill(imgID)
+	c.ImageCache.UserRemoveImage(imgID)
+}
@@ -0,0 +1,70 @@
+package cache
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/docker/docker/image"
+	"github.com/docker/docker/layer"
+	"gotest.tools/assert"
+	is "gotest.tools/assert/cmp"
+)
+
+func TestUserRemoveImage(t *testing.T) {
+	for _, policy := range []string{policyNaive, policyImageLRU, policyLayerLRU, policyArchiveLRU} {
+		b, cleanup := newFakeBackendForTest(t)
+		dir, err := ioutil.TempDir("", "cache-user-remove")
+		assert.NilError(t, err)
+
+		now := time.Now()
+		evicted := b.addImage(t, now, []layer.DiffID{b.layer("evicted", 60)}, "evicted:latest")
+		removed := b.addImage(t, now.Add(time.Second), []layer.DiffID{b.layer("removed", 60)}, "removed:latest")
+
+		path := filepath.Join(dir, "audit.log")
+		base := newCacheBase(100, b)
+		base.policy = policy
+		base.audit = newAuditLog(path)
+		c := newTestCache(t, policy, base)
+		c.PutImage(evicted)
+		c.PutImage(removed)
+		assert.Check(t, is.DeepEqual([]image.ID{evicted.ID()}, b.deleted), policy)
+
+		// an image the user removed is not cached again, unlike an
+		// evicted image
+		c.UserRemoveImage(removed.ID())
+		assert.Check(t, is.Equal(int64(0), c.Level()), policy)
+		assert.Check(t, base.noCache.contains(removed.ID()), policy)
+		assert.Check(t, !base.noCache.contains(evicted.ID()), policy)
+
+		c.PutImage(removed)
+		assert.Check(t, is.Equal(int64(0), c.Level()), policy)
+		repulled := b.addImage(t, now, []layer.DiffID{b.layer("evicted", 60)}, "evicted:latest")
+		c.PutImage(repulled)
+		assert.Check(t, is.Equal(int64(60), c.Level()), policy)
+
+		assert.NilError(t, c.Close())
+		recs := readAuditLog(t, path)
+		assert.Assert(t, is.Len(recs, 2), policy)
+		assert.Check(t, is.Equal(evicted.ID(), recs[0].Image), policy)
+		assert.Check(t, is.Equal(removed.ID(), recs[1].Image), policy)
+		assert.Check(t, is.Equal(int64(60), recs[1].Freed), policy)
+		assert.Check(t, is.Equal(reasonRemovedByUser, recs[1].Reason), policy)
+
+		os.RemoveAll(dir)
+		cleanup()
+	}
+}
+
+func TestNoCacheSetBounded(t *testing.T) {
+	var s noCacheSet
+	for i := 0; i <= maxNoCacheImages; i++ {
+		s.add(image.ID(fmt.Sprintf("sha256:%d", i)))
+	}
+	assert.Check(t, !s.contains("sha256:0"))
+	assert.Check(t, s.contains("sha256:1"))
+	assert.Check(t, is.Len(s.ids, maxNoCacheImages))
+}
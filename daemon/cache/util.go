@@ -4,10 +4,38 @@ import (
 	"os"
 	"path/filepath"
 
+	"github.com/docker/distribution"
 	"github.com/docker/docker/layer"
 	"github.com/opencontainers/go-digest"
+	"github.com/sirupsen/logrus"
 )
 
+// isForeignLayer reports whether l is a foreign layer, such as the base
+// layers of Windows images. Foreign layers are not distributable and are
+// fetched from the URLs of their descriptor rather than from the registry,
+// so the cache leaves them out: they are neither accounted nor evicted.
+func isForeignLayer(l layer.Layer) bool {
+	fs, ok := l.(distribution.Describable)
+	return ok && len(fs.Descriptor().URLs) > 0
+}
+
+// foreignSize returns the size of the foreign layers in the chain of l
+func foreignSize(l layer.Layer) int64 {
+	var size int64
+	for ; l != nil; l = l.Parent() {
+		if !isForeignLayer(l) {
+			continue
+		}
+		diffSize, err := l.DiffSize()
+		if err != nil {
+			logrus.Warnf("error getting the size of foreign layer %s: %v", l.ChainID(), err)
+			continue
+		}
+		size += diffSize
+	}
+	return size
+}
+
 func createLayerArchivePath(diffID layer.DiffID) string {
 	return filepath.Join(os.TempDir(), digest.Digest(diffID).Hex())
 }
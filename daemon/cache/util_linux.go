@@ -0,0 +1,40 @@
+package cache
+
+import (
+	"os"
+
+	"github.com/docker/docker/layer"
+	"github.com/opencontainers/go-digest"
+	"golang.org/x/sys/unix"
+)
+
+// deleteArchives deletes the archives of diffIDs, opening the archive
+// directory once for the whole batch.
+func deleteArchives(diffIDs []layer.DiffID) error {
+	dir, err := os.Open(os.TempDir())
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+
+	var firstErr error
+	fd := int(dir.Fd())
+	for _, diffID := range diffIDs {
+		err := unix.Unlinkat(fd, digest.Digest(diffID).Hex(), 0)
+		if err != nil && err != unix.ENOENT && firstErr == nil {
+			firstErr = &os.PathError{Op: "unlinkat", Path: createLayerArchivePath(diffID), Err: err}
+		}
+	}
+	return firstErr
+}
+
+// freeDiskSpace returns the diskSource of the filesystem holding root
+func freeDiskSpace(root string) diskSource {
+	return func() (int64, error) {
+		var st unix.Statfs_t
+		if err := unix.Statfs(root, &st); err != nil {
+			return 0, &os.PathError{Op: "statfs", Path: root, Err: err}
+		}
+		return int64(st.Bavail) * int64(st.Bsize), nil
+	}
+}
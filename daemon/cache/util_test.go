@@ -0,0 +1,56 @@
+package cache
+
+import (
+	"encoding/json"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/docker/docker/image"
+	"github.com/docker/docker/layer"
+	"gotest.tools/assert"
+)
+
+// testImageStore creates images with content-addressable IDs, as they would
+// be returned by the image store
+type testImageStore struct {
+	fs    image.StoreBackend
+	store image.Store
+	n     int
+}
+
+func newTestImageStore(t *testing.T, root string) *testImageStore {
+	t.Helper()
+	fs, err := image.NewFSStoreBackend(root)
+	assert.NilError(t, err)
+	store, err := image.NewImageStore(fs, nil)
+	assert.NilError(t, err)
+	return &testImageStore{fs: fs, store: store}
+}
+
+func (s *testImageStore) newImage(t *testing.T, created time.Time, diffIDs ...layer.DiffID) *image.Image {
+	t.Helper()
+	return s.newImageFor(t, "", created, diffIDs...)
+}
+
+// newImageFor creates an image of the given operating system
+func (s *testImageStore) newImageFor(t *testing.T, os string, created time.Time, diffIDs ...layer.DiffID) *image.Image {
+	t.Helper()
+	s.n++
+	img := &image.Image{
+		V1Image: image.V1Image{
+			Created: created,
+			Comment: fmt.Sprintf("test image %d", s.n),
+			OS:      os,
+		},
+		RootFS: image.NewRootFS(),
+	}
+	img.RootFS.DiffIDs = diffIDs
+	config, err := json.Marshal(img)
+	assert.NilError(t, err)
+	dgst, err := s.fs.Set(config)
+	assert.NilError(t, err)
+	img, err = s.store.Get(image.IDFromDigest(dgst))
+	assert.NilError(t, err)
+	return img
+}
@@ -0,0 +1,22 @@
+// +build !linux
+
+package cache
+
+import "github.com/docker/docker/layer"
+
+// deleteArchives deletes the archives of diffIDs
+func deleteArchives(diffIDs []layer.DiffID) error {
+	var firstErr error
+	for _, diffID := range diffIDs {
+		if err := deleteArchive(diffID); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// freeDiskSpace returns no diskSource, the free disk space is not checked on
+// this platform
+func freeDiskSpace(root string) diskSource {
+	return nil
+}
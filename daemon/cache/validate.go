@@ -0,0 +1,80 @@
+package cache
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/docker/docker/errdefs"
+)
+
+// ValidatePolicy checks whether the cache could switch to policy, at the
+// given capacity or at its own if zero, without changing anything. It fails
+// if a prerequisite of the policy is missing, or if the largest image of
+// the image store would not fit, and otherwise returns the warnings of what
+// the switch would change.
+func (c *cacheBase) ValidatePolicy(policy string, capacity int64) ([]string, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	policy = strings.ToLower(policy)
+	switch policy {
+	case policyNaive, policyImageLRU, policyLayerLRU, policyLayerLFU:
+	case policyArchiveLRU:
+		if !c.archive {
+			return nil, errdefs.InvalidParameter(fmt.Errorf(`"--cache-archive" is required for "archive-lru" cache policy`))
+		}
+	default:
+		return nil, errdefs.InvalidParameter(fmt.Errorf("invalid cache policy %q", policy))
+	}
+	if c.config.SpillCapacity > 0 && policy != policyImageLRU {
+		return nil, errdefs.InvalidParameter(fmt.Errorf("a cache spill tier requires the %q cache policy", policyImageLRU))
+	}
+	if capacity == 0 {
+		capacity = c.capacity
+	}
+	if capacity < 0 || capacity > maxCacheCapacity {
+		return nil, errdefs.InvalidParameter(fmt.Errorf("invalid cache capacity %d, must be between 1 and %d bytes", capacity, maxCacheCapacity))
+	}
+
+	for _, img := range c.imageService.Map() {
+		size, err := c.getImageSize(img)
+		if err != nil {
+			continue
+		}
+		if size > capacity {
+			return nil, errdefs.InvalidParameter(fmt.Errorf("image %s of %d bytes would not fit in a cache capacity of %d bytes", img.ID(), size, capacity))
+		}
+	}
+
+	var warnings []string
+	if isLayerPolicy(policy) != isLayerPolicy(c.policy) {
+		warnings = append(warnings, fmt.Sprintf("accounting will change from %s to %s, and the cache will be rebuilt from the image store",
+			accountingOf(c.policy), accountingOf(policy)))
+	}
+	if policy == policyArchiveLRU && c.policy != policyArchiveLRU {
+		warnings = append(warnings, "no layer archive exists yet, they will be generated as images are pulled")
+	}
+	if policy != policyArchiveLRU && c.policy == policyArchiveLRU {
+		warnings = append(warnings, "the layer archives will no longer be kept")
+	}
+	if level := c.Level(); level > capacity {
+		warnings = append(warnings, fmt.Sprintf("%d bytes will be evicted to bring the level down to the capacity", level-capacity))
+	}
+	return warnings, nil
+}
+
+// isLayerPolicy reports whether policy accounts for layers rather than
+// images
+func isLayerPolicy(policy string) bool {
+	return policy == policyLayerLRU || policy == policyLayerLFU || policy == policyArchiveLRU
+}
+
+// accountingOf describes what the caches of policy account for. Layers
+// shared by images are accounted once per layer, but in each image per
+// image.
+func accountingOf(policy string) string {
+	if isLayerPolicy(policy) {
+		return "per layer"
+	}
+	return "per image"
+}
@@ -0,0 +1,79 @@
+package cache
+
+import (
+	"testing"
+	"time"
+
+	"github.com/docker/docker/daemon/config"
+	"github.com/docker/docker/errdefs"
+	"github.com/docker/docker/layer"
+	"gotest.tools/assert"
+	is "gotest.tools/assert/cmp"
+)
+
+func TestValidatePolicy(t *testing.T) {
+	b, cleanup := newFakeBackendForTest(t)
+	defer cleanup()
+
+	now := time.Now()
+	base := b.layer("base", 30)
+	b.addImage(t, now, []layer.DiffID{base, b.layer("top1", 10)})
+	b.addImage(t, now, []layer.DiffID{base, b.layer("top2", 20)})
+
+	cfg := config.New()
+	cfg.CachePolicy = policyImageLRU
+	cfg.CacheCapacity = "100"
+	c, err := NewImageCache(cfg, b)
+	assert.NilError(t, err)
+	defer c.Close()
+	level := c.Level()
+
+	// the same policy at the same capacity changes nothing
+	warnings, err := c.ValidatePolicy("Image-LRU", 0)
+	assert.NilError(t, err)
+	assert.Check(t, is.Len(warnings, 0))
+
+	warnings, err = c.ValidatePolicy(policyLayerLRU, 60)
+	assert.NilError(t, err)
+	assert.Check(t, is.DeepEqual([]string{
+		"accounting will change from per image to per layer, and the cache will be rebuilt from the image store",
+		"30 bytes will be evicted to bring the level down to the capacity",
+	}, warnings))
+
+	for _, tc := range []struct {
+		policy   string
+		capacity int64
+		err      string
+	}{
+		{policy: "lfu", err: `invalid cache policy "lfu"`},
+		{policy: policyArchiveLRU, err: `"--cache-archive" is required`},
+		{policy: policyNaive, capacity: 40, err: "would not fit in a cache capacity of 40 bytes"},
+		{policy: policyNaive, capacity: -1, err: "invalid cache capacity -1"},
+	} {
+		_, err := c.ValidatePolicy(tc.policy, tc.capacity)
+		assert.Check(t, is.ErrorContains(err, tc.err), tc.policy)
+		assert.Check(t, errdefs.IsInvalidParameter(err), tc.policy)
+	}
+
+	// nothing was applied
+	assert.Check(t, is.Equal(policyImageLRU, c.Config().Policy))
+	assert.Check(t, is.Equal(int64(100), c.Capacity()))
+	assert.Check(t, is.Equal(level, c.Level()))
+}
+
+func TestValidatePolicyArchive(t *testing.T) {
+	b, cleanup := newFakeBackendForTest(t)
+	defer cleanup()
+
+	cfg := config.New()
+	cfg.CachePolicy = policyLayerLRU
+	cfg.CacheCapacity = "100"
+	cfg.CacheArchive = true
+	c, err := NewImageCache(cfg, b)
+	assert.NilError(t, err)
+	defer c.Close()
+
+	warnings, err := c.ValidatePolicy(policyArchiveLRU, 0)
+	assert.NilError(t, err)
+	assert.Check(t, is.DeepEqual([]string{"no layer archive exists yet, they will be generated as images are pulled"}, warnings))
+}
@@ -0,0 +1,31 @@
+package cache
+
+import (
+	"github.com/docker/docker/image"
+	"github.com/sirupsen/logrus"
+)
+
+// markWarm makes a newly cached image warm, if warm images are enabled: it
+// cannot be evicted until it has been used once
+func (c *cacheBase) markWarm(imgID image.ID) {
+	if c.warm {
+		c.unused[imgID] = true
+	}
+}
+
+// markUsed records the use of a cached image, which is no longer warm
+func (c *cacheBase) markUsed(imgID image.ID) {
+	if c.unused[imgID] {
+		delete(c.unused, imgID)
+		logrus.Debugf("Warm image %s is used, it can be evicted from now on", imgID)
+	}
+}
+
+// protectWarm protects the warm images from eviction
+func (c *cacheBase) protectWarm(plan *evictionPlan, imgs []*image.Image) {
+	for _, img := range imgs {
+		if c.unused[img.ID()] {
+			plan.protected[img.ID()] = true
+		}
+	}
+}
@@ -10,6 +10,7 @@ import (
 	"reflect"
 	"strings"
 	"sync"
+	"time"
 
 	daemondiscovery "github.com/docker/docker/daemon/discovery"
 	"github.com/docker/docker/opts"
@@ -136,6 +137,35 @@ type CommonConfig struct {
 	CachePolicy           string                    `json:"cache-policy,omitempty"`
 	CacheCapacity         string                    `json:"cache-capacity,omitempty"`
 	CacheArchive          bool                      `json:"cache-archive,omitempty"`
+	CacheArchiveMemory    string                    `json:"cache-archive-memory,omitempty"`
+	CacheArchiveShared    string                    `json:"cache-archive-shared,omitempty"`
+	CacheArchiveUpload    bool                      `json:"cache-archive-upload,omitempty"`
+	CacheArchiveDedup     bool                      `json:"cache-archive-dedup,omitempty"`
+	CacheArchivePeers     []string                  `json:"cache-archive-peers,omitempty"`
+	CacheArchiveMaxSize   string                    `json:"cache-archive-max-size,omitempty"`
+	CacheArchiveExclude   []string                  `json:"cache-archive-exclude,omitempty"`
+	CacheSquash           bool                      `json:"cache-squash,omitempty"`
+	CacheMemoryPressure   float64                   `json:"cache-memory-pressure,omitempty"`
+	CacheHistory          bool                      `json:"cache-history,omitempty"`
+	CacheKeepRecentTags   int                       `json:"cache-keep-recent-tags,omitempty"`
+	CacheEvictionBatch    int                       `json:"cache-eviction-batch,omitempty"`
+	CacheEvictThreshold   int                       `json:"cache-evict-threshold,omitempty"`
+	CacheResyncInterval   time.Duration             `json:"cache-resync-interval,omitempty"`
+	CacheDiskReserve      string                    `json:"cache-disk-reserve,omitempty"`
+	CacheNamespaces       map[string]string         `json:"cache-namespaces,omitempty"`
+	CacheAuditLog         string                    `json:"cache-audit-log,omitempty"`
+	CacheOnEvictCommand   string                    `json:"cache-on-evict-command,omitempty"`
+	CacheRecencyWeight    float64                   `json:"cache-recency-weight,omitempty"`
+	CacheMissRateTarget   float64                   `json:"cache-miss-rate-target,omitempty"`
+	CacheWarm             bool                      `json:"cache-warm,omitempty"`
+	CacheMaxLayers        int                       `json:"cache-max-layers,omitempty"`
+	CacheSpillCapacity    string                    `json:"cache-spill-capacity,omitempty"`
+	CacheMode             string                    `json:"cache-mode,omitempty"`
+	CacheRetainRetries    int                       `json:"cache-retain-retries,omitempty"`
+	CacheIdleTimeout      time.Duration             `json:"cache-idle-timeout,omitempty"`
+	CacheIdleFloor        string                    `json:"cache-idle-floor,omitempty"`
+	CacheScanLabel        string                    `json:"cache-scan-label,omitempty"`
+	CacheEvictionIORate   string                    `json:"cache-eviction-io-rate,omitempty"`
 
 	// LiveRestoreEnabled determines whether we should keep containers
 	// alive upon daemon shutdown/start
@@ -242,6 +272,8 @@ func New() *Config {
 	config := Config{}
 	config.LogConfig.Config = make(map[string]string)
 	config.ClusterOpts = make(map[string]string)
+	config.CacheNamespaces = make(map[string]string)
+	config.CacheRecencyWeight = 1
 
 	return &config
 }
@@ -571,6 +603,11 @@ func Validate(config *Config) error {
 		}
 	}
 
+	// validate that the capacity of the cache spill tier is set once
+	if strings.Contains(config.CacheCapacity, "=") && config.CacheSpillCapacity != "" {
+		return fmt.Errorf("the capacity of the cache spill tier is set both in cache-capacity %q and cache-spill-capacity", config.CacheCapacity)
+	}
+
 	// validate platform-specific settings
 	return config.ValidatePlatformConfig()
 }
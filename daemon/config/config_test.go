@@ -305,6 +305,14 @@ func TestValidateConfigurationErrors(t *testing.T) {
 				},
 			},
 		},
+		{
+			config: &Config{
+				CommonConfig: CommonConfig{
+					CacheCapacity:      "hot=2GB,spill=10GB",
+					CacheSpillCapacity: "1GB",
+				},
+			},
+		},
 	}
 	for _, tc := range testCases {
 		err := Validate(tc.config)
@@ -64,6 +64,7 @@ import (
 	"github.com/docker/docker/registry"
 	"github.com/docker/docker/runconfig"
 	volumesservice "github.com/docker/docker/volume/service"
+	"github.com/docker/go-units"
 	"github.com/docker/libnetwork"
 	"github.com/docker/libnetwork/cluster"
 	nwconfig "github.com/docker/libnetwork/config"
@@ -1019,6 +1020,13 @@ func NewDaemon(ctx context.Context, config *config.Config, pluginStore *plugin.S
 
 	d.linkIndex = newLinkIndex()
 
+	var archiveMemory int64
+	if config.CacheArchiveMemory != "" {
+		if archiveMemory, err = units.RAMInBytes(config.CacheArchiveMemory); err != nil {
+			return nil, errors.Wrap(err, "invalid cache-archive-memory")
+		}
+	}
+
 	// TODO: imageStore, distributionMetadataStore, and ReferenceStore are only
 	// used above to run migration. They could be initialized in ImageService
 	// if migration is called from daemon/images. layerStore might move as well.
@@ -1032,7 +1040,14 @@ func NewDaemon(ctx context.Context, config *config.Config, pluginStore *plugin.S
 		MaxConcurrentUploads:      *config.MaxConcurrentUploads,
 		ReferenceStore:            rs,
 		RegistryService:           registryService,
-		CacheArchive:              config.CacheArchive,
+		CacheArchive:              cache.ArchiveEnabled(config),
+		CacheArchiveCapacity:      cache.ArchiveCapacity(config),
+		CacheArchiveMemory:        archiveMemory,
+		CacheArchiveShared:        config.CacheArchiveShared,
+		CacheArchiveUpload:        config.CacheArchiveUpload,
+		CacheArchiveDedup:         config.CacheArchiveDedup,
+		CacheArchivePeers:         config.CacheArchivePeers,
+		CacheArchiveNamespace:     d.ID,
 	})
 
 	d.imageCache, err = cache.NewImageCache(config, d.imageService)
@@ -1179,6 +1194,12 @@ func (daemon *Daemon) Shutdown() error {
 		}
 	}
 
+	if daemon.imageCache != nil {
+		if err := daemon.imageCache.Close(); err != nil {
+			logrus.Errorf("Error closing image cache: %v", err)
+		}
+	}
+
 	if daemon.imageService != nil {
 		daemon.imageService.Cleanup()
 	}
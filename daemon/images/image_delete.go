@@ -412,3 +412,24 @@ func (i *ImageService) checkImageDeleteConflict(imgID image.ID, mask conflictTyp
 func (i *ImageService) imageIsDangling(imgID image.ID) bool {
 	return !(len(i.referenceStore.References(imgID.Digest())) > 0 || len(i.imageStore.Children(imgID)) > 0)
 }
+
+// ImageInUse returns whether any container, running or stopped, uses the
+// given image, which keeps the image from being deleted without force.
+func (i *ImageService) ImageInUse(imgID image.ID) bool {
+	using := func(c *container.Container) bool {
+		return c.ImageID == imgID
+	}
+	return i.containers.First(using) != nil
+}
+
+// LiveContainerImages returns the images used by the containers running,
+// paused or restarting, which need their image to resume.
+func (i *ImageService) LiveContainerImages() map[image.ID]bool {
+	imgs := make(map[image.ID]bool)
+	for _, c := range i.containers.List() {
+		if c.IsRunning() || c.IsPaused() || c.IsRestarting() {
+			imgs[c.ImageID] = true
+		}
+	}
+	return imgs
+}
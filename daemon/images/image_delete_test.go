@@ -0,0 +1,29 @@
+package images // import "github.com/docker/docker/daemon/images"
+
+import (
+	"testing"
+
+	"github.com/docker/docker/container"
+	"github.com/docker/docker/image"
+	"gotest.tools/assert"
+	is "gotest.tools/assert/cmp"
+)
+
+func TestLiveContainerImages(t *testing.T) {
+	store := container.NewMemoryStore()
+	add := func(id string, imgID image.ID, setState func(*container.State)) {
+		c := container.NewBaseContainer(id, "")
+		c.ImageID = imgID
+		setState(c.State)
+		store.Add(id, c)
+	}
+	add("running", "sha256:running", func(s *container.State) { s.Running = true })
+	add("paused", "sha256:paused", func(s *container.State) { s.Running, s.Paused = true, true })
+	add("restarting", "sha256:restarting", func(s *container.State) { s.Restarting = true })
+	add("stopped", "sha256:stopped", func(s *container.State) {})
+
+	i := &ImageService{containers: store}
+	expected := map[image.ID]bool{"sha256:running": true, "sha256:paused": true, "sha256:restarting": true}
+	assert.Check(t, is.DeepEqual(expected, i.LiveContainerImages()))
+	assert.Check(t, i.ImageInUse("sha256:stopped"))
+}
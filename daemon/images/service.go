@@ -12,6 +12,7 @@ import (
 	"github.com/docker/docker/distribution/xfer"
 	"github.com/docker/docker/image"
 	"github.com/docker/docker/layer"
+	"github.com/docker/docker/pkg/system"
 	dockerreference "github.com/docker/docker/reference"
 	"github.com/docker/docker/registry"
 	"github.com/opencontainers/go-digest"
@@ -40,16 +41,55 @@ type ImageServiceConfig struct {
 	ReferenceStore            dockerreference.Store
 	RegistryService           registry.Service
 	CacheArchive              bool
+	CacheArchiveCapacity      int64
+	CacheArchiveMemory        int64
+	CacheArchiveShared        string
+	CacheArchiveUpload        bool
+	CacheArchiveDedup         bool
+	CacheArchivePeers         []string
+	CacheArchiveNamespace     string
 }
 
 // NewImageService returns a new ImageService from a configuration
 func NewImageService(config ImageServiceConfig) *ImageService {
 	logrus.Debugf("Max Concurrent Downloads: %d", config.MaxConcurrentDownloads)
 	logrus.Debugf("Max Concurrent Uploads: %d", config.MaxConcurrentUploads)
+	downloadOptions := []func(*xfer.LayerDownloadManager){
+		xfer.WithArchiveMemoryCache(config.CacheArchiveMemory),
+		xfer.WithArchiveCapacity(config.CacheArchiveCapacity),
+		xfer.WithArchiveTempNamespace(config.CacheArchiveNamespace),
+	}
+	// local misses read through the shared directory, then the peers
+	var remote xfer.ArchiveStore
+	switch {
+	case config.CacheArchiveShared != "" && config.CacheArchiveDedup:
+		remote = xfer.NewChunkArchiveStore(config.CacheArchiveShared)
+	case config.CacheArchiveShared != "":
+		remote = xfer.NewDirArchiveStore(config.CacheArchiveShared)
+	case config.CacheArchiveDedup:
+		logrus.Warn("cache-archive-dedup is ignored without cache-archive-shared")
+	}
+	if len(config.CacheArchivePeers) > 0 {
+		peers := xfer.NewPeerArchiveStore(config.CacheArchivePeers)
+		if remote == nil {
+			remote = peers
+		} else {
+			remote = xfer.NewTieredArchiveStore(remote, peers, false)
+		}
+	}
+	if remote != nil {
+		upload := config.CacheArchiveUpload && config.CacheArchiveShared != ""
+		store := xfer.NewTieredArchiveStore(xfer.NewDirArchiveStore(""), remote, upload)
+		downloadOptions = append(downloadOptions, xfer.WithArchiveStore(store))
+	}
+	downloadManager := xfer.NewLayerDownloadManager(config.LayerStores, config.MaxConcurrentDownloads, config.CacheArchive, downloadOptions...)
+	if err := downloadManager.CleanupArchiveTemp(); err != nil {
+		logrus.Warnf("Failed to clean up the stale layer archives: %v", err)
+	}
 	return &ImageService{
 		containers:                config.ContainerStore,
 		distributionMetadataStore: config.DistributionMetadataStore,
-		downloadManager:           xfer.NewLayerDownloadManager(config.LayerStores, config.MaxConcurrentDownloads, config.CacheArchive),
+		downloadManager:           downloadManager,
 		eventsService:             config.EventsService,
 		imageStore:                config.ImageStore,
 		layerStores:               config.LayerStores,
@@ -133,13 +173,35 @@ func (i *ImageService) CreateLayer(container *container.Container, initFunc laye
 // GetReadOnlyLayer returns a read-only layer by chain ID and operating system
 // called from daemon/cache
 func (i *ImageService) GetReadOnlyLayer(chainID layer.ChainID, os string) (layer.Layer, error) {
-	return i.layerStores[os].Get(chainID)
+	ls, err := i.readOnlyLayerStore(os)
+	if err != nil {
+		return nil, err
+	}
+	return ls.Get(chainID)
 }
 
 // ReleaseReadOnlyLayer releases a read-only layer
 // called from daemon/cache
-func (i *ImageService) ReleaseReadOnlyLayer(layer layer.Layer, os string) ([]layer.Metadata, error) {
-	return i.layerStores[os].Release(layer)
+func (i *ImageService) ReleaseReadOnlyLayer(l layer.Layer, os string) ([]layer.Metadata, error) {
+	if l == nil {
+		return nil, nil
+	}
+	ls, err := i.readOnlyLayerStore(os)
+	if err != nil {
+		return nil, err
+	}
+	return ls.Release(l)
+}
+
+// readOnlyLayerStore returns the layer store of the operating system of the
+// layers handed out to daemon/cache, which may be absent when the daemon
+// runs without the layer store of the operating system of an image
+func (i *ImageService) readOnlyLayerStore(os string) (layer.Store, error) {
+	ls, ok := i.layerStores[os]
+	if !ok || ls == nil {
+		return nil, errors.Wrapf(system.ErrNotSupportedOperatingSystem, "no layer store for operating system %q", os)
+	}
+	return ls, nil
 }
 
 // GetLayerByID returns a layer by ID and operating system
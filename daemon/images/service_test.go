@@ -0,0 +1,60 @@
+package images // import "github.com/docker/docker/daemon/images"
+
+import (
+	"testing"
+
+	"github.com/docker/docker/layer"
+	"github.com/docker/docker/pkg/system"
+	"github.com/pkg/errors"
+	"gotest.tools/assert"
+	is "gotest.tools/assert/cmp"
+)
+
+// fakeLayerStore hands out layers named after the store, and records the
+// layers released to it
+type fakeLayerStore struct {
+	layer.Store
+	name     string
+	released []layer.Layer
+}
+
+type fakeROLayer struct {
+	layer.Layer
+	store string
+}
+
+func (s *fakeLayerStore) Get(chainID layer.ChainID) (layer.Layer, error) {
+	return &fakeROLayer{store: s.name}, nil
+}
+
+func (s *fakeLayerStore) Release(l layer.Layer) ([]layer.Metadata, error) {
+	s.released = append(s.released, l)
+	return nil, nil
+}
+
+func TestReadOnlyLayerPerOperatingSystem(t *testing.T) {
+	linux := &fakeLayerStore{name: "linux"}
+	windows := &fakeLayerStore{name: "windows"}
+	i := &ImageService{layerStores: map[string]layer.Store{"linux": linux, "windows": windows}}
+
+	for _, store := range []*fakeLayerStore{linux, windows} {
+		l, err := i.GetReadOnlyLayer("sha256:layer", store.name)
+		assert.NilError(t, err)
+		assert.Check(t, is.Equal(store.name, l.(*fakeROLayer).store))
+
+		_, err = i.ReleaseReadOnlyLayer(l, store.name)
+		assert.NilError(t, err)
+		assert.Check(t, is.Len(store.released, 1))
+	}
+
+	// an operating system without a layer store is an error, not a panic
+	_, err := i.GetReadOnlyLayer("sha256:layer", "solaris")
+	assert.Check(t, errors.Cause(err) == system.ErrNotSupportedOperatingSystem)
+	_, err = i.ReleaseReadOnlyLayer(&fakeROLayer{store: "solaris"}, "solaris")
+	assert.Check(t, errors.Cause(err) == system.ErrNotSupportedOperatingSystem)
+
+	released, err := i.ReleaseReadOnlyLayer(nil, "linux")
+	assert.NilError(t, err)
+	assert.Check(t, is.Len(released, 0))
+	assert.Check(t, is.Len(linux.released, 1))
+}
@@ -2,16 +2,26 @@ package daemon
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"io"
 
+	buildrouter "github.com/docker/docker/api/server/router/build"
 	"github.com/docker/docker/daemon/cache"
 	"github.com/docker/docker/daemon/images"
 
 	"github.com/sirupsen/logrus"
 
+	"github.com/containerd/containerd/platforms"
+	dist "github.com/docker/distribution"
+	"github.com/docker/distribution/manifest/manifestlist"
+	"github.com/docker/distribution/manifest/schema2"
 	"github.com/docker/distribution/reference"
 	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/backend"
 	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/filters"
+	imagetypes "github.com/docker/docker/api/types/image"
 	"github.com/docker/docker/errdefs"
 	"github.com/docker/docker/image"
 	"github.com/opencontainers/go-digest"
@@ -23,15 +33,24 @@ type Wrapper struct {
 	*Daemon
 	*images.ImageService
 	cache.ImageCache
+	pull func(ctx context.Context, image, tag string, platform *specs.Platform, metaHeaders map[string][]string, authConfig *types.AuthConfig, outStream io.Writer) error
+	// sizeOf returns the expected size of the image to be pulled as ref,
+	// or 0 if unknown
+	sizeOf func(ctx context.Context, ref reference.Named, platform *specs.Platform, authConfig *types.AuthConfig) int64
+	commit func(name string, config *backend.CreateImageConfig) (string, error)
 }
 
 // NewWrapper creates the cache proxy
 func NewWrapper(d *Daemon) *Wrapper {
-	return &Wrapper{
+	w := &Wrapper{
 		Daemon:       d,
 		ImageService: d.ImageService(),
 		ImageCache:   d.ImageCache(),
+		pull:         d.ImageService().PullImage,
+		commit:       d.CreateImageFromContainer,
 	}
+	w.sizeOf = w.expectedImageSize
+	return w
 }
 
 // PullImage puts the image in cache
@@ -55,8 +74,18 @@ func (c *Wrapper) PullImage(ctx context.Context, image, tag string, platform *sp
 		}
 	}
 
-	err = c.ImageService.PullImage(ctx, image, tag, platform, metaHeaders, authConfig, outStream)
-	if err != nil {
+	// in eviction-only mode, the cache only records the pulled image
+	full := c.ImageCache != nil && c.ImageCache.Config().Mode != cache.ModeEvictionOnly
+	if full {
+		c.ImageCache.BeginPull(ref.String())
+		defer c.ImageCache.EndPull(ref.String())
+		// the pulled image takes the place of its reservation once put
+		if c.sizeOf != nil && nearCapacity(c.ImageCache) {
+			defer c.ImageCache.Reserve(ref.String(), c.sizeOf(ctx, ref, platform, authConfig))()
+		}
+	}
+
+	if err := c.pull(ctx, image, tag, platform, metaHeaders, authConfig, outStream); err != nil {
 		return err
 	}
 
@@ -66,12 +95,81 @@ func (c *Wrapper) PullImage(ctx context.Context, image, tag string, platform *sp
 		return err
 	}
 
+	if full {
+		if img, err = c.ImageCache.SquashImage(img); err != nil {
+			logrus.Errorf("error squashing image: %v", err)
+			return err
+		}
+	}
 	if c.ImageCache != nil {
 		c.ImageCache.PutImage(img)
+		c.ImageCache.SetRegistry(img.ID(), reference.Domain(ref))
 	}
 	return nil
 }
 
+// reserveLevel is the percentage of its capacity the level of the cache
+// must reach for a pull to reserve the expected size of its image, which
+// costs a round trip to the registry ahead of the pull
+const reserveLevel = 80
+
+// nearCapacity reports whether the level of c is close enough to its
+// capacity for the pulls to reserve room ahead
+func nearCapacity(c cache.ImageCache) bool {
+	return c.Level() >= c.Capacity()/100*reserveLevel
+}
+
+// expectedImageSize returns the size of the layers of the image to be pulled
+// as ref, as listed by its manifest, or 0 if it can't be fetched. The layers
+// are compressed in the registry, so the size is a lower bound of the size
+// of the image once pulled. Schema 1 manifests do not list the size of the
+// layers, so their images are of unknown size.
+func (c *Wrapper) expectedImageSize(ctx context.Context, ref reference.Named, platform *specs.Platform, authConfig *types.AuthConfig) int64 {
+	repo, _, err := c.ImageService.GetRepository(ctx, ref, authConfig)
+	if err != nil {
+		logrus.Debugf("error getting repository of %s: %v", ref, err)
+		return 0
+	}
+	ms, err := repo.Manifests(ctx)
+	if err != nil {
+		logrus.Debugf("error getting manifest service of %s: %v", ref, err)
+		return 0
+	}
+
+	var m dist.Manifest
+	if canonical, ok := ref.(reference.Canonical); ok {
+		m, err = ms.Get(ctx, canonical.Digest())
+	} else {
+		m, err = ms.Get(ctx, "", dist.WithTag(reference.TagNameOnly(ref).(reference.Tagged).Tag()))
+	}
+	if list, ok := m.(*manifestlist.DeserializedManifestList); ok && err == nil {
+		p := platforms.DefaultSpec()
+		if platform != nil {
+			p = *platform
+		}
+		matcher := platforms.NewMatcher(platforms.Normalize(p))
+		m = nil
+		for _, desc := range list.Manifests {
+			if matcher.Match(specs.Platform{OS: desc.Platform.OS, Architecture: desc.Platform.Architecture, Variant: desc.Platform.Variant}) {
+				m, err = ms.Get(ctx, desc.Digest)
+				break
+			}
+		}
+	}
+	if err != nil {
+		logrus.Debugf("error getting manifest of %s: %v", ref, err)
+		return 0
+	}
+
+	var size int64
+	if m, ok := m.(*schema2.DeserializedManifest); ok {
+		for _, desc := range m.Layers {
+			size += desc.Size
+		}
+	}
+	return size
+}
+
 // ImageDelete removes the image from the cache
 func (c *Wrapper) ImageDelete(imageRef string, force, prune bool) ([]types.ImageDeleteResponseItem, error) {
 	resps, err := c.ImageService.ImageDelete(imageRef, force, prune)
@@ -82,14 +180,307 @@ func (c *Wrapper) ImageDelete(imageRef string, force, prune bool) ([]types.Image
 		return resps, err
 	}
 
+	for _, id := range deletedImageIDs(resps) {
+		c.ImageCache.UserRemoveImage(id)
+	}
+
+	return resps, err
+}
+
+// deletedImageIDs returns the distinct IDs of the images deleted in resps,
+// in order of appearance
+func deletedImageIDs(resps []types.ImageDeleteResponseItem) []image.ID {
+	var ids []image.ID
+	seen := make(map[image.ID]bool)
 	for _, r := range resps {
-		if r.Deleted == "" {
+		id := image.ID(r.Deleted)
+		if id == "" || seen[id] {
 			continue
 		}
-		c.ImageCache.RemoveImage(image.ID(r.Deleted))
+		seen[id] = true
+		ids = append(ids, id)
 	}
+	return ids
+}
 
-	return resps, err
+// Images hides the images internal to the cache from the listing, unless
+// all images are listed. The cache still accounts and evicts them.
+func (c *Wrapper) Images(imageFilters filters.Args, all bool, withExtraAttrs bool) ([]*types.ImageSummary, error) {
+	imgs, err := c.ImageService.Images(imageFilters, all, withExtraAttrs)
+	if err != nil || all || c.ImageCache == nil {
+		return imgs, err
+	}
+	visible := imgs[:0]
+	for _, img := range imgs {
+		if !c.ImageCache.Internal(image.ID(img.ID)) {
+			visible = append(visible, img)
+		}
+	}
+	return visible, nil
+}
+
+// ImageHistory updates image in cache, as inspecting the history of an image
+// is a sign of interest in it
+func (c *Wrapper) ImageHistory(name string) ([]*imagetypes.HistoryResponseItem, error) {
+	history, err := c.ImageService.ImageHistory(name)
+	if err != nil {
+		return history, err
+	}
+	if c.ImageCache != nil {
+		c.ImageCache.UpdateImage(name)
+	}
+	return history, nil
+}
+
+// PromoteImage moves the image to the front of the cache
+func (c *Wrapper) PromoteImage(refOrID string) error {
+	if c.ImageCache == nil {
+		return errdefs.Unavailable(errors.New("image cache is not enabled"))
+	}
+	img, err := c.GetImage(refOrID)
+	if err != nil {
+		return err
+	}
+	return c.ImageCache.Promote(img.ID())
+}
+
+// RebuildCache rebuilds the cache from the image store
+func (c *Wrapper) RebuildCache() error {
+	if c.ImageCache == nil {
+		return errdefs.Unavailable(errors.New("image cache is not enabled"))
+	}
+	return c.ImageCache.Rebuild()
+}
+
+// DrainCache evicts from the cache down to target bytes, as before an
+// upgrade of the daemon
+func (c *Wrapper) DrainCache(ctx context.Context, target int64) error {
+	if c.ImageCache == nil {
+		return errdefs.Unavailable(errors.New("image cache is not enabled"))
+	}
+	return c.ImageCache.Drain(ctx, target)
+}
+
+// CacheReclaimable breaks the cache level down by what keeps it from being
+// reclaimed
+func (c *Wrapper) CacheReclaimable() (types.ImageCacheReclaimable, error) {
+	if c.ImageCache == nil {
+		return types.ImageCacheReclaimable{}, errdefs.Unavailable(errors.New("image cache is not enabled"))
+	}
+	r := c.ImageCache.ReclaimableBreakdown()
+	return types.ImageCacheReclaimable{Free: r.Free, Pinned: r.Pinned, InUse: r.InUse}, nil
+}
+
+// CacheEfficiency summarizes the hits, evictions and re-pulls of the cache
+// since its stats were last reset
+func (c *Wrapper) CacheEfficiency() (types.ImageCacheEfficiency, error) {
+	if c.ImageCache == nil {
+		return types.ImageCacheEfficiency{}, errdefs.Unavailable(errors.New("image cache is not enabled"))
+	}
+	eff := c.ImageCache.Efficiency()
+	return types.ImageCacheEfficiency{
+		Since:        eff.Since,
+		Hits:         eff.Hits,
+		Misses:       eff.Misses,
+		Inserts:      eff.Inserts,
+		Evictions:    eff.Evictions,
+		Repulls:      eff.Repulls,
+		HitRatio:     eff.HitRatio,
+		EvictionRate: eff.EvictionRate,
+		RepullRate:   eff.RepullRate,
+	}, nil
+}
+
+// ResetCacheStats starts a new window for the efficiency of the cache
+func (c *Wrapper) ResetCacheStats() error {
+	if c.ImageCache == nil {
+		return errdefs.Unavailable(errors.New("image cache is not enabled"))
+	}
+	c.ImageCache.ResetStats()
+	return nil
+}
+
+// CacheConfig returns the configuration of the cache as resolved at startup
+func (c *Wrapper) CacheConfig() (types.ImageCacheConfig, error) {
+	if c.ImageCache == nil {
+		return types.ImageCacheConfig{}, errdefs.Unavailable(errors.New("image cache is not enabled"))
+	}
+	cfg := c.ImageCache.Config()
+	return types.ImageCacheConfig{
+		Policy:         cfg.Policy,
+		Mode:           cfg.Mode,
+		Capacity:       cfg.Capacity,
+		Archive:        cfg.Archive,
+		EvictThreshold: cfg.EvictThreshold,
+		RecencyWeight:  cfg.RecencyWeight,
+		ScanLabel:      cfg.ScanLabel,
+		EvictionBatch:  cfg.EvictionBatch,
+		MaxLayers:      cfg.MaxLayers,
+		RetainRetries:  cfg.RetainRetries,
+		DiskReserve:    cfg.DiskReserve,
+		SpillCapacity:  cfg.SpillCapacity,
+		Namespaces:     cfg.Namespaces,
+		IdleTimeout:    cfg.IdleTimeout,
+		IdleFloor:      cfg.IdleFloor,
+		EvictionIORate: cfg.EvictionIORate,
+		Fallbacks:      cfg.Fallbacks,
+	}, nil
+}
+
+// CacheImages returns the images held by the cache
+func (c *Wrapper) CacheImages() ([]types.ImageCacheEntry, error) {
+	if c.ImageCache == nil {
+		return nil, errdefs.Unavailable(errors.New("image cache is not enabled"))
+	}
+	entries := []types.ImageCacheEntry{}
+	for _, entry := range c.ImageCache.List() {
+		for _, id := range entry.Images {
+			entries = append(entries, types.ImageCacheEntry{
+				ID:             id.String(),
+				Size:           entry.Size,
+				Added:          entry.Added,
+				Accessed:       entry.Accessed,
+				Registry:       entry.Registry,
+				ArchivePresent: entry.ArchivePresent,
+				ArchiveBytes:   entry.ArchiveBytes,
+			})
+		}
+	}
+	return entries, nil
+}
+
+// CacheImagePosition returns the position of the image in the eviction order
+// of the cache
+func (c *Wrapper) CacheImagePosition(refOrID string) (types.ImageCachePosition, error) {
+	if c.ImageCache == nil {
+		return types.ImageCachePosition{}, errdefs.Unavailable(errors.New("image cache is not enabled"))
+	}
+	img, err := c.GetImage(refOrID)
+	if err != nil {
+		return types.ImageCachePosition{}, err
+	}
+	rank, total, ok := c.ImageCache.Position(img.ID())
+	if !ok {
+		return types.ImageCachePosition{}, errdefs.NotFound(fmt.Errorf("image %s is not in cache", img.ID()))
+	}
+	return types.ImageCachePosition{ID: img.ID().String(), Rank: rank, Total: total}, nil
+}
+
+// CacheImageFreeable returns the bytes that removing the image from the
+// cache would free
+func (c *Wrapper) CacheImageFreeable(refOrID string) (types.ImageCacheFreeable, error) {
+	if c.ImageCache == nil {
+		return types.ImageCacheFreeable{}, errdefs.Unavailable(errors.New("image cache is not enabled"))
+	}
+	img, err := c.GetImage(refOrID)
+	if err != nil {
+		return types.ImageCacheFreeable{}, err
+	}
+	if _, _, ok := c.ImageCache.Position(img.ID()); !ok {
+		return types.ImageCacheFreeable{}, errdefs.NotFound(fmt.Errorf("image %s is not in cache", img.ID()))
+	}
+	return types.ImageCacheFreeable{ID: img.ID().String(), Bytes: c.ImageCache.FreeableBytes(img.ID())}, nil
+}
+
+// ValidateCachePolicy checks whether the cache could switch to policy at
+// capacity, without applying it
+func (c *Wrapper) ValidateCachePolicy(policy string, capacity int64) (types.ImageCachePolicyValidation, error) {
+	if c.ImageCache == nil {
+		return types.ImageCachePolicyValidation{}, errdefs.Unavailable(errors.New("image cache is not enabled"))
+	}
+	warnings, err := c.ImageCache.ValidatePolicy(policy, capacity)
+	if err != nil {
+		return types.ImageCachePolicyValidation{}, err
+	}
+	if warnings == nil {
+		warnings = []string{}
+	}
+	return types.ImageCachePolicyValidation{Warnings: warnings}, nil
+}
+
+// PinCachePattern keeps the images with a tag matching the pattern from
+// being evicted
+func (c *Wrapper) PinCachePattern(pattern string) error {
+	if c.ImageCache == nil {
+		return errdefs.Unavailable(errors.New("image cache is not enabled"))
+	}
+	return c.ImageCache.PinPattern(pattern)
+}
+
+// UnpinCachePattern drops a pattern pinned by PinCachePattern
+func (c *Wrapper) UnpinCachePattern(pattern string) error {
+	if c.ImageCache == nil {
+		return errdefs.Unavailable(errors.New("image cache is not enabled"))
+	}
+	return c.ImageCache.UnpinPattern(pattern)
+}
+
+// BuildWrapper puts the final images of the builds run by a build backend in
+// the cache, as they never pass through PullImage
+type BuildWrapper struct {
+	buildrouter.Backend
+	cache    cache.ImageCache
+	getImage func(refOrID string) (*image.Image, error)
+}
+
+// NewBuildWrapper creates the cache proxy of a build backend
+func NewBuildWrapper(b buildrouter.Backend, d *Daemon) *BuildWrapper {
+	return &BuildWrapper{
+		Backend:  b,
+		cache:    d.ImageCache(),
+		getImage: d.ImageService().GetImage,
+	}
+}
+
+// Build puts the built image in cache. Intermediate images of the build are
+// not cached, nor are untagged results.
+func (b *BuildWrapper) Build(ctx context.Context, config backend.BuildConfig) (string, error) {
+	imageID, err := b.Backend.Build(ctx, config)
+	if err != nil || imageID == "" || b.cache == nil {
+		return imageID, err
+	}
+	if config.Options == nil || len(config.Options.Tags) == 0 {
+		logrus.Debugf("Built image %s is not tagged, not caching it", imageID)
+		return imageID, nil
+	}
+
+	img, err := b.getImage(imageID)
+	if err != nil {
+		logrus.Errorf("error getting built image: %v", err)
+		return imageID, nil
+	}
+	b.cache.PutImage(img)
+	return imageID, nil
+}
+
+// CreateImageFromContainer commits a container into a new image and puts it
+// in cache. The base image of the container is protected from eviction
+// during the commit, and the committed image until it is put.
+func (c *Wrapper) CreateImageFromContainer(name string, config *backend.CreateImageConfig) (string, error) {
+	if c.ImageCache == nil {
+		return c.commit(name, config)
+	}
+	ctr, err := c.GetContainer(name)
+	if err != nil {
+		return "", err
+	}
+	c.ImageCache.BeginCommit(ctr.ImageID)
+	defer c.ImageCache.EndCommit(ctr.ImageID)
+
+	id, err := c.commit(name, config)
+	if err != nil {
+		return "", err
+	}
+	c.ImageCache.BeginCommit(image.ID(id))
+	defer c.ImageCache.EndCommit(image.ID(id))
+
+	img, err := c.GetImage(id)
+	if err != nil {
+		logrus.Errorf("error getting committed image: %v", err)
+		return id, nil
+	}
+	c.ImageCache.PutImage(img)
+	return id, nil
 }
 
 // ContainerCreate updates image in cache
@@ -0,0 +1,428 @@
+package daemon // import "github.com/docker/docker/daemon"
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+
+	"github.com/docker/distribution/reference"
+	buildrouter "github.com/docker/docker/api/server/router/build"
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/backend"
+	"github.com/docker/docker/api/types/filters"
+	"github.com/docker/docker/container"
+	"github.com/docker/docker/daemon/cache"
+	"github.com/docker/docker/daemon/images"
+	"github.com/docker/docker/image"
+	refstore "github.com/docker/docker/reference"
+	"github.com/opencontainers/go-digest"
+	specs "github.com/opencontainers/image-spec/specs-go/v1"
+	"gotest.tools/assert"
+	is "gotest.tools/assert/cmp"
+)
+
+func TestDeletedImageIDs(t *testing.T) {
+	resps := []types.ImageDeleteResponseItem{
+		{Untagged: "busybox:latest"},
+		{Untagged: "busybox:1.31"},
+		{Deleted: "sha256:a"},
+		{Deleted: "sha256:b"},
+		{Deleted: "sha256:a"},
+	}
+	expected := []image.ID{"sha256:a", "sha256:b"}
+	assert.Check(t, is.DeepEqual(expected, deletedImageIDs(resps)))
+	assert.Check(t, is.Len(deletedImageIDs(resps[:2]), 0))
+}
+
+// fakeBuildBackend creates an intermediate image for each step of the build,
+// the last one being the result
+type fakeBuildBackend struct {
+	buildrouter.Backend
+	images map[string]*image.Image
+	steps  int
+}
+
+func (b *fakeBuildBackend) Build(ctx context.Context, config backend.BuildConfig) (string, error) {
+	var id string
+	for i := 0; i < b.steps; i++ {
+		id = fmt.Sprintf("sha256:%d", len(b.images))
+		b.images[id] = &image.Image{}
+	}
+	return id, nil
+}
+
+type fakeImageCache struct {
+	cache.ImageCache
+	put      []*image.Image
+	updated  []string
+	internal map[image.ID]bool
+	config   cache.CacheConfig
+	pulling  []string
+	squashed []image.ID
+	reserved int64
+	// putReserved are the bytes reserved when each image was put
+	putReserved     []int64
+	level, capacity int64
+	// registries are the registries recorded by image
+	registries map[image.ID][]string
+	// committing counts the commits in progress by image, and
+	// putCommitting tells whether each image put was being committed
+	committing    map[image.ID]int
+	putCommitting []bool
+}
+
+func (c *fakeImageCache) Config() cache.CacheConfig {
+	return c.config
+}
+
+func (c *fakeImageCache) BeginPull(ref string) {
+	c.pulling = append(c.pulling, ref)
+}
+
+func (c *fakeImageCache) EndPull(ref string) {}
+
+func (c *fakeImageCache) Level() int64 {
+	return c.level
+}
+
+func (c *fakeImageCache) Capacity() int64 {
+	return c.capacity
+}
+
+func (c *fakeImageCache) Reserve(ref string, size int64) func() {
+	c.reserved += size
+	return func() { c.reserved -= size }
+}
+
+func (c *fakeImageCache) SquashImage(img *image.Image) (*image.Image, error) {
+	c.squashed = append(c.squashed, img.ID())
+	return img, nil
+}
+
+func (c *fakeImageCache) Internal(imgID image.ID) bool {
+	return c.internal[imgID]
+}
+
+func (c *fakeImageCache) UpdateImage(refOrID string) {
+	c.updated = append(c.updated, refOrID)
+}
+
+func (c *fakeImageCache) PutImage(img *image.Image) {
+	c.put = append(c.put, img)
+	c.putReserved = append(c.putReserved, c.reserved)
+	c.putCommitting = append(c.putCommitting, c.committing[img.ID()] > 0)
+}
+
+func (c *fakeImageCache) BeginCommit(imgIDs ...image.ID) {
+	if c.committing == nil {
+		c.committing = make(map[image.ID]int)
+	}
+	for _, imgID := range imgIDs {
+		c.committing[imgID]++
+	}
+}
+
+func (c *fakeImageCache) EndCommit(imgIDs ...image.ID) {
+	for _, imgID := range imgIDs {
+		if c.committing[imgID]--; c.committing[imgID] == 0 {
+			delete(c.committing, imgID)
+		}
+	}
+}
+
+func (c *fakeImageCache) SetRegistry(imgID image.ID, registry string) {
+	if c.registries == nil {
+		c.registries = make(map[image.ID][]string)
+	}
+	c.registries[imgID] = append(c.registries[imgID], registry)
+}
+
+func TestBuildWrapperCachesFinalImage(t *testing.T) {
+	b := &fakeBuildBackend{images: make(map[string]*image.Image), steps: 3}
+	c := &fakeImageCache{}
+	w := &BuildWrapper{
+		Backend: b,
+		cache:   c,
+		getImage: func(refOrID string) (*image.Image, error) {
+			img, ok := b.images[refOrID]
+			if !ok {
+				return nil, fmt.Errorf("no such image: %s", refOrID)
+			}
+			return img, nil
+		},
+	}
+
+	id, err := w.Build(context.Background(), backend.BuildConfig{Options: &types.ImageBuildOptions{Tags: []string{"app:latest"}}})
+	assert.NilError(t, err)
+	assert.Check(t, is.Equal("sha256:2", id))
+	assert.Check(t, is.Len(b.images, 3))
+	assert.Assert(t, is.Len(c.put, 1))
+	assert.Check(t, c.put[0] == b.images[id])
+
+	// untagged results are not cached
+	id, err = w.Build(context.Background(), backend.BuildConfig{Options: &types.ImageBuildOptions{}})
+	assert.NilError(t, err)
+	assert.Check(t, is.Equal("sha256:5", id))
+	assert.Check(t, is.Len(c.put, 1))
+}
+
+func TestWrapperImageHistoryUpdatesCache(t *testing.T) {
+	dir, err := ioutil.TempDir("", "wrapper-history")
+	assert.NilError(t, err)
+	defer os.RemoveAll(dir)
+
+	fs, err := image.NewFSStoreBackend(filepath.Join(dir, "images"))
+	assert.NilError(t, err)
+	imgStore, err := image.NewImageStore(fs, nil)
+	assert.NilError(t, err)
+	rs, err := refstore.NewReferenceStore(filepath.Join(dir, "repositories.json"))
+	assert.NilError(t, err)
+	id, err := imgStore.Create([]byte(`{"rootfs": {"type": "layers"}, "history": [{"created_by": "test", "empty_layer": true}]}`))
+	assert.NilError(t, err)
+
+	c := &fakeImageCache{}
+	w := &Wrapper{
+		ImageService: images.NewImageService(images.ImageServiceConfig{ImageStore: imgStore, ReferenceStore: rs}),
+		ImageCache:   c,
+	}
+
+	history, err := w.ImageHistory(id.String())
+	assert.NilError(t, err)
+	assert.Check(t, is.Len(history, 1))
+	assert.Check(t, is.DeepEqual([]string{id.String()}, c.updated))
+
+	// failed queries leave the cache alone
+	_, err = w.ImageHistory("sha256:0000000000000000000000000000000000000000000000000000000000000000")
+	assert.Check(t, err != nil)
+	assert.Check(t, is.Len(c.updated, 1))
+}
+
+func TestWrapperImagesHidesInternalImages(t *testing.T) {
+	dir, err := ioutil.TempDir("", "wrapper-images")
+	assert.NilError(t, err)
+	defer os.RemoveAll(dir)
+
+	fs, err := image.NewFSStoreBackend(filepath.Join(dir, "images"))
+	assert.NilError(t, err)
+	imgStore, err := image.NewImageStore(fs, nil)
+	assert.NilError(t, err)
+	rs, err := refstore.NewReferenceStore(filepath.Join(dir, "repositories.json"))
+	assert.NilError(t, err)
+	user, err := imgStore.Create([]byte(`{"rootfs": {"type": "layers"}, "config": {"Cmd": ["user"]}}`))
+	assert.NilError(t, err)
+	internal, err := imgStore.Create([]byte(`{"rootfs": {"type": "layers"}, "config": {"Cmd": ["internal"]}}`))
+	assert.NilError(t, err)
+
+	w := &Wrapper{
+		ImageService: images.NewImageService(images.ImageServiceConfig{ImageStore: imgStore, ReferenceStore: rs}),
+		ImageCache:   &fakeImageCache{internal: map[image.ID]bool{internal: true}},
+	}
+
+	ids := func(all bool) []string {
+		summaries, err := w.Images(filters.NewArgs(), all, false)
+		assert.NilError(t, err)
+		var ids []string
+		for _, s := range summaries {
+			ids = append(ids, s.ID)
+		}
+		sort.Strings(ids)
+		return ids
+	}
+	assert.Check(t, is.DeepEqual([]string{user.String()}, ids(false)))
+
+	expected := []string{user.String(), internal.String()}
+	sort.Strings(expected)
+	assert.Check(t, is.DeepEqual(expected, ids(true)))
+}
+
+func TestWrapperPullImageModes(t *testing.T) {
+	dir, err := ioutil.TempDir("", "wrapper-pull")
+	assert.NilError(t, err)
+	defer os.RemoveAll(dir)
+
+	fs, err := image.NewFSStoreBackend(filepath.Join(dir, "images"))
+	assert.NilError(t, err)
+	imgStore, err := image.NewImageStore(fs, nil)
+	assert.NilError(t, err)
+	rs, err := refstore.NewReferenceStore(filepath.Join(dir, "repositories.json"))
+	assert.NilError(t, err)
+	id, err := imgStore.Create([]byte(`{"rootfs": {"type": "layers"}}`))
+	assert.NilError(t, err)
+	ref, err := reference.ParseNormalizedNamed("busybox:latest")
+	assert.NilError(t, err)
+	assert.NilError(t, rs.AddTag(ref, digest.Digest(id), true))
+
+	for _, mode := range []string{cache.ModeFull, cache.ModeEvictionOnly} {
+		c := &fakeImageCache{config: cache.CacheConfig{Mode: mode}, level: 90, capacity: 100}
+		var (
+			pulls    int
+			reserved []int64
+		)
+		w := &Wrapper{
+			ImageService: images.NewImageService(images.ImageServiceConfig{ImageStore: imgStore, ReferenceStore: rs}),
+			ImageCache:   c,
+			pull: func(ctx context.Context, image, tag string, platform *specs.Platform, metaHeaders map[string][]string, authConfig *types.AuthConfig, outStream io.Writer) error {
+				pulls++
+				reserved = append(reserved, c.reserved)
+				return nil
+			},
+			sizeOf: func(ctx context.Context, ref reference.Named, platform *specs.Platform, authConfig *types.AuthConfig) int64 {
+				return 25
+			},
+		}
+
+		// the image is pulled even though it is already there, and put
+		// in cache every time
+		for i := 0; i < 2; i++ {
+			assert.NilError(t, w.PullImage(context.Background(), "busybox", "latest", nil, nil, nil, ioutil.Discard), mode)
+		}
+		assert.Check(t, is.Equal(2, pulls), mode)
+		assert.Check(t, is.Len(c.put, 2), mode)
+		// the reservation lasts until the image is put
+		assert.Check(t, is.Equal(int64(0), c.reserved), mode)
+		if mode == cache.ModeEvictionOnly {
+			assert.Check(t, is.Len(c.pulling, 0), mode)
+			assert.Check(t, is.Len(c.squashed, 0), mode)
+			assert.Check(t, is.DeepEqual([]int64{0, 0}, reserved), mode)
+			assert.Check(t, is.DeepEqual([]int64{0, 0}, c.putReserved), mode)
+		} else {
+			assert.Check(t, is.DeepEqual([]int64{25, 25}, reserved), mode)
+			assert.Check(t, is.DeepEqual([]int64{25, 25}, c.putReserved), mode)
+			assert.Check(t, is.DeepEqual([]string{"docker.io/library/busybox:latest", "docker.io/library/busybox:latest"}, c.pulling), mode)
+			assert.Check(t, is.DeepEqual([]image.ID{id, id}, c.squashed), mode)
+		}
+	}
+}
+
+func TestWrapperPullImageEstimatesNearCapacity(t *testing.T) {
+	dir, err := ioutil.TempDir("", "wrapper-pull-estimate")
+	assert.NilError(t, err)
+	defer os.RemoveAll(dir)
+
+	fs, err := image.NewFSStoreBackend(filepath.Join(dir, "images"))
+	assert.NilError(t, err)
+	imgStore, err := image.NewImageStore(fs, nil)
+	assert.NilError(t, err)
+	rs, err := refstore.NewReferenceStore(filepath.Join(dir, "repositories.json"))
+	assert.NilError(t, err)
+	id, err := imgStore.Create([]byte(`{"rootfs": {"type": "layers"}}`))
+	assert.NilError(t, err)
+	ref, err := reference.ParseNormalizedNamed("busybox:latest")
+	assert.NilError(t, err)
+	assert.NilError(t, rs.AddTag(ref, digest.Digest(id), true))
+
+	// the manifest is only fetched ahead of the pull once the cache is
+	// close to its capacity
+	for level, estimated := range map[int64]bool{50: false, 79: false, 80: true, 120: true} {
+		c := &fakeImageCache{config: cache.CacheConfig{Mode: cache.ModeFull}, level: level, capacity: 100}
+		var estimates int
+		w := &Wrapper{
+			ImageService: images.NewImageService(images.ImageServiceConfig{ImageStore: imgStore, ReferenceStore: rs}),
+			ImageCache:   c,
+			pull: func(ctx context.Context, image, tag string, platform *specs.Platform, metaHeaders map[string][]string, authConfig *types.AuthConfig, outStream io.Writer) error {
+				return nil
+			},
+			sizeOf: func(ctx context.Context, ref reference.Named, platform *specs.Platform, authConfig *types.AuthConfig) int64 {
+				estimates++
+				return 25
+			},
+		}
+		assert.NilError(t, w.PullImage(context.Background(), "busybox", "latest", nil, nil, nil, ioutil.Discard))
+		assert.Check(t, is.Equal(estimated, estimates == 1), "level %d", level)
+	}
+}
+
+func TestWrapperPullImageRecordsRegistry(t *testing.T) {
+	dir, err := ioutil.TempDir("", "wrapper-pull-registry")
+	assert.NilError(t, err)
+	defer os.RemoveAll(dir)
+
+	fs, err := image.NewFSStoreBackend(filepath.Join(dir, "images"))
+	assert.NilError(t, err)
+	imgStore, err := image.NewImageStore(fs, nil)
+	assert.NilError(t, err)
+	rs, err := refstore.NewReferenceStore(filepath.Join(dir, "repositories.json"))
+	assert.NilError(t, err)
+	ids := make(map[string]image.ID)
+	for _, name := range []string{"busybox:latest", "registry.example.com:5000/team/app:1"} {
+		id, err := imgStore.Create([]byte(fmt.Sprintf(`{"rootfs": {"type": "layers"}, "config": {"Cmd": [%q]}}`, name)))
+		assert.NilError(t, err)
+		ref, err := reference.ParseNormalizedNamed(name)
+		assert.NilError(t, err)
+		assert.NilError(t, rs.AddTag(ref, digest.Digest(id), true))
+		ids[name] = id
+	}
+
+	c := &fakeImageCache{config: cache.CacheConfig{Mode: cache.ModeFull}}
+	w := &Wrapper{
+		ImageService: images.NewImageService(images.ImageServiceConfig{ImageStore: imgStore, ReferenceStore: rs}),
+		ImageCache:   c,
+		pull: func(ctx context.Context, image, tag string, platform *specs.Platform, metaHeaders map[string][]string, authConfig *types.AuthConfig, outStream io.Writer) error {
+			return nil
+		},
+	}
+	assert.NilError(t, w.PullImage(context.Background(), "busybox", "latest", nil, nil, nil, ioutil.Discard))
+	assert.NilError(t, w.PullImage(context.Background(), "registry.example.com:5000/team/app", "1", nil, nil, nil, ioutil.Discard))
+
+	// the registry of the official images is that of Docker Hub
+	expected := map[image.ID][]string{
+		ids["busybox:latest"]:                       {"docker.io"},
+		ids["registry.example.com:5000/team/app:1"]: {"registry.example.com:5000"},
+	}
+	assert.Check(t, is.DeepEqual(expected, c.registries))
+}
+
+func TestWrapperCommitProtectsImages(t *testing.T) {
+	dir, err := ioutil.TempDir("", "wrapper-commit")
+	assert.NilError(t, err)
+	defer os.RemoveAll(dir)
+
+	fs, err := image.NewFSStoreBackend(filepath.Join(dir, "images"))
+	assert.NilError(t, err)
+	imgStore, err := image.NewImageStore(fs, nil)
+	assert.NilError(t, err)
+	rs, err := refstore.NewReferenceStore(filepath.Join(dir, "repositories.json"))
+	assert.NilError(t, err)
+	base, err := imgStore.Create([]byte(`{"rootfs": {"type": "layers"}, "config": {"Cmd": ["base"]}}`))
+	assert.NilError(t, err)
+
+	store := container.NewMemoryStore()
+	ctr := &container.Container{ID: "3cdbd1aa394fd68559fd1441d6eff2ab7c1e6363582c82febfaa8045df3bd8de", ImageID: base}
+	store.Add(ctr.ID, ctr)
+
+	c := &fakeImageCache{}
+	w := &Wrapper{
+		Daemon:       &Daemon{containers: store},
+		ImageService: images.NewImageService(images.ImageServiceConfig{ImageStore: imgStore, ReferenceStore: rs}),
+		ImageCache:   c,
+		commit: func(name string, config *backend.CreateImageConfig) (string, error) {
+			// the base image is protected during the commit
+			assert.Check(t, is.DeepEqual(map[image.ID]int{base: 1}, c.committing))
+			id, err := imgStore.Create([]byte(`{"rootfs": {"type": "layers"}, "config": {"Cmd": ["committed"]}}`))
+			return id.String(), err
+		},
+	}
+
+	id, err := w.CreateImageFromContainer(ctr.ID, &backend.CreateImageConfig{})
+	assert.NilError(t, err)
+	assert.Assert(t, is.Len(c.put, 1))
+	assert.Check(t, is.Equal(id, c.put[0].ID().String()))
+	// the committed image is protected until it is put, and nothing once
+	// done
+	assert.Check(t, is.DeepEqual([]bool{true}, c.putCommitting))
+	assert.Check(t, is.Len(c.committing, 0))
+
+	// failed commits put nothing
+	w.commit = func(name string, config *backend.CreateImageConfig) (string, error) {
+		return "", fmt.Errorf("commit failed")
+	}
+	_, err = w.CreateImageFromContainer(ctr.ID, &backend.CreateImageConfig{})
+	assert.Check(t, err != nil)
+	assert.Check(t, is.Len(c.put, 1))
+	assert.Check(t, is.Len(c.committing, 0))
+}
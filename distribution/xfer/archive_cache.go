@@ -0,0 +1,162 @@
+package xfer // import "github.com/docker/docker/distribution/xfer"
+
+import (
+	"bytes"
+	"container/list"
+	"io"
+	"io/ioutil"
+	"sync"
+
+	"github.com/docker/docker/layer"
+	"github.com/docker/docker/pkg/ioutils"
+	"github.com/sirupsen/logrus"
+)
+
+// archiveMemEntryFraction bounds the size of a single archive kept in
+// memory to a fraction of the total budget, so that large archives always
+// bypass the memory cache and are streamed from the archive store.
+const archiveMemEntryFraction = 4
+
+// archiveMemCache is a bounded in-memory LRU of recently served layer
+// archives, sitting in front of the archive store.
+type archiveMemCache struct {
+	mu        sync.Mutex
+	capacity  int64
+	maxEntry  int64
+	level     int64
+	entries   map[layer.DiffID]*list.Element
+	evictList *list.List
+}
+
+type archiveMemEntry struct {
+	diffID layer.DiffID
+	data   []byte
+}
+
+func newArchiveMemCache(capacity int64) *archiveMemCache {
+	return &archiveMemCache{
+		capacity:  capacity,
+		maxEntry:  capacity / archiveMemEntryFraction,
+		entries:   make(map[layer.DiffID]*list.Element),
+		evictList: list.New(),
+	}
+}
+
+// archiveMemCaches are the memory caches of the download managers, from
+// which GuardArchiveDeletion drops the archives it deletes, so that no
+// archive gone from the store is still served from memory
+var archiveMemCaches = struct {
+	sync.Mutex
+	caches map[*archiveMemCache]bool
+}{caches: make(map[*archiveMemCache]bool)}
+
+// WithArchiveMemoryCache enables an in-memory cache of up to capacity bytes
+// for small layer archives served from disk.
+func WithArchiveMemoryCache(capacity int64) func(*LayerDownloadManager) {
+	return func(ldm *LayerDownloadManager) {
+		if capacity > 0 {
+			ldm.archiveMemCache = newArchiveMemCache(capacity)
+			archiveMemCaches.Lock()
+			archiveMemCaches.caches[ldm.archiveMemCache] = true
+			archiveMemCaches.Unlock()
+		}
+	}
+}
+
+// forgetArchives drops the archives of diffIDs from the memory caches
+func forgetArchives(diffIDs []layer.DiffID) {
+	archiveMemCaches.Lock()
+	defer archiveMemCaches.Unlock()
+	for c := range archiveMemCaches.caches {
+		for _, diffID := range diffIDs {
+			c.remove(diffID)
+		}
+	}
+}
+
+// getArchiveReader returns a reader of the layer archive from store,
+// serving it from memory when possible. A nil cache reads from store
+// directly.
+func (c *archiveMemCache) getArchiveReader(store ArchiveStore, diffID layer.DiffID) (io.ReadCloser, error) {
+	if c == nil || diffID == "" {
+		rc, err := store.Get(diffID)
+		if err != nil || rc == nil {
+			return rc, err
+		}
+		return trackArchiveRead(diffID, rc), nil
+	}
+
+	if data, ok := c.get(diffID); ok {
+		logrus.Debugf("Layer archive of %s is served from memory", diffID)
+		return ioutil.NopCloser(bytes.NewReader(data)), nil
+	}
+
+	rc, err := store.Get(diffID)
+	if err != nil {
+		return nil, err
+	}
+	rc = trackArchiveRead(diffID, rc)
+	data, err := ioutil.ReadAll(io.LimitReader(rc, c.maxEntry+1))
+	if err != nil {
+		rc.Close()
+		return nil, err
+	}
+	if int64(len(data)) > c.maxEntry {
+		return ioutils.NewReadCloserWrapper(io.MultiReader(bytes.NewReader(data), rc), rc.Close), nil
+	}
+	rc.Close()
+	c.put(diffID, data)
+	return ioutil.NopCloser(bytes.NewReader(data)), nil
+}
+
+func (c *archiveMemCache) get(diffID layer.DiffID) ([]byte, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	e, ok := c.entries[diffID]
+	if !ok {
+		return nil, false
+	}
+	c.evictList.MoveToFront(e)
+	return e.Value.(*archiveMemEntry).data, true
+}
+
+func (c *archiveMemCache) put(diffID layer.DiffID, data []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	size := int64(len(data))
+	if size > c.maxEntry {
+		return
+	}
+	if e, ok := c.entries[diffID]; ok {
+		c.evictList.MoveToFront(e)
+		return
+	}
+
+	c.entries[diffID] = c.evictList.PushFront(&archiveMemEntry{diffID: diffID, data: data})
+	c.level += size
+
+	for c.level > c.capacity {
+		e := c.evictList.Back()
+		ent := e.Value.(*archiveMemEntry)
+		c.evictList.Remove(e)
+		delete(c.entries, ent.diffID)
+		c.level -= int64(len(ent.data))
+	}
+}
+
+// remove drops the archive of diffID from memory.
+func (c *archiveMemCache) remove(diffID layer.DiffID) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if e, ok := c.entries[diffID]; ok {
+		c.evictList.Remove(e)
+		delete(c.entries, diffID)
+		c.level -= int64(len(e.Value.(*archiveMemEntry).data))
+	}
+}
@@ -0,0 +1,111 @@
+package xfer // import "github.com/docker/docker/distribution/xfer"
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/docker/docker/layer"
+	"github.com/opencontainers/go-digest"
+	"gotest.tools/assert"
+	is "gotest.tools/assert/cmp"
+)
+
+func writeTestArchive(t *testing.T, dir string, data []byte) layer.DiffID {
+	t.Helper()
+	diffID := layer.DiffID(digest.FromBytes(data))
+	err := ioutil.WriteFile(filepath.Join(dir, digest.Digest(diffID).Hex()), data, 0600)
+	assert.NilError(t, err)
+	return diffID
+}
+
+func readTestArchive(t *testing.T, c *archiveMemCache, diffID layer.DiffID) ([]byte, error) {
+	t.Helper()
+	rc, err := c.getArchiveReader(NewDirArchiveStore(""), diffID)
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	return ioutil.ReadAll(rc)
+}
+
+func TestArchiveMemCache(t *testing.T) {
+	dir, err := ioutil.TempDir("", "archive-mem-cache")
+	assert.NilError(t, err)
+	defer os.RemoveAll(dir)
+
+	oldTmp := os.Getenv("TMPDIR")
+	os.Setenv("TMPDIR", dir)
+	defer os.Setenv("TMPDIR", oldTmp)
+
+	c := newArchiveMemCache(1024)
+	small := []byte("small archive")
+	large := make([]byte, 512)
+	smallID := writeTestArchive(t, dir, small)
+	largeID := writeTestArchive(t, dir, large)
+
+	for i := 0; i < 2; i++ {
+		data, err := readTestArchive(t, c, smallID)
+		assert.NilError(t, err)
+		assert.Check(t, is.DeepEqual(small, data))
+
+		data, err = readTestArchive(t, c, largeID)
+		assert.NilError(t, err)
+		assert.Check(t, is.DeepEqual(large, data))
+	}
+	assert.Check(t, is.Len(c.entries, 1))
+	assert.Check(t, is.Equal(int64(len(small)), c.level))
+
+	// Once on-disk copies are gone, the small archive is still served from
+	// memory while the large one always goes to disk.
+	assert.NilError(t, os.RemoveAll(filepath.Join(dir, digest.Digest(smallID).Hex())))
+	assert.NilError(t, os.RemoveAll(filepath.Join(dir, digest.Digest(largeID).Hex())))
+
+	data, err := readTestArchive(t, c, smallID)
+	assert.NilError(t, err)
+	assert.Check(t, is.DeepEqual(small, data))
+
+	_, err = readTestArchive(t, c, largeID)
+	assert.Check(t, os.IsNotExist(err))
+}
+
+func TestArchiveMemCacheEvict(t *testing.T) {
+	c := newArchiveMemCache(16)
+	c.put("a", []byte("aaaa"))
+	c.put("b", []byte("bbbb"))
+	c.put("c", []byte("cccc"))
+	c.put("d", []byte("dddd"))
+	_, ok := c.get("a")
+	assert.Check(t, ok)
+
+	c.put("e", []byte("eeee"))
+	_, ok = c.get("b")
+	assert.Check(t, !ok)
+	assert.Check(t, is.Equal(int64(16), c.level))
+
+	c.remove("a")
+	_, ok = c.get("a")
+	assert.Check(t, !ok)
+	assert.Check(t, is.Equal(int64(12), c.level))
+}
+
+func TestArchiveMemCacheForgetsDeletedArchives(t *testing.T) {
+	ldm := &LayerDownloadManager{}
+	WithArchiveMemoryCache(16)(ldm)
+	c := ldm.archiveMemCache
+	c.put("a", []byte("aaaa"))
+	c.put("b", []byte("bbbb"))
+
+	var deleted []layer.DiffID
+	err := GuardArchiveDeletion([]layer.DiffID{"a"}, func(diffIDs []layer.DiffID) error {
+		deleted = append(deleted, diffIDs...)
+		return nil
+	})
+	assert.NilError(t, err)
+	assert.Check(t, is.DeepEqual([]layer.DiffID{"a"}, deleted))
+	_, ok := c.get("a")
+	assert.Check(t, !ok)
+	_, ok = c.get("b")
+	assert.Check(t, ok)
+}
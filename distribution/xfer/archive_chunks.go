@@ -0,0 +1,286 @@
+package xfer // import "github.com/docker/docker/distribution/xfer"
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/docker/docker/layer"
+	"github.com/docker/docker/pkg/archive"
+	"github.com/opencontainers/go-digest"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// chunkMinSize and chunkMaxSize bound the size of the chunks cut from
+	// the archives, and chunkMaskBits sets their average size above the
+	// minimum to 2^chunkMaskBits bytes
+	chunkMinSize  = 16 << 10
+	chunkMaxSize  = 256 << 10
+	chunkMaskBits = 16
+)
+
+// gearTable holds the random values of the bytes for the rolling hash of the
+// chunker. It is generated from a fixed seed, so that every daemon cuts the
+// same content into the same chunks.
+var gearTable = func() [256]uint64 {
+	var table [256]uint64
+	x := uint64(0x9e3779b97f4a7c15)
+	for i := range table {
+		// splitmix64
+		x += 0x9e3779b97f4a7c15
+		z := x
+		z = (z ^ (z >> 30)) * 0xbf58476d1ce4e5b9
+		z = (z ^ (z >> 27)) * 0x94d049bb133111eb
+		table[i] = z ^ (z >> 31)
+	}
+	return table
+}()
+
+// chunker cuts a stream into content-defined chunks: a chunk ends where the
+// rolling hash of the bytes read so far matches the mask, so that an edit
+// only changes the chunks around it, unlike fixed-size blocks which would
+// all shift after an insertion
+type chunker struct {
+	r        *bufio.Reader
+	min, max int
+	mask     uint64
+	buf      []byte
+}
+
+func newChunker(r io.Reader, min, max int, maskBits uint) *chunker {
+	return &chunker{
+		r:    bufio.NewReader(r),
+		min:  min,
+		max:  max,
+		mask: 1<<maskBits - 1,
+		buf:  make([]byte, 0, max),
+	}
+}
+
+// next returns the next chunk, valid until the following call, and io.EOF
+// once the stream is consumed
+func (c *chunker) next() ([]byte, error) {
+	c.buf = c.buf[:0]
+	var hash uint64
+	for len(c.buf) < c.max {
+		b, err := c.r.ReadByte()
+		if err != nil {
+			if err == io.EOF && len(c.buf) > 0 {
+				return c.buf, nil
+			}
+			return nil, err
+		}
+		c.buf = append(c.buf, b)
+		hash = hash<<1 + gearTable[b]
+		if len(c.buf) >= c.min && hash&c.mask == 0 {
+			break
+		}
+	}
+	return c.buf, nil
+}
+
+// chunkArchiveStore keeps archives split into content-defined chunks in a
+// directory, each distinct chunk being stored once whatever the archives
+// holding it, so that near-identical layers share most of their storage.
+// The chunks are cut from the uncompressed content of the archives, which
+// are read back uncompressed. Chunks are files named after the hex of their
+// digest under chunks, and the index of an archive, listing the digests of
+// its chunks in order, is named after the hex of its diffID under index.
+type chunkArchiveStore struct {
+	root     string
+	min, max int
+	maskBits uint
+}
+
+// NewChunkArchiveStore returns an ArchiveStore deduplicating the archives
+// it keeps in root by content-defined chunks. root may be a volume shared
+// by several daemons, as the chunks and indexes are written atomically.
+func NewChunkArchiveStore(root string) ArchiveStore {
+	if realRoot, err := filepath.EvalSymlinks(root); err == nil {
+		root = realRoot
+	} else {
+		logrus.Warnf("error resolving the layer archive directory %s: %v", root, err)
+	}
+	return &chunkArchiveStore{
+		root:     root,
+		min:      chunkMinSize,
+		max:      chunkMaxSize,
+		maskBits: chunkMaskBits,
+	}
+}
+
+func (s *chunkArchiveStore) chunkPath(dgst digest.Digest) string {
+	return filepath.Join(s.root, "chunks", dgst.Hex())
+}
+
+func (s *chunkArchiveStore) indexPath(diffID layer.DiffID) string {
+	return filepath.Join(s.root, "index", digest.Digest(diffID).Hex())
+}
+
+// chunksOf returns the digests of the chunks of the archive of diffID, in
+// order
+func (s *chunkArchiveStore) chunksOf(diffID layer.DiffID) ([]digest.Digest, error) {
+	data, err := ioutil.ReadFile(s.indexPath(diffID))
+	if err != nil {
+		return nil, err
+	}
+	var chunks []digest.Digest
+	for _, line := range strings.Fields(string(data)) {
+		dgst, err := digest.Parse(line)
+		if err != nil {
+			return nil, fmt.Errorf("invalid index of layer archive %s: %v", diffID, err)
+		}
+		chunks = append(chunks, dgst)
+	}
+	return chunks, nil
+}
+
+func (s *chunkArchiveStore) Get(diffID layer.DiffID) (io.ReadCloser, error) {
+	if diffID == "" {
+		return nil, nil
+	}
+	chunks, err := s.chunksOf(diffID)
+	if err != nil {
+		return nil, err
+	}
+	return &chunkReader{store: s, chunks: chunks}, nil
+}
+
+func (s *chunkArchiveStore) Put(diffID layer.DiffID, r io.Reader) error {
+	rc, err := archive.DecompressStream(r)
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+
+	var index bytes.Buffer
+	var stored, total int
+	c := newChunker(rc, s.min, s.max, s.maskBits)
+	for {
+		chunk, err := c.next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		dgst := digest.FromBytes(chunk)
+		written, err := s.putChunk(dgst, chunk)
+		if err != nil {
+			return err
+		}
+		if written {
+			stored++
+		}
+		total++
+		fmt.Fprintln(&index, dgst)
+	}
+	if err := writeFileAtomic(s.indexPath(diffID), index.Bytes()); err != nil {
+		return err
+	}
+	logrus.Debugf("Stored layer archive of %s as %d chunks, %d of them new", diffID, total, stored)
+	return nil
+}
+
+// putChunk stores a chunk unless already stored, and reports whether it
+// was written
+func (s *chunkArchiveStore) putChunk(dgst digest.Digest, chunk []byte) (bool, error) {
+	path := s.chunkPath(dgst)
+	if _, err := os.Stat(path); err == nil {
+		return false, nil
+	}
+	return true, writeFileAtomic(path, chunk)
+}
+
+func (s *chunkArchiveStore) Commit(path string, diffID layer.DiffID) error {
+	if path == "" {
+		return nil
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if err := s.Put(diffID, f); err != nil {
+		return err
+	}
+	return os.RemoveAll(path)
+}
+
+// writeFileAtomic writes data to a temporary file next to path, and renames
+// it into place, so that readers never see a partial file
+func writeFileAtomic(path string, data []byte) error {
+	dir := filepath.Dir(path)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	f, err := ioutil.TempFile(dir, ".tmp-")
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		os.RemoveAll(f.Name())
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.RemoveAll(f.Name())
+		return err
+	}
+	if err := os.Rename(f.Name(), path); err != nil {
+		os.RemoveAll(f.Name())
+		return err
+	}
+	return nil
+}
+
+// chunkReader reassembles an archive from its chunks, verifying each of
+// them against its digest as it is read
+type chunkReader struct {
+	store    *chunkArchiveStore
+	chunks   []digest.Digest
+	current  *os.File
+	verifier digest.Verifier
+}
+
+func (r *chunkReader) Read(p []byte) (int, error) {
+	for {
+		if r.current == nil {
+			if len(r.chunks) == 0 {
+				return 0, io.EOF
+			}
+			f, err := os.Open(r.store.chunkPath(r.chunks[0]))
+			if err != nil {
+				return 0, err
+			}
+			r.current, r.verifier = f, r.chunks[0].Verifier()
+		}
+		n, err := r.current.Read(p)
+		r.verifier.Write(p[:n])
+		if err == io.EOF {
+			r.current.Close()
+			r.current = nil
+			if !r.verifier.Verified() {
+				return n, fmt.Errorf("layer archive chunk %s failed verification", r.chunks[0])
+			}
+			r.chunks = r.chunks[1:]
+			err = nil
+		}
+		if n > 0 || err != nil {
+			return n, err
+		}
+	}
+}
+
+func (r *chunkReader) Close() error {
+	if r.current != nil {
+		return r.current.Close()
+	}
+	return nil
+}
@@ -0,0 +1,98 @@
+package xfer // import "github.com/docker/docker/distribution/xfer"
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/docker/docker/layer"
+	"github.com/opencontainers/go-digest"
+	"gotest.tools/assert"
+	is "gotest.tools/assert/cmp"
+)
+
+func gzipBytes(t *testing.T, data []byte) []byte {
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	_, err := w.Write(data)
+	assert.NilError(t, err)
+	assert.NilError(t, w.Close())
+	return buf.Bytes()
+}
+
+func TestChunkArchiveStoreDedup(t *testing.T) {
+	dir, err := ioutil.TempDir("", "archive-chunks")
+	assert.NilError(t, err)
+	defer os.RemoveAll(dir)
+	s := NewChunkArchiveStore(dir).(*chunkArchiveStore)
+
+	// two near-identical layers, the second with a few bytes edited and
+	// inserted in the middle
+	base := make([]byte, 2<<20)
+	rand.New(rand.NewSource(1)).Read(base)
+	edited := append(append(append([]byte(nil), base[:1<<20]...), []byte("edited")...), base[1<<20+3:]...)
+	one := layer.DiffID(digest.FromBytes(base))
+	two := layer.DiffID(digest.FromBytes(edited))
+
+	// archives are chunked uncompressed, whether downloaded compressed or
+	// not
+	assert.NilError(t, s.Put(one, bytes.NewReader(gzipBytes(t, base))))
+	path := filepath.Join(dir, "download")
+	assert.NilError(t, ioutil.WriteFile(path, edited, 0600))
+	assert.NilError(t, s.Commit(path, two))
+	_, err = os.Stat(path)
+	assert.Check(t, os.IsNotExist(err))
+
+	data, err := readArchive(t, s, one)
+	assert.NilError(t, err)
+	assert.Check(t, bytes.Equal(base, data))
+	data, err = readArchive(t, s, two)
+	assert.NilError(t, err)
+	assert.Check(t, bytes.Equal(edited, data))
+
+	// the chunks away from the edit are shared, and stored once
+	chunksOne, err := s.chunksOf(one)
+	assert.NilError(t, err)
+	chunksTwo, err := s.chunksOf(two)
+	assert.NilError(t, err)
+	unique := make(map[digest.Digest]bool)
+	for _, dgst := range chunksOne {
+		unique[dgst] = true
+	}
+	var shared int
+	for _, dgst := range chunksTwo {
+		if unique[dgst] {
+			shared++
+		}
+		unique[dgst] = true
+	}
+	assert.Check(t, shared >= len(chunksTwo)-2, "%d of %d chunks shared", shared, len(chunksTwo))
+	stored, err := ioutil.ReadDir(filepath.Join(dir, "chunks"))
+	assert.NilError(t, err)
+	assert.Check(t, is.Len(stored, len(unique)))
+}
+
+func TestChunkArchiveStoreVerifiesChunks(t *testing.T) {
+	dir, err := ioutil.TempDir("", "archive-chunks")
+	assert.NilError(t, err)
+	defer os.RemoveAll(dir)
+	s := NewChunkArchiveStore(dir).(*chunkArchiveStore)
+
+	_, err = s.Get(layer.DiffID(digest.FromString("missing")))
+	assert.Check(t, os.IsNotExist(err))
+
+	data := make([]byte, 1<<20)
+	rand.New(rand.NewSource(2)).Read(data)
+	diffID := layer.DiffID(digest.FromBytes(data))
+	assert.NilError(t, s.Put(diffID, bytes.NewReader(data)))
+	chunks, err := s.chunksOf(diffID)
+	assert.NilError(t, err)
+	assert.NilError(t, ioutil.WriteFile(s.chunkPath(chunks[len(chunks)/2]), []byte("corrupted"), 0600))
+
+	_, err = readArchive(t, s, diffID)
+	assert.Check(t, is.ErrorContains(err, "failed verification"))
+}
@@ -0,0 +1,175 @@
+package xfer // import "github.com/docker/docker/distribution/xfer"
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/docker/docker/layer"
+	"github.com/docker/docker/pkg/archive"
+	"github.com/docker/docker/pkg/ioutils"
+	"github.com/opencontainers/go-digest"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// peerArchiveTimeout bounds each request for an archive to a peer
+	peerArchiveTimeout = 30 * time.Second
+	// peerArchiveAttempts is the number of attempts made on each peer
+	// before moving on to the next one
+	peerArchiveAttempts = 2
+)
+
+var errPeerArchiveReadOnly = errors.New("peer archive stores are read-only")
+
+// peerArchiveStore reads archives from the archive caches of peer daemons,
+// served over HTTP as files named after the hex of their diffID, as a
+// shared archive directory would be. Archives are only returned once their
+// content is verified against their diffID.
+type peerArchiveStore struct {
+	peers    []string
+	client   *http.Client
+	attempts int
+}
+
+// NewPeerArchiveStore returns a read-only ArchiveStore reading archives from
+// the given peer endpoints, in order
+func NewPeerArchiveStore(peers []string) ArchiveStore {
+	return &peerArchiveStore{
+		peers:    peers,
+		client:   &http.Client{Timeout: peerArchiveTimeout},
+		attempts: peerArchiveAttempts,
+	}
+}
+
+// ValidatePeerEndpoint validates the endpoint of a peer archive cache
+func ValidatePeerEndpoint(val string) (string, error) {
+	uri, err := url.Parse(val)
+	if err != nil {
+		return "", fmt.Errorf("invalid archive peer: %q is not a valid URI", val)
+	}
+	if uri.Scheme != "http" && uri.Scheme != "https" {
+		return "", fmt.Errorf("invalid archive peer: unsupported scheme %q in %q", uri.Scheme, uri)
+	}
+	if uri.RawQuery != "" || uri.Fragment != "" {
+		return "", fmt.Errorf("invalid archive peer: query or fragment at end of the URI %q", uri)
+	}
+	return strings.TrimSuffix(val, "/"), nil
+}
+
+func (s *peerArchiveStore) Get(diffID layer.DiffID) (io.ReadCloser, error) {
+	for _, peer := range s.peers {
+		rc, err := s.getFrom(peer, diffID)
+		if err == nil {
+			logrus.Debugf("Layer archive of %s is found on peer %s", diffID, peer)
+			return rc, nil
+		}
+		if !os.IsNotExist(err) {
+			logrus.Warnf("error getting layer archive of %s from peer %s: %v", diffID, peer, err)
+		}
+	}
+	return nil, &os.PathError{Op: "get", Path: digest.Digest(diffID).Hex(), Err: os.ErrNotExist}
+}
+
+// invalidArchiveError is returned for an archive whose content does not
+// match its diffID
+type invalidArchiveError struct {
+	diffID layer.DiffID
+}
+
+func (e invalidArchiveError) Error() string {
+	return fmt.Sprintf("archive content does not match %s", e.diffID)
+}
+
+// getFrom gets the archive of diffID from peer, retrying on failure. Missing
+// and invalid archives are not retried.
+func (s *peerArchiveStore) getFrom(peer string, diffID layer.DiffID) (io.ReadCloser, error) {
+	var err error
+	for attempt := 0; attempt < s.attempts; attempt++ {
+		var rc io.ReadCloser
+		rc, err = s.fetch(peer, diffID)
+		if _, invalid := err.(invalidArchiveError); err == nil || invalid || os.IsNotExist(err) {
+			return rc, err
+		}
+	}
+	return nil, err
+}
+
+// fetch downloads the archive of diffID from peer to a temporary file, and
+// returns a reader of the file once verified. The file is removed when the
+// reader is closed.
+func (s *peerArchiveStore) fetch(peer string, diffID layer.DiffID) (io.ReadCloser, error) {
+	resp, err := s.client.Get(peer + "/" + digest.Digest(diffID).Hex())
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	switch {
+	case resp.StatusCode == http.StatusNotFound:
+		return nil, os.ErrNotExist
+	case resp.StatusCode != http.StatusOK:
+		return nil, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+
+	f, err := ioutil.TempFile("", "PeerLayerArchive")
+	if err != nil {
+		return nil, err
+	}
+	path := f.Name()
+	_, err = io.Copy(f, resp.Body)
+	if err == nil {
+		_, err = f.Seek(0, io.SeekStart)
+	}
+	if err == nil {
+		err = verifyArchive(f, diffID)
+	}
+	if err == nil {
+		_, err = f.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		f.Close()
+		os.RemoveAll(path)
+		return nil, err
+	}
+	return ioutils.NewReadCloserWrapper(f, func() error {
+		err := f.Close()
+		os.RemoveAll(path)
+		return err
+	}), nil
+}
+
+// verifyArchive checks that the uncompressed content of the archive read
+// from r matches diffID
+func verifyArchive(r io.Reader, diffID layer.DiffID) error {
+	dgst, err := digest.Parse(string(diffID))
+	if err != nil {
+		return err
+	}
+	rc, err := archive.DecompressStream(r)
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+	verifier := dgst.Verifier()
+	if _, err := io.Copy(verifier, rc); err != nil {
+		return err
+	}
+	if !verifier.Verified() {
+		return invalidArchiveError{diffID: diffID}
+	}
+	return nil
+}
+
+func (s *peerArchiveStore) Put(layer.DiffID, io.Reader) error {
+	return errPeerArchiveReadOnly
+}
+
+func (s *peerArchiveStore) Commit(string, layer.DiffID) error {
+	return errPeerArchiveReadOnly
+}
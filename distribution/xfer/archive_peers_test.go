@@ -0,0 +1,103 @@
+package xfer // import "github.com/docker/docker/distribution/xfer"
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"runtime"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/docker/docker/image"
+	"github.com/docker/docker/layer"
+	"github.com/docker/docker/pkg/progress"
+	"github.com/opencontainers/go-digest"
+	"gotest.tools/assert"
+	is "gotest.tools/assert/cmp"
+)
+
+// countingDescriptor counts the downloads of a layer from the registry
+type countingDescriptor struct {
+	*mockDownloadDescriptor
+	downloads int32
+}
+
+func (d *countingDescriptor) Download(ctx context.Context, progressOutput progress.Output) (io.ReadCloser, int64, error) {
+	atomic.AddInt32(&d.downloads, 1)
+	return d.mockDownloadDescriptor.Download(ctx, progressOutput)
+}
+
+// newTestPeer returns a peer serving data as the archives of diffIDs, and
+// counting the requests it gets
+func newTestPeer(archives map[layer.DiffID][]byte, requests *int32) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(requests, 1)
+		for diffID, data := range archives {
+			if r.URL.Path == "/archives/"+digest.Digest(diffID).Hex() {
+				w.Write(data)
+				return
+			}
+		}
+		http.NotFound(w, r)
+	}))
+}
+
+func TestPeerArchiveStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "peer-archive")
+	assert.NilError(t, err)
+	defer os.RemoveAll(dir)
+	oldTmp := os.Getenv("TMPDIR")
+	os.Setenv("TMPDIR", dir)
+	defer os.Setenv("TMPDIR", oldTmp)
+
+	peerLayer := &countingDescriptor{mockDownloadDescriptor: &mockDownloadDescriptor{id: "id1"}}
+	registryLayer := &countingDescriptor{mockDownloadDescriptor: &mockDownloadDescriptor{id: "id2"}}
+	data, err := ioutil.ReadAll(peerLayer.mockTarStream())
+	assert.NilError(t, err)
+	peerLayer.diffID = layer.DiffID(digest.FromBytes(data))
+
+	// the first peer serves a corrupted archive, which is skipped
+	var corruptRequests, peerRequests int32
+	corrupt := newTestPeer(map[layer.DiffID][]byte{peerLayer.diffID: []byte("corrupted")}, &corruptRequests)
+	defer corrupt.Close()
+	peer := newTestPeer(map[layer.DiffID][]byte{peerLayer.diffID: data}, &peerRequests)
+	defer peer.Close()
+
+	store := NewTieredArchiveStore(NewDirArchiveStore(""), NewPeerArchiveStore([]string{corrupt.URL + "/archives", peer.URL + "/archives"}), false)
+	layerStore := &mockLayerStore{make(map[layer.ChainID]*mockLayer)}
+	ldm := NewLayerDownloadManager(map[string]layer.Store{runtime.GOOS: layerStore}, maxDownloadConcurrency, true, WithArchiveStore(store), func(m *LayerDownloadManager) { m.waitDuration = time.Millisecond })
+
+	rootFS, release, err := ldm.Download(context.Background(), *image.NewRootFS(), runtime.GOOS, []DownloadDescriptor{peerLayer, registryLayer}, progress.ChanOutput(make(chan progress.Progress, 1000)))
+	assert.NilError(t, err)
+	defer release()
+
+	assert.Check(t, is.Len(rootFS.DiffIDs, 2))
+	assert.Check(t, is.Equal(peerLayer.diffID, rootFS.DiffIDs[0]))
+	assert.Check(t, is.Equal(int32(0), atomic.LoadInt32(&peerLayer.downloads)))
+	assert.Check(t, is.Equal(int32(1), atomic.LoadInt32(&registryLayer.downloads)))
+	assert.Check(t, is.Equal(int32(1), atomic.LoadInt32(&corruptRequests)))
+	assert.Check(t, is.Equal(int32(1), atomic.LoadInt32(&peerRequests)))
+}
+
+func TestValidatePeerEndpoint(t *testing.T) {
+	for _, tc := range []struct {
+		endpoint, expected, err string
+	}{
+		{endpoint: "http://peer:8080/archives/", expected: "http://peer:8080/archives"},
+		{endpoint: "https://peer", expected: "https://peer"},
+		{endpoint: "peer:8080", err: "unsupported scheme"},
+		{endpoint: "http://peer/?archive", err: "query or fragment"},
+	} {
+		endpoint, err := ValidatePeerEndpoint(tc.endpoint)
+		if tc.err != "" {
+			assert.Check(t, is.ErrorContains(err, tc.err), tc.endpoint)
+			continue
+		}
+		assert.Check(t, err == nil, tc.endpoint)
+		assert.Check(t, is.Equal(tc.expected, endpoint))
+	}
+}
@@ -0,0 +1,107 @@
+package xfer // import "github.com/docker/docker/distribution/xfer"
+
+import (
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/docker/docker/layer"
+	"github.com/docker/docker/pkg/ioutils"
+)
+
+// archiveReadTimeout bounds how long a deletion waits for the reads of the
+// archives it deletes to complete
+const archiveReadTimeout = 10 * time.Second
+
+// archiveReads counts the reads in progress of the archive of each diffID,
+// such as a download served from the archive or the upload of an archive
+// to the shared store. Deleting the archive from under a read would cut
+// the read short, so deletions wait for the reads to complete. changed is
+// closed, and replaced, whenever a read completes.
+var archiveReads = struct {
+	sync.Mutex
+	count   map[layer.DiffID]int
+	changed chan struct{}
+}{count: make(map[layer.DiffID]int), changed: make(chan struct{})}
+
+// BeginArchiveRead marks the archive of diffID as being read until the
+// returned function is called
+func BeginArchiveRead(diffID layer.DiffID) func() {
+	archiveReads.Lock()
+	archiveReads.count[diffID]++
+	archiveReads.Unlock()
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			archiveReads.Lock()
+			defer archiveReads.Unlock()
+			if archiveReads.count[diffID]--; archiveReads.count[diffID] <= 0 {
+				delete(archiveReads.count, diffID)
+			}
+			close(archiveReads.changed)
+			archiveReads.changed = make(chan struct{})
+		})
+	}
+}
+
+// trackArchiveRead marks the archive of diffID as being read until rc is
+// closed
+func trackArchiveRead(diffID layer.DiffID, rc io.ReadCloser) io.ReadCloser {
+	end := BeginArchiveRead(diffID)
+	return ioutils.NewReadCloserWrapper(rc, func() error {
+		defer end()
+		return rc.Close()
+	})
+}
+
+// WaitArchiveReads waits up to timeout for the reads of the archives of
+// diffIDs to complete, or for all reads if diffIDs is empty, and returns
+// the diffIDs whose archive is still being read. The reads are complete
+// once it returns none, until the next read begins.
+func WaitArchiveReads(diffIDs []layer.DiffID, timeout time.Duration) []layer.DiffID {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	for {
+		archiveReads.Lock()
+		busy := readArchives(diffIDs)
+		changed := archiveReads.changed
+		archiveReads.Unlock()
+		if len(busy) == 0 {
+			return nil
+		}
+		select {
+		case <-changed:
+		case <-timer.C:
+			return busy
+		}
+	}
+}
+
+// readArchives returns the diffIDs whose archive is being read, out of
+// diffIDs or out of all if empty. The caller must hold the lock of
+// archiveReads.
+func readArchives(diffIDs []layer.DiffID) []layer.DiffID {
+	var busy []layer.DiffID
+	if len(diffIDs) == 0 {
+		for diffID := range archiveReads.count {
+			busy = append(busy, diffID)
+		}
+		return busy
+	}
+	for _, diffID := range diffIDs {
+		if archiveReads.count[diffID] > 0 {
+			busy = append(busy, diffID)
+		}
+	}
+	return busy
+}
+
+// archivesBeingReadError is returned by a deletion which left the archives
+// still being read once it gave up waiting for them
+type archivesBeingReadError []layer.DiffID
+
+func (e archivesBeingReadError) Error() string {
+	return fmt.Sprintf("layer archives of %v still being read after %s, not deleted", []layer.DiffID(e), archiveReadTimeout)
+}
@@ -0,0 +1,82 @@
+package xfer // import "github.com/docker/docker/distribution/xfer"
+
+import (
+	"io/ioutil"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/docker/docker/layer"
+	"github.com/opencontainers/go-digest"
+	"gotest.tools/assert"
+	is "gotest.tools/assert/cmp"
+)
+
+func TestWaitArchiveReads(t *testing.T) {
+	read := layer.DiffID(digest.FromString("read"))
+	other := layer.DiffID(digest.FromString("other"))
+
+	rc := trackArchiveRead(read, ioutil.NopCloser(strings.NewReader("archive")))
+	assert.Check(t, is.DeepEqual([]layer.DiffID{read}, WaitArchiveReads(nil, 10*time.Millisecond)))
+	assert.Check(t, is.Len(WaitArchiveReads([]layer.DiffID{other}, time.Second), 0))
+
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		rc.Close()
+	}()
+	assert.Check(t, is.Len(WaitArchiveReads([]layer.DiffID{read, other}, time.Minute), 0))
+}
+
+func TestGuardArchiveDeletionWaitsForReads(t *testing.T) {
+	read := layer.DiffID(digest.FromString("read"))
+	written := layer.DiffID(digest.FromString("written"))
+	endWrite := BeginArchiveWrite(written)
+	defer endWrite()
+
+	endRead := BeginArchiveRead(read)
+	ended := make(chan struct{})
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		close(ended)
+		endRead()
+	}()
+
+	var deleted []layer.DiffID
+	err := GuardArchiveDeletion([]layer.DiffID{read, written}, func(diffIDs []layer.DiffID) error {
+		select {
+		case <-ended:
+		default:
+			t.Error("archive deleted while being read")
+		}
+		deleted = append(deleted, diffIDs...)
+		return nil
+	})
+	assert.NilError(t, err)
+	assert.Check(t, is.DeepEqual([]layer.DiffID{read}, deleted))
+}
+
+func TestGuardArchiveDeletionRechecksWrites(t *testing.T) {
+	read := layer.DiffID(digest.FromString("read"))
+	endRead := BeginArchiveRead(read)
+
+	// the write begins while the deletion waits for the read, which does
+	// not hold it up
+	began := make(chan struct{})
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		endWrite := BeginArchiveWrite(read)
+		close(began)
+		endRead()
+		time.Sleep(10 * time.Millisecond)
+		endWrite()
+	}()
+
+	var deleted []layer.DiffID
+	err := GuardArchiveDeletion([]layer.DiffID{read}, func(diffIDs []layer.DiffID) error {
+		deleted = append(deleted, diffIDs...)
+		return nil
+	})
+	assert.NilError(t, err)
+	<-began
+	assert.Check(t, is.Len(deleted, 0))
+}
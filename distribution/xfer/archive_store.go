@@ -0,0 +1,214 @@
+package xfer // import "github.com/docker/docker/distribution/xfer"
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"syscall"
+
+	"github.com/docker/docker/layer"
+	"github.com/opencontainers/go-digest"
+	"github.com/sirupsen/logrus"
+)
+
+// ArchiveStore keeps the compressed archives of downloaded layers, so that
+// they can be registered again without being downloaded
+type ArchiveStore interface {
+	// Get returns a reader of the archive of diffID. It returns an error
+	// satisfying os.IsNotExist if the archive is not in the store.
+	Get(diffID layer.DiffID) (io.ReadCloser, error)
+	// Put stores the archive read from r as the archive of diffID
+	Put(diffID layer.DiffID, r io.Reader) error
+	// Commit moves the archive downloaded to path, on the local filesystem,
+	// into the store as the archive of diffID
+	Commit(path string, diffID layer.DiffID) error
+}
+
+// dirArchiveStore keeps archives as files named after their diffID in a
+// directory
+type dirArchiveStore struct {
+	root string
+}
+
+// NewDirArchiveStore returns an ArchiveStore keeping archives in root, which
+// may be a volume shared by several daemons. An empty root stands for the
+// temporary directory, where archives are downloaded. A root reached through
+// symlinks is resolved, so that the temporary files of the store are created
+// next to the archives whatever the path says.
+func NewDirArchiveStore(root string) ArchiveStore {
+	if root != "" {
+		if realRoot, err := filepath.EvalSymlinks(root); err == nil {
+			root = realRoot
+		} else {
+			logrus.Warnf("error resolving the layer archive directory %s: %v", root, err)
+		}
+	}
+	return &dirArchiveStore{root: root}
+}
+
+// rename is os.Rename, replaceable in tests
+var rename = os.Rename
+
+func (s *dirArchiveStore) dir() string {
+	if s.root == "" {
+		return os.TempDir()
+	}
+	return s.root
+}
+
+func (s *dirArchiveStore) path(diffID layer.DiffID) string {
+	return filepath.Join(s.dir(), digest.Digest(diffID).Hex())
+}
+
+func (s *dirArchiveStore) Get(diffID layer.DiffID) (io.ReadCloser, error) {
+	if diffID == "" {
+		return nil, nil
+	}
+	return os.Open(s.path(diffID))
+}
+
+func (s *dirArchiveStore) Put(diffID layer.DiffID, r io.Reader) error {
+	f, err := ioutil.TempFile(s.dir(), "LayerArchive")
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(f, r); err != nil {
+		f.Close()
+		os.RemoveAll(f.Name())
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.RemoveAll(f.Name())
+		return err
+	}
+	return s.Commit(f.Name(), diffID)
+}
+
+func (s *dirArchiveStore) Commit(path string, diffID layer.DiffID) error {
+	newPath := s.path(diffID)
+	logrus.Debugf("Old path: %s, new path: %s", path, newPath)
+	if path == "" || path == newPath {
+		return nil
+	}
+	if fi, _ := os.Stat(newPath); fi != nil {
+		if err := os.RemoveAll(newPath); err != nil {
+			return err
+		}
+	}
+	err := rename(path, newPath)
+	if le, ok := err.(*os.LinkError); !ok || le.Err != syscall.EXDEV {
+		return err
+	}
+	// the archive was downloaded to another filesystem, such as when the
+	// store is a bind mount, so it is copied next to the archives before
+	// being renamed into place
+	logrus.Debugf("Layer archive %s is on another device than %s, copying it", path, s.dir())
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if err := s.Put(diffID, f); err != nil {
+		return err
+	}
+	return os.RemoveAll(path)
+}
+
+// tieredArchiveStore keeps archives in a local store, falling back to a
+// shared store on local miss. Archives read from the shared store are
+// copied to the local one, and committed archives can be uploaded to the
+// shared store in the background.
+type tieredArchiveStore struct {
+	local  ArchiveStore
+	shared ArchiveStore
+	upload bool
+
+	uploads sync.WaitGroup
+}
+
+// NewTieredArchiveStore returns an ArchiveStore reading through local to
+// shared. Writes always go to local first, and are uploaded to shared
+// asynchronously if upload is set.
+func NewTieredArchiveStore(local, shared ArchiveStore, upload bool) ArchiveStore {
+	return &tieredArchiveStore{
+		local:  local,
+		shared: shared,
+		upload: upload,
+	}
+}
+
+func (s *tieredArchiveStore) Get(diffID layer.DiffID) (io.ReadCloser, error) {
+	rc, err := s.local.Get(diffID)
+	if err == nil || !os.IsNotExist(err) {
+		return rc, err
+	}
+
+	rc, err = s.shared.Get(diffID)
+	if err != nil {
+		return nil, err
+	}
+	logrus.Debugf("Layer archive of %s is found in the shared store", diffID)
+
+	err = s.local.Put(diffID, rc)
+	rc.Close()
+	if err != nil {
+		logrus.Warnf("error copying layer archive of %s from the shared store: %v", diffID, err)
+		return s.shared.Get(diffID)
+	}
+	return s.local.Get(diffID)
+}
+
+func (s *tieredArchiveStore) Put(diffID layer.DiffID, r io.Reader) error {
+	if err := s.local.Put(diffID, r); err != nil {
+		return err
+	}
+	s.uploadArchive(diffID)
+	return nil
+}
+
+func (s *tieredArchiveStore) Commit(path string, diffID layer.DiffID) error {
+	if err := s.local.Commit(path, diffID); err != nil {
+		return err
+	}
+	if path != "" {
+		s.uploadArchive(diffID)
+	}
+	return nil
+}
+
+// uploadArchive copies the local archive of diffID to the shared store in
+// the background, if uploads are enabled
+func (s *tieredArchiveStore) uploadArchive(diffID layer.DiffID) {
+	if !s.upload {
+		return
+	}
+	s.uploads.Add(1)
+	go func() {
+		defer s.uploads.Done()
+
+		defer BeginArchiveRead(diffID)()
+		rc, err := s.local.Get(diffID)
+		if err != nil {
+			logrus.Warnf("error reading layer archive of %s for upload: %v", diffID, err)
+			return
+		}
+		defer rc.Close()
+		if err := s.shared.Put(diffID, rc); err != nil {
+			logrus.Warnf("error uploading layer archive of %s to the shared store: %v", diffID, err)
+			return
+		}
+		logrus.Debugf("Uploaded layer archive of %s to the shared store", diffID)
+	}()
+}
+
+// WithArchiveStore sets the store of the layer archives, which defaults to
+// the temporary directory
+func WithArchiveStore(store ArchiveStore) func(*LayerDownloadManager) {
+	return func(ldm *LayerDownloadManager) {
+		if store != nil {
+			ldm.archiveStore = store
+		}
+	}
+}
@@ -0,0 +1,187 @@
+package xfer // import "github.com/docker/docker/distribution/xfer"
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"testing"
+
+	"github.com/docker/docker/layer"
+	"github.com/opencontainers/go-digest"
+	"gotest.tools/assert"
+	is "gotest.tools/assert/cmp"
+)
+
+type fakeArchiveStore struct {
+	mu       sync.Mutex
+	archives map[layer.DiffID][]byte
+	gets     int
+}
+
+func newFakeArchiveStore() *fakeArchiveStore {
+	return &fakeArchiveStore{archives: make(map[layer.DiffID][]byte)}
+}
+
+func (s *fakeArchiveStore) Get(diffID layer.DiffID) (io.ReadCloser, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.gets++
+	data, ok := s.archives[diffID]
+	if !ok {
+		return nil, os.ErrNotExist
+	}
+	return ioutil.NopCloser(bytes.NewReader(data)), nil
+}
+
+func (s *fakeArchiveStore) Put(diffID layer.DiffID, r io.Reader) error {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.archives[diffID] = data
+	return nil
+}
+
+func (s *fakeArchiveStore) Commit(path string, diffID layer.DiffID) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(path); err != nil {
+		return err
+	}
+	return s.Put(diffID, bytes.NewReader(data))
+}
+
+func (s *fakeArchiveStore) archive(diffID layer.DiffID) ([]byte, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	data, ok := s.archives[diffID]
+	return data, ok
+}
+
+func readArchive(t *testing.T, store ArchiveStore, diffID layer.DiffID) ([]byte, error) {
+	t.Helper()
+	rc, err := store.Get(diffID)
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	return ioutil.ReadAll(rc)
+}
+
+func TestTieredArchiveStoreReadThrough(t *testing.T) {
+	local, shared := newFakeArchiveStore(), newFakeArchiveStore()
+	store := NewTieredArchiveStore(local, shared, false)
+
+	data := []byte("shared archive")
+	diffID := layer.DiffID(digest.FromBytes(data))
+	assert.NilError(t, shared.Put(diffID, bytes.NewReader(data)))
+
+	got, err := readArchive(t, store, diffID)
+	assert.NilError(t, err)
+	assert.Check(t, is.DeepEqual(data, got))
+
+	// the archive is now served locally
+	got, ok := local.archive(diffID)
+	assert.Check(t, ok)
+	assert.Check(t, is.DeepEqual(data, got))
+
+	_, err = readArchive(t, store, diffID)
+	assert.NilError(t, err)
+	assert.Check(t, is.Equal(1, shared.gets))
+
+	_, err = readArchive(t, store, layer.DiffID(digest.FromString("missing")))
+	assert.Check(t, os.IsNotExist(err))
+}
+
+func TestTieredArchiveStoreWrite(t *testing.T) {
+	dir, err := ioutil.TempDir("", "archive-store")
+	assert.NilError(t, err)
+	defer os.RemoveAll(dir)
+
+	for _, upload := range []bool{false, true} {
+		local, shared := newFakeArchiveStore(), newFakeArchiveStore()
+		store := NewTieredArchiveStore(local, shared, upload)
+
+		data := []byte("downloaded archive")
+		diffID := layer.DiffID(digest.FromBytes(data))
+		path := filepath.Join(dir, "LayerArchive")
+		assert.NilError(t, ioutil.WriteFile(path, data, 0600))
+
+		assert.NilError(t, store.Commit(path, diffID))
+		got, ok := local.archive(diffID)
+		assert.Check(t, ok, "upload %v", upload)
+		assert.Check(t, is.DeepEqual(data, got), "upload %v", upload)
+
+		store.(*tieredArchiveStore).uploads.Wait()
+		got, ok = shared.archive(diffID)
+		assert.Check(t, is.Equal(upload, ok), "upload %v", upload)
+		if upload {
+			assert.Check(t, is.DeepEqual(data, got))
+		}
+	}
+}
+
+func TestDirArchiveStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "archive-store")
+	assert.NilError(t, err)
+	defer os.RemoveAll(dir)
+
+	store := NewDirArchiveStore(dir)
+	data := []byte("archive")
+	diffID := layer.DiffID(digest.FromBytes(data))
+
+	_, err = readArchive(t, store, diffID)
+	assert.Check(t, os.IsNotExist(err))
+
+	assert.NilError(t, store.Put(diffID, bytes.NewReader(data)))
+	got, err := readArchive(t, store, diffID)
+	assert.NilError(t, err)
+	assert.Check(t, is.DeepEqual(data, got))
+
+	entries, err := ioutil.ReadDir(dir)
+	assert.NilError(t, err)
+	assert.Check(t, is.Len(entries, 1))
+}
+
+func TestDirArchiveStoreCommitAcrossDevices(t *testing.T) {
+	dir, err := ioutil.TempDir("", "archive-store")
+	assert.NilError(t, err)
+	defer os.RemoveAll(dir)
+	assert.NilError(t, os.Mkdir(filepath.Join(dir, "archives"), 0700))
+	assert.NilError(t, os.Symlink(filepath.Join(dir, "archives"), filepath.Join(dir, "link")))
+
+	// the downloads are on another device than the archives, which are
+	// reached through a symlink
+	defer func() { rename = os.Rename }()
+	rename = func(oldpath, newpath string) error {
+		if filepath.Dir(oldpath) != filepath.Dir(newpath) {
+			return &os.LinkError{Op: "rename", Old: oldpath, New: newpath, Err: syscall.EXDEV}
+		}
+		return os.Rename(oldpath, newpath)
+	}
+	store := NewDirArchiveStore(filepath.Join(dir, "link"))
+
+	data := []byte("archive")
+	diffID := layer.DiffID(digest.FromBytes(data))
+	path := filepath.Join(dir, "download")
+	assert.NilError(t, ioutil.WriteFile(path, data, 0600))
+	assert.NilError(t, store.Commit(path, diffID))
+
+	got, err := readArchive(t, store, diffID)
+	assert.NilError(t, err)
+	assert.Check(t, is.DeepEqual(data, got))
+	_, err = os.Stat(path)
+	assert.Check(t, os.IsNotExist(err))
+	entries, err := ioutil.ReadDir(filepath.Join(dir, "archives"))
+	assert.NilError(t, err)
+	assert.Check(t, is.Len(entries, 1))
+}
@@ -0,0 +1,74 @@
+package xfer // import "github.com/docker/docker/distribution/xfer"
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"unicode"
+
+	"github.com/sirupsen/logrus"
+)
+
+// archiveTempPrefix is the prefix of the temp files the layer archives are
+// downloaded to, before they are promoted into the archive store
+const archiveTempPrefix = "LayerArchive"
+
+// WithArchiveTempNamespace confines the temp files of the downloaded layer
+// archives to a namespace unique to the daemon, such as its ID, so that the
+// daemons sharing a temp directory only clean up their own files. Only the
+// letters and digits of namespace are kept, as the namespace ends at the
+// first separator of the file name.
+func WithArchiveTempNamespace(namespace string) func(*LayerDownloadManager) {
+	return func(ldm *LayerDownloadManager) {
+		ldm.tempNamespace = strings.Map(func(r rune) rune {
+			if r > unicode.MaxASCII || !unicode.IsLetter(r) && !unicode.IsDigit(r) {
+				return -1
+			}
+			return r
+		}, namespace)
+	}
+}
+
+// archiveTempPattern returns the prefix of the temp files of the layer
+// archives downloaded in namespace
+func archiveTempPattern(namespace string) string {
+	if namespace == "" {
+		return archiveTempPrefix
+	}
+	return archiveTempPrefix + "-" + namespace + "-"
+}
+
+// CleanupArchiveTemp removes the temp files of the layer archives left over
+// by the downloads of a previous run of the daemon, and must not be called
+// while downloading. Without a namespace the files cannot be told apart from
+// those of the other daemons, and nothing is removed.
+func (ldm *LayerDownloadManager) CleanupArchiveTemp() error {
+	if ldm.tempNamespace == "" {
+		return nil
+	}
+	dir := ldm.tempDir
+	if dir == "" {
+		dir = os.TempDir()
+	}
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	pattern := archiveTempPattern(ldm.tempNamespace)
+	var firstErr error
+	for _, fi := range entries {
+		if fi.IsDir() || !strings.HasPrefix(fi.Name(), pattern) {
+			continue
+		}
+		path := filepath.Join(dir, fi.Name())
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+		logrus.Debugf("Removed stale layer archive %s", path)
+	}
+	return firstErr
+}
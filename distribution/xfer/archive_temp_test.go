@@ -0,0 +1,59 @@
+package xfer // import "github.com/docker/docker/distribution/xfer"
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/docker/docker/layer"
+	"gotest.tools/assert"
+	is "gotest.tools/assert/cmp"
+)
+
+func TestCleanupArchiveTempOwnNamespace(t *testing.T) {
+	dir, err := ioutil.TempDir("", "layer-archive-temp")
+	assert.NilError(t, err)
+	defer os.RemoveAll(dir)
+
+	// two daemons sharing a temp directory, and a file of someone else
+	newDaemon := func(id string) *LayerDownloadManager {
+		ldm := NewLayerDownloadManager(map[string]layer.Store{}, maxDownloadConcurrency, true, WithArchiveTempNamespace(id))
+		ldm.tempDir = dir
+		return ldm
+	}
+	a := newDaemon("AAAA:BBBB")
+	b := newDaemon("AAAA:BBBB:CCCC")
+	assert.Check(t, is.Equal("AAAABBBB", a.tempNamespace))
+	other := filepath.Join(dir, "LayerArchive123")
+	assert.NilError(t, ioutil.WriteFile(other, nil, 0600))
+
+	download := func(ldm *LayerDownloadManager) string {
+		rc, path, err := createLayerArchive(context.Background(), ldm.tempDir, archiveTempPattern(ldm.tempNamespace), ioutil.NopCloser(strings.NewReader("layer")), nil)
+		assert.NilError(t, err)
+		_, err = ioutil.ReadAll(rc)
+		assert.NilError(t, err)
+		assert.NilError(t, rc.Close())
+		return path
+	}
+	aPath, bPath := download(a), download(b)
+
+	exists := func(path string) bool {
+		_, err := os.Stat(path)
+		return err == nil
+	}
+	assert.NilError(t, a.CleanupArchiveTemp())
+	assert.Check(t, !exists(aPath))
+	assert.Check(t, exists(bPath))
+	assert.Check(t, exists(other))
+
+	assert.NilError(t, b.CleanupArchiveTemp())
+	assert.Check(t, !exists(bPath))
+	assert.Check(t, exists(other))
+
+	// without a namespace nothing is removed
+	assert.NilError(t, newDaemon("").CleanupArchiveTemp())
+	assert.Check(t, exists(other))
+}
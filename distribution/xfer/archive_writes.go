@@ -0,0 +1,91 @@
+package xfer // import "github.com/docker/docker/distribution/xfer"
+
+import (
+	"sync"
+
+	"github.com/docker/docker/layer"
+)
+
+// archiveWrites counts the writes in progress of the archive of each diffID.
+// An archive is written while its layer is pulled, possibly right after the
+// image cache released a previous copy of the layer, so deletions must not
+// remove an archive about to be committed.
+var archiveWrites = struct {
+	sync.Mutex
+	count map[layer.DiffID]int
+}{count: make(map[layer.DiffID]int)}
+
+// BeginArchiveWrite marks the archive of diffID as being written until the
+// returned function is called
+func BeginArchiveWrite(diffID layer.DiffID) func() {
+	archiveWrites.Lock()
+	archiveWrites.count[diffID]++
+	archiveWrites.Unlock()
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			archiveWrites.Lock()
+			defer archiveWrites.Unlock()
+			if archiveWrites.count[diffID]--; archiveWrites.count[diffID] <= 0 {
+				delete(archiveWrites.count, diffID)
+			}
+		})
+	}
+}
+
+// GuardArchiveDeletion calls del with the diffIDs whose archive is being
+// neither written nor read, and returns the error of del. No write nor read
+// of an archive begins while del runs, so that a deletion cannot interleave
+// with a commit or cut a read short. The deletion first waits for the reads
+// of the archives to complete, up to archiveReadTimeout, without holding up
+// the writes meanwhile, and leaves out those still being read, returning an
+// error listing them. The archives deleted are dropped from the memory
+// caches of the downloads as well.
+func GuardArchiveDeletion(diffIDs []layer.DiffID, del func([]layer.DiffID) error) error {
+	archiveWrites.Lock()
+	idle := unwrittenArchives(diffIDs)
+	archiveWrites.Unlock()
+	if len(idle) == 0 {
+		return nil
+	}
+	WaitArchiveReads(idle, archiveReadTimeout)
+
+	// a write may have begun during the wait, so the archives are checked
+	// again, this time holding both locks until del returns
+	archiveWrites.Lock()
+	defer archiveWrites.Unlock()
+	archiveReads.Lock()
+	defer archiveReads.Unlock()
+	var busy archivesBeingReadError
+	unread := make([]layer.DiffID, 0, len(idle))
+	for _, diffID := range unwrittenArchives(idle) {
+		if archiveReads.count[diffID] > 0 {
+			busy = append(busy, diffID)
+			continue
+		}
+		unread = append(unread, diffID)
+	}
+	if len(unread) > 0 {
+		forgetArchives(unread)
+		if err := del(unread); err != nil {
+			return err
+		}
+	}
+	if len(busy) > 0 {
+		return busy
+	}
+	return nil
+}
+
+// unwrittenArchives returns the diffIDs whose archive is not being written.
+// The caller must hold the lock of archiveWrites.
+func unwrittenArchives(diffIDs []layer.DiffID) []layer.DiffID {
+	idle := make([]layer.DiffID, 0, len(diffIDs))
+	for _, diffID := range diffIDs {
+		if archiveWrites.count[diffID] == 0 {
+			idle = append(idle, diffID)
+		}
+	}
+	return idle
+}
@@ -5,20 +5,38 @@ import (
 	"io"
 	"io/ioutil"
 	"os"
-	"path/filepath"
-
-	"github.com/opencontainers/go-digest"
-	"github.com/sirupsen/logrus"
 
 	"github.com/docker/docker/layer"
 	"github.com/docker/docker/pkg/ioutils"
+	"github.com/sirupsen/logrus"
 )
 
-func createLayerArchive(ctx context.Context, downloadReader io.ReadCloser, prevErr error) (io.ReadCloser, string, error) {
+// WithArchiveCapacity skips writing the archives of the layers larger than
+// capacity, which the cache would not keep
+func WithArchiveCapacity(capacity int64) func(*LayerDownloadManager) {
+	return func(ldm *LayerDownloadManager) {
+		ldm.archiveCapacity = capacity
+	}
+}
+
+// archiveFits reports whether the archive of the layer of descriptor, of
+// size bytes, is worth writing. A layer of unknown size is given the benefit
+// of the doubt.
+func (ldm *LayerDownloadManager) archiveFits(descriptor DownloadDescriptor, size int64) bool {
+	if ldm.archiveCapacity <= 0 || size <= ldm.archiveCapacity {
+		return true
+	}
+	logrus.Debugf("Layer %s of %d bytes is larger than the %d bytes the cache can hold, skip writing its archive", descriptor.ID(), size, ldm.archiveCapacity)
+	return false
+}
+
+// createLayerArchive tees downloadReader into a temp file of dir named after
+// pattern, and returns the path of the file along with the reader
+func createLayerArchive(ctx context.Context, dir, pattern string, downloadReader io.ReadCloser, prevErr error) (io.ReadCloser, string, error) {
 	if prevErr != nil {
 		return nil, "", prevErr
 	}
-	f, err := ioutil.TempFile("", "LayerArchive")
+	f, err := ioutil.TempFile(dir, pattern)
 	if err != nil {
 		return nil, "", err
 	}
@@ -41,31 +59,21 @@ func createLayerArchive(ctx context.Context, downloadReader io.ReadCloser, prevE
 	return ioutils.NewCancelReadCloser(ctx, ts), path, nil
 }
 
-func getArchiveReader(diffID layer.DiffID) (io.ReadCloser, error) {
-	if diffID == "" {
-		return nil, nil
-	}
-	path := filepath.Join(os.TempDir(), digest.Digest(diffID).Hex())
-	f, err := os.Open(path)
-	if err != nil {
-		return nil, err
-	}
-	return ioutils.NewReadCloserWrapper(f, func() error {
-		f.Close()
-		return nil
-	}), nil
-}
-
-func renameArchive(path string, diffID layer.DiffID) error {
-	newPath := filepath.Join(os.TempDir(), digest.Digest(diffID).Hex())
-	logrus.Debugf("Old path: %s, new path: %s", path, newPath)
-	if path == "" || path == newPath {
-		return nil
-	}
-	if fi, _ := os.Stat(newPath); fi != nil {
-		if err := os.RemoveAll(newPath); err != nil {
-			return err
+// renameArchive promotes the archive downloaded to path into store as the
+// archive of diffID. The archive of a cancelled download is removed when its
+// reader is closed, so its promotion is skipped rather than failed.
+func renameArchive(ctx context.Context, store ArchiveStore, path string, diffID layer.DiffID) error {
+	if path != "" {
+		select {
+		case <-ctx.Done():
+			logrus.Debugf("Download of %s was cancelled, skip caching its layer archive", diffID)
+			return nil
+		default:
+		}
+		if _, err := os.Stat(path); os.IsNotExist(err) {
+			logrus.Debugf("Layer archive of %s is gone, skip caching it", diffID)
+			return nil
 		}
 	}
-	return os.Rename(path, newPath)
+	return store.Commit(path, diffID)
 }
@@ -0,0 +1,48 @@
+package xfer // import "github.com/docker/docker/distribution/xfer"
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/docker/docker/layer"
+	"github.com/opencontainers/go-digest"
+	"gotest.tools/assert"
+)
+
+func TestRenameArchiveCancelled(t *testing.T) {
+	dir, err := ioutil.TempDir("", "layer-archive")
+	assert.NilError(t, err)
+	defer os.RemoveAll(dir)
+
+	data := []byte("layer archive")
+	diffID := layer.DiffID(digest.FromBytes(data))
+	path := filepath.Join(dir, "LayerArchive")
+	assert.NilError(t, ioutil.WriteFile(path, data, 0600))
+
+	store := newFakeArchiveStore()
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	// the archive of a cancelled download is not promoted, whether or not
+	// it has been removed yet
+	assert.NilError(t, renameArchive(ctx, store, path, diffID))
+	_, ok := store.archive(diffID)
+	assert.Check(t, !ok)
+	assert.NilError(t, renameArchive(ctx, store, filepath.Join(dir, "gone"), diffID))
+	_, ok = store.archive(diffID)
+	assert.Check(t, !ok)
+
+	// neither is an archive removed behind the back of the download
+	assert.NilError(t, renameArchive(context.Background(), store, filepath.Join(dir, "gone"), diffID))
+	_, ok = store.archive(diffID)
+	assert.Check(t, !ok)
+
+	assert.NilError(t, renameArchive(context.Background(), store, path, diffID))
+	_, ok = store.archive(diffID)
+	assert.Check(t, ok)
+	_, err = os.Stat(path)
+	assert.Check(t, os.IsNotExist(err))
+}
@@ -28,6 +28,17 @@ type LayerDownloadManager struct {
 	tm           TransferManager
 	waitDuration time.Duration
 	cacheArchive bool
+
+	archiveStore    ArchiveStore
+	archiveMemCache *archiveMemCache
+	// archiveCapacity is the size of the largest layer archive worth
+	// writing, unbounded if 0
+	archiveCapacity int64
+
+	// tempDir is the directory of the temp files of the layer archives,
+	// the default temp directory if empty
+	tempDir       string
+	tempNamespace string
 }
 
 // SetConcurrency sets the max concurrent downloads for each pull
@@ -42,6 +53,7 @@ func NewLayerDownloadManager(layerStores map[string]layer.Store, concurrencyLimi
 		tm:           NewTransferManager(concurrencyLimit),
 		waitDuration: time.Second,
 		cacheArchive: cacheArchive,
+		archiveStore: NewDirArchiveStore(""),
 	}
 	for _, option := range options {
 		option(&manager)
@@ -117,6 +129,10 @@ func (ldm *LayerDownloadManager) Download(ctx context.Context, initialRootFS ima
 		return image.RootFS{}, nil, system.ErrNotSupportedOperatingSystem
 	}
 
+	// the image cache leaves the layers of the download alone until the
+	// download is done
+	defer BeginLayerDownload(downloadChainIDs(initialRootFS, layers)...)()
+
 	rootFS := initialRootFS
 	for _, descriptor := range layers {
 		key := descriptor.Key()
@@ -272,12 +288,26 @@ func (ldm *LayerDownloadManager) makeDownloadFunc(descriptor DownloadDescriptor,
 
 			diffID, _ := descriptor.DiffID()
 
-			if downloadReader, err = getArchiveReader(diffID); downloadReader == nil || !ldm.cacheArchive {
+			// the archive is marked as being written from the start of the
+			// download to its commit, under the diffID of the descriptor if
+			// known, else under that of the layer once registered
+			endWrite := func() {}
+			if ldm.cacheArchive && diffID != "" {
+				endWrite = BeginArchiveWrite(diffID)
+			}
+			defer func() {
+				endWrite()
+			}()
+			if ldm.cacheArchive {
+				downloadReader, _ = ldm.archiveMemCache.getArchiveReader(ldm.archiveStore, diffID)
+			}
+
+			if downloadReader == nil {
 				logrus.Debugf("Layer archive of %s is not found, downloading ...", diffID)
 				for {
 					downloadReader, size, err = descriptor.Download(d.Transfer.Context(), progressOutput)
-					if ldm.cacheArchive {
-						downloadReader, path, err = createLayerArchive(d.Transfer.Context(), downloadReader, err)
+					if ldm.cacheArchive && ldm.archiveFits(descriptor, size) {
+						downloadReader, path, err = createLayerArchive(d.Transfer.Context(), ldm.tempDir, archiveTempPattern(ldm.tempNamespace), downloadReader, err)
 					}
 					if err == nil {
 						break
@@ -345,6 +375,9 @@ func (ldm *LayerDownloadManager) makeDownloadFunc(descriptor DownloadDescriptor,
 				}
 				parentLayer = l.ChainID()
 			}
+			if parentLayer != "" {
+				defer BeginLayerDownload(parentLayer)()
+			}
 
 			reader := progress.NewProgressReader(ioutils.NewCancelReadCloser(d.Transfer.Context(), downloadReader), progressOutput, size, descriptor.ID(), "Extracting")
 			defer reader.Close()
@@ -375,9 +408,16 @@ func (ldm *LayerDownloadManager) makeDownloadFunc(descriptor DownloadDescriptor,
 			}
 
 			if ldm.cacheArchive {
-				if err := renameArchive(path, d.layer.DiffID()); err != nil {
+				if d.layer.DiffID() != diffID {
+					endWrite()
+					endWrite = BeginArchiveWrite(d.layer.DiffID())
+				}
+				if err := renameArchive(d.Transfer.Context(), ldm.archiveStore, path, d.layer.DiffID()); err != nil {
 					d.err = err
 				}
+				if path != "" {
+					ldm.archiveMemCache.remove(d.layer.DiffID())
+				}
 			}
 
 			progress.Update(progressOutput, descriptor.ID(), "Pull complete")
@@ -452,6 +492,7 @@ func (ldm *LayerDownloadManager) makeDownloadFuncFromDownload(descriptor Downloa
 				d.err = err
 				return
 			}
+			defer BeginLayerDownload(parentLayer)()
 
 			layerReader, err := l.TarStream()
 			if err != nil {
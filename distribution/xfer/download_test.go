@@ -7,6 +7,7 @@ import (
 	"fmt"
 	"io"
 	"io/ioutil"
+	"os"
 	"runtime"
 	"sync/atomic"
 	"testing"
@@ -161,6 +162,7 @@ type mockDownloadDescriptor struct {
 	registeredDiffID layer.DiffID
 	expectedDiffID   layer.DiffID
 	simulateRetries  int
+	size             int64
 }
 
 // Key returns the key used to deduplicate downloads.
@@ -219,7 +221,7 @@ func (d *mockDownloadDescriptor) Download(ctx context.Context, progressOutput pr
 		return nil, 0, errors.New("simulating retry")
 	}
 
-	return d.mockTarStream(), 0, nil
+	return d.mockTarStream(), d.size, nil
 }
 
 func (d *mockDownloadDescriptor) Close() {
@@ -270,7 +272,7 @@ func TestSuccessfulDownload(t *testing.T) {
 	layerStore := &mockLayerStore{make(map[layer.ChainID]*mockLayer)}
 	lsMap := make(map[string]layer.Store)
 	lsMap[runtime.GOOS] = layerStore
-	ldm := NewLayerDownloadManager(lsMap, maxDownloadConcurrency, func(m *LayerDownloadManager) { m.waitDuration = time.Millisecond })
+	ldm := NewLayerDownloadManager(lsMap, maxDownloadConcurrency, false, func(m *LayerDownloadManager) { m.waitDuration = time.Millisecond })
 
 	progressChan := make(chan progress.Progress)
 	progressDone := make(chan struct{})
@@ -334,7 +336,7 @@ func TestCancelledDownload(t *testing.T) {
 	layerStore := &mockLayerStore{make(map[layer.ChainID]*mockLayer)}
 	lsMap := make(map[string]layer.Store)
 	lsMap[runtime.GOOS] = layerStore
-	ldm := NewLayerDownloadManager(lsMap, maxDownloadConcurrency, func(m *LayerDownloadManager) { m.waitDuration = time.Millisecond })
+	ldm := NewLayerDownloadManager(lsMap, maxDownloadConcurrency, false, func(m *LayerDownloadManager) { m.waitDuration = time.Millisecond })
 	progressChan := make(chan progress.Progress)
 	progressDone := make(chan struct{})
 
@@ -360,3 +362,83 @@ func TestCancelledDownload(t *testing.T) {
 	close(progressChan)
 	<-progressDone
 }
+
+func TestDownloadArchive(t *testing.T) {
+	for _, cacheArchive := range []bool{false, true} {
+		dir, err := ioutil.TempDir("", "download-archive")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dir)
+		oldTmp := os.Getenv("TMPDIR")
+		os.Setenv("TMPDIR", dir)
+
+		layerStore := &mockLayerStore{make(map[layer.ChainID]*mockLayer)}
+		lsMap := make(map[string]layer.Store)
+		lsMap[runtime.GOOS] = layerStore
+		ldm := NewLayerDownloadManager(lsMap, maxDownloadConcurrency, cacheArchive, func(m *LayerDownloadManager) { m.waitDuration = time.Millisecond })
+
+		var currentDownloads int32
+		descriptors := downloadDescriptors(&currentDownloads)
+		_, releaseFunc, err := ldm.Download(context.Background(), *image.NewRootFS(), runtime.GOOS, descriptors, progress.ChanOutput(make(chan progress.Progress, 1000)))
+		os.Setenv("TMPDIR", oldTmp)
+		if err != nil {
+			t.Fatalf("download error: %v", err)
+		}
+		releaseFunc()
+
+		files, err := ioutil.ReadDir(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if cacheArchive && len(files) == 0 {
+			t.Fatal("expected layer archives, got none")
+		}
+		if !cacheArchive && len(files) != 0 {
+			t.Fatalf("expected no layer archive, got %d", len(files))
+		}
+	}
+}
+
+func TestDownloadSkipsArchivesNotFitting(t *testing.T) {
+	dir, err := ioutil.TempDir("", "download-archive")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	oldTmp := os.Getenv("TMPDIR")
+	os.Setenv("TMPDIR", dir)
+
+	layerStore := &mockLayerStore{make(map[layer.ChainID]*mockLayer)}
+	lsMap := make(map[string]layer.Store)
+	lsMap[runtime.GOOS] = layerStore
+	ldm := NewLayerDownloadManager(lsMap, maxDownloadConcurrency, true, WithArchiveCapacity(100), func(m *LayerDownloadManager) { m.waitDuration = time.Millisecond })
+
+	// only the first layer fits in the cache
+	descriptors := downloadDescriptors(nil)
+	for i, d := range descriptors {
+		d.(*mockDownloadDescriptor).size = 1000
+		if i == 0 {
+			d.(*mockDownloadDescriptor).size = 10
+		}
+	}
+	_, releaseFunc, err := ldm.Download(context.Background(), *image.NewRootFS(), runtime.GOOS, descriptors, progress.ChanOutput(make(chan progress.Progress, 1000)))
+	os.Setenv("TMPDIR", oldTmp)
+	if err != nil {
+		t.Fatalf("download error: %v", err)
+	}
+	releaseFunc()
+
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := digest.Digest(descriptors[0].(*mockDownloadDescriptor).expectedDiffID).Hex()
+	if len(files) != 1 || files[0].Name() != expected {
+		var names []string
+		for _, f := range files {
+			names = append(names, f.Name())
+		}
+		t.Fatalf("expected only the layer archive %s, got %v", expected, names)
+	}
+}
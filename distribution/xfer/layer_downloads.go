@@ -0,0 +1,69 @@
+package xfer // import "github.com/docker/docker/distribution/xfer"
+
+import (
+	"sync"
+
+	"github.com/docker/docker/image"
+	"github.com/docker/docker/layer"
+)
+
+// layerDownloads counts the downloads in progress using the layer of each
+// chain ID, either registering it or registering a layer on top of it. The
+// image cache releasing such a layer would contend with the registration in
+// the layer store, so it evicts other layers meanwhile.
+var layerDownloads = struct {
+	sync.Mutex
+	count map[layer.ChainID]int
+}{count: make(map[layer.ChainID]int)}
+
+// BeginLayerDownload marks the layers of chainIDs as used by a download
+// until the returned function is called
+func BeginLayerDownload(chainIDs ...layer.ChainID) func() {
+	layerDownloads.Lock()
+	for _, chainID := range chainIDs {
+		layerDownloads.count[chainID]++
+	}
+	layerDownloads.Unlock()
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			layerDownloads.Lock()
+			defer layerDownloads.Unlock()
+			for _, chainID := range chainIDs {
+				if layerDownloads.count[chainID]--; layerDownloads.count[chainID] <= 0 {
+					delete(layerDownloads.count, chainID)
+				}
+			}
+		})
+	}
+}
+
+// LayerDownloading reports whether a download in progress uses the layer of
+// chainID
+func LayerDownloading(chainID layer.ChainID) bool {
+	layerDownloads.Lock()
+	defer layerDownloads.Unlock()
+
+	return layerDownloads.count[chainID] > 0
+}
+
+// downloadChainIDs returns the chain IDs of the layers a download on top of
+// rootFS uses: the layer it starts from, and the layers to be downloaded as
+// far as their diffIDs are known ahead
+func downloadChainIDs(rootFS image.RootFS, layers []DownloadDescriptor) []layer.ChainID {
+	var chainIDs []layer.ChainID
+	if len(rootFS.DiffIDs) > 0 {
+		chainIDs = append(chainIDs, rootFS.ChainID())
+	}
+	rootFS.DiffIDs = append([]layer.DiffID(nil), rootFS.DiffIDs...)
+	for _, descriptor := range layers {
+		diffID, err := descriptor.DiffID()
+		if err != nil {
+			break
+		}
+		rootFS.Append(diffID)
+		chainIDs = append(chainIDs, rootFS.ChainID())
+	}
+	return chainIDs
+}
@@ -0,0 +1,40 @@
+package xfer // import "github.com/docker/docker/distribution/xfer"
+
+import (
+	"testing"
+
+	"github.com/docker/docker/image"
+	"github.com/docker/docker/layer"
+	"gotest.tools/assert"
+	is "gotest.tools/assert/cmp"
+)
+
+func TestDownloadChainIDs(t *testing.T) {
+	rootFS := *image.NewRootFS()
+	rootFS.Append("sha256:base")
+	layers := downloadDescriptors(nil)
+	for _, descriptor := range layers[:2] {
+		descriptor.(*mockDownloadDescriptor).diffID = descriptor.(*mockDownloadDescriptor).expectedDiffID
+	}
+
+	chainIDs := downloadChainIDs(rootFS, layers)
+	assert.Check(t, is.Len(rootFS.DiffIDs, 1))
+	// the descriptors with an unknown diffID end the known chain
+	assert.Assert(t, is.Len(chainIDs, 3))
+	assert.Check(t, is.Equal(layer.ChainID("sha256:base"), chainIDs[0]))
+	expected := layer.CreateChainID([]layer.DiffID{"sha256:base", layers[0].(*mockDownloadDescriptor).diffID, layers[1].(*mockDownloadDescriptor).diffID})
+	assert.Check(t, is.Equal(expected, chainIDs[2]))
+}
+
+func TestBeginLayerDownload(t *testing.T) {
+	chainID := layer.ChainID("sha256:downloading")
+	endOne := BeginLayerDownload(chainID)
+	endTwo := BeginLayerDownload(chainID)
+	assert.Check(t, LayerDownloading(chainID))
+
+	endOne()
+	endOne()
+	assert.Check(t, LayerDownloading(chainID))
+	endTwo()
+	assert.Check(t, !LayerDownloading(chainID))
+}